@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"Library/librarypkg"
+)
+
+// actorOf names who is behind a request for the audit log: the token's name,
+// else its member, else its role. Unauthenticated requests are anonymous.
+func actorOf(ctx context.Context) string {
+	principal, ok := principalFrom(ctx)
+	switch {
+	case !ok || principal.Role == "":
+		return "anonymous"
+	case principal.Name != "":
+		return principal.Name
+	case principal.Member != "":
+		return principal.Member
+	default:
+		return principal.Role
+	}
+}
+
+// audit records action on behalf of the request's actor. err is the result of
+// the action; failures are recorded with their error code.
+func (s *server) audit(r *http.Request, action, title, borrower string, err error) {
+	s.library.RecordAudit(actorOf(r.Context()), action, title, borrower, auditOutcome(err))
+}
+
+func auditOutcome(err error) string {
+	if err == nil {
+		return librarypkg.AuditOK
+	}
+	_, code := errorMapping(err)
+	return code
+}
+
+type auditPage struct {
+	Entries []librarypkg.AuditEntry `json:"entries"`
+	Total   int                     `json:"total"`
+	Limit   int                     `json:"limit"`
+	Offset  int                     `json:"offset"`
+}
+
+func (s *server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.library.Audit == nil {
+		http.Error(w, "The audit log is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	from, to, errs := timeRange(query, "from", "to")
+	limit, offset, pageErrs := pageParams(query)
+	errs = append(errs, pageErrs...)
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	entries := s.library.Audit.Entries(librarypkg.AuditFilter{
+		Action: query.Get("action"),
+		Actor:  query.Get("actor"),
+		From:   from,
+		To:     to,
+	})
+
+	page := auditPage{Total: len(entries), Limit: limit, Offset: offset}
+	start, end := pageBounds(len(entries), limit, offset)
+	page.Entries = entries[start:end]
+
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	roleLibrarian = "librarian"
+	roleMember    = "member"
+)
+
+// apiToken grants a role. Member tokens belong to one borrower and can only
+// act on that borrower's loans. Name identifies the token's holder in the
+// audit log.
+type apiToken struct {
+	Token  string `json:"token"`
+	Role   string `json:"role"`
+	Member string `json:"member,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// loadTokens reads a JSON list of tokens.
+func loadTokens(path string) ([]apiToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []apiToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, token := range tokens {
+		switch {
+		case token.Token == "":
+			return nil, fmt.Errorf("%s: token %d is empty", path, i+1)
+		case token.Role != roleLibrarian && token.Role != roleMember:
+			return nil, fmt.Errorf("%s: token %d has unknown role %q", path, i+1, token.Role)
+		case token.Role == roleMember && token.Member == "":
+			return nil, fmt.Errorf("%s: member token %d needs a member name", path, i+1)
+		}
+	}
+	return tokens, nil
+}
+
+type principalKey struct{}
+
+// principalFrom returns the token the request was authenticated with, if any.
+// Open reads on a server with tokens carry a zero token when the caller
+// didn't present a valid one.
+func principalFrom(ctx context.Context) (apiToken, bool) {
+	principal, ok := ctx.Value(principalKey{}).(apiToken)
+	return principal, ok
+}
+
+// librarianPaths are the endpoints whose mutations need the librarian role.
+var librarianPaths = []string{"/Book", "/Book/archive", "/Book/unarchive", "/Books/import", "/Members", "/Loan", "/Loan/transfer"}
+
+func librarianOnly(path string) bool {
+	if strings.HasPrefix(path, "/admin/") {
+		return true
+	}
+	if strings.HasPrefix(path, "/loans/") && strings.HasSuffix(path, "/transfer") {
+		return true
+	}
+	if strings.HasPrefix(path, "/books/") && strings.HasSuffix(path, "/restore") {
+		return true
+	}
+	for _, p := range librarianPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// requireToken makes mutating requests, and reads too when protectReads is
+// set, present one of tokens as a bearer token. The /admin endpoints always
+// need a librarian token. Missing tokens get a 401; unknown tokens, and member
+// tokens on librarian endpoints, get a 403.
+func requireToken(tokens []apiToken, protectReads bool, next http.Handler) http.Handler {
+	lookup := tokenLookup(tokens)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutation := isMutation(r.Method)
+		admin := strings.HasPrefix(r.URL.Path, "/admin/")
+		if !protectReads && !mutation && !admin {
+			// Open reads still note who is asking, so a librarian token can
+			// see what anonymous readers can't, such as archived books
+			var principal apiToken
+			if presented, ok := bearerToken(r); ok {
+				if match := lookup(presented); match != -1 {
+					principal = tokens[match]
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+			return
+		}
+
+		presented, ok := bearerToken(r)
+		if !ok && !mutation && strings.HasSuffix(r.URL.Path, calendarSuffix) {
+			// Calendar apps subscribe by URL and can't send headers
+			presented = r.URL.Query().Get("token")
+			ok = presented != ""
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="library"`)
+			w.Header().Set(errorCodeHeader, "UNAUTHORIZED")
+			http.Error(w, "Authorization required", http.StatusUnauthorized)
+			return
+		}
+
+		match := lookup(presented)
+		if match == -1 {
+			w.Header().Set(errorCodeHeader, "FORBIDDEN")
+			http.Error(w, "Invalid token", http.StatusForbidden)
+			return
+		}
+
+		principal := tokens[match]
+		if (admin || mutation && librarianOnly(r.URL.Path)) && principal.Role != roleLibrarian {
+			w.Header().Set(errorCodeHeader, "FORBIDDEN")
+			http.Error(w, "Librarian role required", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// tokenLookup returns a function giving the index of the token presented
+// among tokens, or -1. It compares fixed-size hashes against every token so
+// neither the content nor the length of a token leaks through timing.
+func tokenLookup(tokens []apiToken) func(presented string) int {
+	hashes := make([][32]byte, len(tokens))
+	for i, token := range tokens {
+		hashes[i] = sha256.Sum256([]byte(token.Token))
+	}
+
+	return func(presented string) int {
+		got := sha256.Sum256([]byte(presented))
+		match := -1
+		for i := range hashes {
+			if subtle.ConstantTimeCompare(got[:], hashes[i][:]) == 1 {
+				match = i
+			}
+		}
+		return match
+	}
+}
+
+// canActFor reports whether the caller may act on borrower's loans. Member
+// tokens may only act for their own member; librarians, and servers without
+// authentication, may act for anyone.
+func canActFor(r *http.Request, borrower string) bool {
+	return principalCanActFor(r.Context(), borrower)
+}
+
+// principalCanActFor is canActFor for the principal in ctx, for APIs other
+// than HTTP.
+func principalCanActFor(ctx context.Context, borrower string) bool {
+	principal, ok := principalFrom(ctx)
+	return !ok || principal.Role != roleMember || principal.Member == borrower
+}
+
+// isLibrarian reports whether the caller holds a librarian token, or the
+// server runs without authentication.
+func isLibrarian(r *http.Request) bool {
+	principal, ok := principalFrom(r.Context())
+	return !ok || principal.Role == roleLibrarian
+}
+
+// forbidOtherBorrower writes the 403 for a member acting on someone else's
+// loans.
+func forbidOtherBorrower(w http.ResponseWriter) {
+	w.Header().Set(errorCodeHeader, "FORBIDDEN")
+	http.Error(w, "Members can only act on their own loans", http.StatusForbidden)
+}
+
+func isMutation(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+// parseBearer returns the token of an Authorization value of the Bearer
+// scheme.
+func parseBearer(authorization string) (string, bool) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
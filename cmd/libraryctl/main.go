@@ -0,0 +1,307 @@
+// Command libraryctl manages the library from a terminal through its HTTP API.
+//
+// Usage:
+//
+//	libraryctl [-addr URL] [-token TOKEN] [-json] <command> [flags]
+//
+// Commands:
+//
+//	books list [-author NAME]
+//	books add -title TITLE [-author NAME] [-isbn ISBN] [-year YEAR] [-copies N]
+//	books delete -title TITLE
+//	loans list [-borrower NAME] [-overdue]
+//	borrow -title TITLE -borrower NAME
+//	return (-loan ID | -title TITLE -borrower NAME)
+//	stats
+//
+// The exit code tells scripts what went wrong: 2 for bad usage, 3 for a
+// conflict such as no copies left, 4 when something wasn't found, 5 for an
+// invalid request, 6 when the token was refused and 1 for anything else.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"Library/libraryclient"
+	"Library/librarypkg"
+)
+
+const (
+	exitOK           = 0
+	exitError        = 1
+	exitUsage        = 2
+	exitConflict     = 3
+	exitNotFound     = 4
+	exitInvalid      = 5
+	exitUnauthorized = 6
+)
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// cli holds what every command needs.
+type cli struct {
+	client *libraryclient.Client
+	json   bool
+	out    io.Writer
+}
+
+var errUsage = errors.New("usage")
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("libraryctl", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	addr := global.String("addr", envOr("LIBRARY_URL", "http://localhost:3000"), "library API base URL")
+	token := global.String("token", os.Getenv("LIBRARY_TOKEN"), "API token")
+	asJSON := global.Bool("json", false, "print JSON instead of a table")
+	if err := global.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	c := &cli{client: libraryclient.New(*addr, *token), json: *asJSON, out: stdout}
+
+	err := c.dispatch(ctx, global.Args(), stderr)
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(stderr, "usage: libraryctl [-addr URL] [-token TOKEN] [-json] books list|add|delete, loans list, borrow, return, stats")
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+	}
+	return exitCode(err)
+}
+
+func (c *cli) dispatch(ctx context.Context, args []string, stderr io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	command := args[0]
+	if (command == "books" || command == "loans") && len(args) > 1 {
+		command += " " + args[1]
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	switch command {
+	case "books list":
+		author := flags.String("author", "", "only books by this author")
+		if err := flags.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		return c.booksList(ctx, *author)
+
+	case "books add":
+		var book librarypkg.BookDetail
+		flags.StringVar(&book.Title, "title", "", "title")
+		flags.StringVar(&book.Author, "author", "", "author")
+		flags.StringVar(&book.ISBN, "isbn", "", "ISBN-10 or ISBN-13")
+		flags.IntVar(&book.Year, "year", 0, "publication year")
+		flags.IntVar(&book.AvailableCopies, "copies", 1, "number of copies")
+		if err := flags.Parse(args[1:]); err != nil || book.Title == "" {
+			return errUsage
+		}
+		created, err := c.client.AddBook(ctx, book)
+		if err != nil {
+			return err
+		}
+		return c.printBooks([]librarypkg.BookDetail{created})
+
+	case "books delete":
+		title := flags.String("title", "", "title")
+		if err := flags.Parse(args[1:]); err != nil || *title == "" {
+			return errUsage
+		}
+		return c.client.DeleteBook(ctx, *title)
+
+	case "loans list":
+		borrower := flags.String("borrower", "", "only loans of this borrower")
+		overdue := flags.Bool("overdue", false, "only overdue loans, with their fines")
+		if err := flags.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		if *overdue {
+			return c.overdueList(ctx, *borrower)
+		}
+		loans, err := c.client.ListLoans(ctx, *borrower)
+		if err != nil {
+			return err
+		}
+		return c.printLoans(loans)
+
+	case "borrow":
+		title := flags.String("title", "", "title")
+		borrower := flags.String("borrower", "", "borrower")
+		if err := flags.Parse(args[1:]); err != nil || *title == "" || *borrower == "" {
+			return errUsage
+		}
+		loan, err := c.client.Borrow(ctx, *title, *borrower)
+		if err != nil {
+			return err
+		}
+		return c.printLoans([]librarypkg.LoanDetail{loan})
+
+	case "return":
+		loanID := flags.String("loan", "", "loan ID")
+		title := flags.String("title", "", "title")
+		borrower := flags.String("borrower", "", "borrower")
+		if err := flags.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		var receipt librarypkg.ReturnReceipt
+		var err error
+		switch {
+		case *loanID != "":
+			receipt, err = c.client.ReturnLoan(ctx, *loanID)
+		case *title != "" && *borrower != "":
+			receipt, err = c.client.Return(ctx, *title, *borrower)
+		default:
+			return errUsage
+		}
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(receipt)
+		}
+		fmt.Fprintln(c.out, receipt.Message)
+		if receipt.WasOverdue {
+			fmt.Fprintf(c.out, "%d days late, fine %s\n", receipt.DaysLate, formatCents(receipt.Fine))
+		}
+		return nil
+
+	case "stats":
+		if err := flags.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		stats, err := c.client.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(stats)
+		}
+		w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Titles\t%d\n", stats.Titles)
+		fmt.Fprintf(w, "Available copies\t%d\n", stats.AvailableCopies)
+		fmt.Fprintf(w, "Active loans\t%d\n", stats.ActiveLoans)
+		fmt.Fprintf(w, "Overdue loans\t%d\n", stats.OverdueLoans)
+		fmt.Fprintf(w, "Reservations\t%d\n", stats.Reservations)
+		fmt.Fprintf(w, "Members\t%d\n", stats.Members)
+		return w.Flush()
+	}
+
+	return errUsage
+}
+
+func (c *cli) booksList(ctx context.Context, author string) error {
+	books, err := c.client.ListBooks(ctx, author)
+	if err != nil {
+		return err
+	}
+	return c.printBooks(books)
+}
+
+func (c *cli) overdueList(ctx context.Context, borrower string) error {
+	overdue, err := c.client.Overdue(ctx)
+	if err != nil {
+		return err
+	}
+
+	filtered := []librarypkg.OverdueLoan{}
+	for _, o := range overdue {
+		if borrower == "" || o.Loan.NameOfBorrower == borrower {
+			filtered = append(filtered, o)
+		}
+	}
+	if c.json {
+		return c.printJSON(filtered)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TITLE\tBORROWER\tDUE\tDAYS OVERDUE\tFINE")
+	for _, o := range filtered {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", o.Loan.BookTitle, o.Loan.NameOfBorrower, formatDate(o.Loan.ReturnDate), o.DaysOverdue, formatCents(o.Fine))
+	}
+	return w.Flush()
+}
+
+func (c *cli) printBooks(books []librarypkg.BookDetail) error {
+	if c.json {
+		return c.printJSON(books)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TITLE\tAUTHOR\tISBN\tYEAR\tAVAILABLE")
+	for _, book := range books {
+		year := ""
+		if book.Year != 0 {
+			year = strconv.Itoa(book.Year)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", book.Title, book.Author, book.ISBN, year, book.AvailableCopies)
+	}
+	return w.Flush()
+}
+
+func (c *cli) printLoans(loans []librarypkg.LoanDetail) error {
+	if c.json {
+		return c.printJSON(loans)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tBORROWER\tLOANED\tDUE")
+	for _, loan := range loans {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", loan.ID, loan.BookTitle, loan.NameOfBorrower, formatDate(loan.LoanDate), formatDate(loan.ReturnDate))
+	}
+	return w.Flush()
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// exitCode maps an API error to the documented exit codes.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, libraryclient.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, libraryclient.ErrConflict):
+		return exitConflict
+	case errors.Is(err, libraryclient.ErrInvalidRequest):
+		return exitInvalid
+	case errors.Is(err, libraryclient.ErrUnauthorized):
+		return exitUnauthorized
+	}
+	return exitError
+}
+
+func formatDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func formatCents(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"Library/librarypkg"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /Books", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"books": [{"title": "Clean Code", "author": "Robert C. Martin", "availableCopies": 2}, {"title": "Go Programming", "availableCopies": 3}], "total": 2}`)
+	})
+	mux.HandleFunc("GET /Overdue", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"loan": {"id": "a1", "bookTitle": "Clean Code", "nameOfBorrower": "John Doe", "returnDate": "2024-04-30T10:00:00Z"}, "daysOverdue": 3, "fine": 75}]`)
+	})
+	mux.HandleFunc("POST /Borrow", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Error-Code", "BOOK_NOT_FOUND")
+		http.Error(w, "Book not found", http.StatusNotFound)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func runCommand(t *testing.T, args ...string) (int, string, string) {
+	server := newTestServer(t)
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), append([]string{"-addr", server.URL}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestBooksList(t *testing.T) {
+	// Test 1: Table output
+	code, out, _ := runCommand(t, "books", "list")
+	if code != exitOK {
+		t.Fatalf("wrong exit code: got %v want %v", code, exitOK)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "TITLE") || !strings.Contains(lines[1], "Robert C. Martin") {
+		t.Errorf("unexpected table:\n%s", out)
+	}
+
+	// Test 2: JSON output for scripts
+	code, out, _ = runCommand(t, "-json", "books", "list")
+	if code != exitOK {
+		t.Fatalf("wrong exit code: got %v want %v", code, exitOK)
+	}
+
+	var books []librarypkg.BookDetail
+	if err := json.Unmarshal([]byte(out), &books); err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 || books[1].Title != "Go Programming" {
+		t.Errorf("unexpected books: %+v", books)
+	}
+}
+
+func TestLoansListOverdue(t *testing.T) {
+	code, out, _ := runCommand(t, "loans", "list", "--overdue")
+	if code != exitOK {
+		t.Fatalf("wrong exit code: got %v want %v", code, exitOK)
+	}
+	if !strings.Contains(out, "Clean Code") || !strings.Contains(out, "0.75") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	// Test 1: API errors map to exit codes
+	code, _, stderr := runCommand(t, "borrow", "-title", "Missing Book", "-borrower", "John Doe")
+	if code != exitNotFound {
+		t.Errorf("wrong exit code: got %v want %v", code, exitNotFound)
+	}
+	if !strings.Contains(stderr, "Book not found") {
+		t.Errorf("expected the API message on stderr, got %q", stderr)
+	}
+
+	// Test 2: Missing flags are a usage error
+	if code, _, _ := runCommand(t, "borrow", "-title", "Go Programming"); code != exitUsage {
+		t.Errorf("wrong exit code: got %v want %v", code, exitUsage)
+	}
+	if code, _, _ := runCommand(t, "shelve"); code != exitUsage {
+		t.Errorf("wrong exit code: got %v want %v", code, exitUsage)
+	}
+}
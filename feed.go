@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"Library/librarypkg"
+)
+
+// newBooksFeedSize is how many of the most recently added books the Atom
+// feed lists.
+const newBooksFeedSize = 50
+
+// newBooksPath is where the Atom feed of new books is served.
+const newBooksPath = "/Books/new.atom"
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Summary string      `xml:"summary,omitempty"`
+	Link    atomLink    `xml:"link"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// bookEntryID is a tag URI (RFC 4151) for a book's feed entry. It is built
+// from the title and the day the book was added, so refetching the feed
+// never turns an entry into a new one.
+func bookEntryID(book librarypkg.BookDetail) string {
+	return fmt.Sprintf("tag:library,%s:books/%s", book.CreatedAt.UTC().Format(time.DateOnly), url.PathEscape(book.Title))
+}
+
+// newBooksHandler serves the most recently added books as an Atom feed.
+// Last-Modified is when the newest of them was added, so feed readers
+// polling with If-Modified-Since get a 304 until another book comes in.
+func (s *server) newBooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	books := s.library.NewBooks(newBooksFeedSize)
+	updated := s.library.Now()
+	if len(books) > 0 && !books[0].CreatedAt.IsZero() {
+		// HTTP dates have whole seconds, so compare at that precision
+		updated = books[0].CreatedAt.UTC().Truncate(time.Second)
+		w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+	feed := atomFeed{
+		ID:      base + newBooksPath,
+		Title:   "New books",
+		Updated: updated.Format(time.RFC3339),
+		Author:  atomPerson{Name: "Library"},
+		Links:   []atomLink{{Rel: "self", Type: "application/atom+xml", Href: base + newBooksPath}},
+	}
+	for _, book := range books {
+		if book.CreatedAt.IsZero() {
+			continue
+		}
+		entry := atomEntry{
+			ID:      bookEntryID(book),
+			Title:   book.Title,
+			Updated: book.CreatedAt.UTC().Format(time.RFC3339),
+			Link:    atomLink{Rel: "alternate", Type: "application/json", Href: base + "/Book?title=" + url.QueryEscape(book.Title)},
+		}
+		if book.Author != "" {
+			entry.Author = &atomPerson{Name: book.Author}
+		}
+		switch {
+		case book.Author != "" && book.Year != 0:
+			entry.Summary = fmt.Sprintf("By %s (%d)", book.Author, book.Year)
+		case book.Author != "":
+			entry.Summary = "By " + book.Author
+		case book.Year != 0:
+			entry.Summary = fmt.Sprintf("Published %d", book.Year)
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(feed)
+}
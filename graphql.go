@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"Library/librarypkg"
+)
+
+// graphqlPath is where the GraphQL endpoint is served. It is exempt from
+// refuseInMaintenance, since queries are reads sent with POST; its mutations
+// check for read-only mode themselves.
+const graphqlPath = "/graphql"
+
+// The GraphQL schema served at graphqlPath, in SDL:
+//
+//	type Query {
+//	  book(title: String!): Book
+//	  books(filter: BookFilter): [Book!]!
+//	  member(id: String!): Member
+//	}
+//	type Mutation {
+//	  borrowBook(title: String!, borrower: String!): Loan
+//	  returnBook(title: String!, borrower: String!): ReturnReceipt
+//	  extendLoan(title: String!, borrower: String!, days: Int): Loan
+//	}
+//	input BookFilter { title: String, author: String, yearFrom: Int, yearTo: Int, includeArchived: Boolean }
+//	type Book {
+//	  title: String!, workTitle: String!, edition: String, volume: Int
+//	  author: String, isbn: String, year: Int, category: String
+//	  availableCopies: Int!, totalCopies: Int!, inRepair: Int!, reference: Boolean!
+//	  archived: Boolean!, version: Int!, createdAt: String, availability: Availability
+//	}
+//	type Availability {
+//	  availableCopies: Int!, activeLoans: Int!, nextReturnDate: String
+//	  queueLength: Int!, heldCopies: Int!, nextAvailableDate: String
+//	}
+//	type Member { name: String!, email: String!, loans: [Loan!]! }
+//	type Loan {
+//	  id: String!, title: String!, borrower: String!, loanDate: String!
+//	  returnDate: String!, extensions: Int!, overdue: Boolean!, book: Book
+//	}
+//	type ReturnReceipt {
+//	  message: String!, loan: Loan!, returnedAt: String!, status: String!
+//	  wasOverdue: Boolean!, daysLate: Int!, fine: Int!
+//	}
+//
+// Resolvers only translate between GraphQL and the library: each one calls
+// the same Library method as the matching REST handler, with the same
+// permission checks and audit entries.
+
+// gqlResolver produces a field's value from its parent object's value.
+type gqlResolver func(s *server, r *http.Request, parent any, args map[string]any) (any, error)
+
+// gqlFieldDef is a field of a schema type. Fields without a type are scalars.
+// Object fields may resolve to a slice, which is a list of that type.
+type gqlFieldDef struct {
+	typ     string
+	resolve gqlResolver
+}
+
+// gqlScalar is a field read straight off the parent, which is a T.
+func gqlScalar[T any](get func(T) any) gqlFieldDef {
+	return gqlFieldDef{resolve: func(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+		return get(parent.(T)), nil
+	}}
+}
+
+// gqlTime sends zero times as null.
+func gqlTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+var graphqlSchema = map[string]map[string]gqlFieldDef{
+	"Query": {
+		"book":   {typ: "Book", resolve: resolveBook},
+		"books":  {typ: "Book", resolve: resolveBooks},
+		"member": {typ: "Member", resolve: resolveMember},
+	},
+	"Mutation": {
+		"borrowBook": {typ: "Loan", resolve: resolveBorrowBook},
+		"returnBook": {typ: "ReturnReceipt", resolve: resolveReturnBook},
+		"extendLoan": {typ: "Loan", resolve: resolveExtendLoan},
+	},
+	"Book": {
+		"title":           gqlScalar(func(b librarypkg.BookDetail) any { return b.Title }),
+		"workTitle":       gqlScalar(func(b librarypkg.BookDetail) any { return b.WorkTitle() }),
+		"edition":         gqlScalar(func(b librarypkg.BookDetail) any { return b.Edition }),
+		"volume":          gqlScalar(func(b librarypkg.BookDetail) any { return b.Volume }),
+		"author":          gqlScalar(func(b librarypkg.BookDetail) any { return b.Author }),
+		"isbn":            gqlScalar(func(b librarypkg.BookDetail) any { return b.ISBN }),
+		"year":            gqlScalar(func(b librarypkg.BookDetail) any { return b.Year }),
+		"category":        gqlScalar(func(b librarypkg.BookDetail) any { return b.Category }),
+		"availableCopies": gqlScalar(func(b librarypkg.BookDetail) any { return b.AvailableCopies }),
+		"totalCopies":     gqlScalar(func(b librarypkg.BookDetail) any { return b.TotalCopies }),
+		"inRepair":        gqlScalar(func(b librarypkg.BookDetail) any { return b.InRepair }),
+		"reference":       gqlScalar(func(b librarypkg.BookDetail) any { return b.Reference }),
+		"archived":        gqlScalar(func(b librarypkg.BookDetail) any { return b.Archived }),
+		"version":         gqlScalar(func(b librarypkg.BookDetail) any { return b.Version }),
+		"createdAt":       gqlScalar(func(b librarypkg.BookDetail) any { return gqlTime(b.CreatedAt) }),
+		"availability": {typ: "Availability", resolve: func(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+			return s.library.Availability(parent.(librarypkg.BookDetail).Title)
+		}},
+	},
+	"Availability": {
+		"availableCopies":   gqlScalar(func(a librarypkg.BookAvailability) any { return a.AvailableCopies }),
+		"activeLoans":       gqlScalar(func(a librarypkg.BookAvailability) any { return a.ActiveLoans }),
+		"nextReturnDate":    gqlScalar(func(a librarypkg.BookAvailability) any { return a.NextReturnDate }),
+		"queueLength":       gqlScalar(func(a librarypkg.BookAvailability) any { return a.QueueLength }),
+		"heldCopies":        gqlScalar(func(a librarypkg.BookAvailability) any { return a.HeldCopies }),
+		"nextAvailableDate": gqlScalar(func(a librarypkg.BookAvailability) any { return a.NextAvailableDate }),
+	},
+	"Member": {
+		"name":  gqlScalar(func(m librarypkg.Member) any { return m.Name }),
+		"email": gqlScalar(func(m librarypkg.Member) any { return m.Email }),
+		"loans": {typ: "Loan", resolve: func(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+			loans := []librarypkg.LoanDetail{}
+			for _, loan := range s.library.BorrowerLoans(parent.(librarypkg.Member).Name) {
+				loans = append(loans, loan.LoanDetail)
+			}
+			return loans, nil
+		}},
+	},
+	"Loan": {
+		"id":         gqlScalar(func(l librarypkg.LoanDetail) any { return l.ID }),
+		"title":      gqlScalar(func(l librarypkg.LoanDetail) any { return l.BookTitle }),
+		"borrower":   gqlScalar(func(l librarypkg.LoanDetail) any { return l.NameOfBorrower }),
+		"loanDate":   gqlScalar(func(l librarypkg.LoanDetail) any { return l.LoanDate }),
+		"returnDate": gqlScalar(func(l librarypkg.LoanDetail) any { return l.ReturnDate }),
+		"extensions": gqlScalar(func(l librarypkg.LoanDetail) any { return l.Extensions }),
+		"overdue":    gqlScalar(func(l librarypkg.LoanDetail) any { return l.Overdue }),
+		"book": {typ: "Book", resolve: func(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+			return optional(s.library.Book(parent.(librarypkg.LoanDetail).BookTitle))
+		}},
+	},
+	"ReturnReceipt": {
+		"message":    gqlScalar(func(rr librarypkg.ReturnReceipt) any { return rr.Message }),
+		"returnedAt": gqlScalar(func(rr librarypkg.ReturnReceipt) any { return rr.ReturnedAt }),
+		"status":     gqlScalar(func(rr librarypkg.ReturnReceipt) any { return rr.Status }),
+		"wasOverdue": gqlScalar(func(rr librarypkg.ReturnReceipt) any { return rr.WasOverdue }),
+		"daysLate":   gqlScalar(func(rr librarypkg.ReturnReceipt) any { return rr.DaysLate }),
+		"fine":       gqlScalar(func(rr librarypkg.ReturnReceipt) any { return rr.Fine }),
+		"loan": {typ: "Loan", resolve: func(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+			return parent.(librarypkg.ReturnReceipt).Loan, nil
+		}},
+	},
+}
+
+// optional turns a not-found error into a null value, which is how GraphQL
+// reports a missing object.
+func optional[T any](v T, err error) (any, error) {
+	if errors.Is(err, librarypkg.ErrBookNotFound) || errors.Is(err, librarypkg.ErrMemberNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func resolveBook(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+	title, err := stringArg(args, "title", true)
+	if err != nil {
+		return nil, err
+	}
+	return optional(s.library.Book(title))
+}
+
+func resolveBooks(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+	var filter Filter
+	if args["filter"] != nil {
+		fields, ok := args["filter"].(map[string]any)
+		if !ok {
+			return nil, gqlInputError("Argument filter must be an object")
+		}
+		title, err1 := stringArg(fields, "title", false)
+		author, err2 := stringArg(fields, "author", false)
+		yearFrom, err3 := intArg(fields, "yearFrom")
+		yearTo, err4 := intArg(fields, "yearTo")
+		includeArchived, err5 := boolArg(fields, "includeArchived")
+		if err := errors.Join(err1, err2, err3, err4, err5); err != nil {
+			return nil, gqlInputError(err.Error())
+		}
+		filter = Filter{Title: title, Author: author, YearFrom: yearFrom, YearTo: yearTo, IncludeArchived: includeArchived && isLibrarian(r)}
+	}
+	return filterBooks(s.library.ListBooks(), filter), nil
+}
+
+// resolveMember looks a member up by name. Member tokens may only look up
+// their own member, as with their loans over REST.
+func resolveMember(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+	name, err := stringArg(args, "id", true)
+	if err != nil {
+		return nil, err
+	}
+	if !canActFor(r, name) {
+		return nil, errGQLForbidden
+	}
+	return optional(s.library.Member(name))
+}
+
+// loanArgs reads and validates the arguments every loan mutation takes, and
+// refuses them in maintenance mode or for another member's loans.
+func (s *server) loanArgs(r *http.Request, args map[string]any) (loanRequest, error) {
+	if s.library.ReadOnly() {
+		return loanRequest{}, librarypkg.ErrReadOnly
+	}
+	title, err1 := stringArg(args, "title", true)
+	borrower, err2 := stringArg(args, "borrower", true)
+	if err := errors.Join(err1, err2); err != nil {
+		return loanRequest{}, err
+	}
+	request := loanRequest{Title: title, Borrower: borrower}
+	if err := request.Validate(); err != nil {
+		return loanRequest{}, gqlInputError(err.Error())
+	}
+	if !canActFor(r, borrower) {
+		return loanRequest{}, errGQLForbidden
+	}
+	return request, nil
+}
+
+func resolveBorrowBook(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+	request, err := s.loanArgs(r, args)
+	if err != nil {
+		return nil, err
+	}
+	loan, err := s.library.Borrow(request.Title, request.Borrower)
+	s.audit(r, librarypkg.AuditBorrow, request.Title, request.Borrower, err)
+	return loan, err
+}
+
+func resolveReturnBook(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+	request, err := s.loanArgs(r, args)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := s.library.Return(request.Title, request.Borrower)
+	s.audit(r, librarypkg.AuditReturn, request.Title, request.Borrower, err)
+	return receipt, err
+}
+
+func resolveExtendLoan(s *server, r *http.Request, parent any, args map[string]any) (any, error) {
+	request, err := s.loanArgs(r, args)
+	if err != nil {
+		return nil, err
+	}
+	days, err := intArg(args, "days")
+	if err != nil {
+		return nil, err
+	}
+	if err := (extendRequest{loanRequest: request, Days: days}).Validate(); err != nil {
+		return nil, gqlInputError(err.Error())
+	}
+	loan, err := s.library.ExtendBy(request.Title, request.Borrower, days)
+	s.audit(r, librarypkg.AuditExtend, request.Title, request.Borrower, err)
+	return loan, err
+}
+
+// gqlError is an error raised by the GraphQL layer itself rather than the
+// library, with the code to report it under.
+type gqlError struct {
+	message string
+	code    string
+}
+
+func (e *gqlError) Error() string { return e.message }
+
+var errGQLForbidden = &gqlError{"Members can only act on their own loans", "FORBIDDEN"}
+
+func gqlInputError(message string) error {
+	return &gqlError{message, "INVALID_ARGUMENT"}
+}
+
+func stringArg(args map[string]any, name string, required bool) (string, error) {
+	switch v := args[name].(type) {
+	case string:
+		return v, nil
+	case nil:
+		if required {
+			return "", gqlInputError(fmt.Sprintf("Argument %s is required", name))
+		}
+		return "", nil
+	default:
+		return "", gqlInputError(fmt.Sprintf("Argument %s must be a string", name))
+	}
+}
+
+func intArg(args map[string]any, name string) (int, error) {
+	switch v := args[name].(type) {
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+			return 0, gqlInputError(fmt.Sprintf("Argument %s must be an integer", name))
+		}
+		return int(v), nil
+	case nil:
+		return 0, nil
+	default:
+		return 0, gqlInputError(fmt.Sprintf("Argument %s must be an integer", name))
+	}
+}
+
+func boolArg(args map[string]any, name string) (bool, error) {
+	switch v := args[name].(type) {
+	case bool:
+		return v, nil
+	case nil:
+		return false, nil
+	default:
+		return false, gqlInputError(fmt.Sprintf("Argument %s must be a boolean", name))
+	}
+}
+
+// gqlObject is a selection set's result. It keeps the fields in the order
+// they were selected, as GraphQL requires and a map wouldn't.
+type gqlObject []gqlObjectField
+
+type gqlObjectField struct {
+	key   string
+	value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.key)
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlErrorEntry is an entry of a response's errors list. Path is set for
+// errors raised while resolving a field, whose value is then null.
+type gqlErrorEntry struct {
+	Message    string            `json:"message"`
+	Path       []any             `json:"path,omitempty"`
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+type graphqlResponse struct {
+	Data   any             `json:"data,omitempty"`
+	Errors []gqlErrorEntry `json:"errors,omitempty"`
+}
+
+// gqlExecution is the state of running one operation.
+type gqlExecution struct {
+	s         *server
+	r         *http.Request
+	variables map[string]any
+	errors    []gqlErrorEntry
+}
+
+// checkSelections rejects unknown fields, scalars with selections, objects
+// without them and undeclared variables before anything is resolved, so a
+// mistyped mutation never runs half way.
+func checkSelections(typ string, selections []gqlField, variables map[string]bool) error {
+	for _, field := range selections {
+		if field.name == "__typename" {
+			if field.selections != nil {
+				return fmt.Errorf("Field __typename can't have a selection set")
+			}
+			continue
+		}
+		def, ok := graphqlSchema[typ][field.name]
+		if !ok {
+			return fmt.Errorf("Cannot query field %q on type %q", field.name, typ)
+		}
+		if def.typ == "" && field.selections != nil {
+			return fmt.Errorf("Field %q of type %q must not have a selection set", field.name, typ)
+		}
+		if def.typ != "" && field.selections == nil {
+			return fmt.Errorf("Field %q of type %q must have a selection set", field.name, typ)
+		}
+		for _, arg := range field.args {
+			if err := checkVariables(arg, variables); err != nil {
+				return err
+			}
+		}
+		if err := checkSelections(def.typ, field.selections, variables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkVariables(value any, variables map[string]bool) error {
+	switch v := value.(type) {
+	case gqlVariable:
+		if !variables[string(v)] {
+			return fmt.Errorf("Variable $%s is not defined", v)
+		}
+	case []any:
+		for _, item := range v {
+			if err := checkVariables(item, variables); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, item := range v {
+			if err := checkVariables(item, variables); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// substitute replaces the variables in an argument value with their values.
+func (e *gqlExecution) substitute(value any) any {
+	switch v := value.(type) {
+	case gqlVariable:
+		return e.variables[string(v)]
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = e.substitute(item)
+		}
+		return list
+	case map[string]any:
+		object := make(map[string]any, len(v))
+		for name, item := range v {
+			object[name] = e.substitute(item)
+		}
+		return object
+	}
+	return value
+}
+
+// selectFields resolves selections on parent, a value of type typ. Fields are
+// resolved one after another, which the spec requires of mutations and which
+// costs queries little since every resolver is a quick in-memory call.
+func (e *gqlExecution) selectFields(typ string, parent any, selections []gqlField, path []any) gqlObject {
+	object := make(gqlObject, 0, len(selections))
+	for _, field := range selections {
+		key := field.responseKey()
+		if field.name == "__typename" {
+			object = append(object, gqlObjectField{key, typ})
+			continue
+		}
+
+		fieldPath := append(path[:len(path):len(path)], key)
+		def := graphqlSchema[typ][field.name]
+		args := make(map[string]any, len(field.args))
+		for name, arg := range field.args {
+			args[name] = e.substitute(arg)
+		}
+		value, err := def.resolve(e.s, e.r, parent, args)
+		if err != nil {
+			e.fail(fieldPath, err)
+			value = nil
+		}
+		object = append(object, gqlObjectField{key, e.complete(def.typ, value, field.selections, fieldPath)})
+	}
+	return object
+}
+
+// complete turns a resolved value into its result: scalars as they are, and
+// objects and lists of them by resolving the field's selections.
+func (e *gqlExecution) complete(typ string, value any, selections []gqlField, path []any) any {
+	if typ == "" || value == nil {
+		return value
+	}
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Slice {
+		list := make([]any, v.Len())
+		for i := range list {
+			list[i] = e.selectFields(typ, v.Index(i).Interface(), selections, append(path[:len(path):len(path)], i))
+		}
+		return list
+	}
+	return e.selectFields(typ, value, selections, path)
+}
+
+// fail records a field error under the same code the REST API would use.
+func (e *gqlExecution) fail(path []any, err error) {
+	var gqlErr *gqlError
+	if errors.As(err, &gqlErr) {
+		e.errors = append(e.errors, gqlErrorEntry{Message: gqlErr.message, Path: path, Extensions: map[string]string{"code": gqlErr.code}})
+		return
+	}
+
+	status, code := errorMapping(err)
+	message := err.Error()
+	message = strings.ToUpper(message[:1]) + message[1:]
+	if status == http.StatusInternalServerError {
+		log.Printf("unexpected error: %v", err)
+		message = "Internal server error"
+	}
+	e.errors = append(e.errors, gqlErrorEntry{Message: message, Path: path, Extensions: map[string]string{"code": code}})
+}
+
+// graphqlHandler runs a GraphQL operation. Documents that don't parse or
+// don't fit the schema get a 400 with only errors; otherwise the response is
+// a 200 whose errors, if any, belong to fields that came back null.
+func (s *server) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request graphqlRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	operation, variables, err := request.operation()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, graphqlResponse{Errors: []gqlErrorEntry{{Message: err.Error()}}})
+		return
+	}
+
+	execution := &gqlExecution{s: s, r: r, variables: variables}
+	data := execution.selectFields(operation.rootType(), nil, operation.selections, nil)
+	writeJSON(w, http.StatusOK, graphqlResponse{Data: data, Errors: execution.errors})
+}
+
+// operation parses the request's document, picks the operation to run and
+// works out its variables.
+func (request graphqlRequest) operation() (gqlOperation, map[string]any, error) {
+	operations, err := parseGraphQL(request.Query)
+	if err != nil {
+		return gqlOperation{}, nil, err
+	}
+
+	var operation gqlOperation
+	switch {
+	case request.OperationName != "":
+		found := false
+		for _, candidate := range operations {
+			if candidate.name == request.OperationName {
+				operation, found = candidate, true
+			}
+		}
+		if !found {
+			return gqlOperation{}, nil, fmt.Errorf("Unknown operation %q", request.OperationName)
+		}
+	case len(operations) == 1:
+		operation = operations[0]
+	default:
+		return gqlOperation{}, nil, errors.New("OperationName is required for documents with several operations")
+	}
+
+	variables := make(map[string]any, len(operation.variables))
+	declared := make(map[string]bool, len(operation.variables))
+	for _, definition := range operation.variables {
+		declared[definition.name] = true
+		value, ok := request.Variables[definition.name]
+		if !ok {
+			value = definition.fallback
+		}
+		if value == nil && definition.required {
+			return gqlOperation{}, nil, fmt.Errorf("Variable $%s is required", definition.name)
+		}
+		variables[definition.name] = value
+	}
+
+	if err := checkSelections(operation.rootType(), operation.selections, declared); err != nil {
+		return gqlOperation{}, nil, err
+	}
+	return operation, variables, nil
+}
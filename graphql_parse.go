@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This is the subset of GraphQL the /graphql endpoint needs: query and
+// mutation operations with variables, aliases, arguments of any literal
+// type and nested selections. Fragments and directives are rejected.
+
+// gqlOperation is one operation of a GraphQL document.
+type gqlOperation struct {
+	kind       string // "query" or "mutation"
+	name       string
+	variables  []gqlVariableDef
+	selections []gqlField
+}
+
+// rootType is the schema type the operation's selections are fields of.
+func (o gqlOperation) rootType() string {
+	if o.kind == "mutation" {
+		return "Mutation"
+	}
+	return "Query"
+}
+
+type gqlVariableDef struct {
+	name     string
+	required bool // declared with a trailing !
+	fallback any  // the default value, if one was given
+}
+
+// gqlField is a field in a selection set. Argument values are Go values as
+// encoding/json would decode them, with gqlVariable in place of variables.
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]any
+	selections []gqlField
+}
+
+// responseKey is the name the field's result goes under.
+func (f gqlField) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// gqlVariable is a $variable reference in an argument.
+type gqlVariable string
+
+type gqlParser struct {
+	src string
+	pos int
+}
+
+// parseGraphQL parses a document and returns its operations in order.
+func parseGraphQL(src string) ([]gqlOperation, error) {
+	p := &gqlParser{src: src}
+	var operations []gqlOperation
+	for {
+		p.skipIgnored()
+		if p.pos >= len(p.src) {
+			break
+		}
+		operation, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, operation)
+	}
+	if len(operations) == 0 {
+		return nil, fmt.Errorf("document has no operations")
+	}
+	return operations, nil
+}
+
+func (p *gqlParser) errorf(format string, args ...any) error {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	column := p.pos - strings.LastIndex(p.src[:p.pos], "\n")
+	return fmt.Errorf("syntax error at line %d, column %d: %s", line, column, fmt.Sprintf(format, args...))
+}
+
+// skipIgnored skips whitespace, commas and comments, which GraphQL treats
+// alike.
+func (p *gqlParser) skipIgnored() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case strings.HasPrefix(p.src[p.pos:], "\ufeff"):
+			p.pos += len("\ufeff")
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next significant byte, or 0 at the end.
+func (p *gqlParser) peek() byte {
+	p.skipIgnored()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func (p *gqlParser) name() (string, error) {
+	if !isNameStart(p.peek()) {
+		return "", p.errorf("expected a name")
+	}
+	start := p.pos
+	for p.pos < len(p.src) && (isNameStart(p.src[p.pos]) || '0' <= p.src[p.pos] && p.src[p.pos] <= '9') {
+		p.pos++
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *gqlParser) operation() (gqlOperation, error) {
+	operation := gqlOperation{kind: "query"}
+	if p.peek() != '{' {
+		keyword, err := p.name()
+		if err != nil {
+			return operation, err
+		}
+		switch keyword {
+		case "query", "mutation":
+			operation.kind = keyword
+		case "fragment":
+			return operation, p.errorf("fragments are not supported")
+		default:
+			return operation, p.errorf("unsupported operation type %q", keyword)
+		}
+		if isNameStart(p.peek()) {
+			if operation.name, err = p.name(); err != nil {
+				return operation, err
+			}
+		}
+		if p.peek() == '(' {
+			if operation.variables, err = p.variableDefinitions(); err != nil {
+				return operation, err
+			}
+		}
+	}
+	if p.peek() == '@' {
+		return operation, p.errorf("directives are not supported")
+	}
+
+	selections, err := p.selectionSet()
+	operation.selections = selections
+	return operation, err
+}
+
+func (p *gqlParser) variableDefinitions() ([]gqlVariableDef, error) {
+	p.pos++ // (
+	var definitions []gqlVariableDef
+	for p.peek() != ')' {
+		if err := p.expect('$'); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		required, err := p.variableType()
+		if err != nil {
+			return nil, err
+		}
+		definition := gqlVariableDef{name: name, required: required}
+		if p.peek() == '=' {
+			p.pos++
+			if definition.fallback, err = p.value(true); err != nil {
+				return nil, err
+			}
+		}
+		definitions = append(definitions, definition)
+	}
+	p.pos++ // )
+	return definitions, nil
+}
+
+// variableType skips a type such as [String!]! and reports whether it is
+// non-null. Types are otherwise checked when the arguments are used.
+func (p *gqlParser) variableType() (bool, error) {
+	if p.peek() == '[' {
+		p.pos++
+		if _, err := p.variableType(); err != nil {
+			return false, err
+		}
+		if err := p.expect(']'); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.peek() == '!' {
+		p.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for p.peek() != '}' {
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated selection set")
+		}
+		if strings.HasPrefix(p.src[p.pos:], "...") {
+			return nil, p.errorf("fragments are not supported")
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	p.pos++ // }
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	var field gqlField
+	name, err := p.name()
+	if err != nil {
+		return field, err
+	}
+	field.name = name
+	if p.peek() == ':' {
+		p.pos++
+		field.alias = name
+		if field.name, err = p.name(); err != nil {
+			return field, err
+		}
+	}
+	if p.peek() == '(' {
+		if field.args, err = p.arguments(); err != nil {
+			return field, err
+		}
+	}
+	if p.peek() == '@' {
+		return field, p.errorf("directives are not supported")
+	}
+	if p.peek() == '{' {
+		if field.selections, err = p.selectionSet(); err != nil {
+			return field, err
+		}
+	}
+	return field, nil
+}
+
+func (p *gqlParser) arguments() (map[string]any, error) {
+	p.pos++ // (
+	args := make(map[string]any)
+	for p.peek() != ')' {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	p.pos++ // )
+	return args, nil
+}
+
+// value parses a literal or, unless constant is set, a variable reference.
+// Numbers decode as float64 and enum values as strings, as if they came from
+// JSON variables.
+func (p *gqlParser) value(constant bool) (any, error) {
+	switch c := p.peek(); {
+	case c == '$' && !constant:
+		p.pos++
+		name, err := p.name()
+		return gqlVariable(name), err
+	case c == '"':
+		return p.stringValue()
+	case c == '-' || '0' <= c && c <= '9':
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) != -1 {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number")
+		}
+		return n, nil
+	case c == '[':
+		p.pos++
+		list := []any{}
+		for p.peek() != ']' {
+			if p.pos >= len(p.src) {
+				return nil, p.errorf("unterminated list")
+			}
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		p.pos++
+		return list, nil
+	case c == '{':
+		p.pos++
+		object := make(map[string]any)
+		for p.peek() != '}' {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+		return object, nil
+	case isNameStart(c):
+		name, _ := p.name()
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return name, nil
+	default:
+		return nil, p.errorf("expected a value")
+	}
+}
+
+func (p *gqlParser) stringValue() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		return "", p.errorf("block strings are not supported")
+	}
+	p.pos++ // "
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return b.String(), nil
+		case c == '\n' || c == '\r':
+			return "", p.errorf("unterminated string")
+		case c == '\\' && p.pos+1 < len(p.src):
+			escape := p.src[p.pos+1]
+			p.pos += 2
+			switch escape {
+			case '"', '\\', '/':
+				b.WriteByte(escape)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(code))
+				p.pos += 4
+			default:
+				return "", p.errorf("invalid escape \\%c", escape)
+			}
+		default:
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
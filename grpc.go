@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"Library/librarypb"
+	"Library/librarypkg"
+)
+
+// grpcServer serves the librarypb.Library service from the same library as
+// the HTTP handlers.
+type grpcServer struct {
+	librarypb.UnimplementedLibraryServer
+	library *librarypkg.Library
+}
+
+// newGRPCServer serves library over gRPC. With tokens, calls are
+// authenticated as HTTP requests are, see grpcAuth.
+func newGRPCServer(library *librarypkg.Library, tokens []apiToken, protectReads bool) *grpc.Server {
+	var options []grpc.ServerOption
+	if len(tokens) > 0 {
+		options = append(options, grpc.UnaryInterceptor(grpcAuth(tokens, protectReads)))
+	}
+	s := grpc.NewServer(options...)
+	librarypb.RegisterLibraryServer(s, &grpcServer{library: library})
+	return s
+}
+
+// grpcWrites are the methods that change the library, which like mutating
+// HTTP requests always need a token.
+var grpcWrites = map[string]bool{
+	librarypb.Library_BorrowBook_FullMethodName: true,
+	librarypb.Library_ExtendLoan_FullMethodName: true,
+	librarypb.Library_ReturnBook_FullMethodName: true,
+}
+
+// grpcAuth is requireToken for gRPC: writes, and reads too when protectReads
+// is set, present one of tokens as a bearer token in the authorization
+// metadata. A missing token is Unauthenticated and an unknown one
+// PermissionDenied. The token's principal is stored in the context for
+// principalCanActFor and the audit log.
+func grpcAuth(tokens []apiToken, protectReads bool) grpc.UnaryServerInterceptor {
+	lookup := tokenLookup(tokens)
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		var presented string
+		var ok bool
+		if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+			presented, ok = parseBearer(values[0])
+		}
+
+		if !protectReads && !grpcWrites[info.FullMethod] {
+			// Open reads still note who is asking, as over HTTP
+			var principal apiToken
+			if ok {
+				if match := lookup(presented); match != -1 {
+					principal = tokens[match]
+				}
+			}
+			return handler(context.WithValue(ctx, principalKey{}, principal), req)
+		}
+
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "Authorization required")
+		}
+		match := lookup(presented)
+		if match == -1 {
+			return nil, status.Error(codes.PermissionDenied, "Invalid token")
+		}
+		return handler(context.WithValue(ctx, principalKey{}, tokens[match]), req)
+	}
+}
+
+// errGRPCForbidden refuses a member acting on someone else's loans.
+var errGRPCForbidden = status.Error(codes.PermissionDenied, "Members can only act on their own loans")
+
+func (s *grpcServer) GetBook(ctx context.Context, req *librarypb.GetBookRequest) (*librarypb.Book, error) {
+	if req.GetTitle() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Title is required")
+	}
+
+	book, err := s.library.Book(req.GetTitle())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return bookToProto(book), nil
+}
+
+func (s *grpcServer) ListBooks(ctx context.Context, req *librarypb.ListBooksRequest) (*librarypb.ListBooksResponse, error) {
+	resp := &librarypb.ListBooksResponse{}
+	for _, book := range filterBooks(s.library.ListBooks(), Filter{}) {
+		resp.Books = append(resp.Books, bookToProto(book))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) BorrowBook(ctx context.Context, req *librarypb.LoanRequest) (*librarypb.Loan, error) {
+	if s.library.ReadOnly() {
+		return nil, grpcError(librarypkg.ErrReadOnly)
+	}
+	if err := (loanRequest{Title: req.GetTitle(), Borrower: req.GetBorrower()}).Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !principalCanActFor(ctx, req.GetBorrower()) {
+		return nil, errGRPCForbidden
+	}
+
+	loan, err := s.library.Borrow(req.GetTitle(), req.GetBorrower())
+	s.library.RecordAudit(actorOf(ctx), librarypkg.AuditBorrow, req.GetTitle(), req.GetBorrower(), auditOutcome(err))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return loanToProto(loan), nil
+}
+
+func (s *grpcServer) ExtendLoan(ctx context.Context, req *librarypb.LoanRequest) (*librarypb.Loan, error) {
+	if s.library.ReadOnly() {
+		return nil, grpcError(librarypkg.ErrReadOnly)
+	}
+	if err := (loanRequest{Title: req.GetTitle(), Borrower: req.GetBorrower()}).Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !principalCanActFor(ctx, req.GetBorrower()) {
+		return nil, errGRPCForbidden
+	}
+
+	loan, err := s.library.Extend(req.GetTitle(), req.GetBorrower())
+	s.library.RecordAudit(actorOf(ctx), librarypkg.AuditExtend, req.GetTitle(), req.GetBorrower(), auditOutcome(err))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return loanToProto(loan), nil
+}
+
+func (s *grpcServer) ReturnBook(ctx context.Context, req *librarypb.ReturnBookRequest) (*librarypb.ReturnReceipt, error) {
+	if s.library.ReadOnly() {
+		return nil, grpcError(librarypkg.ErrReadOnly)
+	}
+	request := returnRequest{LoanID: req.GetLoanId(), Title: req.GetTitle(), Borrower: req.GetBorrower()}
+	if err := request.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var receipt librarypkg.ReturnReceipt
+	var err error
+	if request.LoanID != "" {
+		// The borrower is checked under the title lock, as over HTTP
+		receipt, err = s.library.ReturnLoanIf(request.LoanID, func(loan librarypkg.LoanDetail) error {
+			if !principalCanActFor(ctx, loan.NameOfBorrower) {
+				return errGRPCForbidden
+			}
+			return nil
+		})
+		if errors.Is(err, errGRPCForbidden) {
+			return nil, errGRPCForbidden
+		}
+	} else if !principalCanActFor(ctx, request.Borrower) {
+		return nil, errGRPCForbidden
+	} else {
+		receipt, err = s.library.Return(request.Title, request.Borrower)
+	}
+	title, borrower := request.Title, request.Borrower
+	if err == nil {
+		title, borrower = receipt.Loan.BookTitle, receipt.Loan.NameOfBorrower
+	}
+	s.library.RecordAudit(actorOf(ctx), librarypkg.AuditReturn, title, borrower, auditOutcome(err))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &librarypb.ReturnReceipt{
+		Message:    receipt.Message,
+		Loan:       loanToProto(receipt.Loan),
+		ReturnedAt: timestamppb.New(receipt.ReturnedAt),
+		WasOverdue: receipt.WasOverdue,
+		DaysLate:   int32(receipt.DaysLate),
+		Fine:       int32(receipt.Fine),
+	}, nil
+}
+
+// grpcCodes translates the HTTP status of a domain error, so both APIs report
+// errors the same way.
+var grpcCodes = map[int]codes.Code{
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusPreconditionFailed:  codes.FailedPrecondition,
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnprocessableEntity: codes.FailedPrecondition,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+func grpcError(err error) error {
+	code, ok := grpcCodes[errorStatus(err)]
+	if !ok {
+		return status.Error(codes.Internal, "Internal server error")
+	}
+	return status.Error(code, err.Error())
+}
+
+func bookToProto(book librarypkg.BookDetail) *librarypb.Book {
+	return &librarypb.Book{
+		Title:           book.Title,
+		Author:          book.Author,
+		Isbn:            book.ISBN,
+		Year:            int32(book.Year),
+		AvailableCopies: int32(book.AvailableCopies),
+		LoanDays:        int32(book.LoanDays),
+		Version:         int32(book.Version),
+	}
+}
+
+func loanToProto(loan librarypkg.LoanDetail) *librarypb.Loan {
+	return &librarypb.Loan{
+		Id:             loan.ID,
+		BookTitle:      loan.BookTitle,
+		NameOfBorrower: loan.NameOfBorrower,
+		LoanDate:       timestamppb.New(loan.LoanDate),
+		ReturnDate:     timestamppb.New(loan.ReturnDate),
+		Extensions:     int32(loan.Extensions),
+	}
+}
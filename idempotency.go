@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// maxIdempotentBody caps the request bodies read up front to fingerprint.
+	maxIdempotentBody = 1 << 20
+)
+
+// replayedHeaders are the response headers kept along with the status and
+// body of a request made with an idempotency key.
+var replayedHeaders = []string{"Content-Type", "Location", errorCodeHeader}
+
+// idempotentResponse is the outcome of the first request made with a key.
+// done is closed once it is filled in, so a retry that arrives while the
+// first request is still running waits for it.
+type idempotentResponse struct {
+	key         string
+	fingerprint [32]byte
+	expires     time.Time
+	done        chan struct{}
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyCache remembers responses by idempotency key for ttl, holding at
+// most size of them, or any number for zero. Keys expire in the order they
+// were first used, which order records, so both limits evict from its front.
+type idempotencyCache struct {
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mutex     sync.Mutex
+	responses map[string]*idempotentResponse
+	order     []*idempotentResponse
+}
+
+func newIdempotencyCache(ttl time.Duration, size int, now func() time.Time) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, size: size, now: now, responses: make(map[string]*idempotentResponse)}
+}
+
+// begin returns the response recorded for key and whether there was one.
+// Without one it records a pending response that the caller must finish or
+// abandon.
+func (c *idempotencyCache) begin(key string, fingerprint [32]byte) (*idempotentResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	for len(c.order) > 0 && (!now.Before(c.order[0].expires) || c.size > 0 && len(c.order) >= c.size) {
+		c.evict()
+	}
+
+	if response, found := c.responses[key]; found {
+		return response, true
+	}
+	response := &idempotentResponse{key: key, fingerprint: fingerprint, expires: now.Add(c.ttl), done: make(chan struct{})}
+	c.responses[key] = response
+	c.order = append(c.order, response)
+	return response, false
+}
+
+// evict expects the caller to hold the mutex. It drops the oldest response.
+func (c *idempotencyCache) evict() {
+	oldest := c.order[0]
+	c.order[0] = nil
+	c.order = c.order[1:]
+	if c.responses[oldest.key] == oldest {
+		delete(c.responses, oldest.key)
+	}
+}
+
+func (c *idempotencyCache) finish(response *idempotentResponse, status int, header http.Header, body []byte) {
+	response.status, response.header, response.body = status, header, body
+	close(response.done)
+}
+
+// abandon forgets a pending response, e.g. after a server error, so a retry
+// runs the request again. Requests waiting on it are answered with a 409.
+func (c *idempotencyCache) abandon(response *idempotentResponse) {
+	c.mutex.Lock()
+	if c.responses[response.key] == response {
+		delete(c.responses, response.key)
+	}
+	c.mutex.Unlock()
+	close(response.done)
+}
+
+// idempotent lets clients retry a POST safely with an Idempotency-Key header:
+// the first request runs and its response is kept, and retries with the same
+// key and body get that response back instead of running again. Reusing a
+// key for a different request is a 422. Keys are scoped to the caller's
+// token.
+func (s *server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || s.idempotency == nil || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256([]byte(r.URL.RequestURI() + "\x00" + string(body)))
+
+		response, found := s.idempotency.begin(actorOf(r.Context())+"\x00"+key, fingerprint)
+		if found {
+			if response.fingerprint != fingerprint {
+				http.Error(w, "Idempotency key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			<-response.done
+			if response.header == nil {
+				http.Error(w, "The request with this idempotency key failed, retry it", http.StatusConflict)
+				return
+			}
+			for name, values := range response.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(response.status)
+			w.Write(response.body)
+			return
+		}
+
+		capture := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		finished := false
+		defer func() {
+			if !finished {
+				s.idempotency.abandon(response)
+			}
+		}()
+		next(capture, r)
+		if capture.status >= http.StatusInternalServerError {
+			return
+		}
+		header := http.Header{}
+		for _, name := range replayedHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				header[name] = values
+			}
+		}
+		s.idempotency.finish(response, capture.status, header, capture.body.Bytes())
+		finished = true
+	}
+}
+
+// captureWriter passes a response through while keeping a copy of its status
+// and body.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,248 @@
+// Package libraryclient is a Go client for the library HTTP API.
+package libraryclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"Library/librarypkg"
+)
+
+// Errors returned by Client methods, matched with errors.Is. Every API error
+// is an *APIError that unwraps to one of these.
+var (
+	ErrNotFound       = errors.New("not found")
+	ErrNoCopies       = errors.New("no copies available")
+	ErrConflict       = errors.New("conflict")
+	ErrInvalidRequest = errors.New("invalid request")
+	ErrUnauthorized   = errors.New("unauthorized")
+)
+
+// APIError is a non-2xx response from the server.
+type APIError struct {
+	StatusCode int
+	Code       string // from the X-Error-Code header, empty if not sent
+	Message    string
+
+	// NextAvailableDate is when a copy of a book that couldn't be borrowed is
+	// due back, if the server said.
+	NextAvailableDate time.Time
+
+	// Fields lists the invalid fields of a rejected request, with 422s and
+	// invalid query parameters.
+	Fields []FieldError
+}
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("library: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("library: %s (%d)", e.Message, e.StatusCode)
+}
+
+func (e *APIError) Unwrap() []error {
+	var errs []error
+	if e.Code == "NO_COPIES" {
+		errs = append(errs, ErrNoCopies)
+	}
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		errs = append(errs, ErrNotFound)
+	case http.StatusConflict:
+		errs = append(errs, ErrConflict)
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		errs = append(errs, ErrInvalidRequest)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		errs = append(errs, ErrUnauthorized)
+	}
+	return errs
+}
+
+type Client struct {
+	BaseURL    string
+	APIKey     string // sent as a bearer token when set
+	HTTPClient *http.Client
+}
+
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) GetBook(ctx context.Context, title string) (librarypkg.BookDetail, error) {
+	var book librarypkg.BookDetail
+	err := c.do(ctx, "GET", "/Book?title="+url.QueryEscape(title), nil, &book)
+	return book, err
+}
+
+// ListBooks returns the whole catalog sorted by title, fetching every page.
+// author filters by a case-insensitive substring when it isn't empty.
+func (c *Client) ListBooks(ctx context.Context, author string) ([]librarypkg.BookDetail, error) {
+	books := []librarypkg.BookDetail{}
+	for {
+		query := url.Values{"limit": {"1000"}, "offset": {strconv.Itoa(len(books))}}
+		if author != "" {
+			query.Set("author", author)
+		}
+
+		var page struct {
+			Books []librarypkg.BookDetail `json:"books"`
+			Total int                     `json:"total"`
+		}
+		if err := c.do(ctx, "GET", "/Books?"+query.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+
+		books = append(books, page.Books...)
+		if len(page.Books) == 0 || len(books) >= page.Total {
+			return books, nil
+		}
+	}
+}
+
+func (c *Client) AddBook(ctx context.Context, book librarypkg.BookDetail) (librarypkg.BookDetail, error) {
+	var created librarypkg.BookDetail
+	err := c.do(ctx, "POST", "/Book", book, &created)
+	return created, err
+}
+
+func (c *Client) DeleteBook(ctx context.Context, title string) error {
+	return c.do(ctx, "DELETE", "/Book?title="+url.QueryEscape(title), nil, nil)
+}
+
+func (c *Client) Borrow(ctx context.Context, title, borrower string) (librarypkg.LoanDetail, error) {
+	var loan librarypkg.LoanDetail
+	err := c.do(ctx, "POST", "/Borrow", loanBody(title, borrower), &loan)
+	return loan, err
+}
+
+func (c *Client) Extend(ctx context.Context, title, borrower string) (librarypkg.LoanDetail, error) {
+	var loan librarypkg.LoanDetail
+	err := c.do(ctx, "POST", "/Extend", loanBody(title, borrower), &loan)
+	return loan, err
+}
+
+// Return closes the borrower's oldest loan of title.
+func (c *Client) Return(ctx context.Context, title, borrower string) (librarypkg.ReturnReceipt, error) {
+	var receipt librarypkg.ReturnReceipt
+	err := c.do(ctx, "POST", "/Return", loanBody(title, borrower), &receipt)
+	return receipt, err
+}
+
+func (c *Client) ReturnLoan(ctx context.Context, loanID string) (librarypkg.ReturnReceipt, error) {
+	var receipt librarypkg.ReturnReceipt
+	err := c.do(ctx, "POST", "/Return", map[string]string{"loanId": loanID}, &receipt)
+	return receipt, err
+}
+
+// ListLoans returns all active loans, or only borrower's if it isn't empty.
+func (c *Client) ListLoans(ctx context.Context, borrower string) ([]librarypkg.LoanDetail, error) {
+	path := "/Loans"
+	if borrower != "" {
+		path += "?borrower=" + url.QueryEscape(borrower)
+	}
+
+	var loans []librarypkg.LoanDetail
+	err := c.do(ctx, "GET", path, nil, &loans)
+	return loans, err
+}
+
+func (c *Client) Overdue(ctx context.Context) ([]librarypkg.OverdueLoan, error) {
+	var overdue []librarypkg.OverdueLoan
+	err := c.do(ctx, "GET", "/Overdue", nil, &overdue)
+	return overdue, err
+}
+
+func (c *Client) Stats(ctx context.Context) (librarypkg.Stats, error) {
+	var stats librarypkg.Stats
+	err := c.do(ctx, "GET", "/Stats", nil, &stats)
+	return stats, err
+}
+
+func loanBody(title, borrower string) map[string]string {
+	return map[string]string{"title": title, "borrower": borrower}
+}
+
+// do sends body as JSON and decodes a successful response into out.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		apiErr := &APIError{
+			StatusCode: resp.StatusCode,
+			Code:       resp.Header.Get("X-Error-Code"),
+			Message:    strings.TrimSpace(string(body)),
+		}
+		// Some errors, such as NO_COPIES on a borrow, come as JSON with details
+		var detail struct {
+			Message           string       `json:"message"`
+			NextAvailableDate *time.Time   `json:"nextAvailableDate"`
+			Errors            []FieldError `json:"errors"`
+		}
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") && json.Unmarshal(body, &detail) == nil {
+			if detail.Message != "" {
+				apiErr.Message = detail.Message
+			}
+			if detail.NextAvailableDate != nil {
+				apiErr.NextAvailableDate = *detail.NextAvailableDate
+			}
+			if len(detail.Errors) > 0 {
+				apiErr.Fields = detail.Errors
+				messages := make([]string, len(detail.Errors))
+				for i, e := range detail.Errors {
+					messages[i] = e.Field + " " + e.Message
+				}
+				apiErr.Message = strings.Join(messages, "; ")
+			}
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
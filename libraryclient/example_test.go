@@ -0,0 +1,54 @@
+package libraryclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"Library/libraryclient"
+)
+
+func ExampleClient_Borrow() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": "4f2a", "bookTitle": "Go Programming", "nameOfBorrower": "John Doe", "loanDate": "2024-04-02T10:00:00Z", "returnDate": "2024-04-30T10:00:00Z"}`)
+	}))
+	defer server.Close()
+
+	client := libraryclient.New(server.URL, "")
+	loan, err := client.Borrow(context.Background(), "Go Programming", "John Doe")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(loan.BookTitle, "due", loan.ReturnDate.Format("2006-01-02"))
+	// Output: Go Programming due 2024-04-30
+}
+
+func ExampleAPIError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Error-Code", "NO_COPIES")
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"code": "NO_COPIES", "message": "No copies available", "nextAvailableDate": "2024-04-30T10:00:00Z"}`)
+	}))
+	defer server.Close()
+
+	client := libraryclient.New(server.URL, "secret")
+	_, err := client.Borrow(context.Background(), "Go Programming", "John Doe")
+
+	fmt.Println(errors.Is(err, libraryclient.ErrNoCopies), errors.Is(err, libraryclient.ErrConflict))
+	fmt.Println(err)
+	var apiErr *libraryclient.APIError
+	if errors.As(err, &apiErr) {
+		fmt.Println("back on", apiErr.NextAvailableDate.Format("2006-01-02"))
+	}
+	// Output:
+	// true true
+	// library: No copies available (409 NO_COPIES)
+	// back on 2024-04-30
+}
@@ -0,0 +1,136 @@
+package librarypkg
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Audited actions.
+const (
+	AuditBorrow      = "borrow"
+	AuditReturn      = "return"
+	AuditExtend      = "extend"
+	AuditUpdateLoan  = "loan.update"
+	AuditTransfer    = "loan.transfer"
+	AuditDueDate     = "loan.due-date"
+	AuditLost        = "loan.lost"
+	AuditDamaged     = "loan.damaged"
+	AuditAbandoned   = "loan.abandoned"
+	AuditAddBook     = "book.add"
+	AuditUpdateBook  = "book.update"
+	AuditImport      = "book.import"
+	AuditDeleteBook  = "book.delete"
+	AuditArchive     = "book.archive"
+	AuditUnarchive   = "book.unarchive"
+	AuditRename      = "book.rename"
+	AuditReserve     = "reservation.add"
+	AuditCancel      = "reservation.cancel"
+	AuditAddMember   = "member.add"
+	AuditAddWebhook  = "webhook.add"
+	AuditMaintenance = "maintenance"
+	AuditRestore     = "restore"
+)
+
+// AuditOK is the outcome of an action that succeeded; failed actions record
+// their error code instead.
+const AuditOK = "ok"
+
+type AuditEntry struct {
+	At       time.Time `json:"at"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Title    string    `json:"title,omitempty"`
+	Borrower string    `json:"borrower,omitempty"`
+	Outcome  string    `json:"outcome"`
+}
+
+// AuditFilter narrows Entries. Zero values match everything; From and To
+// are inclusive.
+type AuditFilter struct {
+	Action string
+	Actor  string
+	From   time.Time
+	To     time.Time
+}
+
+// AuditLog keeps the most recent entries in a fixed-size ring buffer, evicting
+// the oldest first. If Writer is set every entry is also appended to it as a
+// line of JSON, which outlives the buffer.
+type AuditLog struct {
+	Writer io.Writer
+
+	mutex   sync.Mutex
+	entries []AuditEntry
+	next    int // index the next entry is written to
+	full    bool
+}
+
+// DefaultAuditSize is the number of entries kept by NewAuditLog(0).
+const DefaultAuditSize = 1000
+
+func NewAuditLog(size int) *AuditLog {
+	if size <= 0 {
+		size = DefaultAuditSize
+	}
+	return &AuditLog{entries: make([]AuditEntry, size)}
+}
+
+func (a *AuditLog) Record(entry AuditEntry) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.entries[a.next] = entry
+	a.next = (a.next + 1) % len(a.entries)
+	if a.next == 0 {
+		a.full = true
+	}
+
+	if a.Writer != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := a.Writer.Write(append(line, '\n')); err != nil {
+			log.Printf("failed to write audit entry: %v", err)
+		}
+	}
+}
+
+// Entries returns the retained entries matching filter, oldest first.
+func (a *AuditLog) Entries(filter AuditFilter) []AuditEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ordered := a.entries[:a.next]
+	if a.full {
+		ordered = append(a.entries[a.next:len(a.entries):len(a.entries)], a.entries[:a.next]...)
+	}
+
+	matched := []AuditEntry{}
+	for _, entry := range ordered {
+		switch {
+		case filter.Action != "" && entry.Action != filter.Action,
+			filter.Actor != "" && entry.Actor != filter.Actor,
+			!filter.From.IsZero() && entry.At.Before(filter.From),
+			!filter.To.IsZero() && entry.At.After(filter.To):
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	return matched
+}
+
+// RecordAudit adds an entry stamped with the library clock to Audit, if set.
+func (l *Library) RecordAudit(actor, action, title, borrower, outcome string) {
+	if l.Audit == nil {
+		return
+	}
+	l.Audit.Record(AuditEntry{
+		At:       l.Now(),
+		Actor:    actor,
+		Action:   action,
+		Title:    title,
+		Borrower: borrower,
+		Outcome:  outcome,
+	})
+}
@@ -0,0 +1,74 @@
+package librarypkg
+
+import (
+	"bytes"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// calendarProductID identifies the library as the producer of its feeds.
+const calendarProductID = "-//Library//Due Dates//EN"
+
+// calendarLineLength is the most octets RFC 5545 allows on a line before it
+// must be folded.
+const calendarLineLength = 75
+
+var calendarEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// DueDateCalendar renders loans as an iCalendar document (RFC 5545) with an
+// all-day event on each loan's due date. Event UIDs are derived from the
+// loan IDs, so calendar apps refreshing the feed update their events rather
+// than adding them again. stamp is the DTSTAMP of every event, normally the
+// time the feed was generated.
+func DueDateCalendar(loans []LoanDetail, stamp time.Time) []byte {
+	var b bytes.Buffer
+	line := func(content string) {
+		b.WriteString(foldCalendarLine(content))
+		b.WriteString("\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:" + calendarProductID)
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	for _, loan := range loans {
+		due := loan.ReturnDate
+		line("BEGIN:VEVENT")
+		line("UID:loan-" + loan.ID + "@library")
+		line("DTSTAMP:" + stamp.UTC().Format("20060102T150405Z"))
+		line("DTSTART;VALUE=DATE:" + due.Format("20060102"))
+		line("DTEND;VALUE=DATE:" + due.AddDate(0, 0, 1).Format("20060102"))
+		line("SUMMARY:" + calendarEscaper.Replace(loan.BookTitle))
+		line("TRANSP:TRANSPARENT")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return b.Bytes()
+}
+
+// foldCalendarLine splits a content line longer than calendarLineLength
+// octets into continuation lines starting with a space, never inside a
+// UTF-8 sequence.
+func foldCalendarLine(content string) string {
+	if len(content) <= calendarLineLength {
+		return content
+	}
+
+	var b strings.Builder
+	limit := calendarLineLength
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		b.WriteString(content[:cut])
+		b.WriteString("\r\n ")
+		content = content[cut:]
+		// The leading space counts towards the continuation line's length
+		limit = calendarLineLength - 1
+	}
+	b.WriteString(content)
+	return b.String()
+}
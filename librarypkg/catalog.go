@@ -0,0 +1,312 @@
+package librarypkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type ImportSummary struct {
+	Imported          int           `json:"imported"`
+	SkippedDuplicates int           `json:"skippedDuplicates"`
+	Errors            []ImportError `json:"errors"`
+}
+
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// ImportRow is a book to import and the line of the file it was read from.
+type ImportRow struct {
+	BookDetail
+	Line int
+}
+
+// Import adds books to the catalog. Titles that already exist get the
+// imported copies added, or are skipped when strict is set. Every row is
+// checked before any is applied: if one differs only in case from a title in
+// the catalog or earlier in the file, or would take a book outside the
+// allowed number of copies, counting earlier rows of the same title, nothing
+// is imported and the summary lists the failing rows alongside
+// ErrInvalidImport. Nothing is imported either if ctx is done by the time it
+// gets the lock, and ctx's error is returned instead.
+func (l *Library) Import(ctx context.Context, rows []ImportRow, strict bool) (ImportSummary, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return ImportSummary{}, err
+	}
+
+	if importErrors := l.checkImport(rows, strict); len(importErrors) > 0 {
+		return ImportSummary{Errors: importErrors}, ErrInvalidImport
+	}
+
+	summary := ImportSummary{Errors: []ImportError{}}
+	for _, row := range rows {
+		entry, exists := l.titles[row.Title]
+		if exists && strict {
+			summary.SkippedDuplicates++
+			continue
+		}
+		if !exists {
+			entry = &titleEntry{}
+			l.titles[row.Title] = entry
+		}
+
+		book := &entry.book
+		book.Title = row.Title
+		if !exists {
+			book.CreatedAt = l.now()
+		}
+		tracked := book.tracksCopies()
+		book.AvailableCopies += row.AvailableCopies
+		book.TotalCopies += row.AvailableCopies
+		if tracked {
+			book.reconcileCopies()
+		}
+		if book.Author == "" {
+			book.Author = row.Author
+		}
+		if book.Year == 0 {
+			book.Year = row.Year
+		}
+		if _, taken := l.isbnIndex[row.ISBN]; book.ISBN == "" && row.ISBN != "" && !taken {
+			book.ISBN = row.ISBN
+			l.isbnIndex[row.ISBN] = row.Title
+		}
+		book.Version++
+		l.titleIndex[titleKey(row.Title)] = row.Title
+		summary.Imported++
+	}
+
+	if err := l.validate(); err != nil {
+		log.Printf("library state invalid after import: %v", err)
+	}
+
+	return summary, nil
+}
+
+// checkImport expects the caller to hold the mutex. It reports the rows
+// Import would refuse, as Import would apply them in order, so a title
+// repeated in the file is checked against its running total.
+func (l *Library) checkImport(rows []ImportRow, strict bool) []ImportError {
+	var importErrors []ImportError
+	totals := make(map[string]int)    // title -> total copies after the rows so far
+	titles := make(map[string]string) // titleKey -> title of the rows so far
+	for _, row := range rows {
+		title, named := titles[titleKey(row.Title)]
+		if !named {
+			title = l.lookupTitle(row.Title)
+			if _, exists := l.titles[title]; !exists {
+				title = row.Title
+			}
+		}
+		if title != row.Title {
+			importErrors = append(importErrors, ImportError{Line: row.Line, Message: fmt.Sprintf("%s: %v: '%s'", row.Title, ErrTitleCollision, title)})
+			continue
+		}
+		titles[titleKey(row.Title)] = row.Title
+
+		total, seen := totals[row.Title]
+		entry, exists := l.titles[row.Title]
+		if strict && (exists || seen) {
+			continue
+		}
+		if !seen && exists {
+			total = entry.book.TotalCopies
+		}
+
+		total += row.AvailableCopies
+		if err := l.checkCopies(total); err != nil {
+			importErrors = append(importErrors, ImportError{Line: row.Line, Message: fmt.Sprintf("%s: %v", row.Title, err)})
+			continue
+		}
+		totals[row.Title] = total
+	}
+	return importErrors
+}
+
+// ParseCatalogCSV reads a title,availableCopies CSV with a header row and
+// optional author, isbn and year columns. Every row is checked so the caller
+// can reject the whole import on any error.
+func ParseCatalogCSV(r io.Reader) ([]ImportRow, []ImportError) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, []ImportError{{Line: 1, Message: "missing header row"}}
+	}
+
+	titleCol, copiesCol, authorCol, isbnCol, yearCol := -1, -1, -1, -1, -1
+	for i, name := range header {
+		switch strings.TrimSpace(name) {
+		case "title":
+			titleCol = i
+		case "availableCopies":
+			copiesCol = i
+		case "author":
+			authorCol = i
+		case "isbn":
+			isbnCol = i
+		case "year":
+			yearCol = i
+		}
+	}
+	if titleCol == -1 || copiesCol == -1 {
+		return nil, []ImportError{{Line: 1, Message: "header must contain title and availableCopies columns"}}
+	}
+
+	var rows []ImportRow
+	var importErrors []ImportError
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				importErrors = append(importErrors, ImportError{Line: parseErr.Line, Message: parseErr.Err.Error()})
+				continue
+			}
+			importErrors = append(importErrors, ImportError{Message: err.Error()})
+			break
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) <= titleCol || len(record) <= copiesCol {
+			importErrors = append(importErrors, ImportError{Line: line, Message: "missing columns"})
+			continue
+		}
+
+		title := strings.TrimSpace(record[titleCol])
+		if title == "" {
+			importErrors = append(importErrors, ImportError{Line: line, Message: "title is required"})
+			continue
+		}
+		if len(title) > MaxNameLength {
+			importErrors = append(importErrors, ImportError{Line: line, Message: fmt.Sprintf("title must be at most %d characters", MaxNameLength)})
+			continue
+		}
+
+		copies, err := strconv.Atoi(strings.TrimSpace(record[copiesCol]))
+		if err != nil || copies < 0 {
+			importErrors = append(importErrors, ImportError{Line: line, Message: "availableCopies must be a non-negative integer"})
+			continue
+		}
+
+		book := BookDetail{Title: title, AvailableCopies: copies}
+
+		if value := column(record, authorCol); value != "" {
+			book.Author = value
+		}
+		if value := column(record, isbnCol); value != "" {
+			isbn, err := NormalizeISBN(value)
+			if err != nil {
+				importErrors = append(importErrors, ImportError{Line: line, Message: "isbn has an invalid check digit"})
+				continue
+			}
+			book.ISBN = isbn
+		}
+		if value := column(record, yearCol); value != "" {
+			year, err := strconv.Atoi(value)
+			if err != nil {
+				importErrors = append(importErrors, ImportError{Line: line, Message: "year must be an integer"})
+				continue
+			}
+			book.Year = year
+		}
+
+		rows = append(rows, ImportRow{BookDetail: book, Line: line})
+	}
+
+	return rows, importErrors
+}
+
+// LoadSeed reads the books of a seed file: a JSON list of books, or for a
+// .csv file the columns ParseCatalogCSV reads. Errors name the file and the
+// line at fault.
+func LoadSeed(path string) ([]BookDetail, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		rows, importErrors := ParseCatalogCSV(bytes.NewReader(data))
+		if len(importErrors) > 0 {
+			return nil, fmt.Errorf("%s:%d: %s", path, importErrors[0].Line, importErrors[0].Message)
+		}
+		books := make([]BookDetail, len(rows))
+		for i, row := range rows {
+			books[i] = row.BookDetail
+		}
+		return books, nil
+	}
+
+	var books []BookDetail
+	if err := json.Unmarshal(data, &books); err != nil {
+		if line := jsonErrorLine(data, err); line > 0 {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return books, nil
+}
+
+// jsonErrorLine returns the line of data a json.Unmarshal error points at, or
+// 0 if it doesn't point anywhere.
+func jsonErrorLine(data []byte, err error) int {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return 0
+	}
+	return bytes.Count(data[:min(offset, int64(len(data)))], []byte("\n")) + 1
+}
+
+// Seed adds books to a library that has none yet and reports whether it
+// did, so seeding on every start doesn't duplicate books the library already
+// holds. Each book is added as AddBook would; the first it rejects stops the
+// seeding.
+func (l *Library) Seed(books []BookDetail) (bool, error) {
+	l.mutex.RLock()
+	empty := len(l.titles) == 0
+	l.mutex.RUnlock()
+	if !empty {
+		return false, nil
+	}
+
+	for i, book := range books {
+		if _, err := l.AddBook(book); err != nil {
+			return true, fmt.Errorf("book %d (%q): %w", i+1, book.Title, err)
+		}
+	}
+	return true, nil
+}
+
+// column returns the trimmed field at index i, or "" for absent columns.
+func column(record []string, i int) string {
+	if i < 0 || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
@@ -0,0 +1,143 @@
+package librarypkg
+
+import (
+	"log"
+	"slices"
+)
+
+// Copy statuses.
+const (
+	CopyAvailable = "available"
+	CopyLoaned    = "loaned"
+	CopyInRepair  = "repair"
+	CopyLost      = "lost" // kept for the record but no longer owned
+)
+
+// Copy is one physical copy of a book, identified by the barcode on it.
+type Copy struct {
+	Barcode string `json:"barcode" xml:"barcode,attr"`
+	Status  string `json:"status" xml:"status,attr"`
+}
+
+// copyStatuses maps how a loan was closed to what becomes of its copy.
+var copyStatuses = map[string]string{
+	LoanReturned:  CopyAvailable,
+	LoanLost:      CopyLost,
+	LoanDamaged:   CopyInRepair,
+	LoanAbandoned: CopyLost,
+}
+
+// tracksCopies reports whether the book's counts are derived from Copies.
+// Books recorded with counts alone keep working on the counts; a book with
+// no copies at all starts tracking them as soon as it gets some.
+func (b BookDetail) tracksCopies() bool {
+	return len(b.Copies) > 0 || b.TotalCopies == 0
+}
+
+// copyCounts derives the available, in repair and owned copies from Copies.
+func (b BookDetail) copyCounts() (available, inRepair, total int) {
+	for _, c := range b.Copies {
+		switch c.Status {
+		case CopyAvailable:
+			available++
+		case CopyInRepair:
+			inRepair++
+		}
+		if c.Status != CopyLost {
+			total++
+		}
+	}
+	return available, inRepair, total
+}
+
+func (b *BookDetail) countCopies() {
+	b.AvailableCopies, b.InRepair, b.TotalCopies = b.copyCounts()
+}
+
+// moveCopy changes the status of the copy with the given barcode, or of the
+// first copy in from if the barcode is empty or unknown, to to. It returns
+// the barcode of the copy moved, or "" if there was none in from. Copies is
+// copied first since earlier snapshots of the book share it.
+func (b *BookDetail) moveCopy(barcode, from, to string) string {
+	i := slices.IndexFunc(b.Copies, func(c Copy) bool { return c.Barcode == barcode && c.Status == from })
+	if i == -1 {
+		i = slices.IndexFunc(b.Copies, func(c Copy) bool { return c.Status == from })
+	}
+	if i == -1 {
+		return ""
+	}
+
+	b.Copies = slices.Clone(b.Copies)
+	b.Copies[i].Status = to
+	return b.Copies[i].Barcode
+}
+
+// lendCopy takes a copy off the shelf for a new loan and returns its
+// barcode, or "" for a book tracked by counts alone. The caller has checked
+// that a copy is available.
+func (b *BookDetail) lendCopy() string {
+	if !b.tracksCopies() {
+		b.AvailableCopies--
+		return ""
+	}
+	barcode := b.moveCopy("", CopyAvailable, CopyLoaned)
+	b.countCopies()
+	return barcode
+}
+
+// closeCopy accounts for the copy of a loan closed with status: back on the
+// shelf, written off when lost, or into repair.
+func (b *BookDetail) closeCopy(loan LoanDetail, status string) {
+	if b.tracksCopies() {
+		if b.moveCopy(loan.Barcode, CopyLoaned, copyStatuses[status]) == "" {
+			log.Printf("book '%s' has no copy on loan, not counting the close of loan %s", b.Title, loan.ID)
+		}
+		b.countCopies()
+		return
+	}
+
+	switch status {
+	case LoanLost, LoanAbandoned:
+		b.TotalCopies--
+	case LoanDamaged:
+		b.InRepair++
+	default:
+		// The loan was found and removed, so this copy really is back. The
+		// clamp only guards against books whose counts were already off.
+		if b.AvailableCopies < b.TotalCopies-b.InRepair {
+			b.AvailableCopies++
+		} else {
+			log.Printf("book '%s' already has all %d copies available, not counting the return of loan %s", b.Title, b.TotalCopies, loan.ID)
+		}
+	}
+}
+
+// reconcileCopies reshapes Copies to match AvailableCopies and InRepair after
+// the counts were edited. Copies move between the shelf and repair first, then
+// shelf copies are added with new barcodes or retired. Loaned and lost
+// copies are left alone.
+func (b *BookDetail) reconcileCopies() {
+	_, inRepair, _ := b.copyCounts()
+	for ; inRepair > b.InRepair; inRepair-- {
+		b.moveCopy("", CopyInRepair, CopyAvailable)
+	}
+	for ; inRepair < b.InRepair; inRepair++ {
+		if b.moveCopy("", CopyAvailable, CopyInRepair) == "" {
+			b.Copies = append(slices.Clip(b.Copies), Copy{Barcode: newBarcode(), Status: CopyInRepair})
+		}
+	}
+
+	available, _, _ := b.copyCounts()
+	for ; available < b.AvailableCopies; available++ {
+		b.Copies = append(slices.Clip(b.Copies), Copy{Barcode: newBarcode(), Status: CopyAvailable})
+	}
+	for ; available > b.AvailableCopies; available-- {
+		i := slices.IndexFunc(b.Copies, func(c Copy) bool { return c.Status == CopyAvailable })
+		b.Copies = slices.Delete(slices.Clone(b.Copies), i, i+1)
+	}
+	b.countCopies()
+}
+
+func newBarcode() string {
+	return newID(6)
+}
@@ -0,0 +1,61 @@
+package librarypkg
+
+import "errors"
+
+// Errors returned by Library methods. Callers should match them with
+// errors.Is, since some are wrapped with extra context such as the borrower
+// or the current book version.
+var (
+	// Lookups
+	ErrBookNotFound    = errors.New("book not found")
+	ErrNoLoans         = errors.New("no loans found for this book")
+	ErrLoanNotFound    = errors.New("no loan found")
+	ErrLoanReturned    = errors.New("loan has been returned")
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrMemberNotFound  = errors.New("member not found")
+	ErrNotReserved     = errors.New("borrower has no reservation for this book")
+
+	// Conflicts with the current state
+	ErrNoCopies         = errors.New("no copies available")
+	ErrAlreadyReserved  = errors.New("book already reserved by this borrower")
+	ErrReservationsFull = errors.New("reservation queue is full")
+	ErrBookExists       = errors.New("book already exists")
+	ErrTitleCollision   = errors.New("title differs only in case from an existing book")
+	ErrISBNExists       = errors.New("ISBN already belongs to another book")
+	ErrVersionMismatch  = errors.New("book has been modified")
+	ErrExtensionLimit   = errors.New("loan has reached the extension limit")
+	ErrReservedByOthers = errors.New("loan can't be extended while others are waiting for the book")
+	ErrLoanLimit        = errors.New("borrower has reached the loan limit")
+	ErrTitleLoanLimit   = errors.New("borrower already has as many copies of this book as allowed")
+	ErrBookOnLoan       = errors.New("book has active loans")
+	ErrBookHasHistory   = errors.New("book has loan history")
+	ErrTotalBelowLoans  = errors.New("total copies cannot be below the copies on loan")
+	ErrBookArchived     = errors.New("book is archived")
+	ErrReferenceOnly    = errors.New("book is reference only and can't leave the library")
+	ErrMaxLoanDuration  = errors.New("loan would exceed the maximum loan duration")
+	ErrBatchUnavailable = errors.New("some titles in the batch are unavailable")
+
+	// Unavailable for now
+	ErrReadOnly = errors.New("library is read-only for maintenance")
+
+	// Invalid input
+	ErrTitleRequired        = errors.New("title is required")
+	ErrNegativeCopies       = errors.New("available copies cannot be negative")
+	ErrCopiesOutOfRange     = errors.New("number of copies out of range")
+	ErrInvalidISBN          = errors.New("invalid ISBN")
+	ErrInvalidLoanDays      = errors.New("loan days cannot be negative")
+	ErrInvalidWebhook       = errors.New("invalid webhook")
+	ErrNameRequired         = errors.New("name is required")
+	ErrInvalidEmail         = errors.New("invalid email address")
+	ErrInvalidExtensionDays = errors.New("invalid extension days")
+	ErrNegativeCost         = errors.New("replacement cost cannot be negative")
+	ErrDueBeforeLoan        = errors.New("due date cannot be before the loan date")
+	ErrDueInPast            = errors.New("due date is in the past")
+	ErrNameTooLong          = errors.New("name is too long")
+	ErrInvalidSnapshot      = errors.New("invalid snapshot")
+	ErrInvalidImport        = errors.New("invalid import")
+	ErrInvalidVolume        = errors.New("volume cannot be negative")
+
+	// External lookups
+	ErrMetadataUnavailable = errors.New("book metadata lookup failed")
+)
@@ -0,0 +1,113 @@
+package librarypkg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event types published after loan changes.
+const (
+	EventBookBorrowed = "book.borrowed"
+	EventBookReturned = "book.returned"
+	EventLoanExtended = "loan.extended"
+	EventLoanOverdue  = "loan.overdue"
+	EventBookLost     = "book.lost"
+	EventBookDamaged  = "book.damaged"
+)
+
+var eventTypes = map[string]bool{
+	EventBookBorrowed: true,
+	EventBookReturned: true,
+	EventLoanExtended: true,
+	EventLoanOverdue:  true,
+	EventBookLost:     true,
+	EventBookDamaged:  true,
+}
+
+type Event struct {
+	Type     string     `json:"type"`
+	Title    string     `json:"title"`
+	Borrower string     `json:"borrower"`
+	LoanID   string     `json:"loanId"`
+	At       time.Time  `json:"at"`
+	Loan     LoanDetail `json:"-"`
+}
+
+// EventPublisher sends events to consumers of the library's changes. Publish
+// is called after each successful mutation while the title is locked, or
+// the whole library for operations across titles such as BorrowBatch, so
+// implementations that talk to slow external services should hand the work
+// off. Errors are logged and counted in Stats but never fail the mutation.
+type EventPublisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+type NopPublisher struct{}
+
+func (NopPublisher) Publish(ctx context.Context, event Event) error { return nil }
+
+// EventBus fans events out to in-process subscribers. Each subscriber has a
+// small buffer; events for a subscriber that falls behind are dropped rather
+// than holding up the publisher.
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]bool
+	closed      bool
+}
+
+const subscriberBuffer = 16
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]bool)}
+}
+
+// Subscribe returns a channel receiving every published event, and a cancel
+// function to unsubscribe. The channel is closed on cancel or when the bus is
+// closed.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	events := make(chan Event, subscriberBuffer)
+	if b.closed {
+		close(events)
+		return events, func() {}
+	}
+	b.subscribers[events] = true
+
+	return events, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.subscribers[events] {
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Publish hands event to every subscriber with room for it. It never fails.
+func (b *EventBus) Publish(ctx context.Context, event Event) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close ends every subscription and ignores later subscribers.
+func (b *EventBus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for events := range b.subscribers {
+		close(events)
+	}
+	b.subscribers = make(map[chan Event]bool)
+	b.closed = true
+}
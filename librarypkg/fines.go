@@ -0,0 +1,104 @@
+package librarypkg
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultFinePerDay is the fine in cents for each day a loan is overdue.
+const DefaultFinePerDay = 25
+
+type OverdueLoan struct {
+	Loan        LoanDetail `json:"loan"`
+	DaysOverdue int        `json:"daysOverdue"`
+	Fine        int        `json:"fine"` // cents
+}
+
+// Fee is a one-off charge, such as the replacement cost of a lost copy.
+type Fee struct {
+	LoanID string    `json:"loanId"`
+	Title  string    `json:"title"`
+	Reason string    `json:"reason"`
+	Amount int       `json:"amount"` // cents
+	At     time.Time `json:"at"`
+}
+
+type FineSummary struct {
+	Borrower string        `json:"borrower"`
+	Loans    []OverdueLoan `json:"loans"`
+	Fees     []Fee         `json:"fees"`
+	Total    int           `json:"total"` // cents
+}
+
+// Overdue lists the active loans accruing fines, i.e. past their return date
+// by more than the grace period, most overdue first.
+func (l *Library) Overdue() []OverdueLoan {
+	unlock := l.lockAllTitles()
+	defer unlock()
+
+	overdue := []OverdueLoan{}
+	now := l.now()
+	for _, entry := range l.titles {
+		for _, loan := range entry.loans {
+			if days := l.chargeableDays(loan.ReturnDate, now); days > 0 {
+				overdue = append(overdue, OverdueLoan{Loan: loan, DaysOverdue: days, Fine: days * l.FinePerDay})
+			}
+		}
+	}
+
+	sort.Slice(overdue, func(i, j int) bool {
+		return overdue[i].Loan.ReturnDate.Before(overdue[j].Loan.ReturnDate)
+	})
+	return overdue
+}
+
+// Fine returns the fines borrower has accrued so far on their active loans
+// and the fees charged to them, such as for lost copies.
+func (l *Library) Fine(borrower string) FineSummary {
+	summary := FineSummary{Borrower: borrower, Loans: []OverdueLoan{}}
+	for _, overdue := range l.Overdue() {
+		if overdue.Loan.NameOfBorrower != borrower {
+			continue
+		}
+		summary.Loans = append(summary.Loans, overdue)
+		summary.Total += overdue.Fine
+	}
+
+	l.mutex.RLock()
+	l.entries.Lock()
+	summary.Fees = append([]Fee{}, l.fees[borrower]...)
+	l.entries.Unlock()
+	l.mutex.RUnlock()
+	for _, fee := range summary.Fees {
+		summary.Total += fee.Amount
+	}
+	return summary
+}
+
+// chargeReplacement expects the caller to hold entries, or the mutex for
+// writing. It charges the
+// borrower of a lost loan the book's ReplacementCost, or the library's
+// ReplacementFee for books without one, and returns the amount.
+func (l *Library) chargeReplacement(book BookDetail, loan LoanDetail, at time.Time) int {
+	amount := book.ReplacementCost
+	if amount == 0 {
+		amount = l.ReplacementFee
+	}
+	if amount == 0 {
+		return 0
+	}
+
+	l.fees[loan.NameOfBorrower] = append(l.fees[loan.NameOfBorrower], Fee{
+		LoanID: loan.ID,
+		Title:  loan.BookTitle,
+		Reason: "replacement of a lost copy",
+		Amount: amount,
+		At:     at,
+	})
+	return amount
+}
+
+// chargeableDays is the number of started days late beyond GraceDays.
+func (l *Library) chargeableDays(due, at time.Time) int {
+	return max(daysLate(due, at)-l.GraceDays, 0)
+}
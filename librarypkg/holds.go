@@ -0,0 +1,128 @@
+package librarypkg
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// Reservation is a borrower's place in a title's reservation queue, or with
+// HeldSince set, the copy held for them once they reached its head.
+type Reservation struct {
+	Borrower   string    `json:"borrower"`
+	ReservedAt time.Time `json:"reservedAt"`
+	HeldSince  time.Time `json:"heldSince,omitzero"`
+}
+
+// reservedBy reports the index of borrower in queue, or -1.
+func reservedBy(queue []Reservation, borrower string) int {
+	return slices.IndexFunc(queue, func(r Reservation) bool { return r.Borrower == borrower })
+}
+
+// holdCopy expects the caller to hold the mutex and title's lock. It sets a
+// returned copy aside for reservation. Without HoldDays copies aren't held,
+// so the copy stays on the shelf for whoever borrows it first.
+func (l *Library) holdCopy(title string, reservation Reservation) {
+	if l.HoldDays <= 0 {
+		return
+	}
+	reservation.HeldSince = l.now()
+	entry := l.titles[title]
+	entry.holds = append(entry.holds, reservation)
+}
+
+// freeCopies counts the copies of the title borrower can take: those on the
+// shelf less the ones held for others.
+func (e *titleEntry) freeCopies(borrower string) int {
+	held := len(e.holds)
+	if reservedBy(e.holds, borrower) != -1 {
+		held--
+	}
+	return e.book.AvailableCopies - held
+}
+
+// collectHold releases the copy of the title held for borrower, if any, now
+// that they are borrowing it.
+func (e *titleEntry) collectHold(borrower string) {
+	i := reservedBy(e.holds, borrower)
+	if i == -1 {
+		return
+	}
+	if len(e.holds) == 1 {
+		e.holds = nil
+	} else {
+		e.holds = slices.Delete(slices.Clone(e.holds), i, i+1)
+	}
+}
+
+// ExpireHolds releases the copies held longer than HoldDays without being
+// borrowed and returns the holds it dropped. Each copy goes to the next
+// borrower in the queue, who is notified, or back on the shelf if there is
+// none. Titles are found under the write lock and then handled one by one
+// under their title lock, like CloseAbandoned.
+func (l *Library) ExpireHolds() []Reservation {
+	if l.HoldDays <= 0 || l.ReadOnly() {
+		return nil
+	}
+	expired := func(hold Reservation, now time.Time) bool {
+		return now.After(hold.HeldSince.AddDate(0, 0, l.HoldDays))
+	}
+
+	l.mutex.Lock()
+	now := l.now()
+	var titles []string
+	for title, entry := range l.titles {
+		if slices.ContainsFunc(entry.holds, func(hold Reservation) bool { return expired(hold, now) }) {
+			titles = append(titles, title)
+		}
+	}
+	l.mutex.Unlock()
+
+	var dropped []Reservation
+	for _, title := range titles {
+		dropped = append(dropped, l.expireTitleHolds(title, expired)...)
+	}
+	return dropped
+}
+
+// expireTitleHolds drops the expired holds of title, rechecking them under
+// the title lock since they may have been collected since ExpireHolds looked.
+func (l *Library) expireTitleHolds(title string, expired func(Reservation, time.Time) bool) []Reservation {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	// The title may have been renamed or deleted since ExpireHolds looked
+	entry, exists := l.titles[title]
+	if !exists {
+		return nil
+	}
+	now := l.now()
+	var dropped []Reservation
+	var next []string
+	kept := slices.DeleteFunc(slices.Clone(entry.holds), func(hold Reservation) bool {
+		if !expired(hold, now) {
+			return false
+		}
+		dropped = append(dropped, hold)
+		return true
+	})
+	if len(kept) == 0 {
+		kept = nil
+	}
+	entry.holds = kept
+	for range dropped {
+		if borrower := l.fulfillReservation(title); borrower != "" {
+			next = append(next, borrower)
+		}
+	}
+
+	for _, hold := range dropped {
+		log.Printf("hold on '%s' for %s expired after %d days", title, hold.Borrower, l.HoldDays)
+	}
+	for _, borrower := range next {
+		if err := l.Notifier.Notify(borrower, title); err != nil {
+			log.Printf("failed to notify %s about '%s': %v", borrower, title, err)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,66 @@
+package librarypkg
+
+import "sort"
+
+// InventoryDiscrepancy is a title whose copy counts don't add up: every copy
+// it owns should be on the shelf, on loan or in repair.
+type InventoryDiscrepancy struct {
+	Title           string `json:"title"`
+	TotalCopies     int    `json:"totalCopies"`
+	AvailableCopies int    `json:"availableCopies"`
+	ActiveLoans     int    `json:"activeLoans"`
+	InRepair        int    `json:"inRepair"`
+	Difference      int    `json:"difference"` // total minus available, on loan and in repair
+}
+
+type InventoryReport struct {
+	Titles        int                    `json:"titles"`
+	Discrepancies []InventoryDiscrepancy `json:"discrepancies"`
+}
+
+// Inventory cross-checks TotalCopies against the available copies plus the
+// active loans and copies in repair of every title, in title order.
+func (l *Library) Inventory() InventoryReport {
+	unlock := l.lockAllTitles()
+	defer unlock()
+
+	report := InventoryReport{Titles: len(l.titles), Discrepancies: []InventoryDiscrepancy{}}
+	for title, entry := range l.titles {
+		book, onLoan := entry.book, len(entry.loans)
+		if difference := book.TotalCopies - book.AvailableCopies - onLoan - book.InRepair; difference != 0 {
+			report.Discrepancies = append(report.Discrepancies, InventoryDiscrepancy{
+				Title:           title,
+				TotalCopies:     book.TotalCopies,
+				AvailableCopies: book.AvailableCopies,
+				ActiveLoans:     onLoan,
+				InRepair:        book.InRepair,
+				Difference:      difference,
+			})
+		}
+	}
+
+	sort.Slice(report.Discrepancies, func(i, j int) bool {
+		return report.Discrepancies[i].Title < report.Discrepancies[j].Title
+	})
+	return report
+}
+
+// BackfillTotalCopies sets TotalCopies to the available copies plus the
+// active loans for books recorded before copies were counted, i.e. with no
+// TotalCopies, and returns how many it changed. Load older records with it
+// before serving them.
+func (l *Library) BackfillTotalCopies() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	changed := 0
+	for _, entry := range l.titles {
+		book := &entry.book
+		if book.TotalCopies != 0 {
+			continue
+		}
+		book.TotalCopies = book.AvailableCopies + len(entry.loans) + book.InRepair
+		changed++
+	}
+	return changed
+}
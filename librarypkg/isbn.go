@@ -0,0 +1,48 @@
+package librarypkg
+
+import "strings"
+
+// NormalizeISBN strips hyphens and spaces from an ISBN and verifies its
+// ISBN-10 or ISBN-13 check digit.
+func NormalizeISBN(isbn string) (string, error) {
+	isbn = strings.NewReplacer("-", "", " ", "").Replace(isbn)
+
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, c := range isbn {
+			var digit int
+			switch {
+			case c >= '0' && c <= '9':
+				digit = int(c - '0')
+			case (c == 'X' || c == 'x') && i == 9:
+				digit = 10
+			default:
+				return "", ErrInvalidISBN
+			}
+			sum += digit * (10 - i)
+		}
+		if sum%11 != 0 {
+			return "", ErrInvalidISBN
+		}
+		return strings.ToUpper(isbn), nil
+	case 13:
+		sum := 0
+		for i, c := range isbn {
+			if c < '0' || c > '9' {
+				return "", ErrInvalidISBN
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += int(c-'0') * weight
+		}
+		if sum%10 != 0 {
+			return "", ErrInvalidISBN
+		}
+		return isbn, nil
+	default:
+		return "", ErrInvalidISBN
+	}
+}
@@ -0,0 +1,1238 @@
+package librarypkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BookDetail is a title in the catalog. AvailableCopies never goes negative:
+// a borrow checks for a free copy and takes it in the same critical section.
+// Nor does it exceed TotalCopies, the copies owned including those on loan
+// and InRepair, the damaged ones out of circulation. The counts are derived
+// from Copies, the physical copies by barcode, except for books recorded
+// before copies were tracked.
+type BookDetail struct {
+	Title           string    `json:"title" xml:"title"`                         // catalog key, including the edition and volume
+	Edition         string    `json:"edition,omitempty" xml:"edition,omitempty"` // e.g. "2nd edition"; each edition is catalogued separately
+	Volume          int       `json:"volume,omitempty" xml:"volume,omitempty"`   // of a multi-volume work, likewise catalogued separately
+	Author          string    `json:"author,omitempty" xml:"author,omitempty"`
+	ISBN            string    `json:"isbn,omitempty" xml:"isbn,omitempty"`
+	Year            int       `json:"year,omitempty" xml:"year,omitempty"`
+	Category        string    `json:"category,omitempty" xml:"category,omitempty"` // a key of the library's Categories
+	AvailableCopies int       `json:"availableCopies" xml:"availableCopies"`
+	TotalCopies     int       `json:"totalCopies" xml:"totalCopies"`
+	InRepair        int       `json:"inRepair,omitempty" xml:"inRepair,omitempty"`
+	ReplacementCost int       `json:"replacementCost,omitempty" xml:"replacementCost,omitempty"` // cents; zero means the library's ReplacementFee
+	LoanDays        int       `json:"loanDays,omitempty" xml:"loanDays,omitempty"`               // zero means the category's or library's LoanDays
+	ExtensionDays   int       `json:"extensionDays,omitempty" xml:"extensionDays,omitempty"`     // zero means the category's or library's ExtensionDays
+	Reference       bool      `json:"reference,omitempty" xml:"reference,omitempty"`             // never circulates; loans already out are unaffected
+	Archived        bool      `json:"archived,omitempty" xml:"archived,omitempty"`
+	Version         int       `json:"version" xml:"version"`
+	Copies          []Copy    `json:"copies,omitempty" xml:"copies>copy,omitempty"`
+	CreatedAt       time.Time `json:"createdAt,omitzero" xml:"createdAt"` // when the title was added to the catalog
+}
+
+type LoanDetail struct {
+	ID             string    `json:"id" xml:"id"`
+	BookTitle      string    `json:"bookTitle" xml:"bookTitle"`
+	NameOfBorrower string    `json:"nameOfBorrower" xml:"nameOfBorrower"`
+	LoanDate       time.Time `json:"loanDate" xml:"loanDate"`
+	ReturnDate     time.Time `json:"returnDate" xml:"returnDate"`
+	Extensions     int       `json:"extensions" xml:"extensions"`
+	Barcode        string    `json:"barcode,omitempty" xml:"barcode,omitempty"`             // the copy lent, if the book tracks copies
+	DueOverridden  bool      `json:"dueOverridden,omitempty" xml:"dueOverridden,omitempty"` // ReturnDate was set by SetDueDate
+	Overdue        bool      `json:"overdue,omitempty" xml:"overdue,omitempty"`             // flagged by SweepOverdue once ReturnDate passed
+	ReturnedAt     time.Time `json:"returnedAt,omitzero" xml:"returnedAt"`                  // set once the loan is in History
+	Status         string    `json:"status,omitempty" xml:"status,omitempty"`               // how it was closed: LoanReturned, LoanLost, LoanDamaged or LoanAbandoned
+
+	// PreviousBorrowers lists who had the loan before it was transferred,
+	// oldest first.
+	PreviousBorrowers []string `json:"previousBorrowers,omitempty" xml:"previousBorrower,omitempty"`
+}
+
+// Library locking comes in three levels, always taken in this order:
+//
+//   - mutex is held for writing by operations that add, remove or rename
+//     titles, or that change several titles at once, so they see every
+//     title at rest. Operations on a single title hold it for reading, which
+//     keeps the set of titles as it is, and so do reads across titles, see
+//     lockAllTitles.
+//   - titleLocks guard the entry of each title: its book, loans,
+//     reservation queue and holds. Operations on the same title serialize,
+//     including their notifications and events, without blocking other
+//     titles. Operations across titles announce their changes while still
+//     holding the mutex for writing, so they too are announced in order.
+//   - entries guards what titles share: the loan index, the borrowers' loan
+//     counts, History, fees and reminders. Operations holding the mutex for
+//     reading take it around every access to them and never hold it while
+//     taking another lock; holding the mutex for writing excludes them all.
+//
+// Helpers that expect the caller to hold the mutex need it for writing, or
+// for reading along with the lock of every title they touch.
+type Library struct {
+	History      []LoanDetail // returned loans, oldest return first
+	Members      map[string]Member
+	Notifier     Notifier
+	Metadata     MetadataSource
+	Webhooks     *Webhooks              // nil disables webhook delivery
+	Audit        *AuditLog              // nil disables the audit log
+	Events       *EventBus              // in process, for /events
+	Publisher    EventPublisher         // to other services, NopPublisher by default
+	titles       map[string]*titleEntry // title -> its book, loans, reservations and holds
+	isbnIndex    map[string]string      // ISBN -> title
+	titleIndex   map[string]string      // titleKey -> title
+	loanIndex    map[string]string      // loan ID -> title, for active loans
+	loanCounts   map[string]int         // borrower -> active loans
+	reminded     map[string]time.Time   // loan ID -> due date a reminder was sent for
+	fees         map[string][]Fee       // borrower -> replacement fees charged
+	overdueCount int                    // loans SweepOverdue has flagged
+	publishFails atomic.Int64           // events Publisher failed to take
+	readOnly     atomic.Bool            // maintenance mode, see SetReadOnly
+	mutex        sync.RWMutex
+	titleLocks   [titleLockStripes]sync.Mutex
+	entries      sync.Mutex
+	now          func() time.Time // every timestamp goes through here so tests can fake it
+	Debug        bool
+
+	// MaxExtensions caps how often a single loan can be extended; zero means
+	// no limit.
+	MaxExtensions int
+
+	// ExtendReserved lets loans be extended while other borrowers are
+	// waiting for the book. By default they are refused with
+	// ErrReservedByOthers, so the copy comes back for the next in line.
+	ExtendReserved bool
+
+	// LoanDays is how long a loan runs and ExtensionDays how far an
+	// extension moves the return date, unless the book or its category sets
+	// its own. MaxLoanDays caps the total loan from the loan date, extensions
+	// included; zero means no limit.
+	LoanDays      int
+	ExtensionDays int
+	MaxLoanDays   int
+
+	// DueEndOfDay moves the return date of new loans and extensions to
+	// 23:59:59 of its day in Location, so a book borrowed at 3pm isn't
+	// overdue at 3:01pm on the day it is due. A nil Location means UTC.
+	DueEndOfDay bool
+	Location    *time.Location
+
+	// Categories sets the loan and extension periods of books by category.
+	// It is only read once the library is serving, so set it up front.
+	Categories map[string]CategoryPeriods
+
+	// FinePerDay is charged in cents for every day a loan is overdue beyond
+	// GraceDays. ReplacementFee is charged in cents for a lost copy of a
+	// book without its own ReplacementCost.
+	FinePerDay     int
+	GraceDays      int
+	ReplacementFee int
+
+	// MaxLoansPerBorrower caps how many books one borrower can have out at
+	// once; zero means no limit.
+	MaxLoansPerBorrower int
+
+	// MaxCopiesPerBorrowerPerTitle caps how many copies of the same title one
+	// borrower can have out at once, so nobody takes every copy of a popular
+	// book; zero means no limit.
+	MaxCopiesPerBorrowerPerTitle int
+
+	// MaxCopies caps a book's total copies, so a typo can't add a billion of
+	// them; zero means no limit. Books always need at least one copy.
+	MaxCopies int
+
+	// MaxHistoryEntries and HistoryRetention bound History by count and by
+	// age; the oldest returns are dropped as new ones come in. Zero means no
+	// limit.
+	MaxHistoryEntries int
+	HistoryRetention  time.Duration
+
+	// AutoCloseDays is how many days past its return date CloseAbandoned
+	// waits before writing a loan's copy off; zero disables it.
+	AutoCloseDays int
+
+	// MaxReservations caps how many borrowers can queue for one title; zero
+	// means no limit. HoldDays is how long a returned copy is held for the
+	// borrower at the head of the queue before ExpireHolds passes it on;
+	// zero means copies aren't held and go back on the shelf for anyone.
+	MaxReservations int
+	HoldDays        int
+}
+
+// titleEntry is the state of one title, guarded by its title lock.
+type titleEntry struct {
+	book         BookDetail
+	loans        []LoanDetail  // active loans, oldest first
+	reservations []Reservation // the queue, first come first served
+	holds        []Reservation // copies held for reservations, see HoldDays
+}
+
+// Notifier tells a borrower that a book they reserved is ready for them.
+// It is called while the title is locked, or the whole library for
+// ReturnBatch, so implementations that talk to slow external services should
+// hand the work off.
+type Notifier interface {
+	Notify(borrower, title string) error
+}
+
+type NopNotifier struct{}
+
+func (NopNotifier) Notify(borrower, title string) error { return nil }
+
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(borrower, title string) error {
+	log.Printf("notify %s: '%s' is now available", borrower, title)
+	return nil
+}
+
+type BookAvailability struct {
+	Title             string     `json:"title"`
+	AvailableCopies   int        `json:"availableCopies"`
+	ActiveLoans       int        `json:"activeLoans"`
+	NextReturnDate    *time.Time `json:"nextReturnDate,omitempty"`
+	QueueLength       int        `json:"queueLength"`
+	HeldCopies        int        `json:"heldCopies,omitempty"`        // on the shelf but held for reservations
+	NextAvailableDate *time.Time `json:"nextAvailableDate,omitempty"` // the next return date, set only while no copy can be borrowed
+}
+
+// BookUpdate holds the fields of a partial book update; nil fields are left
+// unchanged. Copies can be set as either AvailableCopies or TotalCopies, and
+// the other follows from the copies on loan and in repair. Lowering InRepair
+// puts the repaired copies back on the shelf.
+type BookUpdate struct {
+	AvailableCopies *int    `json:"availableCopies"`
+	TotalCopies     *int    `json:"totalCopies"`
+	InRepair        *int    `json:"inRepair"`
+	ReplacementCost *int    `json:"replacementCost"`
+	LoanDays        *int    `json:"loanDays"`
+	ExtensionDays   *int    `json:"extensionDays"`
+	Category        *string `json:"category"`
+	Reference       *bool   `json:"reference"`
+}
+
+// CategoryPeriods are the loan and extension periods in days for a category
+// of books; zero falls back to the library's.
+type CategoryPeriods struct {
+	LoanDays      int `json:"loanDays"`
+	ExtensionDays int `json:"extensionDays"`
+}
+
+// DefaultCategories returns the categories NewLibrary starts with: reference
+// books and new releases circulate for a shorter time than regular stock.
+func DefaultCategories() map[string]CategoryPeriods {
+	return map[string]CategoryPeriods{
+		"reference": {LoanDays: 7, ExtensionDays: 7},
+		"new":       {LoanDays: 14, ExtensionDays: 7},
+	}
+}
+
+const DefaultMaxExtensions = 2
+
+// DefaultLoanDays is the loan period when neither the library, the book nor
+// its category set one.
+const DefaultLoanDays = 28
+
+// DefaultExtensionDays is the extension period when neither the library nor
+// the book set one.
+const DefaultExtensionDays = 21
+
+// DefaultMaxCopies is the most copies of one book NewLibrary allows.
+const DefaultMaxCopies = 10000
+
+// DefaultMaxCopiesPerTitle is how many copies of one title NewLibrary lets a
+// borrower have out at once.
+const DefaultMaxCopiesPerTitle = 1
+
+// MaxNameLength limits titles, authors and borrower names.
+const MaxNameLength = 200
+
+// AnyVersion skips the version check in UpdateBook.
+const AnyVersion = -1
+
+func NewLibrary() *Library {
+	lib := &Library{
+		Members:    make(map[string]Member),
+		Notifier:   NopNotifier{},
+		Metadata:   NewOpenLibrary(),
+		Events:     NewEventBus(),
+		Publisher:  NopPublisher{},
+		titles:     make(map[string]*titleEntry),
+		isbnIndex:  make(map[string]string),
+		titleIndex: make(map[string]string),
+		loanIndex:  make(map[string]string),
+		loanCounts: make(map[string]int),
+		reminded:   make(map[string]time.Time),
+		fees:       make(map[string][]Fee),
+		now:        time.Now,
+
+		MaxExtensions: DefaultMaxExtensions,
+		LoanDays:      DefaultLoanDays,
+		ExtensionDays: DefaultExtensionDays,
+		Categories:    DefaultCategories(),
+		FinePerDay:    DefaultFinePerDay,
+		MaxCopies:     DefaultMaxCopies,
+
+		MaxCopiesPerBorrowerPerTitle: DefaultMaxCopiesPerTitle,
+	}
+
+	return lib
+}
+
+// SetClock replaces the library's time source, mostly for tests.
+func (l *Library) SetClock(now func() time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.now = now
+}
+
+func (l *Library) Now() time.Time {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.now()
+}
+
+func (l *Library) Book(title string) (BookDetail, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	entry, exists := l.titles[l.lookupTitle(title)]
+	if !exists {
+		return BookDetail{}, ErrBookNotFound
+	}
+	return entry.book, nil
+}
+
+// LoadBook puts book into the catalog as it is, with loans as its active
+// loans, replacing the book and loans of its title if it has them. Nothing
+// is checked, so records kept from before the library checked them can be
+// loaded too: follow up with BackfillTotalCopies and Validate.
+func (l *Library) LoadBook(book BookDetail, loans ...LoanDetail) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry, exists := l.titles[book.Title]
+	if !exists {
+		entry = &titleEntry{}
+		l.titles[book.Title] = entry
+		l.titleIndex[titleKey(book.Title)] = book.Title
+	}
+	for _, loan := range entry.loans {
+		l.unindexLoan(loan)
+	}
+	if entry.book.ISBN != "" {
+		delete(l.isbnIndex, entry.book.ISBN)
+	}
+	entry.book = book
+	entry.loans = slices.Clone(loans)
+	for _, loan := range entry.loans {
+		l.indexLoan(book.Title, loan)
+	}
+	if book.ISBN != "" {
+		l.isbnIndex[book.ISBN] = book.Title
+	}
+}
+
+// AddBook adds a new title to the catalog. A provided ISBN must carry a valid
+// ISBN-10 or ISBN-13 check digit and is stored without separators. Editions
+// and volumes are catalogued under titles that carry them, see catalogTitle.
+func (l *Library) AddBook(book BookDetail) (BookDetail, error) {
+	if book.Title == "" {
+		return BookDetail{}, ErrTitleRequired
+	}
+	if book.Volume < 0 {
+		return BookDetail{}, ErrInvalidVolume
+	}
+	book.Title = book.catalogTitle()
+	if book.AvailableCopies < 0 {
+		return BookDetail{}, ErrNegativeCopies
+	}
+	// A new title has nothing on loan, so every copy is on the shelf
+	if err := l.checkCopies(book.AvailableCopies); err != nil {
+		return BookDetail{}, err
+	}
+	if err := checkNameLengths(book); err != nil {
+		return BookDetail{}, err
+	}
+	if book.LoanDays < 0 {
+		return BookDetail{}, ErrInvalidLoanDays
+	}
+	if book.ExtensionDays < 0 {
+		return BookDetail{}, ErrInvalidExtensionDays
+	}
+	if book.ReplacementCost < 0 {
+		return BookDetail{}, ErrNegativeCost
+	}
+	if book.ISBN != "" {
+		isbn, err := NormalizeISBN(book.ISBN)
+		if err != nil {
+			return BookDetail{}, err
+		}
+		book.ISBN = isbn
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.checkTitleFree(book.Title); err != nil {
+		return BookDetail{}, err
+	}
+	if _, exists := l.isbnIndex[book.ISBN]; exists && book.ISBN != "" {
+		return BookDetail{}, ErrISBNExists
+	}
+
+	book.Copies, book.TotalCopies, book.InRepair = nil, 0, 0
+	book.reconcileCopies()
+	book.Version = 1
+	book.CreatedAt = l.now()
+	l.titles[book.Title] = &titleEntry{book: book}
+	l.titleIndex[titleKey(book.Title)] = book.Title
+	if book.ISBN != "" {
+		l.isbnIndex[book.ISBN] = book.Title
+	}
+	l.checkInvariants()
+
+	return book, nil
+}
+
+// AddBookByISBN fills in the title, author and year from the metadata source
+// and adds the book. If the ISBN resolves to a title already in the catalog
+// the copies are merged into it instead, and created is false. The lookup
+// is abandoned once ctx is done.
+func (l *Library) AddBookByISBN(ctx context.Context, isbn string, copies int) (book BookDetail, created bool, err error) {
+	if copies < 0 {
+		return BookDetail{}, false, ErrNegativeCopies
+	}
+	if err := l.checkCopies(copies); err != nil {
+		return BookDetail{}, false, err
+	}
+	isbn, err = NormalizeISBN(isbn)
+	if err != nil {
+		return BookDetail{}, false, err
+	}
+
+	// Look the ISBN up before taking the lock; it is a network call
+	found, err := l.Metadata.LookupISBN(ctx, isbn)
+	if err != nil {
+		return BookDetail{}, false, err
+	}
+
+	l.mutex.Lock()
+	entry, exists := l.titles[l.lookupTitle(found.Title)]
+	if exists {
+		existing := entry.book
+		if err := l.checkCopies(existing.TotalCopies + copies); err != nil {
+			l.mutex.Unlock()
+			return existing, false, err
+		}
+		tracked := existing.tracksCopies()
+		existing.AvailableCopies += copies
+		existing.TotalCopies += copies
+		if tracked {
+			existing.reconcileCopies()
+		}
+		if existing.ISBN == "" {
+			if _, taken := l.isbnIndex[isbn]; !taken {
+				existing.ISBN = isbn
+				l.isbnIndex[isbn] = existing.Title
+			}
+		}
+		if existing.Author == "" {
+			existing.Author = found.Author
+		}
+		if existing.Year == 0 {
+			existing.Year = found.Year
+		}
+		existing.Version++
+		entry.book = existing
+		l.checkInvariants()
+		l.mutex.Unlock()
+		return existing, false, nil
+	}
+	l.mutex.Unlock()
+
+	book, err = l.AddBook(BookDetail{
+		Title:           found.Title,
+		Author:          found.Author,
+		ISBN:            isbn,
+		Year:            found.Year,
+		AvailableCopies: copies,
+	})
+	return book, err == nil, err
+}
+
+func (l *Library) BookByISBN(isbn string) (BookDetail, error) {
+	isbn, err := NormalizeISBN(isbn)
+	if err != nil {
+		return BookDetail{}, err
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	title, exists := l.isbnIndex[isbn]
+	if !exists {
+		return BookDetail{}, ErrBookNotFound
+	}
+
+	lock := l.titleLock(title)
+	lock.Lock()
+	defer lock.Unlock()
+	return l.titles[title].book, nil
+}
+
+// UpdateBook applies update if the book is still at the given version, or
+// unconditionally for AnyVersion. On ErrVersionMismatch the current record is
+// returned alongside the error.
+func (l *Library) UpdateBook(title string, version int, update BookUpdate) (BookDetail, error) {
+	if update.AvailableCopies != nil && *update.AvailableCopies < 0 {
+		return BookDetail{}, ErrNegativeCopies
+	}
+	if update.AvailableCopies != nil && update.TotalCopies != nil {
+		return BookDetail{}, fmt.Errorf("%w, set available or total copies but not both", ErrCopiesOutOfRange)
+	}
+	if update.LoanDays != nil && *update.LoanDays < 0 {
+		return BookDetail{}, ErrInvalidLoanDays
+	}
+	if update.ExtensionDays != nil && *update.ExtensionDays < 0 {
+		return BookDetail{}, ErrInvalidExtensionDays
+	}
+	if update.InRepair != nil && *update.InRepair < 0 {
+		return BookDetail{}, ErrNegativeCopies
+	}
+	if update.ReplacementCost != nil && *update.ReplacementCost < 0 {
+		return BookDetail{}, ErrNegativeCost
+	}
+
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists {
+		return BookDetail{}, ErrBookNotFound
+	}
+
+	book := entry.book
+	if version != AnyVersion && version != book.Version {
+		return book, fmt.Errorf("%w, current version is %d", ErrVersionMismatch, book.Version)
+	}
+
+	tracked := book.tracksCopies()
+	if update.InRepair != nil {
+		available := book.AvailableCopies + book.InRepair - *update.InRepair
+		if available < 0 {
+			return book, fmt.Errorf("%w, only %d copies are on the shelf to send for repair", ErrNegativeCopies, book.AvailableCopies)
+		}
+		book.AvailableCopies = available
+		book.InRepair = *update.InRepair
+	}
+	if update.AvailableCopies != nil {
+		total := *update.AvailableCopies + len(entry.loans) + book.InRepair
+		if err := l.checkCopies(total); err != nil {
+			return book, err
+		}
+		book.AvailableCopies = *update.AvailableCopies
+		book.TotalCopies = total
+	}
+	if update.TotalCopies != nil {
+		unavailable := len(entry.loans) + book.InRepair
+		if *update.TotalCopies < unavailable {
+			return book, fmt.Errorf("%w and in repair (%d)", ErrTotalBelowLoans, unavailable)
+		}
+		if err := l.checkCopies(*update.TotalCopies); err != nil {
+			return book, err
+		}
+		book.TotalCopies = *update.TotalCopies
+		book.AvailableCopies = book.TotalCopies - unavailable
+	}
+	if tracked {
+		book.reconcileCopies()
+	}
+	if update.ReplacementCost != nil {
+		book.ReplacementCost = *update.ReplacementCost
+	}
+	if update.LoanDays != nil {
+		book.LoanDays = *update.LoanDays
+	}
+	if update.ExtensionDays != nil {
+		book.ExtensionDays = *update.ExtensionDays
+	}
+	if update.Category != nil {
+		book.Category = *update.Category
+	}
+	if update.Reference != nil {
+		book.Reference = *update.Reference
+	}
+	book.Version++
+	entry.book = book
+	l.checkTitleInvariants(title)
+
+	return book, nil
+}
+
+// ReplaceBook overwrites the metadata of title with book's title, edition,
+// volume, author, ISBN, year and loan days, if the book is still at the given version or for
+// AnyVersion. Copy counts are kept, and a new title carries the book's loans
+// and reservations over with it. On ErrVersionMismatch the current record is
+// returned alongside the error.
+func (l *Library) ReplaceBook(title string, version int, book BookDetail) (BookDetail, error) {
+	if book.Title == "" {
+		return BookDetail{}, ErrTitleRequired
+	}
+	if book.Volume < 0 {
+		return BookDetail{}, ErrInvalidVolume
+	}
+	book.Title = book.catalogTitle()
+	if err := checkNameLengths(book); err != nil {
+		return BookDetail{}, err
+	}
+	if book.LoanDays < 0 {
+		return BookDetail{}, ErrInvalidLoanDays
+	}
+	if book.ExtensionDays < 0 {
+		return BookDetail{}, ErrInvalidExtensionDays
+	}
+	if book.ReplacementCost < 0 {
+		return BookDetail{}, ErrNegativeCost
+	}
+	if book.ISBN != "" {
+		isbn, err := NormalizeISBN(book.ISBN)
+		if err != nil {
+			return BookDetail{}, err
+		}
+		book.ISBN = isbn
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists {
+		return BookDetail{}, ErrBookNotFound
+	}
+	current := entry.book
+	if version != AnyVersion && version != current.Version {
+		return current, fmt.Errorf("%w, current version is %d", ErrVersionMismatch, current.Version)
+	}
+	// Changing only the case of its own title is a rename like any other
+	if titleKey(book.Title) != titleKey(title) {
+		if err := l.checkTitleFree(book.Title); err != nil {
+			return BookDetail{}, err
+		}
+	}
+	if owner, taken := l.isbnIndex[book.ISBN]; taken && book.ISBN != "" && owner != title {
+		return BookDetail{}, ErrISBNExists
+	}
+
+	if current.ISBN != "" {
+		delete(l.isbnIndex, current.ISBN)
+	}
+	if book.Title != title {
+		l.renameBook(title, book.Title)
+	}
+
+	current.Title = book.Title
+	current.Edition = book.Edition
+	current.Volume = book.Volume
+	current.Author = book.Author
+	current.ISBN = book.ISBN
+	current.Year = book.Year
+	current.LoanDays = book.LoanDays
+	current.ExtensionDays = book.ExtensionDays
+	current.Category = book.Category
+	current.Reference = book.Reference
+	current.ReplacementCost = book.ReplacementCost
+	current.Version++
+	entry.book = current
+	if current.ISBN != "" {
+		l.isbnIndex[current.ISBN] = current.Title
+	}
+	l.checkInvariants()
+
+	return current, nil
+}
+
+// RenameBook changes the title of a book, e.g. to fix a typo, carrying its
+// loans, loan history, reservations, holds and fees over in one step, so
+// borrowers carry on under the new title. Changing only the case of the
+// title is allowed; any other title in use is ErrBookExists or
+// ErrTitleCollision. The edition and volume are kept as they are.
+func (l *Library) RenameBook(from, to string) (BookDetail, error) {
+	if to == "" {
+		return BookDetail{}, ErrTitleRequired
+	}
+	if err := checkNameLengths(BookDetail{Title: to}); err != nil {
+		return BookDetail{}, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	from = l.lookupTitle(from)
+	entry, exists := l.titles[from]
+	if !exists {
+		return BookDetail{}, ErrBookNotFound
+	}
+	if titleKey(to) != titleKey(from) {
+		if err := l.checkTitleFree(to); err != nil {
+			return BookDetail{}, err
+		}
+	}
+	if to == from {
+		return entry.book, nil
+	}
+
+	l.renameBook(from, to)
+	entry.book.Version++
+	if entry.book.ISBN != "" {
+		l.isbnIndex[entry.book.ISBN] = to
+	}
+	l.checkInvariants()
+
+	return entry.book, nil
+}
+
+// renameBook expects the caller to hold the mutex for writing and to have
+// checked that to is free. It moves the book, its loans, history,
+// reservation queue, holds and fees to the new title; the ISBN index is left
+// to the caller.
+func (l *Library) renameBook(from, to string) {
+	entry := l.titles[from]
+	delete(l.titles, from)
+	delete(l.titleIndex, titleKey(from))
+	l.titles[to] = entry
+	l.titleIndex[titleKey(to)] = to
+
+	entry.book.Title = to
+	for i := range entry.loans {
+		entry.loans[i].BookTitle = to
+		if id := entry.loans[i].ID; id != "" {
+			l.loanIndex[id] = to
+		}
+	}
+	for i := range l.History {
+		if l.History[i].BookTitle == from {
+			l.History[i].BookTitle = to
+		}
+	}
+	for _, fees := range l.fees {
+		for i := range fees {
+			if fees[i].Title == from {
+				fees[i].Title = to
+			}
+		}
+	}
+}
+
+// DeleteBook removes title from the catalog along with its reservations. A
+// book that is still on loan, or whose returned loans are in History, can't
+// be deleted, so statistics and borrowing histories never point at a missing
+// book; archive it instead.
+func (l *Library) DeleteBook(title string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists {
+		return ErrBookNotFound
+	}
+	if len(entry.loans) > 0 {
+		return ErrBookOnLoan
+	}
+	if slices.ContainsFunc(l.History, func(loan LoanDetail) bool { return loan.BookTitle == title }) {
+		return ErrBookHasHistory
+	}
+
+	delete(l.titles, title)
+	delete(l.titleIndex, titleKey(title))
+	if entry.book.ISBN != "" {
+		delete(l.isbnIndex, entry.book.ISBN)
+	}
+	l.checkInvariants()
+
+	return nil
+}
+
+// SetArchived archives or restores title. Archived books keep their loans
+// and reservations but can't be borrowed.
+func (l *Library) SetArchived(title string, archived bool) (BookDetail, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	entry, exists := l.titles[l.lookupTitle(title)]
+	if !exists {
+		return BookDetail{}, ErrBookNotFound
+	}
+
+	if entry.book.Archived != archived {
+		entry.book.Archived = archived
+		entry.book.Version++
+	}
+
+	return entry.book, nil
+}
+
+func (l *Library) Availability(title string) (BookAvailability, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists {
+		return BookAvailability{}, ErrBookNotFound
+	}
+
+	availability := BookAvailability{
+		Title:           title,
+		AvailableCopies: entry.book.AvailableCopies,
+		ActiveLoans:     len(entry.loans),
+		QueueLength:     len(entry.reservations),
+		HeldCopies:      len(entry.holds),
+	}
+	for _, loan := range entry.loans {
+		if availability.NextReturnDate == nil || loan.ReturnDate.Before(*availability.NextReturnDate) {
+			returnDate := loan.ReturnDate
+			availability.NextReturnDate = &returnDate
+		}
+	}
+	if entry.freeCopies("") <= 0 {
+		availability.NextAvailableDate = availability.NextReturnDate
+	}
+
+	return availability, nil
+}
+
+// BookLoan is a loan in a book's timeline: still out when ReturnedAt is zero,
+// else closed as its Status says.
+type BookLoan struct {
+	LoanDetail
+	ReturnedLate bool `json:"returnedLate"` // closed after ReturnDate
+}
+
+// BookHistory lists the active loans of title and its loans in History,
+// oldest loan first, to see who had the book and when. Loans dropped from
+// History by its limits are gone from it too. It scans the whole history, so
+// it gives up with ctx's error if ctx is done by the time it gets the lock.
+func (l *Library) BookHistory(ctx context.Context, title string) ([]BookLoan, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists {
+		return nil, ErrBookNotFound
+	}
+
+	timeline := []BookLoan{}
+	l.entries.Lock()
+	for _, loan := range l.History {
+		if loan.BookTitle == title {
+			timeline = append(timeline, BookLoan{LoanDetail: loan, ReturnedLate: loan.ReturnedAt.After(loan.ReturnDate)})
+		}
+	}
+	l.entries.Unlock()
+	for _, loan := range entry.loans {
+		timeline = append(timeline, BookLoan{LoanDetail: loan})
+	}
+	slices.SortStableFunc(timeline, func(a, b BookLoan) int {
+		return a.LoanDate.Compare(b.LoanDate)
+	})
+	return timeline, nil
+}
+
+type Stats struct {
+	Titles          int `json:"titles"`
+	AvailableCopies int `json:"availableCopies"`
+	ActiveLoans     int `json:"activeLoans"`
+	OverdueLoans    int `json:"overdueLoans"`
+	OverdueFlagged  int `json:"overdueCount"`    // loans flagged overdue by the sweeper since startup
+	PublishFailures int `json:"publishFailures"` // events the EventPublisher failed to take since startup
+	Reservations    int `json:"reservations"`
+	Members         int `json:"members"`
+}
+
+func (l *Library) Stats() Stats {
+	unlock := l.lockAllTitles()
+	defer unlock()
+
+	stats := Stats{Titles: len(l.titles), Members: len(l.Members), OverdueFlagged: l.overdueCount, PublishFailures: int(l.publishFails.Load())}
+	now := l.now()
+	for _, entry := range l.titles {
+		stats.AvailableCopies += entry.book.AvailableCopies
+		stats.ActiveLoans += len(entry.loans)
+		for _, loan := range entry.loans {
+			if loan.ReturnDate.Before(now) {
+				stats.OverdueLoans++
+			}
+		}
+		stats.Reservations += len(entry.reservations)
+	}
+
+	return stats
+}
+
+// PopularBook is a title ranked by how often it was borrowed.
+type PopularBook struct {
+	Title           string `json:"title"`
+	Borrows         int    `json:"borrows"`
+	AvailableCopies int    `json:"availableCopies"`
+}
+
+// Popular ranks the titles in the catalog by the loans made between since
+// and until, returned or not, most borrowed first and then by title. Zero
+// times leave the range open and a limit of zero returns every title that
+// was borrowed. Loans dropped from History by its limits no longer count.
+// It scans the whole history, so it gives up with ctx's error if ctx is done
+// by the time it gets the lock.
+func (l *Library) Popular(ctx context.Context, since, until time.Time, limit int) ([]PopularBook, error) {
+	unlock := l.lockAllTitles()
+	defer unlock()
+	l.entries.Lock()
+	defer l.entries.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	borrows := make(map[string]int)
+	count := func(loan LoanDetail) {
+		if !since.IsZero() && loan.LoanDate.Before(since) || !until.IsZero() && loan.LoanDate.After(until) {
+			return
+		}
+		borrows[loan.BookTitle]++
+	}
+	for _, loan := range l.History {
+		count(loan)
+	}
+	for _, entry := range l.titles {
+		for _, loan := range entry.loans {
+			count(loan)
+		}
+	}
+
+	popular := []PopularBook{}
+	for title, n := range borrows {
+		entry, exists := l.titles[title]
+		if !exists {
+			continue
+		}
+		popular = append(popular, PopularBook{Title: title, Borrows: n, AvailableCopies: entry.book.AvailableCopies})
+	}
+	sort.Slice(popular, func(i, j int) bool {
+		if popular[i].Borrows != popular[j].Borrows {
+			return popular[i].Borrows > popular[j].Borrows
+		}
+		return popular[i].Title < popular[j].Title
+	})
+	if limit > 0 && len(popular) > limit {
+		popular = popular[:limit]
+	}
+	return popular, nil
+}
+
+// LoanDurations summarizes how long completed loans actually ran, from
+// LoanDate to ReturnedAt, in days.
+type LoanDurations struct {
+	Loans       int     `json:"loans"`
+	AverageDays float64 `json:"averageDays"`
+	MedianDays  float64 `json:"medianDays"`
+	MinDays     float64 `json:"minDays"`
+	MaxDays     float64 `json:"maxDays"`
+}
+
+// LoanDurations summarizes the loans in History whose copy came back,
+// returned or damaged, leaving out those written off as lost or abandoned.
+// An empty title counts every book, and otherwise matches the title in any
+// case; since and until bound the loan date as for Popular. Loans dropped
+// from History by its limits no longer count. It gives up with ctx's error if
+// ctx is done by the time it gets the lock.
+func (l *Library) LoanDurations(ctx context.Context, title string, since, until time.Time) (LoanDurations, error) {
+	l.mutex.RLock()
+	l.entries.Lock()
+	if err := ctx.Err(); err != nil {
+		l.entries.Unlock()
+		l.mutex.RUnlock()
+		return LoanDurations{}, err
+	}
+
+	var days []float64
+	var total float64
+	for _, loan := range l.History {
+		if loan.Status == LoanLost || loan.Status == LoanAbandoned {
+			continue
+		}
+		if title != "" && !strings.EqualFold(loan.BookTitle, title) {
+			continue
+		}
+		if !since.IsZero() && loan.LoanDate.Before(since) || !until.IsZero() && loan.LoanDate.After(until) {
+			continue
+		}
+		d := loan.ReturnedAt.Sub(loan.LoanDate).Hours() / 24
+		days = append(days, d)
+		total += d
+	}
+	l.entries.Unlock()
+	l.mutex.RUnlock()
+
+	if len(days) == 0 {
+		return LoanDurations{}, nil
+	}
+	slices.Sort(days)
+	median := days[len(days)/2]
+	if len(days)%2 == 0 {
+		median = (days[len(days)/2-1] + median) / 2
+	}
+	return LoanDurations{
+		Loans:       len(days),
+		AverageDays: total / float64(len(days)),
+		MedianDays:  median,
+		MinDays:     days[0],
+		MaxDays:     days[len(days)-1],
+	}, nil
+}
+
+// LoanCounts is a cheap headline summary of the loans, for dashboards that
+// poll. AsOf is when the counts were taken.
+type LoanCounts struct {
+	ActiveLoans  int       `json:"activeLoans"`
+	OverdueLoans int       `json:"overdueLoans"`
+	Reservations int       `json:"reservations"`
+	Borrowers    int       `json:"borrowers"` // distinct borrowers with an active loan
+	AsOf         time.Time `json:"asOf"`
+}
+
+// LoanCounts counts the active and overdue loans, reservations and
+// borrowers in one pass.
+func (l *Library) LoanCounts() LoanCounts {
+	unlock := l.lockAllTitles()
+	defer unlock()
+
+	l.entries.Lock()
+	borrowers := len(l.loanCounts)
+	l.entries.Unlock()
+	counts := LoanCounts{AsOf: l.now(), Borrowers: borrowers}
+	for _, entry := range l.titles {
+		counts.ActiveLoans += len(entry.loans)
+		for _, loan := range entry.loans {
+			if loan.ReturnDate.Before(counts.AsOf) {
+				counts.OverdueLoans++
+			}
+		}
+		counts.Reservations += len(entry.reservations)
+	}
+
+	return counts
+}
+
+// ListBooks returns a copy of the catalog sorted by title.
+func (l *Library) ListBooks() []BookDetail {
+	unlock := l.lockAllTitles()
+	books := make([]BookDetail, 0, len(l.titles))
+	for _, entry := range l.titles {
+		books = append(books, entry.book)
+	}
+	unlock()
+
+	sort.Slice(books, func(i, j int) bool { return books[i].Title < books[j].Title })
+	return books
+}
+
+// Books, Loans and Reservations return copies of the catalog, the active
+// loans and the reservation queues keyed by title, taken together with every
+// title locked. They replace the exported fields of the same names, which
+// could not be read safely once each title got its own lock; put records in
+// with LoadBook instead. Titles without loans or reservations are left out
+// of those maps, as in a Snapshot.
+func (l *Library) Books() map[string]BookDetail {
+	return l.Snapshot().Books
+}
+
+// Loans returns a copy of the active loans by title, see Books.
+func (l *Library) Loans() map[string][]LoanDetail {
+	return l.Snapshot().Loans
+}
+
+// Reservations returns a copy of the reservation queues by title, see Books.
+func (l *Library) Reservations() map[string][]Reservation {
+	return l.Snapshot().Reservations
+}
+
+// NewBooks returns up to limit books, the most recently added first. Books
+// added before CreatedAt was recorded come last.
+func (l *Library) NewBooks(limit int) []BookDetail {
+	books := l.ListBooks()
+	sort.SliceStable(books, func(i, j int) bool { return books[i].CreatedAt.After(books[j].CreatedAt) })
+	if len(books) > limit {
+		books = books[:limit]
+	}
+	return books
+}
+
+// ListLoans returns a copy of all active loans sorted by title and loan date.
+func (l *Library) ListLoans() []LoanDetail {
+	unlock := l.lockAllTitles()
+	var loans []LoanDetail
+	for _, entry := range l.titles {
+		loans = append(loans, entry.loans...)
+	}
+	unlock()
+
+	sort.Slice(loans, func(i, j int) bool {
+		if loans[i].BookTitle != loans[j].BookTitle {
+			return loans[i].BookTitle < loans[j].BookTitle
+		}
+		return loans[i].LoanDate.Before(loans[j].LoanDate)
+	})
+	return loans
+}
+
+// Validate checks the library invariants and reports every violation found.
+func (l *Library) Validate() error {
+	unlock := l.lockAllTitles()
+	defer unlock()
+	return l.validate()
+}
+
+// validate expects the caller to hold the mutex for writing, or for reading
+// along with every title lock.
+func (l *Library) validate() error {
+	var errs []error
+	for _, title := range slices.Sorted(maps.Keys(l.titles)) {
+		errs = append(errs, l.validateTitle(title)...)
+	}
+	return errors.Join(errs...)
+}
+
+// validateTitle expects the caller to hold the mutex and title's lock. It
+// reports what title's entry gets wrong.
+func (l *Library) validateTitle(title string) []error {
+	var errs []error
+	entry := l.titles[title]
+	book := entry.book
+	if book.AvailableCopies < 0 {
+		errs = append(errs, fmt.Errorf("book '%s' has negative available copies (%d)", title, book.AvailableCopies))
+	}
+	if book.AvailableCopies > book.TotalCopies-book.InRepair {
+		errs = append(errs, fmt.Errorf("book '%s' has more available copies (%d) than it owns outside repair (%d)", title, book.AvailableCopies, book.TotalCopies-book.InRepair))
+	}
+	if available, inRepair, total := book.copyCounts(); len(book.Copies) > 0 && (available != book.AvailableCopies || inRepair != book.InRepair || total != book.TotalCopies) {
+		errs = append(errs, fmt.Errorf("book '%s' copy counts (%d available, %d in repair, %d total) don't match its copies (%d, %d, %d)", title, book.AvailableCopies, book.InRepair, book.TotalCopies, available, inRepair, total))
+	}
+	for _, loan := range entry.loans {
+		if loan.BookTitle != title {
+			errs = append(errs, fmt.Errorf("loan %s of '%s' is stored under '%s'", loan.ID, loan.BookTitle, title))
+		}
+		if loan.ReturnDate.Before(loan.LoanDate) {
+			errs = append(errs, fmt.Errorf("loan of '%s' by %s has return date before loan date", title, loan.NameOfBorrower))
+		}
+	}
+	return errs
+}
+
+// checkCopies reports a total number of copies below one or above
+// MaxCopies.
+func (l *Library) checkCopies(total int) error {
+	if l.MaxCopies > 0 && (total < 1 || total > l.MaxCopies) {
+		return fmt.Errorf("%w, a book needs between 1 and %d copies", ErrCopiesOutOfRange, l.MaxCopies)
+	}
+	if total < 1 {
+		return fmt.Errorf("%w, a book needs at least 1 copy", ErrCopiesOutOfRange)
+	}
+	return nil
+}
+
+// checkNameLengths reports a title or author longer than MaxNameLength.
+func checkNameLengths(book BookDetail) error {
+	if len(book.Title) > MaxNameLength || len(book.Author) > MaxNameLength || len(book.Category) > MaxNameLength || len(book.Edition) > MaxNameLength {
+		return fmt.Errorf("%w, titles, authors, categories and editions can be at most %d characters", ErrNameTooLong, MaxNameLength)
+	}
+	return nil
+}
+
+// loanPeriod returns the number of days a new loan of book runs for.
+func (l *Library) loanPeriod(book BookDetail) int {
+	switch {
+	case book.LoanDays > 0:
+		return book.LoanDays
+	case l.Categories[book.Category].LoanDays > 0:
+		return l.Categories[book.Category].LoanDays
+	case l.LoanDays > 0:
+		return l.LoanDays
+	default:
+		return DefaultLoanDays
+	}
+}
+
+// extensionPeriod returns the number of days an extension of a loan of book
+// adds at most.
+func (l *Library) extensionPeriod(book BookDetail) int {
+	switch {
+	case book.ExtensionDays > 0:
+		return book.ExtensionDays
+	case l.Categories[book.Category].ExtensionDays > 0:
+		return l.Categories[book.Category].ExtensionDays
+	case l.ExtensionDays > 0:
+		return l.ExtensionDays
+	default:
+		return DefaultExtensionDays
+	}
+}
+
+// publish expects the caller to hold the mutex for reading at least. Callers
+// on a single title publish while holding the title lock, so a title's events
+// arrive in order.
+func (l *Library) publish(eventType string, loan LoanDetail) {
+	event := Event{
+		Type:     eventType,
+		Title:    loan.BookTitle,
+		Borrower: loan.NameOfBorrower,
+		LoanID:   loan.ID,
+		At:       l.now(),
+		Loan:     loan,
+	}
+
+	l.Events.Publish(context.Background(), event)
+	if l.Webhooks != nil {
+		l.Webhooks.Publish(event)
+	}
+	if err := l.Publisher.Publish(context.Background(), event); err != nil {
+		l.publishFails.Add(1)
+		log.Printf("failed to publish %s for '%s': %v", event.Type, event.Title, err)
+	}
+}
+
+// checkInvariants validates the state after a mutation when debug mode is on.
+// It expects the caller to hold the mutex for writing.
+func (l *Library) checkInvariants() {
+	if !l.Debug {
+		return
+	}
+	if err := l.validate(); err != nil {
+		log.Printf("library invariant violated: %v", err)
+	}
+}
+
+// checkTitleInvariants is checkInvariants for a mutation of title alone,
+// with its title lock held.
+func (l *Library) checkTitleInvariants(title string) {
+	if !l.Debug {
+		return
+	}
+	if err := errors.Join(l.validateTitle(title)...); err != nil {
+		log.Printf("library invariant violated: %v", err)
+	}
+}
@@ -0,0 +1,2140 @@
+package librarypkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNow is the time test libraries start at, so due dates and fines come
+// out the same on every run.
+var testNow = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+// newTestLibrary returns a library seeded from testdata/seed.json with the
+// demo books: Go Programming with 3 copies and Clean Code with 2. Its clock
+// stands still at testNow until a test sets its own.
+func newTestLibrary(t *testing.T) *Library {
+	t.Helper()
+	books, err := LoadSeed("testdata/seed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	library := NewLibrary()
+	library.SetClock(func() time.Time { return testNow })
+	if _, err := library.Seed(books); err != nil {
+		t.Fatal(err)
+	}
+	return library
+}
+
+func TestBorrowExtendReturn(t *testing.T) {
+	library := newTestLibrary(t)
+	now := time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+
+	// Test 1: Borrow
+	loan, err := library.Borrow("Clean Code", "Jane Smith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loan.LoanDate.Equal(now) || !loan.ReturnDate.Equal(now.AddDate(0, 0, 28)) {
+		t.Errorf("unexpected loan dates: %v - %v", loan.LoanDate, loan.ReturnDate)
+	}
+	if book, _ := library.Book("Clean Code"); book.AvailableCopies != 1 {
+		t.Errorf("expected 1 available copy, got %d", book.AvailableCopies)
+	}
+
+	// Test 2: Extend
+	extended, err := library.Extend("Clean Code", "Jane Smith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extended.ReturnDate.Equal(loan.ReturnDate.AddDate(0, 0, 21)) {
+		t.Errorf("unexpected extended return date: %v", extended.ReturnDate)
+	}
+
+	// Test 3: Return
+	receipt, err := library.Return("Clean Code", "Jane Smith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Loan.ID != loan.ID || receipt.WasOverdue {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	if book, _ := library.Book("Clean Code"); book.AvailableCopies != 2 {
+		t.Errorf("expected 2 available copies, got %d", book.AvailableCopies)
+	}
+}
+
+func TestDomainErrors(t *testing.T) {
+	library := newTestLibrary(t)
+	library.LoadBook(BookDetail{Title: "Clean Code", AvailableCopies: 0})
+
+	if _, err := library.Borrow("Nonexistent Book", "John Doe"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("expected ErrBookNotFound, got %v", err)
+	}
+	if _, err := library.Borrow("Clean Code", "John Doe"); !errors.Is(err, ErrNoCopies) {
+		t.Errorf("expected ErrNoCopies, got %v", err)
+	}
+	if _, err := library.Extend("Go Programming", "John Doe"); !errors.Is(err, ErrNoLoans) {
+		t.Errorf("expected ErrNoLoans, got %v", err)
+	}
+	if _, err := library.Borrow("Go Programming", "Jane Smith"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Go Programming", "John Doe"); !errors.Is(err, ErrLoanNotFound) {
+		t.Errorf("expected ErrLoanNotFound, got %v", err)
+	}
+	if _, err := library.ReturnLoan("does-not-exist"); !errors.Is(err, ErrLoanNotFound) {
+		t.Errorf("expected ErrLoanNotFound, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	library := newTestLibrary(t)
+
+	if err := library.Validate(); err != nil {
+		t.Fatalf("expected fresh library to be valid, got %v", err)
+	}
+
+	now := testNow
+	library.LoadBook(BookDetail{Title: "Clean Code", AvailableCopies: -1})
+	book, _ := library.Book("Go Programming")
+	library.LoadBook(book,
+		LoanDetail{BookTitle: "Go Programming", NameOfBorrower: "Jane Smith", LoanDate: now, ReturnDate: now.AddDate(0, 0, -1)},
+		LoanDetail{ID: "misfiled", BookTitle: "Clean Code", NameOfBorrower: "John Doe", LoanDate: now, ReturnDate: now.AddDate(0, 0, 14)},
+	)
+
+	err := library.Validate()
+	if err == nil {
+		t.Fatal("expected validation error for invalid state")
+	}
+
+	for _, want := range []string{
+		"book 'Clean Code' has negative available copies",
+		"loan of 'Go Programming' by Jane Smith has return date before loan date",
+		"loan misfiled of 'Clean Code' is stored under 'Go Programming'",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected validation error to contain %q, got %q", want, err.Error())
+		}
+	}
+}
+
+func TestNormalizeISBN(t *testing.T) {
+	valid := map[string]string{
+		"0-13-235088-2":     "0132350882",
+		"978-0-13-235088-4": "9780132350884",
+		"080442957x":        "080442957X",
+	}
+	for input, want := range valid {
+		got, err := NormalizeISBN(input)
+		if err != nil || got != want {
+			t.Errorf("NormalizeISBN(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{"0-13-235088-3", "978-0-13-235088-5", "12345", "97801323508X4"} {
+		if _, err := NormalizeISBN(input); !errors.Is(err, ErrInvalidISBN) {
+			t.Errorf("NormalizeISBN(%q) expected ErrInvalidISBN, got %v", input, err)
+		}
+	}
+}
+
+func TestExtensionLimit(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxExtensions = 2
+
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := library.Extend("Go Programming", "John Doe"); err != nil {
+			t.Fatalf("extension %d failed: %v", i+1, err)
+		}
+	}
+
+	if _, err := library.Extend("Go Programming", "John Doe"); !errors.Is(err, ErrExtensionLimit) {
+		t.Errorf("expected ErrExtensionLimit, got %v", err)
+	}
+}
+
+func TestLoanDaysPerBook(t *testing.T) {
+	library := newTestLibrary(t)
+	now := time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+
+	if _, err := library.AddBook(BookDetail{Title: "Atlas", AvailableCopies: 1, LoanDays: -1}); !errors.Is(err, ErrInvalidLoanDays) {
+		t.Errorf("expected ErrInvalidLoanDays, got %v", err)
+	}
+	if _, err := library.AddBook(BookDetail{Title: "Atlas", AvailableCopies: 1, LoanDays: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	loan, err := library.Borrow("Atlas", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.AddDate(0, 0, 7); !loan.ReturnDate.Equal(want) {
+		t.Errorf("got return date %v, want %v", loan.ReturnDate, want)
+	}
+
+	// Books without their own period use the library default
+	loan, err = library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.AddDate(0, 0, DefaultLoanDays); !loan.ReturnDate.Equal(want) {
+		t.Errorf("got return date %v, want %v", loan.ReturnDate, want)
+	}
+}
+
+type sentMail struct {
+	to, subject, body string
+}
+
+type fakeMailer struct {
+	sent []sentMail
+}
+
+func (m *fakeMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, sentMail{to, subject, body})
+	return nil
+}
+
+func TestSendReminders(t *testing.T) {
+	library := newTestLibrary(t)
+	now := time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+
+	if _, err := library.AddMember(Member{Name: "John Doe", Email: "not an email"}); !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("expected ErrInvalidEmail, got %v", err)
+	}
+	if _, err := library.AddMember(Member{Name: "John Doe", Email: "john@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, title := range []string{"Go Programming", "Clean Code"} {
+		if _, err := library.Borrow(title, "John Doe"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No member record, so no reminder
+	if _, err := library.Borrow("Go Programming", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &fakeMailer{}
+	window := 3 * 24 * time.Hour
+
+	// Nothing is due within the window yet
+	if sent := library.SendReminders(mailer, window); sent != 0 {
+		t.Errorf("expected no reminders, sent %d", sent)
+	}
+
+	// Two days before the due date both loans go out in one digest
+	now = now.AddDate(0, 0, 26)
+	if sent := library.SendReminders(mailer, window); sent != 1 {
+		t.Fatalf("expected 1 reminder, sent %d", sent)
+	}
+	if mail := mailer.sent[0]; mail.to != "john@example.com" || !strings.Contains(mail.body, "Go Programming") || !strings.Contains(mail.body, "Clean Code") {
+		t.Errorf("unexpected reminder: %+v", mail)
+	}
+
+	// The next day's run doesn't repeat the reminder
+	now = now.AddDate(0, 0, 1)
+	if sent := library.SendReminders(mailer, window); sent != 0 {
+		t.Errorf("expected no repeated reminder, sent %d", sent)
+	}
+
+	// An extended loan is reminded again once its new due date comes close
+	if _, err := library.Extend("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.AddDate(0, 0, 20)
+	if sent := library.SendReminders(mailer, window); sent != 1 {
+		t.Fatalf("expected 1 reminder after extension, sent %d", sent)
+	}
+	if mail := mailer.sent[1]; !strings.Contains(mail.body, "Clean Code") || strings.Contains(mail.body, "Go Programming") {
+		t.Errorf("unexpected reminder: %+v", mail)
+	}
+}
+
+func TestConcurrentBorrowReturn(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Debug = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			borrower := fmt.Sprintf("Borrower %d", i)
+			// Most goroutines fight over one title and the rest over
+			// another, while snapshots are taken alongside
+			title := "Go Programming"
+			if i%4 == 3 {
+				title = "Clean Code"
+			}
+			for j := 0; j < 100; j++ {
+				loan, err := library.Borrow(title, borrower)
+				if errors.Is(err, ErrNoCopies) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("Borrow: %v", err)
+					return
+				}
+				if j%2 == 0 {
+					_, err = library.ReturnLoan(loan.ID)
+				} else {
+					_, err = library.Return(title, borrower)
+				}
+				if err != nil {
+					t.Errorf("Return: %v", err)
+					return
+				}
+				library.Stats()
+				library.ListLoans()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Test 1: Every copy is back on the shelf
+	if book, _ := library.Book("Go Programming"); book.AvailableCopies != 3 {
+		t.Errorf("expected 3 copies of Go Programming, got %d", book.AvailableCopies)
+	}
+	if book, _ := library.Book("Clean Code"); book.AvailableCopies != 2 {
+		t.Errorf("expected 2 copies of Clean Code, got %d", book.AvailableCopies)
+	}
+
+	// Test 2: No loans are left behind and the invariants hold
+	if loans := library.ListLoans(); len(loans) != 0 {
+		t.Errorf("expected no loans, got %d", len(loans))
+	}
+	if err := library.Validate(); err != nil {
+		t.Errorf("expected a valid library, got %v", err)
+	}
+}
+
+func TestLoanLimitConcurrent(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxLoansPerBorrower = 2
+	const titles = 16
+	for i := 0; i < titles; i++ {
+		if _, err := library.AddBook(BookDetail{Title: fmt.Sprintf("Title %d", i), AvailableCopies: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Borrows of different titles run under different title locks, but the
+	// limit counts loans across titles
+	var borrowed, refused atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < titles; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := library.Borrow(fmt.Sprintf("Title %d", i), "Alice")
+			switch {
+			case err == nil:
+				borrowed.Add(1)
+			case errors.Is(err, ErrLoanLimit):
+				refused.Add(1)
+			default:
+				t.Errorf("Borrow: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Test 1: Exactly the limit goes through
+	if borrowed.Load() != 2 || refused.Load() != titles-2 {
+		t.Errorf("expected 2 loans and %d refusals, got %d and %d", titles-2, borrowed.Load(), refused.Load())
+	}
+	if loans := library.BorrowerLoans("Alice"); len(loans) != 2 {
+		t.Errorf("expected Alice to hold 2 loans, got %d", len(loans))
+	}
+
+	// Test 2: A return frees a place under the limit
+	loan := library.BorrowerLoans("Alice")[0]
+	if _, err := library.ReturnLoan(loan.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Go Programming", "Alice"); err != nil {
+		t.Errorf("expected a borrow after the return, got %v", err)
+	}
+}
+
+// slowPublisher stands in for a publisher waiting on the network.
+type slowPublisher struct {
+	delay time.Duration
+}
+
+func (p slowPublisher) Publish(ctx context.Context, event Event) error {
+	time.Sleep(p.delay)
+	return nil
+}
+
+// BenchmarkBorrowReturnParallel borrows and returns with every goroutine on
+// its own title and borrower. TitleLocks runs them as the library does, while
+// GlobalMutex serializes every call, as when one lock guarded everything.
+// SlowPublisher makes each event wait as a publisher on the network would.
+func BenchmarkBorrowReturnParallel(b *testing.B) {
+	for _, publisher := range []struct {
+		name      string
+		publisher EventPublisher
+	}{
+		{"NopPublisher", NopPublisher{}},
+		{"SlowPublisher", slowPublisher{delay: 50 * time.Microsecond}},
+	} {
+		b.Run(publisher.name+"/TitleLocks", func(b *testing.B) {
+			benchmarkBorrowReturn(b, publisher.publisher, false)
+		})
+		b.Run(publisher.name+"/GlobalMutex", func(b *testing.B) {
+			benchmarkBorrowReturn(b, publisher.publisher, true)
+		})
+	}
+}
+
+func benchmarkBorrowReturn(b *testing.B, publisher EventPublisher, global bool) {
+	library := NewLibrary()
+	library.Publisher = publisher
+	for i := 0; i < titleLockStripes; i++ {
+		library.LoadBook(BookDetail{Title: fmt.Sprintf("Title %d", i), AvailableCopies: 1000, TotalCopies: 1000})
+	}
+
+	var serial sync.Mutex
+	call := func(f func() error) error {
+		if global {
+			serial.Lock()
+			defer serial.Unlock()
+		}
+		return f()
+	}
+
+	var next atomic.Int32
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(1)
+		title := fmt.Sprintf("Title %d", i%titleLockStripes)
+		borrower := fmt.Sprintf("Borrower %d", i)
+		for pb.Next() {
+			if err := call(func() error {
+				_, err := library.Borrow(title, borrower)
+				return err
+			}); err != nil {
+				b.Error(err)
+				return
+			}
+			if err := call(func() error {
+				_, err := library.Return(title, borrower)
+				return err
+			}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestReturnHistory(t *testing.T) {
+	library := newTestLibrary(t)
+	start := time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC)
+	now := start
+	library.SetClock(func() time.Time { return now })
+
+	for _, borrower := range []string{"Early", "On Time", "Late"} {
+		if _, err := library.Borrow("Go Programming", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due := start.AddDate(0, 0, DefaultLoanDays)
+
+	// Test 1: The receipt says how the return compares with the due date
+	for _, tc := range []struct {
+		borrower string
+		at       time.Time
+		status   string
+	}{
+		{"Early", due.AddDate(0, 0, -3), ReturnedEarly},
+		{"On Time", due.Add(-2 * time.Hour), ReturnedOnTime},
+		{"Late", due.Add(time.Hour), ReturnedLate},
+	} {
+		now = tc.at
+		receipt, err := library.Return("Go Programming", tc.borrower)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != tc.status {
+			t.Errorf("%s: expected status %q, got %q", tc.borrower, tc.status, receipt.Status)
+		}
+		if !receipt.Loan.ReturnedAt.Equal(tc.at) {
+			t.Errorf("%s: expected the loan to be stamped %v, got %v", tc.borrower, tc.at, receipt.Loan.ReturnedAt)
+		}
+	}
+
+	// Test 2: Returned loans are kept in history in return order
+	if len(library.History) != 3 {
+		t.Fatalf("expected 3 loans in history, got %d", len(library.History))
+	}
+	for i, borrower := range []string{"Early", "On Time", "Late"} {
+		if library.History[i].NameOfBorrower != borrower || library.History[i].ReturnedAt.IsZero() {
+			t.Errorf("unexpected history entry %d: %+v", i, library.History[i])
+		}
+	}
+}
+
+func TestAuditLogEviction(t *testing.T) {
+	audit := NewAuditLog(3)
+	for _, borrower := range []string{"A", "B", "C", "D", "E"} {
+		audit.Record(AuditEntry{Action: AuditBorrow, Borrower: borrower})
+	}
+
+	// Test 1: Only the newest entries are kept, oldest first
+	entries := audit.Entries(AuditFilter{})
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, borrower := range []string{"C", "D", "E"} {
+		if entries[i].Borrower != borrower {
+			t.Errorf("entry %d: expected borrower %s, got %s", i, borrower, entries[i].Borrower)
+		}
+	}
+}
+
+func TestExtensionDays(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxExtensions = 0
+	library.MaxLoanDays = 60
+	library.LoadBook(BookDetail{Title: "Atlas", AvailableCopies: 1, TotalCopies: 1, LoanDays: 7, ExtensionDays: 7})
+
+	for _, title := range []string{"Go Programming", "Atlas"} {
+		if _, err := library.Borrow(title, "Jane Smith"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Test 1: Extensions default to the library's 21 days and can be shorter
+	loan, err := library.Extend("Go Programming", "Jane Smith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days := loan.ReturnDate.Sub(loan.LoanDate).Hours() / 24; days != 28+21 {
+		t.Errorf("expected a 49 day loan, got %v days", days)
+	}
+	loan, err = library.ExtendBy("Go Programming", "Jane Smith", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days := loan.ReturnDate.Sub(loan.LoanDate).Hours() / 24; days != 28+21+5 {
+		t.Errorf("expected a 54 day loan, got %v days", days)
+	}
+
+	// Test 2: Extensions can't run past the maximum loan duration
+	if _, err := library.ExtendBy("Go Programming", "Jane Smith", 7); !errors.Is(err, ErrMaxLoanDuration) {
+		t.Errorf("expected ErrMaxLoanDuration, got %v", err)
+	}
+
+	// Test 3: A book's own extension period caps the requested days
+	if _, err := library.ExtendBy("Atlas", "Jane Smith", 10); !errors.Is(err, ErrInvalidExtensionDays) {
+		t.Errorf("expected ErrInvalidExtensionDays, got %v", err)
+	}
+	loan, err = library.Extend("Atlas", "Jane Smith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days := loan.ReturnDate.Sub(loan.LoanDate).Hours() / 24; days != 14 {
+		t.Errorf("expected a 14 day loan, got %v days", days)
+	}
+}
+
+func TestCopyLimits(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxCopies = 10
+
+	for _, copies := range []int{0, 11, 1000000000} {
+		if _, err := library.AddBook(BookDetail{Title: "Atlas", AvailableCopies: copies}); !errors.Is(err, ErrCopiesOutOfRange) {
+			t.Errorf("%d copies: expected ErrCopiesOutOfRange, got %v", copies, err)
+		}
+	}
+	if _, err := library.AddBook(BookDetail{Title: strings.Repeat("x", MaxNameLength+1), AvailableCopies: 1}); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("expected ErrNameTooLong, got %v", err)
+	}
+	if _, err := library.AddBook(BookDetail{Title: "Atlas", AvailableCopies: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adjustments count the copies on loan too
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	zero, ten := 0, 10
+	if _, err := library.UpdateBook("Clean Code", AnyVersion, BookUpdate{AvailableCopies: &ten}); !errors.Is(err, ErrCopiesOutOfRange) {
+		t.Errorf("expected ErrCopiesOutOfRange, got %v", err)
+	}
+	book, err := library.UpdateBook("Clean Code", AnyVersion, BookUpdate{AvailableCopies: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.TotalCopies != 1 {
+		t.Errorf("expected the copy on loan to remain, got %d total", book.TotalCopies)
+	}
+	if _, err := library.UpdateBook("Go Programming", AnyVersion, BookUpdate{AvailableCopies: &zero}); !errors.Is(err, ErrCopiesOutOfRange) {
+		t.Errorf("expected ErrCopiesOutOfRange, got %v", err)
+	}
+
+	// Imports that would exceed the limit apply no rows
+	summary, err := library.Import(context.Background(), []ImportRow{
+		{BookDetail: BookDetail{Title: "Atlas", AvailableCopies: 1}, Line: 2},
+		{BookDetail: BookDetail{Title: "Dune", AvailableCopies: 2}, Line: 3},
+	}, false)
+	if !errors.Is(err, ErrInvalidImport) || summary.Imported != 0 || len(summary.Errors) != 1 || summary.Errors[0].Line != 2 {
+		t.Errorf("unexpected import summary: %+v, %v", summary, err)
+	}
+	if _, exists := library.Books()["Dune"]; exists || library.Books()["Atlas"].TotalCopies != 10 {
+		t.Error("expected the rejected import to leave the catalog alone")
+	}
+
+	// Rows repeating a title count against its running total
+	summary, err = library.Import(context.Background(), []ImportRow{
+		{BookDetail: BookDetail{Title: "Dune", AvailableCopies: 6}, Line: 2},
+		{BookDetail: BookDetail{Title: "Dune", AvailableCopies: 6}, Line: 3},
+	}, false)
+	if !errors.Is(err, ErrInvalidImport) || len(summary.Errors) != 1 || summary.Errors[0].Line != 3 {
+		t.Errorf("unexpected import summary: %+v, %v", summary, err)
+	}
+	if _, exists := library.Books()["Dune"]; exists {
+		t.Error("expected no copies of Dune to be imported")
+	}
+}
+
+func TestCategoryPeriods(t *testing.T) {
+	library := newTestLibrary(t)
+	now := time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+	library.Categories = map[string]CategoryPeriods{
+		"reference": {LoanDays: 7, ExtensionDays: 3},
+		"new":       {LoanDays: 14},
+	}
+
+	for _, book := range []BookDetail{
+		{Title: "Atlas", Category: "reference", AvailableCopies: 1},
+		{Title: "Dune", Category: "new", AvailableCopies: 1},
+		{Title: "Emma", Category: "classics", AvailableCopies: 1},
+		{Title: "Ulysses", Category: "reference", LoanDays: 10, AvailableCopies: 1},
+	} {
+		if _, err := library.AddBook(book); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		title             string
+		loanDays, extDays int
+	}{
+		{"Atlas", 7, 3},
+		{"Dune", 14, DefaultExtensionDays},
+		{"Emma", DefaultLoanDays, DefaultExtensionDays}, // unknown category
+		{"Ulysses", 10, 3},                              // the book's own period wins
+	}
+	for _, tt := range tests {
+		loan, err := library.Borrow(tt.title, "John Doe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := now.AddDate(0, 0, tt.loanDays); !loan.ReturnDate.Equal(want) {
+			t.Errorf("%s: got return date %v, want %v", tt.title, loan.ReturnDate, want)
+		}
+
+		extended, err := library.Extend(tt.title, "John Doe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := loan.ReturnDate.AddDate(0, 0, tt.extDays); !extended.ReturnDate.Equal(want) {
+			t.Errorf("%s: got extended return date %v, want %v", tt.title, extended.ReturnDate, want)
+		}
+	}
+}
+
+func TestInventory(t *testing.T) {
+	library := newTestLibrary(t)
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	if report := library.Inventory(); report.Titles != 2 || len(report.Discrepancies) != 0 {
+		t.Errorf("expected a clean inventory, got %+v", report)
+	}
+
+	// A corrupted record shows up with the missing copies
+	book := library.Books()["Go Programming"]
+	book.AvailableCopies = 1
+	library.LoadBook(book, library.Loans()["Go Programming"]...)
+
+	report := library.Inventory()
+	want := InventoryDiscrepancy{Title: "Go Programming", TotalCopies: 3, AvailableCopies: 1, ActiveLoans: 1, Difference: 1}
+	if len(report.Discrepancies) != 1 || report.Discrepancies[0] != want {
+		t.Errorf("got discrepancies %+v, want %+v", report.Discrepancies, want)
+	}
+
+	// Total copies can't drop below the copies on loan
+	zero, two := 0, 2
+	if _, err := library.UpdateBook("Go Programming", AnyVersion, BookUpdate{TotalCopies: &zero}); !errors.Is(err, ErrTotalBelowLoans) {
+		t.Errorf("expected ErrTotalBelowLoans, got %v", err)
+	}
+	updated, err := library.UpdateBook("Go Programming", AnyVersion, BookUpdate{TotalCopies: &two})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.TotalCopies != 2 || updated.AvailableCopies != 1 {
+		t.Errorf("unexpected copies after update: %+v", updated)
+	}
+	if report := library.Inventory(); len(report.Discrepancies) != 0 {
+		t.Errorf("expected the update to fix the inventory, got %+v", report)
+	}
+
+	// Records from before TotalCopies are backfilled from the shelf and loans
+	library.LoadBook(BookDetail{Title: "Go Programming", AvailableCopies: 1}, library.Loans()["Go Programming"]...)
+	if changed := library.BackfillTotalCopies(); changed != 1 {
+		t.Errorf("expected one book to be backfilled, got %d", changed)
+	}
+	if total := library.Books()["Go Programming"].TotalCopies; total != 2 {
+		t.Errorf("expected 2 total copies, got %d", total)
+	}
+}
+
+func TestHistoryLimits(t *testing.T) {
+	library := newTestLibrary(t)
+	start := time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC)
+	now := start
+	library.SetClock(func() time.Time { return now })
+	library.MaxHistoryEntries = 3
+	library.HistoryRetention = 10 * 24 * time.Hour
+
+	returnOne := func(borrower string) {
+		t.Helper()
+		if _, err := library.Borrow("Go Programming", borrower); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := library.Return("Go Programming", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+	borrowers := func() []string {
+		var names []string
+		for _, loan := range library.History {
+			names = append(names, loan.NameOfBorrower)
+		}
+		return names
+	}
+
+	// Test 1: The oldest returns are dropped beyond MaxHistoryEntries
+	for _, borrower := range []string{"A", "B", "C", "D", "E"} {
+		returnOne(borrower)
+		now = now.Add(24 * time.Hour)
+	}
+	if got := fmt.Sprint(borrowers()); got != "[C D E]" {
+		t.Errorf("expected the 3 latest returns, got %s", got)
+	}
+
+	// Test 2: Returns older than HistoryRetention are dropped too
+	now = start.Add(13 * 24 * time.Hour)
+	returnOne("F")
+	if got := fmt.Sprint(borrowers()); got != "[D E F]" {
+		t.Errorf("expected returns within 10 days, got %s", got)
+	}
+	now = now.Add(10 * 24 * time.Hour)
+	returnOne("G")
+	if got := fmt.Sprint(borrowers()); got != "[F G]" {
+		t.Errorf("expected returns within 10 days, got %s", got)
+	}
+}
+
+func TestLostAndDamaged(t *testing.T) {
+	library := newTestLibrary(t)
+	library.ReplacementFee = 2000
+	lost, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged, err := library.Borrow("Go Programming", "Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: A lost copy is written off and its replacement charged
+	receipt, err := library.ReportLost(lost.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.ReplacementFee != 2000 || receipt.Loan.Status != LoanLost {
+		t.Errorf("unexpected receipt for a lost copy: %+v", receipt)
+	}
+	if book := library.Books()["Go Programming"]; book.TotalCopies != 2 || book.AvailableCopies != 1 {
+		t.Errorf("expected 2 copies with 1 available, got %+v", book)
+	}
+	if fine := library.Fine("John Doe"); fine.Total != 2000 || len(fine.Fees) != 1 || fine.Fees[0].LoanID != lost.ID {
+		t.Errorf("expected the replacement fee in the fines, got %+v", fine)
+	}
+	if _, err := library.Loan(lost.ID); !errors.Is(err, ErrLoanReturned) {
+		t.Errorf("expected the lost loan to be closed, got %v", err)
+	}
+
+	// Test 2: A damaged copy comes back into repair, not onto the shelf
+	receipt, err = library.ReportDamaged(damaged.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.ReplacementFee != 0 || receipt.Loan.Status != LoanDamaged {
+		t.Errorf("unexpected receipt for a damaged copy: %+v", receipt)
+	}
+	if book := library.Books()["Go Programming"]; book.TotalCopies != 2 || book.AvailableCopies != 1 || book.InRepair != 1 {
+		t.Errorf("expected 1 of 2 copies in repair, got %+v", book)
+	}
+	if fine := library.Fine("Jane Doe"); fine.Total != 0 {
+		t.Errorf("expected no fee for a damaged copy, got %+v", fine)
+	}
+
+	// Test 3: The inventory accounts for both
+	if report := library.Inventory(); len(report.Discrepancies) != 0 {
+		t.Errorf("expected a clean inventory, got %+v", report)
+	}
+	if err := library.validate(); err != nil {
+		t.Errorf("expected valid counts, got %v", err)
+	}
+
+	// Test 4: A book's own replacement cost wins over the library's fee
+	cost := 3500
+	if _, err := library.UpdateBook("Clean Code", AnyVersion, BookUpdate{ReplacementCost: &cost}); err != nil {
+		t.Fatal(err)
+	}
+	loan, err := library.Borrow("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt, err := library.ReportLost(loan.ID); err != nil || receipt.ReplacementFee != 3500 {
+		t.Errorf("expected a 3500 replacement fee, got %+v, %v", receipt, err)
+	}
+
+	// Test 5: A negative cost is refused however the book is written
+	negative := -100
+	if _, err := library.AddBook(BookDetail{Title: "Dune", AvailableCopies: 1, ReplacementCost: negative}); !errors.Is(err, ErrNegativeCost) {
+		t.Errorf("expected ErrNegativeCost from AddBook, got %v", err)
+	}
+	if _, err := library.UpdateBook("Clean Code", AnyVersion, BookUpdate{ReplacementCost: &negative}); !errors.Is(err, ErrNegativeCost) {
+		t.Errorf("expected ErrNegativeCost from UpdateBook, got %v", err)
+	}
+	if _, err := library.ReplaceBook("Clean Code", AnyVersion, BookDetail{Title: "Clean Code", ReplacementCost: negative}); !errors.Is(err, ErrNegativeCost) {
+		t.Errorf("expected ErrNegativeCost from ReplaceBook, got %v", err)
+	}
+	if cost := library.Books()["Clean Code"].ReplacementCost; cost != 3500 {
+		t.Errorf("expected the cost to stay 3500, got %d", cost)
+	}
+
+	// Test 6: Repaired copies go back on the shelf
+	zero := 0
+	book, err := library.UpdateBook("Go Programming", AnyVersion, BookUpdate{InRepair: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.AvailableCopies != 2 || book.InRepair != 0 {
+		t.Errorf("expected both copies available after repair, got %+v", book)
+	}
+}
+
+func TestCopies(t *testing.T) {
+	library := newTestLibrary(t)
+	statuses := func() map[string]string {
+		got := map[string]string{}
+		for _, c := range library.Books()["Go Programming"].Copies {
+			got[c.Barcode] = c.Status
+		}
+		return got
+	}
+	if copies := statuses(); len(copies) != 3 {
+		t.Fatalf("expected 3 copies with distinct barcodes, got %v", copies)
+	}
+
+	// Test 1: A borrow lends a specific copy
+	first, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := library.Borrow("Go Programming", "Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Barcode == "" || first.Barcode == second.Barcode {
+		t.Fatalf("expected distinct barcodes on the loans, got %q and %q", first.Barcode, second.Barcode)
+	}
+	if status := statuses()[first.Barcode]; status != CopyLoaned {
+		t.Errorf("expected the lent copy to be loaned, got %q", status)
+	}
+
+	// Test 2: Closing a loan settles that copy and the counts follow
+	if _, err := library.ReturnLoan(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.ReportLost(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	copies := statuses()
+	if copies[first.Barcode] != CopyAvailable || copies[second.Barcode] != CopyLost {
+		t.Errorf("unexpected copy statuses: %v", copies)
+	}
+	if book := library.Books()["Go Programming"]; book.AvailableCopies != 2 || book.TotalCopies != 2 {
+		t.Errorf("expected 2 of 2 copies available, got %+v", book)
+	}
+
+	// Test 3: Editing the counts adds or retires shelf copies
+	one, four := 1, 4
+	book, err := library.UpdateBook("Go Programming", AnyVersion, BookUpdate{AvailableCopies: &four})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Copies) != 5 || book.TotalCopies != 4 {
+		t.Errorf("expected 2 new copies besides the lost one, got %+v", book)
+	}
+	book, err = library.UpdateBook("Go Programming", AnyVersion, BookUpdate{InRepair: &one})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.AvailableCopies != 3 || book.InRepair != 1 || book.TotalCopies != 4 {
+		t.Errorf("expected 3 available and 1 in repair, got %+v", book)
+	}
+	if _, err := library.UpdateBook("Go Programming", AnyVersion, BookUpdate{AvailableCopies: &one}); err != nil {
+		t.Fatal(err)
+	}
+	if copies := statuses(); len(copies) != 3 || copies[second.Barcode] != CopyLost {
+		t.Errorf("expected shelf copies to be retired, got %v", copies)
+	}
+	if err := library.validate(); err != nil {
+		t.Errorf("expected valid counts, got %v", err)
+	}
+
+	// Test 4: Books recorded by count alone still lend copies without barcodes
+	library.LoadBook(BookDetail{Title: "Legacy", AvailableCopies: 1, TotalCopies: 1})
+	loan, err := library.Borrow("Legacy", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.Barcode != "" || library.Books()["Legacy"].AvailableCopies != 0 {
+		t.Errorf("unexpected loan of a count-only book: %+v", loan)
+	}
+	if _, err := library.ReturnLoan(loan.ID); err != nil || library.Books()["Legacy"].AvailableCopies != 1 {
+		t.Errorf("expected the copy back on the shelf, got %v", err)
+	}
+}
+
+func TestCaseInsensitiveTitles(t *testing.T) {
+	library := newTestLibrary(t)
+
+	// Test 1: Lookups ignore case and return the title as it was added
+	book, err := library.Book("go programming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Go Programming" {
+		t.Errorf("expected the display title 'Go Programming', got '%s'", book.Title)
+	}
+
+	// Test 2: Loans made in any case land on the same book
+	loan, err := library.Borrow("GO PROGRAMMING", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.BookTitle != "Go Programming" {
+		t.Errorf("expected the loan on 'Go Programming', got '%s'", loan.BookTitle)
+	}
+	if _, err := library.Return("go Programming", "John Doe"); err != nil {
+		t.Errorf("expected the return to find the loan, got %v", err)
+	}
+	if book, _ := library.Book("Go Programming"); book.AvailableCopies != 3 {
+		t.Errorf("expected 3 copies back, got %d", book.AvailableCopies)
+	}
+
+	// Test 3: Adding a title that differs only in case collides
+	if _, err := library.AddBook(BookDetail{Title: "Clean code", AvailableCopies: 1}); !errors.Is(err, ErrTitleCollision) {
+		t.Errorf("expected ErrTitleCollision, got %v", err)
+	}
+	if _, err := library.AddBook(BookDetail{Title: "Clean Code", AvailableCopies: 1}); !errors.Is(err, ErrBookExists) {
+		t.Errorf("expected ErrBookExists, got %v", err)
+	}
+	summary, err := library.Import(context.Background(), []ImportRow{
+		{BookDetail: BookDetail{Title: "Refactoring", AvailableCopies: 1}, Line: 2},
+		{BookDetail: BookDetail{Title: "CLEAN CODE", AvailableCopies: 1}, Line: 3},
+		{BookDetail: BookDetail{Title: "REFACTORING", AvailableCopies: 1}, Line: 4},
+	}, false)
+	if !errors.Is(err, ErrInvalidImport) || summary.Imported != 0 || len(summary.Errors) != 2 || summary.Errors[0].Line != 3 || summary.Errors[1].Line != 4 {
+		t.Errorf("expected lines 3 and 4 to collide, got %+v, %v", summary, err)
+	}
+	if _, exists := library.Books()["Refactoring"]; exists {
+		t.Error("expected the rejected import to leave the catalog alone")
+	}
+
+	// Test 4: A renamed book is found by its new title in any case, and a
+	// book can be recased
+	if _, err := library.ReplaceBook("clean code", AnyVersion, BookDetail{Title: "Clean Code 2nd Edition"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Book("clean code 2nd edition"); err != nil {
+		t.Errorf("expected the renamed book to be found, got %v", err)
+	}
+	if _, err := library.Book("clean code"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("expected the old title to be gone, got %v", err)
+	}
+	if _, err := library.ReplaceBook("Clean Code 2nd Edition", AnyVersion, BookDetail{Title: "Clean Code 2nd edition"}); err != nil {
+		t.Errorf("expected a recase to be allowed, got %v", err)
+	}
+	if _, err := library.ReplaceBook("go programming", AnyVersion, BookDetail{Title: "clean code 2ND EDITION"}); !errors.Is(err, ErrTitleCollision) {
+		t.Errorf("expected ErrTitleCollision, got %v", err)
+	}
+
+	// Test 5: A deleted book frees its title in every case
+	if err := library.DeleteBook("CLEAN CODE 2ND EDITION"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.AddBook(BookDetail{Title: "clean code 2nd edition", AvailableCopies: 1}); err != nil {
+		t.Errorf("expected the title to be free again, got %v", err)
+	}
+}
+
+func TestSweepOverdue(t *testing.T) {
+	library := newTestLibrary(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+	events, cancel := library.Events.Subscribe()
+	defer cancel()
+	overdueEvents := func() []string {
+		var ids []string
+		for {
+			select {
+			case event := <-events:
+				if event.Type == EventLoanOverdue {
+					ids = append(ids, event.LoanID)
+				}
+			default:
+				return ids
+			}
+		}
+	}
+
+	first, _ := library.Borrow("Go Programming", "John Doe")
+	now = now.AddDate(0, 0, 7)
+	second, _ := library.Borrow("Clean Code", "Jane Doe")
+
+	// Test 1: Nothing is flagged before the due dates
+	if flagged := library.SweepOverdue(); flagged != 0 {
+		t.Errorf("expected no loans flagged, got %d", flagged)
+	}
+
+	// Test 2: A loan past its due date is flagged with one event
+	now = first.ReturnDate.Add(time.Hour)
+	if flagged := library.SweepOverdue(); flagged != 1 {
+		t.Errorf("expected 1 loan flagged, got %d", flagged)
+	}
+	if ids := overdueEvents(); len(ids) != 1 || ids[0] != first.ID {
+		t.Errorf("expected one overdue event for %s, got %v", first.ID, ids)
+	}
+	if loan, _ := library.Loan(first.ID); !loan.Overdue {
+		t.Errorf("expected the loan to be flagged overdue")
+	}
+
+	// Test 3: Repeated sweeps only announce newly overdue loans
+	library.SweepOverdue()
+	now = second.ReturnDate.Add(time.Hour)
+	library.SweepOverdue()
+	library.SweepOverdue()
+	if ids := overdueEvents(); len(ids) != 1 || ids[0] != second.ID {
+		t.Errorf("expected one overdue event for %s, got %v", second.ID, ids)
+	}
+	if stats := library.Stats(); stats.OverdueFlagged != 2 {
+		t.Errorf("expected 2 loans flagged in the stats, got %d", stats.OverdueFlagged)
+	}
+
+	// Test 4: Moving the due date back into the future clears the flag, and
+	// the loan is announced again once it passes
+	loan, err := library.SetDueDate(first.ID, now.AddDate(0, 0, 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.Overdue {
+		t.Errorf("expected the due date override to clear the flag")
+	}
+	now = now.AddDate(0, 0, 2)
+	library.SweepOverdue()
+	if ids := overdueEvents(); len(ids) != 1 || ids[0] != first.ID {
+		t.Errorf("expected one overdue event for %s, got %v", first.ID, ids)
+	}
+
+	// Test 5: Returning a flagged loan doesn't announce it again
+	if _, err := library.ReturnLoan(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ids := overdueEvents(); len(ids) != 0 {
+		t.Errorf("expected no overdue event on return, got %v", ids)
+	}
+}
+
+func TestCloseAbandoned(t *testing.T) {
+	library := newTestLibrary(t)
+	library.ReplacementFee = 2000
+	library.Audit = NewAuditLog(0)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+
+	abandoned, _ := library.Borrow("Go Programming", "John Doe")
+	extended, _ := library.Borrow("Go Programming", "Jane Doe")
+	alsoAbandoned, _ := library.Borrow("Clean Code", "John Doe")
+	now = now.AddDate(0, 0, 7)
+	later, _ := library.Borrow("Clean Code", "Jane Doe")
+
+	// Test 1: Nothing is closed while auto-close is off
+	now = abandoned.ReturnDate.AddDate(0, 0, 100)
+	if receipts := library.CloseAbandoned(); receipts != nil {
+		t.Errorf("expected no loans closed with AutoCloseDays unset, got %d", len(receipts))
+	}
+
+	// Test 2: Loans past the threshold are written off, the others kept
+	library.AutoCloseDays = 90
+	now = abandoned.ReturnDate.AddDate(0, 0, 91)
+	if _, err := library.SetDueDate(extended.ID, now.AddDate(0, 0, 1), false); err != nil {
+		t.Fatal(err)
+	}
+	receipts := library.CloseAbandoned()
+	closed := map[string]bool{}
+	for _, receipt := range receipts {
+		closed[receipt.Loan.ID] = true
+		if receipt.Loan.Status != LoanAbandoned || receipt.ReplacementFee != 2000 {
+			t.Errorf("expected an abandoned loan charged 2000, got %q and %d", receipt.Loan.Status, receipt.ReplacementFee)
+		}
+	}
+	if len(closed) != 2 || !closed[abandoned.ID] || !closed[alsoAbandoned.ID] {
+		t.Fatalf("expected loans %s and %s closed, got %v", abandoned.ID, alsoAbandoned.ID, closed)
+	}
+	if _, err := library.Loan(later.ID); err != nil {
+		t.Errorf("expected the later loan to stay open, got %v", err)
+	}
+	if _, err := library.Loan(extended.ID); err != nil {
+		t.Errorf("expected the extended loan to stay open, got %v", err)
+	}
+	if loan, err := library.Loan(abandoned.ID); !errors.Is(err, ErrLoanReturned) || loan.Status != LoanAbandoned {
+		t.Errorf("expected the abandoned loan in the history, got %v and %q", err, loan.Status)
+	}
+
+	// Test 3: The copies are written off the inventory
+	if book, _ := library.Book("Go Programming"); book.TotalCopies != 2 || book.AvailableCopies != 1 {
+		t.Errorf("expected 2 copies owned and 1 available, got %d and %d", book.TotalCopies, book.AvailableCopies)
+	}
+	if book, _ := library.Book("Clean Code"); book.TotalCopies != 1 || book.AvailableCopies != 0 {
+		t.Errorf("expected 1 copy owned and none available, got %d and %d", book.TotalCopies, book.AvailableCopies)
+	}
+	if fine := library.Fine("John Doe"); len(fine.Fees) != 2 {
+		t.Errorf("expected 2 replacement fees for John Doe, got %d", len(fine.Fees))
+	}
+	if entries := library.Audit.Entries(AuditFilter{Action: AuditAbandoned}); len(entries) != 2 {
+		t.Errorf("expected 2 audit entries, got %d", len(entries))
+	}
+	if err := library.Validate(); err != nil {
+		t.Errorf("expected a valid library, got %v", err)
+	}
+
+	// Test 4: Another sweep finds nothing new
+	if receipts := library.CloseAbandoned(); len(receipts) != 0 {
+		t.Errorf("expected no more loans closed, got %d", len(receipts))
+	}
+}
+
+func TestSeed(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Test 1: A new library starts empty
+	if books := NewLibrary().ListBooks(); len(books) != 0 {
+		t.Errorf("expected an empty library, got %d books", len(books))
+	}
+
+	// Test 2: Seeding from JSON makes the books queryable
+	books, err := LoadSeed("testdata/seed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	library := NewLibrary()
+	if seeded, err := library.Seed(books); err != nil || !seeded {
+		t.Fatalf("expected the library to be seeded, got %v and %v", seeded, err)
+	}
+	book, err := library.Book("Go Programming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.AvailableCopies != 3 || book.TotalCopies != 3 || len(book.Copies) != 3 {
+		t.Errorf("expected 3 copies of Go Programming, got %+v", book)
+	}
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Errorf("expected to borrow a seeded book, got %v", err)
+	}
+
+	// Test 3: A library that already has books isn't seeded again
+	if seeded, err := library.Seed(books); err != nil || seeded {
+		t.Errorf("expected the seed to be skipped, got %v and %v", seeded, err)
+	}
+	if len(library.ListBooks()) != 2 {
+		t.Errorf("expected 2 books, got %d", len(library.ListBooks()))
+	}
+
+	// Test 4: Seeding from CSV
+	books, err = LoadSeed(write("seed.csv", "title,availableCopies,author\nRefactoring,2,Martin Fowler\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	library = NewLibrary()
+	library.Seed(books)
+	if book, err := library.Book("Refactoring"); err != nil || book.Author != "Martin Fowler" {
+		t.Errorf("expected Refactoring by Martin Fowler, got %+v and %v", book, err)
+	}
+
+	// Test 5: Parse errors name the file and line
+	for name, content := range map[string]string{
+		"bad.csv":  "title,availableCopies\nRefactoring,2\nDune,many\n",
+		"bad.json": "[\n  {\"title\": \"Dune\", \"availableCopies\": 1},\n  {\"title\": \"Emma\", \"availableCopies\": \"two\"}\n]\n",
+	} {
+		path := write(name, content)
+		if _, err := LoadSeed(path); err == nil || !strings.HasPrefix(err.Error(), path+":3:") {
+			t.Errorf("expected an error at %s:3, got %v", path, err)
+		}
+	}
+
+	// Test 6: Books the library rejects stop the seeding
+	if _, err := NewLibrary().Seed([]BookDetail{{Title: "Dune", AvailableCopies: -1}}); !errors.Is(err, ErrNegativeCopies) {
+		t.Errorf("expected ErrNegativeCopies, got %v", err)
+	}
+}
+
+func TestCancelReservation(t *testing.T) {
+	library := newTestLibrary(t)
+	for _, borrower := range []string{"Alice", "Bob", "Carol"} {
+		if _, err := library.Reserve("Clean Code", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Test 1: Cancelling returns the position and keeps the others in order
+	position, err := library.CancelReservation("clean code", "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 2 {
+		t.Errorf("expected position 2, got %d", position)
+	}
+	if queue := library.Reservations()["Clean Code"]; len(queue) != 2 || queue[0].Borrower != "Alice" || queue[1].Borrower != "Carol" {
+		t.Errorf("expected Alice then Carol, got %v", queue)
+	}
+
+	// Test 2: A borrower who isn't queued can't cancel
+	if _, err := library.CancelReservation("Clean Code", "Bob"); !errors.Is(err, ErrNotReserved) {
+		t.Errorf("expected ErrNotReserved, got %v", err)
+	}
+	if _, err := library.CancelReservation("Dune", "Alice"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("expected ErrBookNotFound, got %v", err)
+	}
+
+	// Test 3: A reservation fulfilled by a return can't be cancelled after
+	library.LoadBook(BookDetail{Title: "Clean Code", AvailableCopies: 0, TotalCopies: 1},
+		LoanDetail{ID: "loan-1", BookTitle: "Clean Code", NameOfBorrower: "Dan", LoanDate: library.Now(), ReturnDate: library.Now().AddDate(0, 0, 7)})
+	if _, err := library.ReturnLoan("loan-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.CancelReservation("Clean Code", "Alice"); !errors.Is(err, ErrNotReserved) {
+		t.Errorf("expected ErrNotReserved, got %v", err)
+	}
+
+	// Test 4: Cancelling the last reservation empties the queue
+	if _, err := library.CancelReservation("Clean Code", "Carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := library.Reservations()["Clean Code"]; exists {
+		t.Errorf("expected no reservation queue left")
+	}
+
+	// Test 5: Racing cancellations and returns, each reservation is either
+	// fulfilled or cancelled, never both
+	const borrowers = 20
+	notified := &notifyCounter{}
+	library.Notifier = notified
+	var loans []LoanDetail
+	for i := 0; i < borrowers; i++ {
+		loans = append(loans, LoanDetail{ID: fmt.Sprintf("race-%d", i), BookTitle: "Clean Code", NameOfBorrower: "Dan", LoanDate: library.Now(), ReturnDate: library.Now().AddDate(0, 0, 7)})
+	}
+	library.LoadBook(BookDetail{Title: "Clean Code", AvailableCopies: 0, TotalCopies: borrowers}, loans...)
+	for i := 0; i < borrowers; i++ {
+		library.Reserve("Clean Code", fmt.Sprintf("Borrower %d", i))
+	}
+	var cancelled atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < borrowers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			library.ReturnLoan(fmt.Sprintf("race-%d", i))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := library.CancelReservation("Clean Code", fmt.Sprintf("Borrower %d", i)); err == nil {
+				cancelled.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := int(cancelled.Load()) + notified.count(); got != borrowers {
+		t.Errorf("expected %d reservations fulfilled or cancelled, got %d", borrowers, got)
+	}
+	if queue := library.Reservations()["Clean Code"]; len(queue) != 0 {
+		t.Errorf("expected the queue to be empty, got %v", queue)
+	}
+}
+
+// notifyCounter counts reservation notifications.
+type notifyCounter struct {
+	mutex sync.Mutex
+	sent  int
+}
+
+func (n *notifyCounter) Notify(borrower, title string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.sent++
+	return nil
+}
+
+func (n *notifyCounter) count() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.sent
+}
+
+func TestReservationHolds(t *testing.T) {
+	library := newTestLibrary(t)
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+	library.MaxReservations = 2
+	library.HoldDays = 3
+	notified := &notifyCounter{}
+	library.Notifier = notified
+	for _, borrower := range []string{"Dan", "Erin"} {
+		if _, err := library.Borrow("Clean Code", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Test 1: The queue takes MaxReservations borrowers, each stamped
+	for _, borrower := range []string{"Alice", "Bob"} {
+		if _, err := library.Reserve("Clean Code", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := library.Reserve("Clean Code", "Carol"); !errors.Is(err, ErrReservationsFull) {
+		t.Errorf("expected ErrReservationsFull, got %v", err)
+	}
+	if queue := library.Reservations()["Clean Code"]; !queue[0].ReservedAt.Equal(now) {
+		t.Errorf("expected the reservation stamped %v, got %+v", now, queue[0])
+	}
+
+	// Test 2: A returned copy is held for the head of the queue
+	if _, err := library.Return("Clean Code", "Dan"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Clean Code", "Carol"); !errors.Is(err, ErrNoCopies) {
+		t.Errorf("expected the held copy to be refused to Carol, got %v", err)
+	}
+	if availability, _ := library.Availability("Clean Code"); availability.AvailableCopies != 1 || availability.HeldCopies != 1 {
+		t.Errorf("expected 1 copy available and held, got %+v", availability)
+	}
+
+	// Test 3: Holds younger than HoldDays are kept
+	now = now.AddDate(0, 0, 3)
+	if dropped := library.ExpireHolds(); len(dropped) != 0 {
+		t.Errorf("expected no expired holds, got %v", dropped)
+	}
+
+	// Test 4: An expired hold passes the copy to the next in the queue
+	now = now.Add(time.Minute)
+	dropped := library.ExpireHolds()
+	if len(dropped) != 1 || dropped[0].Borrower != "Alice" {
+		t.Fatalf("expected Alice's hold to expire, got %v", dropped)
+	}
+	if _, err := library.Borrow("Clean Code", "Alice"); !errors.Is(err, ErrNoCopies) {
+		t.Errorf("expected Alice to have lost the copy, got %v", err)
+	}
+	if notified.count() != 2 {
+		t.Errorf("expected Alice and then Bob notified, got %d notifications", notified.count())
+	}
+
+	// Test 5: The borrower it is held for collects it
+	if _, err := library.Borrow("Clean Code", "Bob"); err != nil {
+		t.Fatalf("expected Bob to borrow his held copy, got %v", err)
+	}
+	if len(library.Snapshot().Holds) != 0 || len(library.Reservations()) != 0 {
+		t.Errorf("expected no holds or reservations left, got %v %v", library.Snapshot().Holds, library.Reservations())
+	}
+
+	// Test 6: With an empty queue an expired hold goes back on the shelf
+	library.Reserve("Clean Code", "Carol")
+	library.Return("Clean Code", "Erin")
+	now = now.AddDate(0, 0, 4)
+	if dropped := library.ExpireHolds(); len(dropped) != 1 {
+		t.Errorf("expected Carol's hold to expire, got %v", dropped)
+	}
+	if _, err := library.Borrow("Clean Code", "Dan"); err != nil {
+		t.Errorf("expected the copy back on the shelf, got %v", err)
+	}
+
+	// Test 7: Without HoldDays copies aren't held
+	library.HoldDays = 0
+	library.Reserve("Clean Code", "Alice")
+	library.Return("Clean Code", "Dan")
+	if _, err := library.Borrow("Clean Code", "Carol"); err != nil {
+		t.Errorf("expected the copy free for anyone, got %v", err)
+	}
+}
+
+func TestCancelHeldReservation(t *testing.T) {
+	library := newTestLibrary(t)
+	library.HoldDays = 3
+	notified := &notifyCounter{}
+	library.Notifier = notified
+	for _, borrower := range []string{"Dan", "Erin"} {
+		if _, err := library.Borrow("Clean Code", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, borrower := range []string{"Alice", "Bob"} {
+		if _, err := library.Reserve("Clean Code", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := library.Return("Clean Code", "Dan"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Cancelling a held copy passes it to the next in the queue
+	if position, err := library.CancelReservation("clean code", "Alice"); err != nil || position != 0 {
+		t.Fatalf("expected Alice's hold cancelled, got position %d, %v", position, err)
+	}
+	if holds := library.Snapshot().Holds["Clean Code"]; len(holds) != 1 || holds[0].Borrower != "Bob" {
+		t.Errorf("expected the copy held for Bob, got %v", holds)
+	}
+	if notified.count() != 2 {
+		t.Errorf("expected Alice and then Bob notified, got %d notifications", notified.count())
+	}
+	if _, err := library.CancelReservation("Clean Code", "Alice"); !errors.Is(err, ErrNotReserved) {
+		t.Errorf("expected ErrNotReserved, got %v", err)
+	}
+
+	// Test 2: With no one left in the queue it goes back on the shelf
+	if _, err := library.CancelReservation("Clean Code", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Clean Code", "Carol"); err != nil {
+		t.Errorf("expected the copy free for anyone, got %v", err)
+	}
+}
+
+// calendarTestLoans exercise the escaping and folding in DueDateCalendar.
+func calendarTestLoans() []LoanDetail {
+	due := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+	return []LoanDetail{
+		{ID: "a1b2c3d4", BookTitle: "Clean Code", NameOfBorrower: "Alice", ReturnDate: due},
+		{ID: "e5f6a7b8", BookTitle: "Design Patterns; Elements of Reusable, Object-Oriented Software", NameOfBorrower: "Alice", ReturnDate: due.AddDate(0, 0, 14)},
+		{ID: "c9d0e1f2", BookTitle: "C:\\Windows\nInternals: Ünïcödé édition with a title long enough to need folding", NameOfBorrower: "Alice", ReturnDate: due.AddDate(0, 1, 0)},
+	}
+}
+
+func TestDueDateCalendar(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "calendar.ics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: The feed matches the golden file
+	got := DueDateCalendar(calendarTestLoans(), time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	if string(got) != string(want) {
+		t.Errorf("calendar doesn't match testdata/calendar.ics:\n%s", got)
+	}
+
+	// Test 2: No line is longer than RFC 5545 allows
+	for _, line := range strings.Split(string(got), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets: %q", len(line), line)
+		}
+	}
+
+	// Test 3: Without loans it is still a valid, empty calendar
+	if empty := string(DueDateCalendar(nil, testNow)); !strings.HasPrefix(empty, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(empty, "END:VCALENDAR\r\n") || strings.Contains(empty, "VEVENT") {
+		t.Errorf("unexpected empty calendar: %q", empty)
+	}
+}
+
+func TestTransferLoan(t *testing.T) {
+	library := newTestLibrary(t)
+	loan, err := library.Borrow("Clean Code", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: The loan changes hands with its ID and dates
+	transferred, err := library.TransferLoan("clean code", "Alice", "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transferred.ID != loan.ID || transferred.NameOfBorrower != "Bob" || !transferred.LoanDate.Equal(loan.LoanDate) || !transferred.ReturnDate.Equal(loan.ReturnDate) {
+		t.Errorf("expected loan %+v transferred to Bob, got %+v", loan, transferred)
+	}
+	if _, err := library.TransferLoan("Clean Code", "Alice", "Bob"); !errors.Is(err, ErrLoanNotFound) {
+		t.Errorf("expected ErrLoanNotFound, got %v", err)
+	}
+
+	// Test 2: The new borrower is held to the loan limit
+	library.MaxLoansPerBorrower = 1
+	if _, err := library.Borrow("Go Programming", "Carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.TransferLoan("Clean Code", "Bob", "Carol"); !errors.Is(err, ErrLoanLimit) {
+		t.Errorf("expected ErrLoanLimit, got %v", err)
+	}
+
+	// Test 3: Once there are members the new borrower must be one
+	library.AddMember(Member{Name: "Dan", Email: "dan@example.org"})
+	if _, err := library.TransferLoan("Clean Code", "Bob", "Erin"); !errors.Is(err, ErrMemberNotFound) {
+		t.Errorf("expected ErrMemberNotFound, got %v", err)
+	}
+	if transferred, err := library.TransferLoan("Clean Code", "Bob", "Dan"); err != nil || transferred.NameOfBorrower != "Dan" {
+		t.Errorf("expected the loan transferred to Dan, got %+v, %v", transferred, err)
+	}
+}
+
+func TestReturnLoanIf(t *testing.T) {
+	library := newTestLibrary(t)
+	loan, err := library.Borrow("Clean Code", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.TransferLoanByID(loan.ID, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	errNotAlice := errors.New("not Alice's loan")
+	onlyAlice := func(loan LoanDetail) error {
+		if loan.NameOfBorrower != "Alice" {
+			return errNotAlice
+		}
+		return nil
+	}
+
+	// Test 1: A rejected loan stays open
+	if _, err := library.ReturnLoanIf(loan.ID, onlyAlice); !errors.Is(err, errNotAlice) {
+		t.Errorf("expected the check's error, got %v", err)
+	}
+	if _, err := library.ReportLostIf(loan.ID, onlyAlice); !errors.Is(err, errNotAlice) {
+		t.Errorf("expected the check's error, got %v", err)
+	}
+	if open, err := library.Loan(loan.ID); err != nil || open.NameOfBorrower != "Bob" {
+		t.Errorf("expected Bob's loan to stay open, got %+v, %v", open, err)
+	}
+
+	// Test 2: An accepted one is closed, with the borrower it had then
+	receipt, err := library.ReturnLoanIf(loan.ID, func(LoanDetail) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Loan.NameOfBorrower != "Bob" {
+		t.Errorf("expected Bob's loan returned, got %+v", receipt.Loan)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	library := newTestLibrary(t)
+	if _, err := library.AddBook(BookDetail{Title: "Refactoring", ISBN: "9780134757599", AvailableCopies: 1}); err != nil {
+		t.Fatal(err)
+	}
+	loan, err := library.Borrow("Refactoring", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Reserve("Refactoring", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Clean Code", "Carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Clean Code", "Carol"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := library.Snapshot()
+
+	// Test 1: A snapshot survives a JSON round trip into another library
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewLibrary()
+	if err := restored.Restore(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := restored.BookByISBN("9780134757599"); err != nil || got.Title != "Refactoring" {
+		t.Errorf("expected the ISBN index rebuilt, got %+v, %v", got, err)
+	}
+	if loans := restored.BorrowerLoans("Alice"); len(loans) != 1 || loans[0].ID != loan.ID {
+		t.Errorf("expected Alice's loan %s restored, got %+v", loan.ID, loans)
+	}
+	if state := restored.Snapshot(); len(state.Reservations["Refactoring"]) != 1 || len(state.History) != 1 {
+		t.Errorf("expected the reservation and history restored, got %+v and %+v", state.Reservations, state.History)
+	}
+	if err := restored.Validate(); err != nil {
+		t.Errorf("expected a valid library, got %v", err)
+	}
+
+	// Test 2: The snapshot is a copy that later changes don't touch
+	if _, err := library.Return("Refactoring", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Loans["Refactoring"]) != 1 {
+		t.Errorf("expected the snapshot to keep the loan, got %+v", snapshot.Loans)
+	}
+
+	// Test 3: A snapshot that doesn't hold together is refused whole
+	broken := restored.Snapshot()
+	broken.Loans["Missing"] = []LoanDetail{{ID: "x", BookTitle: "Missing", NameOfBorrower: "Dan"}}
+	book := broken.Books["Clean Code"]
+	book.ISBN = "9780134757599"
+	broken.Books["Clean Code"] = book
+	err = restored.Restore(broken)
+	if !errors.Is(err, ErrInvalidSnapshot) || !strings.Contains(err.Error(), "missing book 'Missing'") || !strings.Contains(err.Error(), "ISBN") {
+		t.Errorf("expected ErrInvalidSnapshot naming both problems, got %v", err)
+	}
+	if _, err := restored.Book("Missing"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("expected the library unchanged, got %v", err)
+	}
+	if loans := restored.BorrowerLoans("Alice"); len(loans) != 1 {
+		t.Errorf("expected Alice's loan kept, got %+v", loans)
+	}
+}
+
+func TestEditions(t *testing.T) {
+	library := newTestLibrary(t)
+	first, err := library.AddBook(BookDetail{Title: "Refactoring", AvailableCopies: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := library.AddBook(BookDetail{Title: "Refactoring", Edition: "2nd edition", AvailableCopies: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume, err := library.AddBook(BookDetail{Title: "The Art of Computer Programming", Edition: "3rd edition", Volume: 2, AvailableCopies: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Editions and volumes are catalogued under their own titles
+	if second.Title != "Refactoring (2nd edition)" || volume.Title != "The Art of Computer Programming (3rd edition), vol. 2" {
+		t.Errorf("unexpected catalog titles %q and %q", second.Title, volume.Title)
+	}
+	for _, book := range []BookDetail{first, second, volume} {
+		if want := strings.SplitN(book.Title, " (", 2)[0]; book.WorkTitle() != want {
+			t.Errorf("expected work title %q for %q, got %q", want, book.Title, book.WorkTitle())
+		}
+	}
+
+	// Test 2: Each edition has its own copies and loans
+	if _, err := library.Borrow("Refactoring", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Refactoring", "Bob"); !errors.Is(err, ErrNoCopies) {
+		t.Errorf("expected ErrNoCopies for the first edition, got %v", err)
+	}
+	if _, err := library.Borrow("Refactoring (2nd edition)", "Bob"); err != nil {
+		t.Errorf("expected the 2nd edition to lend, got %v", err)
+	}
+
+	// Test 3: Replacing a book with its own record keeps its title, and
+	// re-adding an edition is a duplicate
+	replaced, err := library.ReplaceBook(second.Title, AnyVersion, second)
+	if err != nil || replaced.Title != second.Title {
+		t.Errorf("expected %q kept, got %+v, %v", second.Title, replaced, err)
+	}
+	if _, err := library.AddBook(BookDetail{Title: "Refactoring", Edition: "2nd edition", AvailableCopies: 1}); !errors.Is(err, ErrBookExists) {
+		t.Errorf("expected ErrBookExists, got %v", err)
+	}
+	if _, err := library.AddBook(BookDetail{Title: "Refactoring", Volume: -1, AvailableCopies: 1}); !errors.Is(err, ErrInvalidVolume) {
+		t.Errorf("expected ErrInvalidVolume, got %v", err)
+	}
+}
+
+func TestTitleLoanLimit(t *testing.T) {
+	library := newTestLibrary(t)
+	if _, err := library.Borrow("Go Programming", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: A second copy of the same title is refused, other titles aren't
+	if _, err := library.Borrow("Go Programming", "Alice"); !errors.Is(err, ErrTitleLoanLimit) {
+		t.Errorf("expected ErrTitleLoanLimit, got %v", err)
+	}
+	if _, err := library.Borrow("Clean Code", "Alice"); err != nil {
+		t.Errorf("expected another title to be lent, got %v", err)
+	}
+	if _, err := library.Borrow("Go Programming", "Bob"); err != nil {
+		t.Errorf("expected another borrower to get a copy, got %v", err)
+	}
+
+	// Test 2: Batches and transfers count the copies already held
+	if _, err := library.BorrowBatch("Carol", []string{"Go Programming", "Go Programming"}); err == nil {
+		t.Error("expected a batch of two copies of one title to be refused")
+	}
+	if _, err := library.TransferLoan("Go Programming", "Bob", "Alice"); !errors.Is(err, ErrTitleLoanLimit) {
+		t.Errorf("expected ErrTitleLoanLimit, got %v", err)
+	}
+
+	// Test 3: Raising the limit allows more copies, zero lifts it
+	library.MaxCopiesPerBorrowerPerTitle = 2
+	if _, err := library.Borrow("Go Programming", "Alice"); err != nil {
+		t.Errorf("expected a second copy under a limit of 2, got %v", err)
+	}
+	library.MaxCopiesPerBorrowerPerTitle = 0
+	if _, err := library.Borrow("Clean Code", "Alice"); err != nil {
+		t.Errorf("expected no limit, got %v", err)
+	}
+}
+
+func TestTransferLoanByID(t *testing.T) {
+	library := newTestLibrary(t)
+	loan, err := library.Borrow("Clean Code", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan, err = library.Extend("Clean Code", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Only the borrower changes, and the old one is remembered
+	transferred, err := library.TransferLoanByID(loan.ID, "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transferred.NameOfBorrower != "Bob" || !transferred.ReturnDate.Equal(loan.ReturnDate) || transferred.Extensions != 1 {
+		t.Errorf("expected loan %+v transferred to Bob, got %+v", loan, transferred)
+	}
+	if !slices.Equal(transferred.PreviousBorrowers, []string{"Alice"}) {
+		t.Errorf("expected Alice as the previous borrower, got %v", transferred.PreviousBorrowers)
+	}
+	if _, err := library.TransferLoanByID("missing", "Bob"); !errors.Is(err, ErrLoanNotFound) {
+		t.Errorf("expected ErrLoanNotFound, got %v", err)
+	}
+
+	// Test 2: The loan is listed under the new borrower only, and only they
+	// can extend or return it
+	if loans := library.BorrowerLoans("Alice"); len(loans) != 0 {
+		t.Errorf("expected Alice to have no loans, got %+v", loans)
+	}
+	if loans := library.BorrowerLoans("Bob"); len(loans) != 1 || loans[0].ID != loan.ID {
+		t.Errorf("expected Bob to have the loan, got %+v", loans)
+	}
+	if _, err := library.Extend("Clean Code", "Alice"); !errors.Is(err, ErrLoanNotFound) {
+		t.Errorf("expected ErrLoanNotFound, got %v", err)
+	}
+	if _, err := library.Return("Clean Code", "Alice"); !errors.Is(err, ErrLoanNotFound) {
+		t.Errorf("expected ErrLoanNotFound, got %v", err)
+	}
+
+	// Test 3: The receiving borrower is held to the loan limit
+	library.MaxLoansPerBorrower = 1
+	if _, err := library.Borrow("Go Programming", "Carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.TransferLoanByID(loan.ID, "Carol"); !errors.Is(err, ErrLoanLimit) {
+		t.Errorf("expected ErrLoanLimit, got %v", err)
+	}
+	if loans := library.BorrowerLoans("Bob"); len(loans) != 1 {
+		t.Errorf("expected a refused transfer to leave the loan with Bob, got %+v", loans)
+	}
+
+	// Test 4: The chain of borrowers is kept in the history once returned
+	if _, err := library.TransferLoanByID(loan.ID, "Dan"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Clean Code", "Dan"); err != nil {
+		t.Fatal(err)
+	}
+	if last := library.History[len(library.History)-1]; !slices.Equal(last.PreviousBorrowers, []string{"Alice", "Bob"}) {
+		t.Errorf("expected Alice and Bob in the history, got %v", last.PreviousBorrowers)
+	}
+}
+
+func TestExtendReserved(t *testing.T) {
+	library := newTestLibrary(t)
+	if _, err := library.Borrow("Clean Code", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Go Programming", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: The borrower's own reservation doesn't block an extension
+	if _, err := library.Reserve("Clean Code", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Extend("Clean Code", "Alice"); err != nil {
+		t.Errorf("expected the extension, got %v", err)
+	}
+
+	// Test 2: Someone else waiting refuses it, here and in ExtendAll
+	if _, err := library.Reserve("Clean Code", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Extend("Clean Code", "Alice"); !errors.Is(err, ErrReservedByOthers) {
+		t.Errorf("expected ErrReservedByOthers, got %v", err)
+	}
+	for _, result := range library.ExtendAll("Alice") {
+		if reserved := result.Loan.BookTitle == "Clean Code"; result.Extended == reserved {
+			t.Errorf("%s: expected extended %v, got %+v", result.Loan.BookTitle, !reserved, result)
+		}
+	}
+
+	// Test 3: ExtendReserved restores unconditional extensions
+	library.ExtendReserved = true
+	if _, err := library.Extend("Clean Code", "Alice"); err != nil {
+		t.Errorf("expected the extension, got %v", err)
+	}
+}
+
+// fakePublisher captures published events, or fails them with err.
+type fakePublisher struct {
+	mutex  sync.Mutex
+	events []Event
+	err    error
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, event Event) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestEventPublisher(t *testing.T) {
+	library := newTestLibrary(t)
+	publisher := &fakePublisher{}
+	library.Publisher = publisher
+	events, cancel := library.Events.Subscribe()
+	defer cancel()
+
+	loan, err := library.Borrow("Go Programming", "Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Extend("Go Programming", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Go Programming", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Missing Book", "Alice"); err == nil {
+		t.Fatal("expected the borrow to fail")
+	}
+
+	// Test 1: Each successful mutation is published once, in order
+	var types []string
+	for _, event := range publisher.events {
+		types = append(types, event.Type)
+	}
+	if want := []string{EventBookBorrowed, EventLoanExtended, EventBookReturned}; !slices.Equal(types, want) {
+		t.Errorf("expected %v, got %v", want, types)
+	}
+	if event := publisher.events[0]; event.LoanID != loan.ID || event.Title != "Go Programming" || event.Borrower != "Alice" {
+		t.Errorf("unexpected borrow event: %+v", event)
+	}
+
+	// Test 2: The in-process bus gets the same events
+	for _, want := range types {
+		if event := <-events; event.Type != want {
+			t.Errorf("expected %s on the bus, got %s", want, event.Type)
+		}
+	}
+
+	// Test 3: Failures are counted but don't fail the mutation
+	publisher.err = errors.New("broker down")
+	if _, err := library.Borrow("Clean Code", "Bob"); err != nil {
+		t.Errorf("expected the borrow to succeed, got %v", err)
+	}
+	if stats := library.Stats(); stats.PublishFailures != 1 {
+		t.Errorf("expected 1 publish failure, got %d", stats.PublishFailures)
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	if _, err := NewNATSPublisher("http://localhost:4222"); err == nil {
+		t.Error("expected a non-NATS URL to be rejected")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The fake server accepts one client and reports what it publishes
+	published := make(chan [2]string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprint(conn, "INFO {\"server_id\":\"fake\"}\r\n")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 0:
+			case fields[0] == "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case fields[0] == "PUB" && len(fields) == 3:
+				payload, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				published <- [2]string{fields[1], strings.TrimSuffix(payload, "\r\n")}
+			}
+		}
+	}()
+
+	publisher, err := NewNATSPublisher("nats://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	// Test 1: Events fail until the connection is up, then go out as JSON
+	// on their subject
+	event := Event{Type: EventBookBorrowed, Title: "Go Programming", Borrower: "Alice", LoanID: "abc", At: testNow}
+	deadline := time.Now().Add(5 * time.Second)
+	for publisher.Publish(context.Background(), event) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("publisher never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case msg := <-published:
+		var got Event
+		if err := json.Unmarshal([]byte(msg[1]), &got); err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] != "library.loans.borrowed" || got.LoanID != "abc" || got.Type != EventBookBorrowed {
+			t.Errorf("unexpected message on %s: %s", msg[0], msg[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message published")
+	}
+
+	// Test 2: Once closed, events fail rather than queue up
+	publisher.Close()
+	if err := publisher.Publish(context.Background(), event); err == nil {
+		t.Error("expected publishing after Close to fail")
+	}
+}
+
+func TestDeleteBookWithHistory(t *testing.T) {
+	library := newTestLibrary(t)
+
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: A returned loan keeps the book from being removed
+	if err := library.DeleteBook("Clean Code"); !errors.Is(err, ErrBookHasHistory) {
+		t.Errorf("expected ErrBookHasHistory, got %v", err)
+	}
+
+	// Test 2: Books that were never borrowed can still be removed
+	if err := library.DeleteBook("Go Programming"); err != nil {
+		t.Errorf("expected Go Programming to be deleted, got %v", err)
+	}
+}
+
+func TestRenameBook(t *testing.T) {
+	library := newTestLibrary(t)
+	library.ExtendReserved = true // Jane's reservation mustn't block John's extension
+
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Clean Code", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Reserve("Clean Code", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: The book moves with its loans and reservations
+	version := library.Books()["Clean Code"].Version
+	book, err := library.RenameBook("clean code", "Clean Code: A Handbook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Clean Code: A Handbook" || book.Version != version+1 {
+		t.Errorf("unexpected book: %+v", book)
+	}
+	if _, err := library.Book("Clean Code"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("expected the old title to be gone, got %v", err)
+	}
+	availability, err := library.Availability("Clean Code: A Handbook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if availability.ActiveLoans != 2 || availability.QueueLength != 1 {
+		t.Errorf("expected 2 loans and 1 reservation under the new title, got %+v", availability)
+	}
+
+	// Test 2: The borrower extends and returns under the new title
+	loan, err := library.Extend("Clean Code: A Handbook", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.BookTitle != "Clean Code: A Handbook" || loan.Extensions != 1 {
+		t.Errorf("unexpected loan: %+v", loan)
+	}
+	if _, err := library.Return("Clean Code: A Handbook", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if last := library.History[len(library.History)-1]; last.BookTitle != "Clean Code: A Handbook" {
+		t.Errorf("expected the history to use the new title, got %+v", last)
+	}
+
+	// Test 3: Titles in use are refused, a change of case is not
+	if _, err := library.RenameBook("Go Programming", "Clean Code: A Handbook"); !errors.Is(err, ErrBookExists) {
+		t.Errorf("expected ErrBookExists, got %v", err)
+	}
+	if _, err := library.RenameBook("Go Programming", "CLEAN CODE: A HANDBOOK"); !errors.Is(err, ErrTitleCollision) {
+		t.Errorf("expected ErrTitleCollision, got %v", err)
+	}
+	if _, err := library.RenameBook("Missing", "Anything"); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("expected ErrBookNotFound, got %v", err)
+	}
+	if book, err := library.RenameBook("Go Programming", "GO PROGRAMMING"); err != nil || book.Title != "GO PROGRAMMING" {
+		t.Errorf("expected a recase to be allowed, got %+v, %v", book, err)
+	}
+}
+
+func TestDueEndOfDay(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxCopiesPerBorrowerPerTitle = 0
+	library.LoanDays = 28
+	library.ExtensionDays = 21
+	now := time.Date(2024, time.March, 4, 15, 0, 0, 0, time.UTC)
+	library.SetClock(func() time.Time { return now })
+
+	// Test 1: By default the book is due to the second 28 days out
+	loan, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.AddDate(0, 0, 28); !loan.ReturnDate.Equal(want) {
+		t.Errorf("expected due %v, got %v", want, loan.ReturnDate)
+	}
+
+	// Test 2: Rounded, it is due by the end of that day
+	library.DueEndOfDay = true
+	loan, err = library.Borrow("Go Programming", "Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, time.April, 1, 23, 59, 59, 0, time.UTC); !loan.ReturnDate.Equal(want) {
+		t.Errorf("expected due %v, got %v", want, loan.ReturnDate)
+	}
+
+	// Test 3: The day is the one in the library's time zone, where 3pm UTC
+	// is already tomorrow
+	tokyo := time.FixedZone("UTC+9", 9*60*60)
+	library.Location = tokyo
+	now = time.Date(2024, time.March, 4, 20, 0, 0, 0, time.UTC)
+	loan, err = library.Borrow("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, time.April, 2, 23, 59, 59, 0, tokyo); !loan.ReturnDate.Equal(want) {
+		t.Errorf("expected due %v, got %v", want, loan.ReturnDate)
+	}
+
+	// Test 4: Extensions are rounded the same way and may reach the last
+	// day of -max-loan-days
+	library.MaxLoanDays = 49
+	loan, err = library.Extend("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, time.April, 23, 23, 59, 59, 0, tokyo); !loan.ReturnDate.Equal(want) {
+		t.Errorf("expected due %v, got %v", want, loan.ReturnDate)
+	}
+}
+
+func TestWebhookDeliveryLimit(t *testing.T) {
+	// Without workers nothing leaves the queue, so once it is full every
+	// event is recorded as dropped
+	webhooks := NewWebhooks(0)
+	defer webhooks.Close()
+	webhooks.MaxDeliveries = 3
+	hook, err := webhooks.Register("http://example.org/hook", []string{EventBookBorrowed}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range cap(webhooks.jobs) + 5 {
+		webhooks.Publish(Event{Type: EventBookBorrowed})
+	}
+
+	deliveries, err := webhooks.Deliveries(hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("expected the last 3 deliveries, got %d", len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		if delivery.Error != "queue full" {
+			t.Errorf("unexpected delivery: %+v", delivery)
+		}
+	}
+}
@@ -0,0 +1,1116 @@
+package librarypkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Return statuses compare the return with the loan's due date.
+const (
+	ReturnedEarly  = "early"  // before the due date
+	ReturnedOnTime = "onTime" // on the due date, before the due time
+	ReturnedLate   = "late"   // after the due time
+)
+
+// How a loan was closed, recorded as its Status in History.
+const (
+	LoanReturned  = "returned"  // the copy is back on the shelf
+	LoanLost      = "lost"      // the copy is gone and written off
+	LoanDamaged   = "damaged"   // the copy is back but out for repair
+	LoanAbandoned = "abandoned" // never came back and written off by the auto-close sweep
+)
+
+type ReturnReceipt struct {
+	Message        string     `json:"message"`
+	Loan           LoanDetail `json:"loan"`
+	ReturnedAt     time.Time  `json:"returnedAt"`
+	Status         string     `json:"status"`
+	WasOverdue     bool       `json:"wasOverdue"`
+	DaysLate       int        `json:"daysLate"`
+	Fine           int        `json:"fine"`                     // cents, zero within the grace period
+	ReplacementFee int        `json:"replacementFee,omitempty"` // cents, charged when the copy was lost
+}
+
+func (l *Library) Borrow(title, borrower string) (LoanDetail, error) {
+	loan, _, err := l.borrow(title, borrower, false)
+	return loan, err
+}
+
+// BorrowOrReserve borrows title for borrower, or if no copy is free adds them
+// to its reservation queue instead and returns their position in it. Both
+// happen under the title lock, so a copy returned in between can't be missed.
+func (l *Library) BorrowOrReserve(title, borrower string) (LoanDetail, int, error) {
+	return l.borrow(title, borrower, true)
+}
+
+func (l *Library) borrow(title, borrower string, reserve bool) (LoanDetail, int, error) {
+	id := newID(8)
+
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	title = l.lookupTitle(title)
+	loan, err := l.newLoan(title, borrower)
+	if reserve && errors.Is(err, ErrNoCopies) {
+		position, err := l.reserve(title, borrower)
+		return LoanDetail{}, position, err
+	}
+	if err != nil {
+		return LoanDetail{}, 0, err
+	}
+	loan.ID = id
+
+	// The loan limit counts loans across titles, so it is checked as the
+	// loan is counted, where concurrent borrows of other titles can't
+	// overrun it
+	if err := l.addLoan(loan); err != nil {
+		return LoanDetail{}, 0, err
+	}
+
+	// newLoan saw a free copy under this same title lock, so the decrement
+	// can't take the count below zero
+	entry := l.titles[title]
+	loan.Barcode = entry.book.lendCopy()
+	entry.book.Version++
+	entry.collectHold(borrower)
+	entry.loans = append(entry.loans, loan)
+	l.checkTitleInvariants(title)
+
+	l.publish(EventBookBorrowed, loan)
+	return loan, 0, nil
+}
+
+// PreviewBorrow runs the same checks as Borrow and returns the loan it would
+// create, without an ID and without changing anything.
+func (l *Library) PreviewBorrow(title, borrower string) (LoanDetail, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	loan, err := l.newLoan(l.lookupTitle(title), borrower)
+	if err != nil {
+		return LoanDetail{}, err
+	}
+	l.entries.Lock()
+	defer l.entries.Unlock()
+	if l.loanLimitReached(borrower) {
+		return LoanDetail{}, ErrLoanLimit
+	}
+	return loan, nil
+}
+
+// BorrowFailure is a title that kept a batch borrow from going through.
+type BorrowFailure struct {
+	Title  string `json:"title"`
+	Reason string `json:"reason"`
+	Err    error  `json:"-"`
+}
+
+// BatchError is returned by BorrowBatch when some titles can't be borrowed.
+// It matches ErrBatchUnavailable.
+type BatchError struct {
+	Failures []BorrowFailure
+}
+
+func (e *BatchError) Error() string {
+	titles := make([]string, len(e.Failures))
+	for i, failure := range e.Failures {
+		titles[i] = failure.Title
+	}
+	return fmt.Sprintf("%v: %s", ErrBatchUnavailable, strings.Join(titles, ", "))
+}
+
+func (e *BatchError) Unwrap() error { return ErrBatchUnavailable }
+
+// BorrowBatch lends borrower one copy for each entry in titles, all or
+// nothing, holding the mutex for writing since it spans titles. A title
+// listed twice takes two copies. The loan limit applies to the whole batch,
+// and every unavailable title is reported in a *BatchError.
+func (l *Library) BorrowBatch(borrower string, titles []string) ([]LoanDetail, error) {
+	if len(titles) == 0 {
+		return nil, ErrTitleRequired
+	}
+	ids := make([]string, len(titles))
+	for i := range ids {
+		ids[i] = newID(8)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	titles = slices.Clone(titles)
+	for i, title := range titles {
+		titles[i] = l.lookupTitle(title)
+	}
+	if l.MaxLoansPerBorrower > 0 && l.loanCounts[borrower]+len(titles) > l.MaxLoansPerBorrower {
+		return nil, fmt.Errorf("%w, %d more would exceed %d", ErrLoanLimit, len(titles), l.MaxLoansPerBorrower)
+	}
+
+	wanted := make(map[string]int)
+	for _, title := range titles {
+		wanted[title]++
+	}
+	var failures []BorrowFailure
+	for _, title := range titles {
+		count, unchecked := wanted[title]
+		if !unchecked {
+			continue
+		}
+		delete(wanted, title)
+		if err := l.checkBatchTitle(title, borrower, count); err != nil {
+			failures = append(failures, BorrowFailure{Title: title, Reason: err.Error(), Err: err})
+		}
+	}
+	if failures != nil {
+		return nil, &BatchError{Failures: failures}
+	}
+
+	now := l.now()
+	loans := make([]LoanDetail, len(titles))
+	for i, title := range titles {
+		entry := l.titles[title]
+		barcode := entry.book.lendCopy()
+		entry.book.Version++
+		entry.collectHold(borrower)
+
+		loans[i] = LoanDetail{
+			ID:             ids[i],
+			BookTitle:      title,
+			NameOfBorrower: borrower,
+			LoanDate:       now,
+			ReturnDate:     l.dueDate(now.AddDate(0, 0, l.loanPeriod(entry.book))),
+			Barcode:        barcode,
+		}
+		entry.loans = append(entry.loans, loans[i])
+		l.indexLoan(title, loans[i])
+	}
+	l.checkInvariants()
+
+	for _, loan := range loans {
+		l.publish(EventBookBorrowed, loan)
+	}
+	return loans, nil
+}
+
+// checkBatchTitle expects the caller to hold the mutex. It checks that count
+// copies of title can be borrowed by borrower.
+func (l *Library) checkBatchTitle(title, borrower string, count int) error {
+	entry, exists := l.titles[title]
+	if !exists {
+		return ErrBookNotFound
+	}
+	if entry.book.Archived {
+		return ErrBookArchived
+	}
+	if entry.book.Reference {
+		return ErrReferenceOnly
+	}
+	if err := l.checkTitleLoans(title, borrower, count); err != nil {
+		return err
+	}
+	if free := entry.freeCopies(borrower); free < count {
+		return fmt.Errorf("%w, %d requested and %d available", ErrNoCopies, count, free)
+	}
+	return nil
+}
+
+// newLoan expects the caller to hold the mutex and title's lock. It checks
+// that borrower may take out title, short of the loan limit that addLoan
+// checks, and builds the loan without an ID, leaving the library untouched.
+func (l *Library) newLoan(title, borrower string) (LoanDetail, error) {
+	entry, exists := l.titles[title]
+	if !exists {
+		return LoanDetail{}, ErrBookNotFound
+	}
+	book := entry.book
+
+	if book.Archived {
+		return LoanDetail{}, ErrBookArchived
+	}
+
+	if book.Reference {
+		return LoanDetail{}, ErrReferenceOnly
+	}
+
+	if err := l.checkTitleLoans(title, borrower, 1); err != nil {
+		return LoanDetail{}, err
+	}
+
+	if entry.freeCopies(borrower) <= 0 {
+		return LoanDetail{}, ErrNoCopies
+	}
+
+	now := l.now()
+	return LoanDetail{
+		BookTitle:      title,
+		NameOfBorrower: borrower,
+		LoanDate:       now,
+		ReturnDate:     l.dueDate(now.AddDate(0, 0, l.loanPeriod(book))),
+	}, nil
+}
+
+// checkTitleLoans expects the caller to hold the mutex and title's lock. It fails with
+// ErrTitleLoanLimit if count more copies of title would take borrower past
+// MaxCopiesPerBorrowerPerTitle.
+func (l *Library) checkTitleLoans(title, borrower string, count int) error {
+	if l.MaxCopiesPerBorrowerPerTitle <= 0 {
+		return nil
+	}
+	held := 0
+	for _, loan := range l.titles[title].loans {
+		if loan.NameOfBorrower == borrower {
+			held++
+		}
+	}
+	if held+count > l.MaxCopiesPerBorrowerPerTitle {
+		return fmt.Errorf("%w (%d)", ErrTitleLoanLimit, l.MaxCopiesPerBorrowerPerTitle)
+	}
+	return nil
+}
+
+// loanLimitReached expects the caller to hold entries, or the mutex for
+// writing. It reports whether borrower has as many loans as
+// MaxLoansPerBorrower allows.
+func (l *Library) loanLimitReached(borrower string) bool {
+	return l.MaxLoansPerBorrower > 0 && l.loanCounts[borrower] >= l.MaxLoansPerBorrower
+}
+
+// addLoan indexes loan, new to the library, and counts it against its
+// borrower, failing with ErrLoanLimit if they have reached
+// MaxLoansPerBorrower.
+func (l *Library) addLoan(loan LoanDetail) error {
+	l.entries.Lock()
+	defer l.entries.Unlock()
+
+	if l.loanLimitReached(loan.NameOfBorrower) {
+		return ErrLoanLimit
+	}
+	l.indexLoan(loan.BookTitle, loan)
+	return nil
+}
+
+// moveLoan counts loan against borrower instead of its current borrower,
+// failing with ErrLoanLimit if they have reached MaxLoansPerBorrower.
+func (l *Library) moveLoan(loan LoanDetail, borrower string) error {
+	l.entries.Lock()
+	defer l.entries.Unlock()
+
+	if l.loanLimitReached(borrower) {
+		return ErrLoanLimit
+	}
+	l.unindexLoan(loan)
+	loan.NameOfBorrower = borrower
+	l.indexLoan(loan.BookTitle, loan)
+	return nil
+}
+
+// indexLoan expects the caller to hold entries, or the mutex for writing. It
+// records loan of title in the loan index and its borrower's loan count.
+func (l *Library) indexLoan(title string, loan LoanDetail) {
+	if loan.ID != "" {
+		l.loanIndex[loan.ID] = title
+	}
+	l.loanCounts[loan.NameOfBorrower]++
+}
+
+// unindexLoan undoes indexLoan, under the same locks.
+func (l *Library) unindexLoan(loan LoanDetail) {
+	if loan.ID != "" {
+		delete(l.loanIndex, loan.ID)
+	}
+	if l.loanCounts[loan.NameOfBorrower]--; l.loanCounts[loan.NameOfBorrower] <= 0 {
+		delete(l.loanCounts, loan.NameOfBorrower)
+	}
+}
+
+// Extend extends borrower's loan of title by the full extension period.
+func (l *Library) Extend(title, borrower string) (LoanDetail, error) {
+	return l.ExtendBy(title, borrower, 0)
+}
+
+// ExtendBy extends borrower's loan of title by days, which may be shorter
+// than the book's extension period; zero means the full period.
+func (l *Library) ExtendBy(title, borrower string, days int) (LoanDetail, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists || len(entry.loans) == 0 {
+		return LoanDetail{}, ErrNoLoans
+	}
+
+	for i, loan := range entry.loans {
+		if loan.NameOfBorrower == borrower {
+			if err := l.extendLoan(&entry.loans[i], days); err != nil {
+				return loan, err
+			}
+			extended := entry.loans[i]
+			l.checkTitleInvariants(title)
+
+			l.publish(EventLoanExtended, extended)
+			return extended, nil
+		}
+	}
+
+	return LoanDetail{}, fmt.Errorf("%w for this borrower", ErrLoanNotFound)
+}
+
+type ExtensionResult struct {
+	Loan     LoanDetail `json:"loan"`
+	Extended bool       `json:"extended"`
+	Reason   string     `json:"reason,omitempty"`
+	Err      error      `json:"-"` // why the loan was skipped
+}
+
+// ExtendAll extends every loan held by borrower in one atomic step, holding
+// the mutex for writing since it spans titles. Loans at the extension limit
+// are reported as skipped.
+func (l *Library) ExtendAll(borrower string) []ExtensionResult {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	results := []ExtensionResult{}
+	for _, entry := range l.titles {
+		loans := entry.loans
+		for i := range loans {
+			if loans[i].NameOfBorrower != borrower {
+				continue
+			}
+			if err := l.extendLoan(&loans[i], 0); err != nil {
+				results = append(results, ExtensionResult{Loan: loans[i], Reason: err.Error(), Err: err})
+				continue
+			}
+			results = append(results, ExtensionResult{Loan: loans[i], Extended: true})
+			l.publish(EventLoanExtended, loans[i])
+		}
+	}
+	l.checkInvariants()
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i].Loan, results[j].Loan
+		if a.BookTitle != b.BookTitle {
+			return a.BookTitle < b.BookTitle
+		}
+		return a.LoanDate.Before(b.LoanDate)
+	})
+	return results
+}
+
+// extendLoan expects the caller to hold the mutex and the lock of the loan's
+// title. It moves the return date
+// of loan by days, or by the full extension period for zero, unless someone
+// else has reserved the book.
+func (l *Library) extendLoan(loan *LoanDetail, days int) error {
+	if l.MaxExtensions > 0 && loan.Extensions >= l.MaxExtensions {
+		return ErrExtensionLimit
+	}
+	entry := l.titles[loan.BookTitle]
+	if !l.ExtendReserved && slices.ContainsFunc(entry.reservations, func(r Reservation) bool {
+		return r.Borrower != loan.NameOfBorrower
+	}) {
+		return ErrReservedByOthers
+	}
+
+	period := l.extensionPeriod(entry.book)
+	if days == 0 {
+		days = period
+	}
+	if days < 0 || days > period {
+		return fmt.Errorf("%w, must be between 1 and %d", ErrInvalidExtensionDays, period)
+	}
+
+	returnDate := l.dueDate(loan.ReturnDate.AddDate(0, 0, days))
+	if l.MaxLoanDays > 0 && returnDate.After(l.dueDate(loan.LoanDate.AddDate(0, 0, l.MaxLoanDays))) {
+		return fmt.Errorf("%w of %d days", ErrMaxLoanDuration, l.MaxLoanDays)
+	}
+
+	loan.ReturnDate = returnDate
+	loan.Extensions++
+	l.clearOverdue(loan)
+	return nil
+}
+
+// dueDate returns when a loan running until t is due: t itself, or with
+// DueEndOfDay the last second of t's day in Location.
+func (l *Library) dueDate(t time.Time) time.Time {
+	if !l.DueEndOfDay {
+		return t
+	}
+	location := l.Location
+	if location == nil {
+		location = time.UTC
+	}
+	year, month, day := t.In(location).Date()
+	return time.Date(year, month, day, 23, 59, 59, 0, location)
+}
+
+// DueWithin lists the active loans due in the next days days that aren't
+// overdue yet, soonest first.
+func (l *Library) DueWithin(days int) []LoanDetail {
+	unlock := l.lockAllTitles()
+	now := l.now()
+	until := now.AddDate(0, 0, days)
+	due := []LoanDetail{}
+	for _, entry := range l.titles {
+		for _, loan := range entry.loans {
+			if !loan.ReturnDate.Before(now) && !loan.ReturnDate.After(until) {
+				due = append(due, loan)
+			}
+		}
+	}
+	unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].ReturnDate.Before(due[j].ReturnDate) })
+	return due
+}
+
+// BorrowerLoan is an active loan with the whole days left until it's due,
+// negative once it's overdue.
+type BorrowerLoan struct {
+	LoanDetail
+	DaysRemaining int `json:"daysRemaining"`
+}
+
+// BorrowerLoans lists borrower's active loans across all titles, soonest due
+// first. It's empty rather than nil when they have nothing checked out.
+func (l *Library) BorrowerLoans(borrower string) []BorrowerLoan {
+	unlock := l.lockAllTitles()
+	now := l.now()
+	borrowed := []BorrowerLoan{}
+	for _, entry := range l.titles {
+		for _, loan := range entry.loans {
+			if loan.NameOfBorrower == borrower {
+				borrowed = append(borrowed, BorrowerLoan{LoanDetail: loan, DaysRemaining: daysRemaining(loan.ReturnDate, now)})
+			}
+		}
+	}
+	unlock()
+
+	sort.Slice(borrowed, func(i, j int) bool { return borrowed[i].ReturnDate.Before(borrowed[j].ReturnDate) })
+	return borrowed
+}
+
+// Return closes the borrower's loan of title. If they hold several copies the
+// oldest loan is closed.
+func (l *Library) Return(title, borrower string) (ReturnReceipt, error) {
+	return l.closeBorrowerLoan(title, borrower, LoanReturned)
+}
+
+// ReportLostBook is ReportLost for the borrower's oldest loan of title.
+func (l *Library) ReportLostBook(title, borrower string) (ReturnReceipt, error) {
+	return l.closeBorrowerLoan(title, borrower, LoanLost)
+}
+
+// closeBorrowerLoan closes the borrower's oldest loan of title with status.
+func (l *Library) closeBorrowerLoan(title, borrower, status string) (ReturnReceipt, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists || len(entry.loans) == 0 {
+		return ReturnReceipt{}, ErrNoLoans
+	}
+
+	loanIndex := oldestLoan(entry.loans, borrower)
+	if loanIndex == -1 {
+		return ReturnReceipt{}, fmt.Errorf("%w for this borrower", ErrLoanNotFound)
+	}
+
+	receipt, next := l.closeLoan(title, loanIndex, status)
+	l.announceReturn(receipt, next)
+	return receipt, nil
+}
+
+// oldestLoan returns the index of borrower's oldest loan in loans, or -1.
+func oldestLoan(loans []LoanDetail, borrower string) int {
+	loanIndex := -1
+	for i, loan := range loans {
+		if loan.NameOfBorrower != borrower {
+			continue
+		}
+		if loanIndex == -1 || loan.LoanDate.Before(loans[loanIndex].LoanDate) {
+			loanIndex = i
+		}
+	}
+	return loanIndex
+}
+
+// ReturnItem names a loan in a batch return, by ID or by title.
+type ReturnItem struct {
+	LoanID string `json:"loanId,omitempty"`
+	Title  string `json:"title,omitempty"`
+}
+
+type ReturnResult struct {
+	Item     ReturnItem     `json:"item"`
+	Returned bool           `json:"returned"`
+	Receipt  *ReturnReceipt `json:"receipt,omitempty"`
+	Reason   string         `json:"reason,omitempty"`
+	Err      error          `json:"-"` // why the item wasn't returned
+}
+
+// ReturnBatch closes borrower's loans for every item in one atomic step,
+// holding the mutex for writing since it spans titles. Unlike BorrowBatch it
+// is best effort: the books are already back, so items that don't match one
+// of borrower's loans are reported and the rest are still returned. Items
+// by title close the oldest loan, as Return does.
+func (l *Library) ReturnBatch(borrower string, items []ReturnItem) []ReturnResult {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	results := make([]ReturnResult, len(items))
+	for i, item := range items {
+		results[i].Item = item
+		title, loanIndex, err := l.findBatchLoan(borrower, item)
+		if err != nil {
+			results[i].Reason, results[i].Err = err.Error(), err
+			continue
+		}
+
+		receipt, next := l.closeLoan(title, loanIndex, LoanReturned)
+		l.announceReturn(receipt, next)
+		results[i].Returned, results[i].Receipt = true, &receipt
+	}
+	return results
+}
+
+// findBatchLoan expects the caller to hold the mutex. It locates the loan of
+// borrower that item names.
+func (l *Library) findBatchLoan(borrower string, item ReturnItem) (string, int, error) {
+	if item.LoanID != "" {
+		title, loanIndex := l.findLoan(item.LoanID)
+		if loanIndex == -1 || l.titles[title].loans[loanIndex].NameOfBorrower != borrower {
+			return "", -1, fmt.Errorf("%w with this ID for this borrower", ErrLoanNotFound)
+		}
+		return title, loanIndex, nil
+	}
+
+	title := l.lookupTitle(item.Title)
+	entry, exists := l.titles[title]
+	if !exists {
+		return "", -1, ErrBookNotFound
+	}
+	loanIndex := oldestLoan(entry.loans, borrower)
+	if loanIndex == -1 {
+		return "", -1, fmt.Errorf("%w for this borrower", ErrLoanNotFound)
+	}
+	return title, loanIndex, nil
+}
+
+// ReturnLoan closes the loan with the given ID.
+func (l *Library) ReturnLoan(id string) (ReturnReceipt, error) {
+	return l.closeLoanByID(id, LoanReturned)
+}
+
+// ReportLost closes the loan with the given ID for a copy that won't come
+// back. The copy is written off TotalCopies instead of returning to the
+// shelf, and the borrower is charged its replacement cost.
+func (l *Library) ReportLost(id string) (ReturnReceipt, error) {
+	return l.closeLoanByID(id, LoanLost)
+}
+
+// ReportDamaged closes the loan with the given ID for a copy that came back
+// needing repair. It is counted InRepair rather than available until an
+// update puts it back in circulation.
+func (l *Library) ReportDamaged(id string) (ReturnReceipt, error) {
+	return l.closeLoanByID(id, LoanDamaged)
+}
+
+// ReturnLoanIf, ReportLostIf and ReportDamagedIf are ReturnLoan, ReportLost
+// and ReportDamaged, but leave the loan open and return check's error if
+// check rejects it. Check runs under the title lock, so the loan it sees,
+// e.g. its borrower, can't change before the loan is closed.
+func (l *Library) ReturnLoanIf(id string, check func(LoanDetail) error) (ReturnReceipt, error) {
+	return l.closeLoanIf(id, LoanReturned, check)
+}
+
+func (l *Library) ReportLostIf(id string, check func(LoanDetail) error) (ReturnReceipt, error) {
+	return l.closeLoanIf(id, LoanLost, check)
+}
+
+func (l *Library) ReportDamagedIf(id string, check func(LoanDetail) error) (ReturnReceipt, error) {
+	return l.closeLoanIf(id, LoanDamaged, check)
+}
+
+// closeLoanByID closes the loan with the given ID with status.
+func (l *Library) closeLoanByID(id, status string) (ReturnReceipt, error) {
+	return l.closeLoanIf(id, status, nil)
+}
+
+// closeLoanIf is closeLoanByID, but leaves the loan open if check, when set,
+// rejects it as it stands once the title lock is held.
+func (l *Library) closeLoanIf(id, status string, check func(LoanDetail) error) (ReturnReceipt, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	// Find the title first so its lock can be taken, then look for the loan
+	// in it in case it was returned in between
+	l.entries.Lock()
+	title, exists := l.loanIndex[id]
+	l.entries.Unlock()
+	if !exists {
+		return ReturnReceipt{}, fmt.Errorf("%w with this ID", ErrLoanNotFound)
+	}
+
+	lock := l.titleLock(title)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := l.titles[title]
+	loanIndex := entry.indexOf(id)
+	if loanIndex == -1 {
+		return ReturnReceipt{}, fmt.Errorf("%w with this ID", ErrLoanNotFound)
+	}
+	if check != nil {
+		if err := check(entry.loans[loanIndex]); err != nil {
+			return ReturnReceipt{}, err
+		}
+	}
+
+	receipt, next := l.closeLoan(title, loanIndex, status)
+	l.announceReturn(receipt, next)
+	return receipt, nil
+}
+
+// Loan returns the active loan with the given ID. For a loan that has been
+// returned it gives the closed record from History with ErrLoanReturned.
+func (l *Library) Loan(id string) (LoanDetail, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	l.entries.Lock()
+	title, active := l.loanIndex[id]
+	l.entries.Unlock()
+	if active {
+		lock := l.titleLock(title)
+		lock.Lock()
+		entry := l.titles[title]
+		loanIndex := entry.indexOf(id)
+		var loan LoanDetail
+		if loanIndex != -1 {
+			loan = entry.loans[loanIndex]
+		}
+		lock.Unlock()
+		if loanIndex != -1 {
+			return loan, nil
+		}
+	}
+
+	// Returned, possibly since the loan index was read
+	l.entries.Lock()
+	defer l.entries.Unlock()
+	for _, loan := range l.History {
+		if loan.ID == id {
+			return loan, ErrLoanReturned
+		}
+	}
+	return LoanDetail{}, fmt.Errorf("%w with this ID", ErrLoanNotFound)
+}
+
+// CorrectBorrower fixes the borrower name on a loan, e.g. after a typo at
+// the desk. The loan is found by ID, or else by title and the borrower name
+// it was recorded under, picking their oldest loan of it as Return does.
+func (l *Library) CorrectBorrower(id, title, borrower, corrected string) (LoanDetail, error) {
+	if corrected == "" {
+		return LoanDetail{}, ErrNameRequired
+	}
+	if len(corrected) > MaxNameLength {
+		return LoanDetail{}, fmt.Errorf("%w, names can be at most %d characters", ErrNameTooLong, MaxNameLength)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	loanIndex := -1
+	if id != "" {
+		title, loanIndex = l.findLoan(id)
+	} else {
+		title = l.lookupTitle(title)
+		if entry, exists := l.titles[title]; exists {
+			loanIndex = oldestLoan(entry.loans, borrower)
+		}
+	}
+	if loanIndex == -1 {
+		return LoanDetail{}, ErrLoanNotFound
+	}
+
+	loan := &l.titles[title].loans[loanIndex]
+	l.unindexLoan(*loan)
+	loan.NameOfBorrower = corrected
+	l.indexLoan(title, *loan)
+	l.checkInvariants()
+	return *loan, nil
+}
+
+// TransferLoan hands borrower's oldest loan of title over to newBorrower, for
+// a copy that changed hands without coming back to the desk. The loan keeps
+// its ID and dates. Unlike CorrectBorrower the new borrower must be able to
+// take the loan: they are held to the loan limits, and once the library has
+// registered members they must be one.
+func (l *Library) TransferLoan(title, borrower, newBorrower string) (LoanDetail, error) {
+	if err := checkBorrowerName(newBorrower); err != nil {
+		return LoanDetail{}, err
+	}
+
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	title = l.lookupTitle(title)
+	loanIndex := -1
+	if entry, exists := l.titles[title]; exists {
+		loanIndex = oldestLoan(entry.loans, borrower)
+	}
+	if loanIndex == -1 {
+		return LoanDetail{}, fmt.Errorf("%w for this borrower", ErrLoanNotFound)
+	}
+	return l.transfer(title, loanIndex, newBorrower)
+}
+
+// TransferLoanByID hands the loan with the given ID over to newBorrower, as
+// TransferLoan does. Once transferred, the loan can only be extended or
+// returned by the new borrower.
+func (l *Library) TransferLoanByID(id, newBorrower string) (LoanDetail, error) {
+	if err := checkBorrowerName(newBorrower); err != nil {
+		return LoanDetail{}, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	title, loanIndex := l.findLoan(id)
+	if loanIndex == -1 {
+		return LoanDetail{}, fmt.Errorf("%w with this ID", ErrLoanNotFound)
+	}
+	return l.transfer(title, loanIndex, newBorrower)
+}
+
+func checkBorrowerName(name string) error {
+	if name == "" {
+		return ErrNameRequired
+	}
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("%w, names can be at most %d characters", ErrNameTooLong, MaxNameLength)
+	}
+	return nil
+}
+
+// transfer expects the caller to hold the mutex and title's lock. It moves
+// the loan at loanIndex of title to newBorrower, recording who had it before.
+func (l *Library) transfer(title string, loanIndex int, newBorrower string) (LoanDetail, error) {
+	loan := &l.titles[title].loans[loanIndex]
+	if newBorrower == loan.NameOfBorrower {
+		return *loan, nil
+	}
+	if _, exists := l.Members[newBorrower]; len(l.Members) > 0 && !exists {
+		return LoanDetail{}, ErrMemberNotFound
+	}
+	l.entries.Lock()
+	limitReached := l.loanLimitReached(newBorrower)
+	l.entries.Unlock()
+	if limitReached {
+		return LoanDetail{}, ErrLoanLimit
+	}
+	if err := l.checkTitleLoans(title, newBorrower, 1); err != nil {
+		return LoanDetail{}, err
+	}
+	// The limit is checked again as the loan is counted, in case the new
+	// borrower took out another title in between
+	if err := l.moveLoan(*loan, newBorrower); err != nil {
+		return LoanDetail{}, err
+	}
+
+	// Clip so a loan copied by Snapshot never shares the appended array
+	loan.PreviousBorrowers = append(slices.Clip(loan.PreviousBorrowers), loan.NameOfBorrower)
+	loan.NameOfBorrower = newBorrower
+	l.checkTitleInvariants(title)
+	return *loan, nil
+}
+
+// SetDueDate overrides the due date of the loan with the given ID, e.g. for
+// a semester loan or a recalled book. It ignores the extension limit, but the
+// date can't be before the loan was made, nor in the past unless force is set.
+func (l *Library) SetDueDate(id string, due time.Time, force bool) (LoanDetail, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	title, loanIndex := l.findLoan(id)
+	if loanIndex == -1 {
+		return LoanDetail{}, fmt.Errorf("%w with this ID", ErrLoanNotFound)
+	}
+
+	loan := &l.titles[title].loans[loanIndex]
+	if due.Before(loan.LoanDate) {
+		return *loan, ErrDueBeforeLoan
+	}
+	if due.Before(l.now()) && !force {
+		return *loan, ErrDueInPast
+	}
+
+	loan.ReturnDate = due
+	loan.DueOverridden = true
+	l.clearOverdue(loan)
+	l.checkInvariants()
+	return *loan, nil
+}
+
+// closeLoan expects the caller to hold the mutex and title's lock, and to
+// have checked that the loan at loanIndex exists. Status says where the copy
+// goes: back on the shelf, off the books when lost, or into repair. It
+// returns the receipt and the borrower whose reservation the returned copy
+// goes to, if any; both are for announceReturn.
+func (l *Library) closeLoan(title string, loanIndex int, status string) (ReturnReceipt, string) {
+	entry := l.titles[title]
+	closedLoan := entry.loans[loanIndex]
+	returnedAt := l.now()
+	closedLoan.ReturnedAt = returnedAt
+	closedLoan.Status = status
+
+	// Remove the loan while keeping the remaining loans in order
+	if len(entry.loans) == 1 {
+		entry.loans = nil
+	} else {
+		entry.loans = append(entry.loans[:loanIndex:loanIndex], entry.loans[loanIndex+1:]...)
+	}
+	book := &entry.book
+	book.closeCopy(closedLoan, status)
+	book.Version++
+
+	l.entries.Lock()
+	l.unindexLoan(closedLoan)
+	delete(l.reminded, closedLoan.ID)
+	l.History = append(l.History, closedLoan)
+	l.trimHistory(returnedAt)
+	replacementFee := 0
+	if status == LoanLost || status == LoanAbandoned {
+		replacementFee = l.chargeReplacement(*book, closedLoan, returnedAt)
+	}
+	l.entries.Unlock()
+
+	message := fmt.Sprintf("Book '%s' successfully returned by %s", title, closedLoan.NameOfBorrower)
+	switch status {
+	case LoanLost:
+		message = fmt.Sprintf("Copy of '%s' reported lost by %s", title, closedLoan.NameOfBorrower)
+	case LoanAbandoned:
+		message = fmt.Sprintf("Copy of '%s' never returned by %s and written off", title, closedLoan.NameOfBorrower)
+	case LoanDamaged:
+		message = fmt.Sprintf("Copy of '%s' returned damaged by %s and sent for repair", title, closedLoan.NameOfBorrower)
+	}
+	next := ""
+	if status == LoanReturned {
+		next = l.fulfillReservation(title)
+	}
+	l.checkTitleInvariants(title)
+
+	receipt := ReturnReceipt{
+		Message:        message,
+		Loan:           closedLoan,
+		ReturnedAt:     returnedAt,
+		Status:         returnStatus(closedLoan.ReturnDate, returnedAt),
+		WasOverdue:     returnedAt.After(closedLoan.ReturnDate),
+		DaysLate:       daysLate(closedLoan.ReturnDate, returnedAt),
+		Fine:           l.chargeableDays(closedLoan.ReturnDate, returnedAt) * l.FinePerDay,
+		ReplacementFee: replacementFee,
+	}
+	return receipt, next
+}
+
+// trimHistory expects the caller to hold entries, or the mutex for writing.
+// It drops the returns
+// older than HistoryRetention and then the oldest beyond MaxHistoryEntries.
+// History is resliced rather than copied, so the dropped entries are freed
+// once append next grows it.
+func (l *Library) trimHistory(now time.Time) {
+	if l.HistoryRetention > 0 {
+		cutoff := now.Add(-l.HistoryRetention)
+		kept := sort.Search(len(l.History), func(i int) bool {
+			return !l.History[i].ReturnedAt.Before(cutoff)
+		})
+		l.History = l.History[kept:]
+	}
+	if l.MaxHistoryEntries > 0 && len(l.History) > l.MaxHistoryEntries {
+		l.History = l.History[len(l.History)-l.MaxHistoryEntries:]
+	}
+}
+
+// announceReturn expects the caller to hold the title lock, or the mutex for
+// writing. It notifies the next borrower in the reservation queue and
+// publishes the return.
+func (l *Library) announceReturn(receipt ReturnReceipt, next string) {
+	title := receipt.Loan.BookTitle
+	if next != "" {
+		if err := l.Notifier.Notify(next, title); err != nil {
+			log.Printf("failed to notify %s about '%s': %v", next, title, err)
+		}
+	}
+
+	switch receipt.Loan.Status {
+	case LoanLost, LoanAbandoned:
+		l.publish(EventBookLost, receipt.Loan)
+	case LoanDamaged:
+		l.publish(EventBookDamaged, receipt.Loan)
+	default:
+		l.publish(EventBookReturned, receipt.Loan)
+	}
+	// The sweeper already announced loans it flagged
+	if receipt.WasOverdue && !receipt.Loan.Overdue {
+		l.publish(EventLoanOverdue, receipt.Loan)
+	}
+}
+
+// Reserve adds borrower to the title's reservation queue and returns their
+// position in it.
+func (l *Library) Reserve(title, borrower string) (int, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	return l.reserve(l.lookupTitle(title), borrower)
+}
+
+// reserve expects the caller to hold the mutex and title's lock. A queue
+// already MaxReservations long takes no one else.
+func (l *Library) reserve(title, borrower string) (int, error) {
+	entry, exists := l.titles[title]
+	if !exists {
+		return 0, ErrBookNotFound
+	}
+	if entry.book.Reference {
+		return 0, ErrReferenceOnly
+	}
+
+	queue := entry.reservations
+	if reservedBy(queue, borrower) != -1 {
+		return 0, ErrAlreadyReserved
+	}
+	if l.MaxReservations > 0 && len(queue) >= l.MaxReservations {
+		return 0, fmt.Errorf("%w, %d waiting", ErrReservationsFull, len(queue))
+	}
+
+	entry.reservations = append(queue, Reservation{Borrower: borrower, ReservedAt: l.now()})
+	return len(queue) + 1, nil
+}
+
+// CancelReservation takes borrower out of the title's reservation queue and
+// returns the position they had in it; everyone behind them moves up one. If
+// a copy is already held for them it is released to the next borrower in the
+// queue, who is notified, or back to the shelf, and the position is 0. It
+// runs under the title lock, as does handing a returned copy to the head of
+// the queue, so a borrower whose reservation was just fulfilled without a
+// hold gets ErrNotReserved rather than being removed twice.
+func (l *Library) CancelReservation(title, borrower string) (int, error) {
+	unlock := l.lockTitle(title)
+	defer unlock()
+
+	title = l.lookupTitle(title)
+	entry, exists := l.titles[title]
+	if !exists {
+		return 0, ErrBookNotFound
+	}
+
+	if held := reservedBy(entry.holds, borrower); held != -1 {
+		entry.holds = slices.Delete(slices.Clone(entry.holds), held, held+1)
+		if len(entry.holds) == 0 {
+			entry.holds = nil
+		}
+		if next := l.fulfillReservation(title); next != "" {
+			if err := l.Notifier.Notify(next, title); err != nil {
+				log.Printf("failed to notify %s about '%s': %v", next, title, err)
+			}
+		}
+		return 0, nil
+	}
+
+	queue := entry.reservations
+	i := reservedBy(queue, borrower)
+	if i == -1 {
+		return 0, ErrNotReserved
+	}
+	if len(queue) == 1 {
+		entry.reservations = nil
+	} else {
+		entry.reservations = slices.Delete(slices.Clone(queue), i, i+1)
+	}
+	return i + 1, nil
+}
+
+// fulfillReservation expects the caller to hold the mutex and title's lock.
+// It pops the next borrower waiting for the title, holds a copy for them, and
+// returns them, or "" if there is none.
+func (l *Library) fulfillReservation(title string) string {
+	entry := l.titles[title]
+	if len(entry.reservations) == 0 {
+		return ""
+	}
+
+	next := entry.reservations[0]
+	if len(entry.reservations) == 1 {
+		entry.reservations = nil
+	} else {
+		entry.reservations = entry.reservations[1:]
+	}
+	l.holdCopy(title, next)
+	return next.Borrower
+}
+
+// findLoan expects the caller to hold the mutex for writing. It returns the
+// title and the index of the loan within that title's loans, or -1 if no loan
+// has the ID.
+func (l *Library) findLoan(id string) (string, int) {
+	title, exists := l.loanIndex[id]
+	if !exists {
+		return "", -1
+	}
+	return title, l.titles[title].indexOf(id)
+}
+
+// indexOf returns the index of the loan with the given ID among the title's
+// loans, or -1.
+func (e *titleEntry) indexOf(id string) int {
+	return slices.IndexFunc(e.loans, func(loan LoanDetail) bool { return loan.ID == id })
+}
+
+// newID returns a random hex identifier of n bytes.
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// returnStatus classifies a return at returned against the due date.
+func returnStatus(due, returned time.Time) string {
+	switch {
+	case returned.After(due):
+		return ReturnedLate
+	case returned.Format(time.DateOnly) == due.In(returned.Location()).Format(time.DateOnly):
+		return ReturnedOnTime
+	default:
+		return ReturnedEarly
+	}
+}
+
+// daysRemaining is the number of days left until due, counting a started day
+// as a whole one, or minus the days late once it has passed.
+func daysRemaining(due, now time.Time) int {
+	if now.After(due) {
+		return -daysLate(due, now)
+	}
+	return int(math.Ceil(due.Sub(now).Hours() / 24))
+}
+
+// daysLate counts started days between the due date and the actual return.
+func daysLate(due, returned time.Time) int {
+	if !returned.After(due) {
+		return 0
+	}
+	return int(math.Ceil(returned.Sub(due).Hours() / 24))
+}
@@ -0,0 +1,49 @@
+package librarypkg
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// titleLockStripes is the number of locks titles are spread over. Titles that
+// share a stripe serialize, so it only needs to be large enough to make that
+// rare under load.
+const titleLockStripes = 64
+
+// titleLock returns the lock guarding title. It is striped by hash, so two
+// titles may share a lock, but a title always maps to the same one whatever
+// its case.
+func (l *Library) titleLock(title string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(titleKey(title)))
+	return &l.titleLocks[h.Sum32()%titleLockStripes]
+}
+
+// lockTitle takes the mutex for reading and then title's lock, which is how
+// every operation on a single title starts. It returns the matching unlock.
+func (l *Library) lockTitle(title string) (unlock func()) {
+	l.mutex.RLock()
+	lock := l.titleLock(title)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mutex.RUnlock()
+	}
+}
+
+// lockAllTitles takes the mutex for reading and then every title lock in
+// index order, for reads that need every title at rest at once. Such reads
+// run alongside each other and alongside reads of the shared state alone,
+// where the write lock would queue them. It returns the matching unlock.
+func (l *Library) lockAllTitles() (unlock func()) {
+	l.mutex.RLock()
+	for i := range l.titleLocks {
+		l.titleLocks[i].Lock()
+	}
+	return func() {
+		for i := len(l.titleLocks) - 1; i >= 0; i-- {
+			l.titleLocks[i].Unlock()
+		}
+		l.mutex.RUnlock()
+	}
+}
@@ -0,0 +1,13 @@
+package librarypkg
+
+// SetReadOnly turns maintenance mode on or off. While it is on the API
+// refuses changes with ErrReadOnly and the background sweeps skip their runs,
+// so the library stays as it is, e.g. during a migration.
+func (l *Library) SetReadOnly(readOnly bool) {
+	l.readOnly.Store(readOnly)
+}
+
+// ReadOnly reports whether maintenance mode is on.
+func (l *Library) ReadOnly() bool {
+	return l.readOnly.Load()
+}
@@ -0,0 +1,37 @@
+package librarypkg
+
+import "net/mail"
+
+// Member holds contact details for a borrower, keyed by the name used on
+// their loans.
+type Member struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// AddMember registers a member or updates the email of an existing one.
+func (l *Library) AddMember(member Member) (Member, error) {
+	if member.Name == "" {
+		return Member{}, ErrNameRequired
+	}
+	if _, err := mail.ParseAddress(member.Email); err != nil {
+		return Member{}, ErrInvalidEmail
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.Members[member.Name] = member
+	return member, nil
+}
+
+func (l *Library) Member(name string) (Member, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	member, exists := l.Members[name]
+	if !exists {
+		return Member{}, ErrMemberNotFound
+	}
+	return member, nil
+}
@@ -0,0 +1,90 @@
+package librarypkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// MetadataSource resolves an ISBN to the book's title, author and year. It
+// gives up with ctx's error once ctx is done.
+type MetadataSource interface {
+	LookupISBN(ctx context.Context, isbn string) (BookDetail, error)
+}
+
+// OpenLibrary is a MetadataSource backed by the Open Library books API.
+type OpenLibrary struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewOpenLibrary() *OpenLibrary {
+	return &OpenLibrary{
+		BaseURL: "https://openlibrary.org",
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+var yearPattern = regexp.MustCompile(`\b\d{4}\b`)
+
+func (o *OpenLibrary) LookupISBN(ctx context.Context, isbn string) (BookDetail, error) {
+	var edition struct {
+		Title       string `json:"title"`
+		PublishDate string `json:"publish_date"`
+		Authors     []struct {
+			Key string `json:"key"`
+		} `json:"authors"`
+	}
+	if err := o.get(ctx, "/isbn/"+url.PathEscape(isbn)+".json", &edition); err != nil {
+		return BookDetail{}, err
+	}
+	if edition.Title == "" {
+		return BookDetail{}, fmt.Errorf("%w: no title for ISBN %s", ErrMetadataUnavailable, isbn)
+	}
+
+	book := BookDetail{Title: edition.Title, ISBN: isbn}
+	if year := yearPattern.FindString(edition.PublishDate); year != "" {
+		book.Year, _ = strconv.Atoi(year)
+	}
+
+	// The edition only links to its authors, so fetch the first one's name
+	if len(edition.Authors) > 0 {
+		var author struct {
+			Name string `json:"name"`
+		}
+		if err := o.get(ctx, edition.Authors[0].Key+".json", &author); err == nil {
+			book.Author = author.Name
+		}
+	}
+
+	return book, nil
+}
+
+func (o *OpenLibrary) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.BaseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMetadataUnavailable, err)
+	}
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		// The caller gave up rather than Open Library failing
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %v", ErrMetadataUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrMetadataUnavailable, path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMetadataUnavailable, err)
+	}
+	return nil
+}
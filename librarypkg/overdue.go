@@ -0,0 +1,147 @@
+package librarypkg
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// SweepOverdue flags the active loans whose return date has passed and
+// publishes a loan.overdue event for each, holding the mutex for writing
+// since it spans titles. A loan is only flagged once, so repeated sweeps
+// don't repeat its event; moving its due date back into the future clears
+// the flag. It returns the number of loans newly flagged.
+func (l *Library) SweepOverdue() int {
+	if l.ReadOnly() {
+		return 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	var flagged []LoanDetail
+	for _, entry := range l.titles {
+		loans := entry.loans
+		for i := range loans {
+			if loans[i].Overdue || !loans[i].ReturnDate.Before(now) {
+				continue
+			}
+			loans[i].Overdue = true
+			flagged = append(flagged, loans[i])
+		}
+	}
+	l.overdueCount += len(flagged)
+
+	for _, loan := range flagged {
+		l.publish(EventLoanOverdue, loan)
+	}
+	return len(flagged)
+}
+
+// StartOverdueSweeper runs SweepOverdue and ExpireHolds every interval until
+// stop is called. stop returns once a sweep in progress has finished.
+func (l *Library) StartOverdueSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				l.SweepOverdue()
+				l.ExpireHolds()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// errNotAbandoned keeps CloseAbandoned from closing a loan that was extended
+// or given a new due date after it was found.
+var errNotAbandoned = errors.New("loan is no longer past the auto-close threshold")
+
+// CloseAbandoned writes off the loans more than AutoCloseDays past their
+// return date as if they were reported lost, status LoanAbandoned, and
+// returns their receipts. Loans are found under the write lock and then
+// closed one by one under their title lock, so a sweep over many loans never
+// holds up the whole library.
+func (l *Library) CloseAbandoned() []ReturnReceipt {
+	if l.AutoCloseDays <= 0 || l.ReadOnly() {
+		return nil
+	}
+	abandoned := func(loan LoanDetail, now time.Time) bool {
+		return now.After(loan.ReturnDate.AddDate(0, 0, l.AutoCloseDays))
+	}
+
+	l.mutex.Lock()
+	now := l.now()
+	var ids []string
+	for _, entry := range l.titles {
+		for _, loan := range entry.loans {
+			if abandoned(loan, now) {
+				ids = append(ids, loan.ID)
+			}
+		}
+	}
+	l.mutex.Unlock()
+
+	var receipts []ReturnReceipt
+	for _, id := range ids {
+		receipt, err := l.closeLoanIf(id, LoanAbandoned, func(loan LoanDetail) error {
+			if !abandoned(loan, l.now()) {
+				return errNotAbandoned
+			}
+			return nil
+		})
+		if err != nil {
+			continue
+		}
+		l.RecordAudit("auto-close", AuditAbandoned, receipt.Loan.BookTitle, receipt.Loan.NameOfBorrower, AuditOK)
+		log.Printf("loan %s of '%s' by %s closed as abandoned, %d days overdue", id, receipt.Loan.BookTitle, receipt.Loan.NameOfBorrower, receipt.DaysLate)
+		receipts = append(receipts, receipt)
+	}
+	return receipts
+}
+
+// StartAutoClose runs CloseAbandoned every interval until stop is called,
+// which returns once a run in progress has finished.
+func (l *Library) StartAutoClose(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				l.CloseAbandoned()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// clearOverdue unflags loan once its due date is back in the future.
+func (l *Library) clearOverdue(loan *LoanDetail) {
+	if loan.Overdue && !loan.ReturnDate.Before(l.now()) {
+		loan.Overdue = false
+	}
+}
@@ -0,0 +1,105 @@
+package librarypkg
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mailer sends a plain text email.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends mail through an SMTP server. Auth may be nil for servers
+// that don't require it.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", m.From, to, subject, body)
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(message))
+}
+
+// SendReminders emails every member with loans due within window one digest
+// listing those titles. A loan is only reminded about once per due date, so
+// extending it makes it eligible again. Loans of borrowers without a member
+// email are skipped. It returns the number of emails sent.
+func (l *Library) SendReminders(mailer Mailer, window time.Duration) int {
+	l.mutex.Lock()
+	now := l.now()
+	due := make(map[string][]LoanDetail)
+	for _, entry := range l.titles {
+		for _, loan := range entry.loans {
+			if loan.ReturnDate.Before(now) || loan.ReturnDate.After(now.Add(window)) {
+				continue
+			}
+			if reminded, ok := l.reminded[loan.ID]; ok && reminded.Equal(loan.ReturnDate) {
+				continue
+			}
+			if _, exists := l.Members[loan.NameOfBorrower]; !exists {
+				continue
+			}
+			due[loan.NameOfBorrower] = append(due[loan.NameOfBorrower], loan)
+		}
+	}
+	members := make(map[string]Member, len(due))
+	for name := range due {
+		members[name] = l.Members[name]
+	}
+	l.mutex.Unlock()
+
+	// Send without holding the lock; SMTP can be slow
+	sent := 0
+	for name, loans := range due {
+		sort.Slice(loans, func(i, j int) bool { return loans[i].ReturnDate.Before(loans[j].ReturnDate) })
+
+		var body strings.Builder
+		fmt.Fprintf(&body, "Hello %s,\n\nThe following books are due soon:\n\n", name)
+		for _, loan := range loans {
+			fmt.Fprintf(&body, "- %s, due %s\n", loan.BookTitle, loan.ReturnDate.Format("Monday 2 January 2006"))
+		}
+
+		if err := mailer.Send(members[name].Email, "Library books due soon", body.String()); err != nil {
+			log.Printf("failed to send reminder to %s: %v", name, err)
+			continue
+		}
+		sent++
+
+		l.mutex.Lock()
+		for _, loan := range loans {
+			l.reminded[loan.ID] = loan.ReturnDate
+		}
+		l.mutex.Unlock()
+	}
+
+	return sent
+}
+
+// StartReminders runs SendReminders every interval until stop is called.
+func (l *Library) StartReminders(mailer Mailer, window, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				l.SendReminders(mailer, window)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
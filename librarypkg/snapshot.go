@@ -0,0 +1,165 @@
+package librarypkg
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Snapshot is the library's whole state: its catalog, members, loans,
+// reservations, holds, history and fees. Settings such as LoanDays aren't
+// part of it, since they come from the server's flags.
+type Snapshot struct {
+	TakenAt      time.Time                `json:"takenAt"`
+	Books        map[string]BookDetail    `json:"books"`
+	Loans        map[string][]LoanDetail  `json:"loans"`
+	Reservations map[string][]Reservation `json:"reservations"`
+	Holds        map[string][]Reservation `json:"holds"` // copies held for reservations, see HoldDays
+	History      []LoanDetail             `json:"history"`
+	Members      map[string]Member        `json:"members"`
+	Fees         map[string][]Fee         `json:"fees"` // borrower -> replacement fees charged
+}
+
+// cloneLists copies m along with its slices, so the copy shares no memory
+// with the library.
+func cloneLists[K comparable, V any](m map[K][]V) map[K][]V {
+	clone := make(map[K][]V, len(m))
+	for k, list := range m {
+		clone[k] = slices.Clone(list)
+	}
+	return clone
+}
+
+// Snapshot copies the library's state with every title locked, so it is
+// consistent across titles even while loans keep coming in. Titles without
+// loans, reservations or holds are left out of those maps.
+func (l *Library) Snapshot() Snapshot {
+	unlock := l.lockAllTitles()
+	defer unlock()
+	l.entries.Lock()
+	defer l.entries.Unlock()
+
+	snapshot := Snapshot{
+		TakenAt:      l.now(),
+		Books:        make(map[string]BookDetail, len(l.titles)),
+		Loans:        make(map[string][]LoanDetail),
+		Reservations: make(map[string][]Reservation),
+		Holds:        make(map[string][]Reservation),
+		History:      slices.Clone(l.History),
+		Members:      maps.Clone(l.Members),
+		Fees:         cloneLists(l.fees),
+	}
+	for title, entry := range l.titles {
+		book := entry.book
+		book.Copies = slices.Clone(book.Copies)
+		snapshot.Books[title] = book
+		if len(entry.loans) > 0 {
+			snapshot.Loans[title] = slices.Clone(entry.loans)
+		}
+		if len(entry.reservations) > 0 {
+			snapshot.Reservations[title] = slices.Clone(entry.reservations)
+		}
+		if len(entry.holds) > 0 {
+			snapshot.Holds[title] = slices.Clone(entry.holds)
+		}
+	}
+	return snapshot
+}
+
+// Restore replaces the library's state with snapshot, as taken by Snapshot
+// on this or another server. The snapshot is checked first, and a snapshot
+// that breaks the library invariants is refused with ErrInvalidSnapshot,
+// leaving the library as it was. Due date reminders already sent for loans
+// in the snapshot aren't sent again.
+func (l *Library) Restore(snapshot Snapshot) error {
+	restored := &Library{
+		History:    slices.Clone(snapshot.History),
+		Members:    maps.Clone(snapshot.Members),
+		titles:     make(map[string]*titleEntry),
+		isbnIndex:  make(map[string]string),
+		titleIndex: make(map[string]string),
+		loanIndex:  make(map[string]string),
+		loanCounts: make(map[string]int),
+		fees:       cloneLists(snapshot.Fees),
+	}
+	if restored.Members == nil {
+		restored.Members = make(map[string]Member)
+	}
+	if err := restored.index(snapshot); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.titles, l.History, l.Members = restored.titles, restored.History, restored.Members
+	l.isbnIndex, l.titleIndex = restored.isbnIndex, restored.titleIndex
+	l.loanIndex, l.loanCounts = restored.loanIndex, restored.loanCounts
+	l.fees = restored.fees
+
+	reminded := make(map[string]time.Time)
+	for id := range l.loanIndex {
+		if due, ok := l.reminded[id]; ok {
+			reminded[id] = due
+		}
+	}
+	l.reminded = reminded
+	return nil
+}
+
+// index builds the title entries and indexes of a library being restored
+// from snapshot and checks that the snapshot's maps agree with each other and
+// with validate.
+func (l *Library) index(snapshot Snapshot) error {
+	var errs []error
+	for _, title := range slices.Sorted(maps.Keys(snapshot.Books)) {
+		book := snapshot.Books[title]
+		if book.Title != title {
+			errs = append(errs, fmt.Errorf("book '%s' is stored under '%s'", book.Title, title))
+			continue
+		}
+		if other, taken := l.titleIndex[titleKey(title)]; taken {
+			errs = append(errs, fmt.Errorf("book '%s' differs only in case from '%s'", title, other))
+		}
+		l.titleIndex[titleKey(title)] = title
+		book.Copies = slices.Clone(book.Copies)
+		l.titles[title] = &titleEntry{
+			book:         book,
+			reservations: slices.Clone(snapshot.Reservations[title]),
+			holds:        slices.Clone(snapshot.Holds[title]),
+		}
+		if book.ISBN == "" {
+			continue
+		}
+		if other, taken := l.isbnIndex[book.ISBN]; taken {
+			errs = append(errs, fmt.Errorf("book '%s' has the ISBN of '%s'", title, other))
+		}
+		l.isbnIndex[book.ISBN] = title
+	}
+
+	for _, title := range slices.Sorted(maps.Keys(snapshot.Loans)) {
+		entry, exists := l.titles[title]
+		if !exists {
+			errs = append(errs, fmt.Errorf("loans reference missing book '%s'", title))
+			continue
+		}
+		for _, loan := range snapshot.Loans[title] {
+			if loan.BookTitle != title {
+				errs = append(errs, fmt.Errorf("loan %s of '%s' is stored under '%s'", loan.ID, loan.BookTitle, title))
+			}
+			l.indexLoan(title, loan)
+		}
+		entry.loans = slices.Clone(snapshot.Loans[title])
+	}
+	for _, queues := range []map[string][]Reservation{snapshot.Reservations, snapshot.Holds} {
+		for _, title := range slices.Sorted(maps.Keys(queues)) {
+			if _, exists := l.titles[title]; !exists {
+				errs = append(errs, fmt.Errorf("reservations reference missing book '%s'", title))
+			}
+		}
+	}
+
+	return errors.Join(append(errs, l.validate())...)
+}
@@ -0,0 +1,71 @@
+package librarypkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// titleKey is the case-folded form titles are matched on, so "go programming"
+// finds "Go Programming". Books keep the title they were added with for
+// display and as their key in the maps.
+func titleKey(title string) string {
+	return strings.ToLower(title)
+}
+
+// lookupTitle expects the caller to hold the mutex. It returns the title a
+// book is catalogued under that matches title in any case, or title itself
+// when none does.
+func (l *Library) lookupTitle(title string) string {
+	if _, exists := l.titles[title]; exists {
+		return title
+	}
+	if stored, exists := l.titleIndex[titleKey(title)]; exists {
+		return stored
+	}
+	return title
+}
+
+// checkTitleFree expects the caller to hold the mutex. It fails with
+// ErrBookExists if title is taken, or ErrTitleCollision if a title differing
+// from it only in case is.
+func (l *Library) checkTitleFree(title string) error {
+	stored := l.lookupTitle(title)
+	if _, exists := l.titles[stored]; !exists {
+		return nil
+	}
+	if stored != title {
+		return fmt.Errorf("%w: '%s'", ErrTitleCollision, stored)
+	}
+	return ErrBookExists
+}
+
+// editionSuffix is what sets an edition or volume's title apart from the
+// work's: " (2nd edition)" for an edition, ", vol. 2" for a volume, or both.
+func editionSuffix(edition string, volume int) string {
+	var suffix string
+	if edition != "" {
+		suffix = " (" + edition + ")"
+	}
+	if volume > 0 {
+		suffix += fmt.Sprintf(", vol. %d", volume)
+	}
+	return suffix
+}
+
+// catalogTitle is the title book is catalogued under. Each edition and
+// volume is a book of its own, with its own copies and loans, so their
+// titles carry the edition and volume. A title that already ends with them,
+// such as one read back from the catalog, is left as it is.
+func (b BookDetail) catalogTitle() string {
+	suffix := editionSuffix(b.Edition, b.Volume)
+	if strings.HasSuffix(b.Title, suffix) {
+		return b.Title
+	}
+	return b.Title + suffix
+}
+
+// WorkTitle is the title of the work book is an edition or volume of, that
+// is its title without the edition and volume.
+func (b BookDetail) WorkTitle() string {
+	return strings.TrimSuffix(b.Title, editionSuffix(b.Edition, b.Volume))
+}
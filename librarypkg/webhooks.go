@@ -0,0 +1,233 @@
+package librarypkg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type Webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// WebhookDelivery records a single attempt to deliver an event.
+type WebhookDelivery struct {
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	Delivered  bool      `json:"delivered"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, keyed with
+// the webhook's secret.
+const SignatureHeader = "X-Library-Signature"
+
+// Webhooks delivers events to registered URLs from a fixed pool of workers,
+// so a slow receiver never holds up the library. Failed deliveries are retried
+// with exponential backoff.
+type Webhooks struct {
+	Client        *http.Client
+	MaxAttempts   int
+	Backoff       time.Duration // wait before the second attempt, doubled after each failure
+	MaxDeliveries int           // attempts and drops kept per webhook, oldest dropped first; zero keeps all
+
+	mutex      sync.Mutex
+	hooks      map[string]Webhook
+	deliveries map[string][]WebhookDelivery
+	jobs       chan webhookJob
+	closed     bool
+	workers    sync.WaitGroup
+}
+
+// DefaultMaxDeliveries is how many deliveries NewWebhooks keeps per webhook.
+const DefaultMaxDeliveries = 100
+
+type webhookJob struct {
+	hook  Webhook
+	event Event
+}
+
+func NewWebhooks(workers int) *Webhooks {
+	w := &Webhooks{
+		Client:        &http.Client{Timeout: 5 * time.Second},
+		MaxAttempts:   3,
+		Backoff:       time.Second,
+		MaxDeliveries: DefaultMaxDeliveries,
+		hooks:         make(map[string]Webhook),
+		deliveries:    make(map[string][]WebhookDelivery),
+		jobs:          make(chan webhookJob, 100),
+	}
+	for range workers {
+		w.workers.Add(1)
+		go w.work()
+	}
+	return w
+}
+
+// Register adds a webhook for the given event types. A secret is generated
+// when none is provided; it is only returned here.
+func (w *Webhooks) Register(target string, events []string, secret string) (Webhook, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidWebhook)
+	}
+	if len(events) == 0 {
+		return Webhook{}, fmt.Errorf("%w: at least one event is required", ErrInvalidWebhook)
+	}
+	for _, event := range events {
+		if !eventTypes[event] {
+			return Webhook{}, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+	}
+	if secret == "" {
+		secret = newID(32)
+	}
+
+	hook := Webhook{ID: newID(8), URL: target, Events: events, Secret: secret}
+
+	w.mutex.Lock()
+	w.hooks[hook.ID] = hook
+	w.mutex.Unlock()
+
+	return hook, nil
+}
+
+func (w *Webhooks) Deliveries(id string) ([]WebhookDelivery, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, exists := w.hooks[id]; !exists {
+		return nil, ErrWebhookNotFound
+	}
+	return append([]WebhookDelivery{}, w.deliveries[id]...), nil
+}
+
+// Publish queues event for every webhook subscribed to its type. It never
+// blocks; if the queue is full the delivery is dropped and recorded as failed.
+// Events published after Close are dropped.
+func (w *Webhooks) Publish(event Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+	for _, hook := range w.hooks {
+		if !subscribed(hook, event.Type) {
+			continue
+		}
+		select {
+		case w.jobs <- webhookJob{hook: hook, event: event}:
+		default:
+			log.Printf("webhook %s: queue full, dropping %s", hook.ID, event.Type)
+			w.record(hook.ID, WebhookDelivery{
+				Event: event.Type,
+				Error: "queue full",
+				At:    time.Now(),
+			})
+		}
+	}
+}
+
+// Close stops accepting events and waits for queued deliveries to finish.
+// Closing again does nothing.
+func (w *Webhooks) Close() {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.jobs)
+	}
+	w.mutex.Unlock()
+	w.workers.Wait()
+}
+
+func (w *Webhooks) work() {
+	defer w.workers.Done()
+	for job := range w.jobs {
+		w.deliver(job)
+	}
+}
+
+func (w *Webhooks) deliver(job webhookJob) {
+	body, err := json.Marshal(job.event)
+	if err != nil {
+		log.Printf("webhook %s: encoding %s: %v", job.hook.ID, job.event.Type, err)
+		return
+	}
+
+	mac := hmac.New(sha256.New, []byte(job.hook.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := w.Backoff
+	for attempt := 1; attempt <= w.MaxAttempts; attempt++ {
+		delivery := WebhookDelivery{Event: job.event.Type, Attempt: attempt}
+
+		req, err := http.NewRequest("POST", job.hook.URL, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(SignatureHeader, signature)
+
+			var resp *http.Response
+			resp, err = w.Client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				delivery.StatusCode = resp.StatusCode
+				delivery.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+			}
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		} else if !delivery.Delivered {
+			delivery.Error = fmt.Sprintf("receiver returned %d", delivery.StatusCode)
+		}
+		delivery.At = time.Now()
+
+		w.mutex.Lock()
+		w.record(job.hook.ID, delivery)
+		w.mutex.Unlock()
+
+		if delivery.Delivered {
+			return
+		}
+		log.Printf("webhook %s: attempt %d of %s failed: %s", job.hook.ID, attempt, job.event.Type, delivery.Error)
+		if attempt < w.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// record expects the caller to hold the mutex. It adds delivery to the log of
+// webhook id, dropping the oldest beyond MaxDeliveries. The log is resliced
+// rather than copied, so the dropped entries are freed once append next grows
+// it.
+func (w *Webhooks) record(id string, delivery WebhookDelivery) {
+	deliveries := append(w.deliveries[id], delivery)
+	if w.MaxDeliveries > 0 && len(deliveries) > w.MaxDeliveries {
+		deliveries = deliveries[len(deliveries)-w.MaxDeliveries:]
+	}
+	w.deliveries[id] = deliveries
+}
+
+func subscribed(hook Webhook, eventType string) bool {
+	for _, event := range hook.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -1,247 +1,1891 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"sync"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
+
+	"Library/librarypkg"
 )
 
-type BookDetail struct {
-	Title           string `json:"title"`
-	AvailableCopies int    `json:"availableCopies"`
+type server struct {
+	library     *librarypkg.Library
+	idempotency *idempotencyCache // nil ignores Idempotency-Key headers
+	timeout     time.Duration     // how long a request may take; zero for no limit
+	metrics     *httpMetrics      // nil turns off metricsPath
+}
+
+func main() {
+	library := librarypkg.NewLibrary()
+
+	flag.BoolVar(&library.Debug, "debug", false, "validate library invariants after every mutation")
+	flag.IntVar(&library.MaxExtensions, "max-extensions", librarypkg.DefaultMaxExtensions, "maximum extensions per loan, 0 for unlimited")
+	flag.BoolVar(&library.ExtendReserved, "extend-reserved", false, "allow extending loans of books other borrowers have reserved")
+	flag.IntVar(&library.LoanDays, "loan-days", librarypkg.DefaultLoanDays, "days a loan runs, unless the book or its category sets its own")
+	flag.IntVar(&library.ExtensionDays, "extension-days", librarypkg.DefaultExtensionDays, "days an extension adds, unless the book or its category sets its own")
+	readOnly := flag.Bool("read-only", false, "start in maintenance mode, refusing changes until POST /admin/maintenance turns it off")
+	seedFile := flag.String("seed", "", "JSON or CSV file of books to start with when the library is empty")
+	categoriesFile := flag.String("categories", "", "JSON file mapping book categories to their loanDays and extensionDays, replacing the defaults")
+	flag.IntVar(&library.MaxLoanDays, "max-loan-days", 0, "maximum total loan length in days including extensions, 0 for unlimited")
+	flag.BoolVar(&library.DueEndOfDay, "due-end-of-day", false, "make loans and extensions due at 23:59:59 of their last day in -timezone")
+	timezone := flag.String("timezone", "UTC", "the library's time zone, such as Europe/Berlin, for -due-end-of-day")
+	flag.IntVar(&library.MaxLoansPerBorrower, "max-loans", 0, "maximum books a borrower can have out at once, 0 for unlimited")
+	flag.IntVar(&library.MaxCopiesPerBorrowerPerTitle, "max-copies-per-title", librarypkg.DefaultMaxCopiesPerTitle, "maximum copies of one book a borrower can have out at once, 0 for unlimited")
+	flag.IntVar(&library.MaxCopies, "max-copies", librarypkg.DefaultMaxCopies, "maximum copies of one book, 0 for unlimited")
+	flag.IntVar(&library.MaxHistoryEntries, "max-history", 0, "returned loans kept in the history, oldest dropped first, 0 for unlimited")
+	flag.DurationVar(&library.HistoryRetention, "history-retention", 0, "drop returned loans from the history after this long, e.g. 8760h, 0 to keep them")
+	flag.IntVar(&library.FinePerDay, "fine-per-day", librarypkg.DefaultFinePerDay, "fine in cents per overdue day")
+	flag.IntVar(&library.GraceDays, "grace-days", 0, "days a loan can be overdue before fines accrue")
+	flag.IntVar(&library.ReplacementFee, "replacement-fee", 0, "fee in cents for a lost copy of a book without its own replacement cost")
+	flag.IntVar(&library.AutoCloseDays, "auto-close-days", 0, "write off loans this many days overdue as abandoned, charging the replacement fee, 0 to never")
+	flag.IntVar(&library.MaxReservations, "max-reservations", 0, "maximum borrowers queued for one book, 0 for unlimited")
+	flag.IntVar(&library.HoldDays, "hold-days", 0, "days a returned copy is held for the next reservation before passing to the one after, 0 to not hold copies")
+	autoCloseInterval := flag.Duration("auto-close-interval", 6*time.Hour, "how often to look for loans to write off with -auto-close-days")
+	openLibraryURL := flag.String("openlibrary-url", "https://openlibrary.org", "base URL of the Open Library API used to enrich books by ISBN")
+	notify := flag.Bool("notify-log", false, "log reservation notifications")
+	webhookWorkers := flag.Int("webhook-workers", 4, "number of workers delivering webhook events")
+	var webhookURLs []string
+	flag.Func("webhook", "URL to send loan events to, may be repeated; more can be registered with POST /admin/webhooks", func(target string) error {
+		webhookURLs = append(webhookURLs, target)
+		return nil
+	})
+	webhookSecret := flag.String("webhook-secret", "", "secret signing the events sent to -webhook URLs, random when empty")
+	natsURL := flag.String("nats-url", "", "NATS server to publish loan events to as library.loans.<event>, e.g. nats://localhost:4222; off when empty")
+	smtpAddr := flag.String("smtp-addr", "", "SMTP server (host:port) for due date reminders; reminders are off when empty")
+	smtpFrom := flag.String("smtp-from", "library@localhost", "sender address for reminder emails")
+	smtpUser := flag.String("smtp-user", "", "SMTP username, if the server requires authentication")
+	smtpPassword := flag.String("smtp-password", "", "SMTP password")
+	grpcAddr := flag.String("grpc-addr", "", "address for the gRPC API, e.g. :3001; off when empty")
+	protectReads := flag.Bool("auth-reads", false, "also require the API token for read requests")
+	tokensFile := flag.String("tokens", "", "JSON file of API tokens with librarian or member roles")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 24*time.Hour, "how long responses to requests with an Idempotency-Key are kept for retries")
+	idempotencySize := flag.Int("idempotency-size", 10000, "most Idempotency-Key responses kept, oldest dropped first, 0 for unlimited")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 5*time.Second, "how long a client may take to send the request headers, 0 for no limit")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "how long a client may take to send the whole request, 0 for no limit")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "how long writing a response may take from the end of the request headers, except for /events, 0 for no limit")
+	requestTimeout := flag.Duration("request-timeout", 30*time.Second, "how long a handler may wait on metadata lookups and long scans before answering 503, 0 for no limit")
+	corsOrigins := flag.String("cors-origins", "", "comma-separated origins allowed to call the API from a browser, or * for any")
+	auditSize := flag.Int("audit-size", librarypkg.DefaultAuditSize, "number of audit log entries kept in memory")
+	auditFile := flag.String("audit-file", "", "also append audit log entries to this file as JSON lines")
+	overdueSweep := flag.Duration("overdue-sweep", time.Hour, "how often to flag overdue loans, sending their loan.overdue events, and expire -hold-days holds, 0 to disable")
+	reminderWindow := flag.Duration("reminder-window", 72*time.Hour, "remind members about loans due within this window")
+	flag.Parse()
+	library.SetReadOnly(*readOnly)
+
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("timezone: %v", err)
+	}
+	library.Location = location
+
+	if *seedFile != "" {
+		books, err := librarypkg.LoadSeed(*seedFile)
+		if err != nil {
+			log.Fatalf("seed: %v", err)
+		}
+		if _, err := library.Seed(books); err != nil {
+			log.Fatalf("seed %s: %v", *seedFile, err)
+		}
+	}
+	if *categoriesFile != "" {
+		categories, err := loadCategories(*categoriesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		library.Categories = categories
+	}
+	if *notify {
+		library.Notifier = librarypkg.LogNotifier{}
+	}
+	openLibrary := librarypkg.NewOpenLibrary()
+	openLibrary.BaseURL = *openLibraryURL
+	library.Metadata = openLibrary
+	library.Webhooks = librarypkg.NewWebhooks(*webhookWorkers)
+	for _, target := range webhookURLs {
+		if _, err := library.Webhooks.Register(target, loanEvents, *webhookSecret); err != nil {
+			log.Fatalf("webhook %s: %v", target, err)
+		}
+	}
+	if *natsURL != "" {
+		publisher, err := librarypkg.NewNATSPublisher(*natsURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer publisher.Close()
+		library.Publisher = publisher
+	}
+	library.Audit = librarypkg.NewAuditLog(*auditSize)
+	if *auditFile != "" {
+		file, err := os.OpenFile(*auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		library.Audit.Writer = file
+	}
+
+	if *smtpAddr != "" {
+		mailer := librarypkg.SMTPMailer{Addr: *smtpAddr, From: *smtpFrom}
+		if *smtpUser != "" {
+			host, _, _ := strings.Cut(*smtpAddr, ":")
+			mailer.Auth = smtp.PlainAuth("", *smtpUser, *smtpPassword, host)
+		}
+		library.StartReminders(mailer, *reminderWindow, 24*time.Hour)
+	}
+
+	srv := &server{library: library, idempotency: newIdempotencyCache(*idempotencyTTL, *idempotencySize, time.Now), timeout: *requestTimeout, metrics: newHTTPMetrics()}
+
+	var tokens []apiToken
+	if *tokensFile != "" {
+		var err error
+		if tokens, err = loadTokens(*tokensFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if token := os.Getenv("LIBRARY_API_TOKEN"); token != "" {
+		tokens = append(tokens, apiToken{Token: token, Role: roleLibrarian})
+	}
+
+	var grpcSrv *grpc.Server
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcSrv = newGRPCServer(library, tokens, *protectReads)
+		go func() {
+			fmt.Printf("Starting gRPC server on %s...\n", *grpcAddr)
+			if err := grpcSrv.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	var handler http.Handler = recoverPanics(srv.routes())
+	if len(tokens) > 0 {
+		handler = requireToken(tokens, *protectReads, handler)
+	} else {
+		log.Println("No API tokens are configured, the API is open to everyone")
+	}
+	handler = compressResponses(handler)
+	if origins := parseOrigins(*corsOrigins); len(origins) > 0 {
+		handler = allowCORS(origins, handler)
+	}
+
+	httpServer := &http.Server{
+		Addr:              ":3000",
+		Handler:           handler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+	}
+	// Event streams never finish on their own, so end them before waiting
+	// for in-flight requests
+	httpServer.RegisterOnShutdown(library.Events.Close)
+	var stopJobs []func()
+	if *overdueSweep > 0 {
+		stopJobs = append(stopJobs, library.StartOverdueSweeper(*overdueSweep))
+	}
+	if library.AutoCloseDays > 0 {
+		stopJobs = append(stopJobs, library.StartAutoClose(*autoCloseInterval))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// ListenAndServe returns as soon as Shutdown starts, so wait for
+	// in-flight requests to drain before stopping what they publish to
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
+	fmt.Printf("Starting e-Library server %s (commit %s, built %s) on :3000...\n", version, commit, buildDate)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	for _, stopJob := range stopJobs {
+		stopJob()
+	}
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
+	library.Webhooks.Close()
 }
 
-type LoanDetail struct {
-	BookTitle      string    `json:"bookTitle"`
-	NameOfBorrower string    `json:"nameOfBorrower"`
-	LoanDate       time.Time `json:"loanDate"`
-	ReturnDate     time.Time `json:"returnDate"`
+// loanEvents are the events sent to the URLs given with -webhook.
+var loanEvents = []string{librarypkg.EventBookBorrowed, librarypkg.EventLoanExtended, librarypkg.EventBookReturned, librarypkg.EventLoanOverdue}
+
+// loadCategories reads the category periods from a JSON object keyed by
+// category, e.g. {"reference": {"loanDays": 7, "extensionDays": 7}}.
+func loadCategories(path string) (map[string]librarypkg.CategoryPeriods, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var categories map[string]librarypkg.CategoryPeriods
+	if err := json.Unmarshal(data, &categories); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, periods := range categories {
+		if periods.LoanDays < 0 || periods.ExtensionDays < 0 {
+			return nil, fmt.Errorf("%s: category %q has a negative period", path, name)
+		}
+	}
+	return categories, nil
 }
 
-type Library struct {
-	Books map[string]BookDetail
-	Loans map[string][]LoanDetail
-	mutex sync.RWMutex
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	for _, route := range s.routeTable() {
+		handler := allowMethods(route.methods(), s.refuseInMaintenance(s.withTimeout(route.handler)))
+		mux.HandleFunc(route.pattern, s.instrument(route.pattern, handler))
+	}
+
+	return mux
 }
 
-func NewLibrary() *Library {
-	lib := &Library{
-		Books: make(map[string]BookDetail),
-		Loans: make(map[string][]LoanDetail),
+// allowMethods answers OPTIONS with a 204 listing methods in the Allow
+// header, and any other method not among them with a 405 carrying the same
+// header, before the request reaches next.
+func allowMethods(methods []string, next http.HandlerFunc) http.HandlerFunc {
+	allow := strings.Join(append(slices.Clone(methods), http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodOptions:
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		case !slices.Contains(methods, r.Method):
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			next(w, r)
+		}
 	}
+}
 
-	lib.Books["Go Programming"] = BookDetail{Title: "Go Programming", AvailableCopies: 3}
-	lib.Books["Clean Code"] = BookDetail{Title: "Clean Code", AvailableCopies: 2}
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
 
-	return lib
+func writeFieldErrors(w http.ResponseWriter, status int, errs []fieldError) {
+	writeJSON(w, status, map[string][]fieldError{"errors": errs})
 }
 
-func main() {
-	library := NewLibrary()
+// writeJSON encodes v to the client. Handlers only pass it values already
+// copied out of the library, never while holding a lock, so a slow client
+// can't hold up borrows and returns.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// errorStatuses maps domain errors to HTTP status codes and the stable error
+// codes sent in the X-Error-Code header. Anything not listed is an internal
+// error.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{librarypkg.ErrBookNotFound, http.StatusNotFound, "BOOK_NOT_FOUND"},
+	{librarypkg.ErrNoLoans, http.StatusNotFound, "NO_LOANS"},
+	{librarypkg.ErrLoanNotFound, http.StatusNotFound, "LOAN_NOT_FOUND"},
+	{librarypkg.ErrLoanReturned, http.StatusNotFound, "LOAN_RETURNED"},
+	{librarypkg.ErrWebhookNotFound, http.StatusNotFound, "WEBHOOK_NOT_FOUND"},
+	{librarypkg.ErrMemberNotFound, http.StatusNotFound, "MEMBER_NOT_FOUND"},
+	{librarypkg.ErrNotReserved, http.StatusNotFound, "NOT_RESERVED"},
+	{librarypkg.ErrNoCopies, http.StatusConflict, "NO_COPIES"},
+	{librarypkg.ErrAlreadyReserved, http.StatusConflict, "ALREADY_RESERVED"},
+	{librarypkg.ErrReservationsFull, http.StatusConflict, "RESERVATIONS_FULL"},
+	{librarypkg.ErrBookExists, http.StatusConflict, "BOOK_EXISTS"},
+	{librarypkg.ErrTitleCollision, http.StatusConflict, "TITLE_COLLISION"},
+	{librarypkg.ErrISBNExists, http.StatusConflict, "ISBN_EXISTS"},
+	{librarypkg.ErrExtensionLimit, http.StatusConflict, "EXTENSION_LIMIT"},
+	{librarypkg.ErrReservedByOthers, http.StatusConflict, "RESERVED_BY_OTHERS"},
+	{librarypkg.ErrLoanLimit, http.StatusConflict, "LOAN_LIMIT"},
+	{librarypkg.ErrTitleLoanLimit, http.StatusConflict, "TITLE_LOAN_LIMIT"},
+	{librarypkg.ErrBookOnLoan, http.StatusConflict, "BOOK_ON_LOAN"},
+	{librarypkg.ErrBookHasHistory, http.StatusConflict, "BOOK_HAS_HISTORY"},
+	{librarypkg.ErrTotalBelowLoans, http.StatusConflict, "TOTAL_BELOW_LOANS"},
+	{librarypkg.ErrBookArchived, http.StatusConflict, "BOOK_ARCHIVED"},
+	{librarypkg.ErrReferenceOnly, http.StatusConflict, "REFERENCE_ONLY"},
+	{librarypkg.ErrMaxLoanDuration, http.StatusConflict, "MAX_LOAN_DURATION"},
+	{librarypkg.ErrBatchUnavailable, http.StatusConflict, "BATCH_UNAVAILABLE"},
+	{librarypkg.ErrVersionMismatch, http.StatusPreconditionFailed, "VERSION_MISMATCH"},
+	{librarypkg.ErrNegativeCopies, http.StatusBadRequest, "NEGATIVE_COPIES"},
+	{librarypkg.ErrCopiesOutOfRange, http.StatusBadRequest, "COPIES_OUT_OF_RANGE"},
+	{librarypkg.ErrNameTooLong, http.StatusBadRequest, "NAME_TOO_LONG"},
+	{librarypkg.ErrTitleRequired, http.StatusBadRequest, "TITLE_REQUIRED"},
+	{librarypkg.ErrInvalidISBN, http.StatusBadRequest, "INVALID_ISBN"},
+	{librarypkg.ErrInvalidLoanDays, http.StatusBadRequest, "INVALID_LOAN_DAYS"},
+	{librarypkg.ErrInvalidWebhook, http.StatusBadRequest, "INVALID_WEBHOOK"},
+	{librarypkg.ErrNameRequired, http.StatusBadRequest, "NAME_REQUIRED"},
+	{librarypkg.ErrInvalidEmail, http.StatusBadRequest, "INVALID_EMAIL"},
+	{librarypkg.ErrInvalidExtensionDays, http.StatusBadRequest, "INVALID_EXTENSION_DAYS"},
+	{librarypkg.ErrNegativeCost, http.StatusBadRequest, "NEGATIVE_COST"},
+	{librarypkg.ErrDueBeforeLoan, http.StatusBadRequest, "DUE_BEFORE_LOAN"},
+	{librarypkg.ErrDueInPast, http.StatusBadRequest, "DUE_IN_PAST"},
+	{librarypkg.ErrInvalidSnapshot, http.StatusBadRequest, "INVALID_SNAPSHOT"},
+	{librarypkg.ErrInvalidVolume, http.StatusBadRequest, "INVALID_VOLUME"},
+	{librarypkg.ErrMetadataUnavailable, http.StatusUnprocessableEntity, "METADATA_UNAVAILABLE"},
+	{librarypkg.ErrInvalidImport, http.StatusUnprocessableEntity, "INVALID_IMPORT"},
+	{librarypkg.ErrReadOnly, http.StatusServiceUnavailable, "MAINTENANCE"},
+	{context.DeadlineExceeded, http.StatusServiceUnavailable, "TIMEOUT"},
+	{context.Canceled, http.StatusServiceUnavailable, "CANCELED"}, // the client left, so nobody reads this
+}
 
-	http.HandleFunc("/Book", library.getBookHandler)
-	http.HandleFunc("/Borrow", library.borrowBookHandler)
-	http.HandleFunc("/Extend", library.extendLoanHandler)
-	http.HandleFunc("/Return", library.returnBookHandler)
+// errorCodeHeader lets clients tell errors apart without parsing messages.
+const errorCodeHeader = "X-Error-Code"
 
-	fmt.Println("Starting e-Library server on :3000...")
-	log.Fatal(http.ListenAndServe(":3000", nil))
+func errorStatus(err error) int {
+	status, _ := errorMapping(err)
+	return status
 }
 
-func (l *Library) getBookHandler(w http.ResponseWriter, r *http.Request) {
+func errorMapping(err error) (int, string) {
+	for _, mapping := range errorStatuses {
+		if errors.Is(err, mapping.err) {
+			return mapping.status, mapping.code
+		}
+	}
+	return http.StatusInternalServerError, "INTERNAL"
+}
+
+// errorResponse is the body of an error for clients that asked for XML, and
+// of the JSON 500 sent after a panic; other errors are sent as plain text.
+type errorResponse struct {
+	Code    string `json:"code" xml:"code"`
+	Message string `json:"message" xml:"message"`
+}
+
+// writeError sends err with the status code and error code matching its
+// domain error. The domain messages are lower case, so the first letter is
+// capitalised to match the other error responses.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorMapping(err)
+	w.Header().Set(errorCodeHeader, code)
+	message := err.Error()
+	message = strings.ToUpper(message[:1]) + message[1:]
+	if status == http.StatusInternalServerError {
+		log.Printf("unexpected error: %v", err)
+		message = "Internal server error"
+	}
+
+	if useXML, _ := preferredFormat(r.Header.Get("Accept")); useXML {
+		varyAccept(w)
+		writeXML(w, status, "error", errorResponse{Code: code, Message: message})
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func (s *server) bookHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getBookHandler(w, r)
+	case http.MethodPost:
+		s.createBookHandler(w, r)
+	case http.MethodPut:
+		s.putBookHandler(w, r)
+	case http.MethodPatch:
+		s.patchBookHandler(w, r)
+	case http.MethodDelete:
+		s.deleteBookHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) getBookHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if _, ok := negotiateXML(w, r); !ok {
+		return
+	}
+
 	title := r.URL.Query().Get("title")
 	if title == "" {
 		http.Error(w, "Title query parameter is required", http.StatusBadRequest)
 		return
 	}
+	s.writeBook(w, r, title)
+}
+
+// bookByPathHandler serves GET /books/{title}, for clients and proxies that
+// mangle spaces and other characters in query strings. The mux matches on
+// the escaped path and decodes the segment, so a title with a slash is sent
+// with it encoded as %2F.
+func (s *server) bookByPathHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	l.mutex.RLock()
-	book, exists := l.Books[title]
-	l.mutex.RUnlock()
+	if _, ok := negotiateXML(w, r); !ok {
+		return
+	}
 
-	if !exists {
-		http.Error(w, "Book not found", http.StatusNotFound)
+	title := r.PathValue("title")
+	if title == "" {
+		http.Error(w, "Title is required", http.StatusBadRequest)
 		return
 	}
+	s.writeBook(w, r, title)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(book)
+// writeBook answers with the book matching title in any case, as GET /Book
+// does.
+func (s *server) writeBook(w http.ResponseWriter, r *http.Request, title string) {
+	book, err := s.library.Book(title)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	response := bookResponse{BookDetail: book}
+	if availability, err := s.library.Availability(book.Title); err == nil {
+		response.NextAvailableDate = availability.NextAvailableDate
+		response.QueueLength = availability.QueueLength
+	}
+	w.Header().Set("ETag", bookETag(book))
+	writeResponse(w, r, http.StatusOK, response)
+}
+
+// bookResponse is a book as GET /Book serves it: with the date a copy is
+// due back while none is on the shelf, and how many borrowers are queued for
+// it.
+type bookResponse struct {
+	librarypkg.BookDetail
+	NextAvailableDate *time.Time `json:"nextAvailableDate,omitempty" xml:"nextAvailableDate,omitempty"`
+	QueueLength       int        `json:"queueLength,omitempty" xml:"queueLength,omitempty"`
+}
+
+// noCopiesResponse is the 409 body of a borrow refused for want of copies,
+// telling the borrower when to come back.
+type noCopiesResponse struct {
+	Code              string     `json:"code" xml:"code"`
+	Message           string     `json:"message" xml:"message"`
+	NextAvailableDate *time.Time `json:"nextAvailableDate,omitempty" xml:"nextAvailableDate,omitempty"`
+	QueueLength       int        `json:"queueLength,omitempty" xml:"queueLength,omitempty"`
+}
+
+// writeBorrowError is writeError for a failed borrow of title. A NO_COPIES
+// error also says when a copy is due back and how many are queued for it.
+func (s *server) writeBorrowError(w http.ResponseWriter, r *http.Request, title string, err error) {
+	if !errors.Is(err, librarypkg.ErrNoCopies) {
+		writeError(w, r, err)
+		return
+	}
+	availability, lookupErr := s.library.Availability(title)
+	if lookupErr != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	status, code := errorMapping(err)
+	w.Header().Set(errorCodeHeader, code)
+	message := err.Error()
+	writeResponse(w, r, status, noCopiesResponse{
+		Code:              code,
+		Message:           strings.ToUpper(message[:1]) + message[1:],
+		NextAvailableDate: availability.NextAvailableDate,
+		QueueLength:       availability.QueueLength,
+	})
 }
 
-func (l *Library) borrowBookHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) createBookHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var request struct {
-		Title    string `json:"title"`
-		Borrower string `json:"borrower"`
+	var request bookRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	// With enrich=true a bare ISBN is enough; the rest comes from Open Library
+	if r.URL.Query().Get("enrich") == "true" && request.Title == "" && request.ISBN != "" {
+		book, created, err := s.library.AddBookByISBN(r.Context(), request.ISBN, request.AvailableCopies)
+		s.audit(r, librarypkg.AuditAddBook, book.Title, "", err)
+		if errors.Is(err, librarypkg.ErrMetadataUnavailable) {
+			http.Error(w, "Could not look up the ISBN, please provide the title, author and year manually", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		w.Header().Set("ETag", bookETag(book))
+		writeResponse(w, r, status, book)
+		return
+	}
+
+	book, err := s.library.AddBook(request.BookDetail)
+	s.audit(r, librarypkg.AuditAddBook, request.Title, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", bookETag(book))
+	writeResponse(w, r, http.StatusCreated, book)
+}
+
+// Filter narrows a book listing. Zero values match everything.
+type Filter struct {
+	Title           string // the work's title, matching all its editions and volumes
+	Author          string
+	YearFrom        int
+	YearTo          int
+	IncludeArchived bool
+}
+
+// filterBooks keeps the books matching every set field of f. Title matching
+// is case-insensitive and author matching a case-insensitive substring match.
+func filterBooks(books []librarypkg.BookDetail, f Filter) []librarypkg.BookDetail {
+	author := strings.ToLower(f.Author)
+
+	filtered := []librarypkg.BookDetail{}
+	for _, book := range books {
+		if book.Archived && !f.IncludeArchived {
+			continue
+		}
+		if f.Title != "" && !strings.EqualFold(book.WorkTitle(), f.Title) {
+			continue
+		}
+		if author != "" && !strings.Contains(strings.ToLower(book.Author), author) {
+			continue
+		}
+		if f.YearFrom != 0 && book.Year < f.YearFrom {
+			continue
+		}
+		if f.YearTo != 0 && (book.Year == 0 || book.Year > f.YearTo) {
+			continue
+		}
+		filtered = append(filtered, book)
+	}
+	return filtered
+}
+
+type bookPage struct {
+	Books  []librarypkg.BookDetail `json:"books" xml:"books>book"`
+	Total  int                     `json:"total" xml:"total"`
+	Limit  int                     `json:"limit" xml:"limit"`
+	Offset int                     `json:"offset" xml:"offset"`
+}
+
+// intParam parses the integer query parameter name, or returns fallback when
+// it is absent. A value that isn't an integer is added to errs.
+func intParam(query url.Values, name string, fallback int, errs *[]fieldError) int {
+	value := query.Get(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		*errs = append(*errs, fieldError{Field: name, Message: "must be an integer"})
+		return fallback
+	}
+	return n
+}
+
+// pageParams parses the limit and offset query parameters of a paginated
+// listing, 50 and 0 when absent.
+func pageParams(query url.Values) (limit, offset int, errs []fieldError) {
+	limit = intParam(query, "limit", 50, &errs)
+	offset = intParam(query, "offset", 0, &errs)
+	if limit < 1 || limit > 1000 {
+		errs = append(errs, fieldError{Field: "limit", Message: "must be between 1 and 1000"})
+	}
+	if offset < 0 {
+		errs = append(errs, fieldError{Field: "offset", Message: "must not be negative"})
+	}
+	return limit, offset, errs
+}
+
+// pageBounds returns the slice bounds of the page of n items starting at
+// offset, clamped to n.
+func pageBounds(n, limit, offset int) (start, end int) {
+	start = min(offset, n)
+	end = min(start+limit, n)
+	return start, end
+}
+
+func (s *server) listBooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := negotiateXML(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	var errs []fieldError
+
+	filter := Filter{
+		Title:    query.Get("title"),
+		Author:   query.Get("author"),
+		YearFrom: intParam(query, "yearFrom", 0, &errs),
+		YearTo:   intParam(query, "yearTo", 0, &errs),
+
+		IncludeArchived: query.Get("includeArchived") == "true" && isLibrarian(r),
+	}
+	if filter.YearFrom != 0 && filter.YearTo != 0 && filter.YearFrom > filter.YearTo {
+		errs = append(errs, fieldError{Field: "yearFrom", Message: "must not be after yearTo"})
+	}
+	limit, offset, pageErrs := pageParams(query)
+	errs = append(errs, pageErrs...)
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	books := filterBooks(s.library.ListBooks(), filter)
+
+	page := bookPage{Total: len(books), Limit: limit, Offset: offset}
+	start, end := pageBounds(len(books), limit, offset)
+	page.Books = books[start:end]
+
+	writeResponse(w, r, http.StatusOK, page)
+}
+
+func (s *server) bookByISBNHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if request.Title == "" || request.Borrower == "" {
-		http.Error(w, "Title and borrower are required", http.StatusBadRequest)
+	book, err := s.library.BookByISBN(r.PathValue("isbn"))
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+	w.Header().Set("ETag", bookETag(book))
+	writeResponse(w, r, http.StatusOK, book)
+}
 
-	book, exists := l.Books[request.Title]
-	if !exists {
-		http.Error(w, "Book not found", http.StatusNotFound)
+func (s *server) patchBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if book.AvailableCopies <= 0 {
-		http.Error(w, "No copies available", http.StatusConflict)
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		http.Error(w, "Title query parameter is required", http.StatusBadRequest)
 		return
 	}
 
-	book.AvailableCopies--
-	l.Books[request.Title] = book
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
 
-	now := time.Now()
-	loan := LoanDetail{
-		BookTitle:      request.Title,
-		NameOfBorrower: request.Borrower,
-		LoanDate:       now,
-		ReturnDate:     now.AddDate(0, 0, 28), // 4 weeks loan period
+	var request bookUpdateRequest
+	if !decodeRequest(w, r, &request) {
+		return
 	}
 
-	l.Loans[request.Title] = append(l.Loans[request.Title], loan)
+	book, err := s.library.UpdateBook(title, version, request.BookUpdate)
+	s.audit(r, librarypkg.AuditUpdateBook, title, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(loan)
+	w.Header().Set("ETag", bookETag(book))
+	writeResponse(w, r, http.StatusOK, book)
 }
 
-func (l *Library) extendLoanHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+func (s *server) putBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var request struct {
-		Title    string `json:"title"`
-		Borrower string `json:"borrower"`
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		http.Error(w, "Title query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	var request bookRequest
+	if !decodeRequest(w, r, &request) {
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	book, err := s.library.ReplaceBook(title, version, request.BookDetail)
+	s.audit(r, librarypkg.AuditUpdateBook, title, "", err)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if request.Title == "" || request.Borrower == "" {
-		http.Error(w, "Title and borrower are required", http.StatusBadRequest)
+	w.Header().Set("ETag", bookETag(book))
+	writeResponse(w, r, http.StatusOK, book)
+}
+
+// deleteBookHandler archives a book, keeping it for loan histories and
+// statistics. With hard=true it removes the book instead, which only works
+// for books that were never borrowed.
+func (s *server) deleteBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+	query := r.URL.Query()
+	title := query.Get("title")
+	if title == "" {
+		http.Error(w, "Title query parameter is required", http.StatusBadRequest)
+		return
+	}
 
-	loans, exists := l.Loans[request.Title]
-	if !exists {
-		http.Error(w, "No loans found for this book", http.StatusNotFound)
+	var err error
+	if query.Get("hard") == "true" {
+		err = s.library.DeleteBook(title)
+		s.audit(r, librarypkg.AuditDeleteBook, title, "", err)
+	} else {
+		_, err = s.library.SetArchived(title, true)
+		s.audit(r, librarypkg.AuditArchive, title, "", err)
+	}
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	var loanFound bool
-	var extendedLoan LoanDetail
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// archiveBookHandler serves both /Book/archive and /Book/unarchive.
+func (s *server) archiveBookHandler(archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	for i, loan := range loans {
-		if loan.NameOfBorrower == request.Borrower {
-			// Extend loan by 3 weeks from current return date
-			loans[i].ReturnDate = loan.ReturnDate.AddDate(0, 0, 21)
-			extendedLoan = loans[i]
-			loanFound = true
-			break
+		title := r.URL.Query().Get("title")
+		if title == "" {
+			http.Error(w, "Title query parameter is required", http.StatusBadRequest)
+			return
 		}
+		s.setArchived(w, r, title, archived)
 	}
+}
 
-	if !loanFound {
-		http.Error(w, "No loan found for this borrower", http.StatusNotFound)
+// restoreBookHandler serves POST /books/{title}/restore, bringing an
+// archived book back into listings and loans. It sits beside GET
+// /books/{title}, as /Books/{title}/restore would clash with
+// /Books/isbn/{isbn}.
+func (s *server) restoreBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	l.Loans[request.Title] = loans
+	title := r.PathValue("title")
+	if title == "" {
+		http.Error(w, "Title is required", http.StatusBadRequest)
+		return
+	}
+	s.setArchived(w, r, title, false)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(extendedLoan)
+// setArchived archives or restores title and writes the book.
+func (s *server) setArchived(w http.ResponseWriter, r *http.Request, title string, archived bool) {
+	book, err := s.library.SetArchived(title, archived)
+	action := librarypkg.AuditUnarchive
+	if archived {
+		action = librarypkg.AuditArchive
+	}
+	s.audit(r, action, title, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", bookETag(book))
+	writeResponse(w, r, http.StatusOK, book)
+}
+
+func bookETag(book librarypkg.BookDetail) string {
+	return `"` + strconv.Itoa(book.Version) + `"`
+}
+
+// ifMatchVersion reads the book version from the required If-Match header,
+// "*" meaning any version. It writes a 428 or 400 and returns false if the
+// header is missing or invalid.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "If-Match header is required", http.StatusPreconditionRequired)
+		return 0, false
+	}
+
+	if ifMatch == "*" {
+		return librarypkg.AnyVersion, true
+	}
+	version, err := strconv.Atoi(strings.Trim(ifMatch, `"`))
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return 0, false
+	}
+	return version, true
 }
 
-func (l *Library) returnBookHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) importBooksHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var request struct {
-		Title    string `json:"title"`
-		Borrower string `json:"borrower"`
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if mode != "merge" && mode != "strict" {
+		http.Error(w, "Mode must be merge or strict", http.StatusBadRequest)
 		return
 	}
 
-	if request.Title == "" || request.Borrower == "" {
-		http.Error(w, "Title and borrower are required", http.StatusBadRequest)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Multipart upload must contain a file field", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	rows, importErrors := librarypkg.ParseCatalogCSV(body)
+	if len(importErrors) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, librarypkg.ImportSummary{Errors: importErrors})
 		return
 	}
 
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+	summary, err := s.library.Import(r.Context(), rows, mode == "strict")
+	s.audit(r, librarypkg.AuditImport, "", "", err)
+	if errors.Is(err, librarypkg.ErrInvalidImport) {
+		writeJSON(w, http.StatusUnprocessableEntity, summary)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
 
-	loans, exists := l.Loans[request.Title]
-	if !exists {
-		http.Error(w, "No loans found for this book", http.StatusNotFound)
+func (s *server) exportBooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	book, bookExists := l.Books[request.Title]
-	if !bookExists {
-		http.Error(w, "Book not found", http.StatusNotFound)
+	// ListBooks copies under the lock so a slow download doesn't block writers
+	books := s.library.ListBooks()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="books.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"title", "availableCopies"})
+	for _, book := range books {
+		writer.Write([]string{book.Title, strconv.Itoa(book.AvailableCopies)})
+	}
+	writer.Flush()
+}
+
+// listLoansHandler lists active loans, optionally only those of one borrower.
+func (s *server) listLoansHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var loanIndex = -1
-	for i, loan := range loans {
-		if loan.NameOfBorrower == request.Borrower {
-			loanIndex = i
-			break
+	borrower := r.URL.Query().Get("borrower")
+	loans := []librarypkg.LoanDetail{}
+	for _, loan := range s.library.ListLoans() {
+		if borrower == "" || loan.NameOfBorrower == borrower {
+			loans = append(loans, loan)
 		}
 	}
 
-	if loanIndex == -1 {
-		http.Error(w, "No loan found for this borrower", http.StatusNotFound)
+	writeJSON(w, http.StatusOK, loans)
+}
+
+func (s *server) loanCountsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.LoanCounts())
+}
+
+func (s *server) dueLoansHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Remove the loan by swapping with the last element and truncating
-	loans[loanIndex] = loans[len(loans)-1]
-	l.Loans[request.Title] = loans[:len(loans)-1]
+	days := 3
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Days query parameter must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
 
-	book.AvailableCopies++
-	l.Books[request.Title] = book
+	writeJSON(w, http.StatusOK, s.library.DueWithin(days))
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": fmt.Sprintf("Book '%s' successfully returned by %s", request.Title, request.Borrower),
-	})
+func (s *server) borrowerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Name query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.BorrowerLoans(name))
+}
+
+func (s *server) exportLoansHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// ListLoans copies under the lock so a slow download doesn't block writers
+	loans := s.library.ListLoans()
+	now := s.library.Now()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="loans.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"title", "borrower", "loanDate", "returnDate", "overdue"})
+	for _, loan := range loans {
+		writer.Write([]string{
+			loan.BookTitle,
+			loan.NameOfBorrower,
+			loan.LoanDate.Format(time.RFC3339),
+			loan.ReturnDate.Format(time.RFC3339),
+			strconv.FormatBool(now.After(loan.ReturnDate)),
+		})
+	}
+	writer.Flush()
+}
+
+func (s *server) bookAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		http.Error(w, "Title query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	availability, err := s.library.Availability(title)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, availability)
+}
+
+// bookHistoryHandler serves GET /Book/history, every loan of one title.
+func (s *server) bookHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		http.Error(w, "Title query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	history, err := s.library.BookHistory(r.Context(), title)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// dryRunResponse answers POST /Borrow?dryRun=true with the loan that would
+// have been created.
+type dryRunResponse struct {
+	DryRun bool                  `json:"dryRun"`
+	Loan   librarypkg.LoanDetail `json:"loan"`
+}
+
+func (s *server) borrowBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request loanRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	if !canActFor(r, request.Borrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+
+	if r.URL.Query().Get("dryRun") == "true" {
+		loan, err := s.library.PreviewBorrow(request.Title, request.Borrower)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dryRunResponse{DryRun: true, Loan: loan})
+		return
+	}
+
+	if r.URL.Query().Get("reserveIfUnavailable") == "true" {
+		s.borrowOrReserve(w, r, request)
+		return
+	}
+
+	loan, err := s.library.Borrow(request.Title, request.Borrower)
+	s.audit(r, librarypkg.AuditBorrow, request.Title, request.Borrower, err)
+	if err != nil {
+		s.writeBorrowError(w, r, request.Title, err)
+		return
+	}
+
+	w.Header().Set("Location", loanLocation(loan))
+	writeResponse(w, r, http.StatusCreated, loan)
+}
+
+// borrowOrReserve answers POST /Borrow?reserveIfUnavailable=true: a 201 with
+// the loan, or a 202 with the queue position when there was no copy to lend.
+func (s *server) borrowOrReserve(w http.ResponseWriter, r *http.Request, request loanRequest) {
+	loan, position, err := s.library.BorrowOrReserve(request.Title, request.Borrower)
+	if position > 0 {
+		// The borrow itself still failed, the reservation is the fallback
+		s.audit(r, librarypkg.AuditBorrow, request.Title, request.Borrower, librarypkg.ErrNoCopies)
+		s.audit(r, librarypkg.AuditReserve, request.Title, request.Borrower, nil)
+		writeJSON(w, http.StatusAccepted, reservationResponse{
+			Title:    request.Title,
+			Borrower: request.Borrower,
+			Position: position,
+		})
+		return
+	}
+	s.audit(r, librarypkg.AuditBorrow, request.Title, request.Borrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", loanLocation(loan))
+	writeResponse(w, r, http.StatusCreated, loan)
+}
+
+// loanLocation is the URL GET /loans/{id} serves loan at.
+func loanLocation(loan librarypkg.LoanDetail) string {
+	return "/loans/" + url.PathEscape(loan.ID)
+}
+
+// returnedLoanResponse is the 404 body for a loan that has been returned,
+// carrying its closed record.
+type returnedLoanResponse struct {
+	Status string                `json:"status" xml:"status"`
+	Loan   librarypkg.LoanDetail `json:"loan" xml:"loan"`
+}
+
+func (s *server) loanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	loan, err := s.library.Loan(r.PathValue("id"))
+	if errors.Is(err, librarypkg.ErrLoanReturned) {
+		_, code := errorMapping(err)
+		w.Header().Set(errorCodeHeader, code)
+		status := loan.Status
+		if status == "" {
+			status = librarypkg.LoanReturned
+		}
+		writeResponse(w, r, http.StatusNotFound, returnedLoanResponse{Status: status, Loan: loan})
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, loan)
+}
+
+func (s *server) loanLostHandler(w http.ResponseWriter, r *http.Request) {
+	s.closeLoan(w, r, librarypkg.AuditLost, s.library.ReportLostIf)
+}
+
+func (s *server) loanDamagedHandler(w http.ResponseWriter, r *http.Request) {
+	s.closeLoan(w, r, librarypkg.AuditDamaged, s.library.ReportDamagedIf)
+}
+
+// closeLoan closes the loan named by the id path value with report, on
+// behalf of its borrower, and audits it as action.
+func (s *server) closeLoan(w http.ResponseWriter, r *http.Request, action string, report closeLoanFunc) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receipt, err := report(r.PathValue("id"), borrowerCheck(r))
+	if errors.Is(err, errOtherBorrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+	s.audit(r, action, receipt.Loan.BookTitle, receipt.Loan.NameOfBorrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, receipt)
+}
+
+// batchUnavailableResponse is the 409 body of a batch borrow, listing every
+// title that kept it from going through.
+type batchUnavailableResponse struct {
+	Error       string                     `json:"error"`
+	Unavailable []librarypkg.BorrowFailure `json:"unavailable"`
+}
+
+func (s *server) borrowBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request batchBorrowRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	if !canActFor(r, request.Borrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+
+	loans, err := s.library.BorrowBatch(request.Borrower, request.Titles)
+	for _, title := range request.Titles {
+		s.audit(r, librarypkg.AuditBorrow, title, request.Borrower, err)
+	}
+
+	var batchErr *librarypkg.BatchError
+	if errors.As(err, &batchErr) {
+		_, code := errorMapping(err)
+		w.Header().Set(errorCodeHeader, code)
+		writeJSON(w, http.StatusConflict, batchUnavailableResponse{Error: "Some titles are unavailable", Unavailable: batchErr.Failures})
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, loans)
+}
+
+func (s *server) extendLoanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request extendRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	if !canActFor(r, request.Borrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+
+	extendedLoan, err := s.library.ExtendBy(request.Title, request.Borrower, request.Days)
+	s.audit(r, librarypkg.AuditExtend, request.Title, request.Borrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, extendedLoan)
+}
+
+func (s *server) extendAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request borrowerRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	if !canActFor(r, request.Borrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+
+	results := s.library.ExtendAll(request.Borrower)
+	for _, result := range results {
+		s.audit(r, librarypkg.AuditExtend, result.Loan.BookTitle, request.Borrower, result.Err)
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *server) returnBookHandler(w http.ResponseWriter, r *http.Request) {
+	s.closeRequestedLoan(w, r, librarypkg.AuditReturn, s.library.ReturnLoanIf, s.library.Return)
+}
+
+func (s *server) lostBookHandler(w http.ResponseWriter, r *http.Request) {
+	s.closeRequestedLoan(w, r, librarypkg.AuditLost, s.library.ReportLostIf, s.library.ReportLostBook)
+}
+
+// closeLoanFunc closes the loan with the given ID unless check rejects it,
+// like Library.ReturnLoanIf.
+type closeLoanFunc func(id string, check func(librarypkg.LoanDetail) error) (librarypkg.ReturnReceipt, error)
+
+// errOtherBorrower is what borrowerCheck rejects a loan with.
+var errOtherBorrower = errors.New("loan belongs to another borrower")
+
+// borrowerCheck returns a check for a closeLoanFunc that rejects loans r
+// can't act for with errOtherBorrower.
+func borrowerCheck(r *http.Request) func(librarypkg.LoanDetail) error {
+	return func(loan librarypkg.LoanDetail) error {
+		if !canActFor(r, loan.NameOfBorrower) {
+			return errOtherBorrower
+		}
+		return nil
+	}
+}
+
+// closeRequestedLoan closes the loan a returnRequest names, with byID for a
+// loan ID or else byTitle, and audits it as action.
+func (s *server) closeRequestedLoan(w http.ResponseWriter, r *http.Request, action string,
+	byID closeLoanFunc, byTitle func(string, string) (librarypkg.ReturnReceipt, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request returnRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	var receipt librarypkg.ReturnReceipt
+	var err error
+	if request.LoanID != "" {
+		if receipt, err = byID(request.LoanID, borrowerCheck(r)); errors.Is(err, errOtherBorrower) {
+			forbidOtherBorrower(w)
+			return
+		}
+	} else if !canActFor(r, request.Borrower) {
+		forbidOtherBorrower(w)
+		return
+	} else {
+		receipt, err = byTitle(request.Title, request.Borrower)
+	}
+	title, borrower := request.Title, request.Borrower
+	if err == nil {
+		title, borrower = receipt.Loan.BookTitle, receipt.Loan.NameOfBorrower
+	}
+	s.audit(r, action, title, borrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, receipt)
+}
+
+func (s *server) returnBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request batchReturnRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	if !canActFor(r, request.Borrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+
+	results := s.library.ReturnBatch(request.Borrower, request.items())
+	for _, result := range results {
+		title := result.Item.Title
+		if result.Receipt != nil {
+			title = result.Receipt.Loan.BookTitle
+		}
+		s.audit(r, librarypkg.AuditReturn, title, request.Borrower, result.Err)
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *server) loanUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request loanUpdateRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	loan, err := s.library.CorrectBorrower(request.LoanID, request.Title, request.Borrower, request.NewBorrower)
+	title := request.Title
+	if err == nil {
+		title = loan.BookTitle
+	}
+	s.audit(r, librarypkg.AuditUpdateLoan, title, request.NewBorrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, loan)
+}
+
+func (s *server) loanTransferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request loanTransferRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	loan, err := s.library.TransferLoan(request.Title, request.Borrower, request.NewBorrower)
+	s.audit(r, librarypkg.AuditTransfer, request.Title, request.NewBorrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, loan)
+}
+
+func (s *server) loanTransferByIDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request transferRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	loan, err := s.library.TransferLoanByID(r.PathValue("id"), request.NewBorrower)
+	s.audit(r, librarypkg.AuditTransfer, loan.BookTitle, request.NewBorrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, loan)
+}
+
+func (s *server) dueDateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request dueDateRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	loan, err := s.library.SetDueDate(r.PathValue("id"), request.DueDate, request.Force)
+	s.audit(r, librarypkg.AuditDueDate, loan.BookTitle, loan.NameOfBorrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, loan)
+}
+
+// renameBookHandler serves POST /admin/books/rename. The audit log records
+// the rename as "from -> to".
+func (s *server) renameBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request renameRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	book, err := s.library.RenameBook(request.From, request.To)
+	s.audit(r, librarypkg.AuditRename, request.From+" -> "+request.To, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", bookETag(book))
+	writeResponse(w, r, http.StatusOK, book)
+}
+
+type reservationResponse struct {
+	Title    string `json:"title"`
+	Borrower string `json:"borrower"`
+	Position int    `json:"position"`
+}
+
+func (s *server) reserveHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.reserveBookHandler(w, r)
+	case http.MethodDelete:
+		s.cancelReservationHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) reserveBookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request loanRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	if !canActFor(r, request.Borrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+
+	position, err := s.library.Reserve(request.Title, request.Borrower)
+	s.audit(r, librarypkg.AuditReserve, request.Title, request.Borrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, reservationResponse{
+		Title:    request.Title,
+		Borrower: request.Borrower,
+		Position: position,
+	})
+}
+
+func (s *server) cancelReservationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	title, borrower := r.URL.Query().Get("title"), r.URL.Query().Get("borrower")
+	if title == "" || borrower == "" {
+		http.Error(w, "Title and borrower query parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	if !canActFor(r, borrower) {
+		forbidOtherBorrower(w)
+		return
+	}
+
+	position, err := s.library.CancelReservation(title, borrower)
+	s.audit(r, librarypkg.AuditCancel, title, borrower, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, reservationResponse{Title: title, Borrower: borrower, Position: position})
+}
+
+func (s *server) overdueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.Overdue())
+}
+
+func (s *server) fineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	borrower := r.URL.Query().Get("borrower")
+	if borrower == "" {
+		http.Error(w, "Borrower query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.Fine(borrower))
+}
+
+func (s *server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.Stats())
+}
+
+func (s *server) popularBooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var errs []fieldError
+
+	limit := 10
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			errs = append(errs, fieldError{Field: "limit", Message: "must be between 1 and 1000"})
+		}
+		limit = n
+	}
+	since, until, rangeErrs := timeRange(query, "since", "until")
+	errs = append(errs, rangeErrs...)
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	popular, err := s.library.Popular(r.Context(), since, until, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, popular)
+}
+
+// timeRange parses the optional RFC 3339 query parameters named from and to,
+// leaving a bound zero when it is absent.
+func timeRange(query url.Values, from, to string) (since, until time.Time, errs []fieldError) {
+	timeParam := func(name string) time.Time {
+		value := query.Get(name)
+		if value == "" {
+			return time.Time{}
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			errs = append(errs, fieldError{Field: name, Message: "must be an RFC 3339 timestamp"})
+		}
+		return t
+	}
+	since, until = timeParam(from), timeParam(to)
+	if !since.IsZero() && !until.IsZero() && since.After(until) {
+		errs = append(errs, fieldError{Field: from, Message: "must not be after " + to})
+	}
+	return since, until, errs
+}
+
+func (s *server) loanDurationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	since, until, errs := timeRange(query, "since", "until")
+	if len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	durations, err := s.library.LoanDurations(r.Context(), query.Get("title"), since, until)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, durations)
+}
+
+func (s *server) inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.Inventory())
+}
+
+func (s *server) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.Snapshot())
+}
+
+// restoreHandler replaces the library's state with a snapshot from GET
+// /admin/snapshot and answers with the stats of the restored library.
+func (s *server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request restoreRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	err := s.library.Restore(request.Snapshot)
+	s.audit(r, librarypkg.AuditRestore, "", "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.library.Stats())
+}
+
+func (s *server) addMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request memberRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	member, err := s.library.AddMember(request.Member)
+	s.audit(r, librarypkg.AuditAddMember, "", request.Name, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, member)
+}
+
+// calendarSuffix ends the path of a member's due date feed.
+const calendarSuffix = "/calendar.ics"
+
+// memberCalendarHandler serves a member's active loans as an iCalendar feed
+// of due dates for their calendar app to subscribe to.
+func (s *server) memberCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	if !canActFor(r, name) {
+		forbidOtherBorrower(w)
+		return
+	}
+	if _, err := s.library.Member(name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var loans []librarypkg.LoanDetail
+	for _, loan := range s.library.BorrowerLoans(name) {
+		loans = append(loans, loan.LoanDetail)
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(librarypkg.DueDateCalendar(loans, s.library.Now()))
+}
+
+// eventsHandler streams loan events as Server-Sent Events until the client
+// disconnects or the server shuts down.
+func (s *server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := s.library.Events.Subscribe()
+	defer cancel()
+
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event.Loan)
+			if err != nil {
+				log.Printf("encoding %s event: %v", event.Type, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.library.Validate(); err != nil {
+		http.Error(w, "Invalid library state: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *server) registerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.library.Webhooks == nil {
+		http.Error(w, "Webhooks are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var request webhookRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	hook, err := s.library.Webhooks.Register(request.URL, request.Events, request.Secret)
+	s.audit(r, librarypkg.AuditAddWebhook, request.URL, "", err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+func (s *server) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.library.Webhooks == nil {
+		http.Error(w, "Webhooks are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	deliveries, err := s.library.Webhooks.Deliveries(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
 }
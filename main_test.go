@@ -1,16 +1,98 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"Library/libraryclient"
+	"Library/librarypb"
+	"Library/librarypkg"
 )
 
+// testNow is the time test libraries start at, so due dates and fines come
+// out the same on every run.
+var testNow = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+// newTestLibrary returns a library seeded with the demo books shared with the
+// librarypkg tests: Go Programming with 3 copies and Clean Code with 2. Its
+// clock stands still at testNow; tests that need time to pass use
+// useFakeClock.
+func newTestLibrary(t *testing.T) *librarypkg.Library {
+	t.Helper()
+	books, err := librarypkg.LoadSeed("librarypkg/testdata/seed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	library := librarypkg.NewLibrary()
+	library.SetClock(func() time.Time { return testNow })
+	if _, err := library.Seed(books); err != nil {
+		t.Fatal(err)
+	}
+	return library
+}
+
+// fakeClock is a settable time source for tests.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// useFakeClock routes the library's clock through a fake starting at start.
+func useFakeClock(library *librarypkg.Library, start time.Time) *fakeClock {
+	clock := &fakeClock{now: start}
+	library.SetClock(clock.Now)
+	return clock
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func TestGetBookHandler(t *testing.T) {
-	library := NewLibrary()
+	library := newTestLibrary(t)
+	srv := &server{library: library}
 
 	// Test 1: Get an existing book
 	req, err := http.NewRequest("GET", "/Book?title=Go Programming", nil)
@@ -19,14 +101,14 @@ func TestGetBookHandler(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(library.getBookHandler)
+	handler := http.HandlerFunc(srv.getBookHandler)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
-	var book BookDetail
+	var book librarypkg.BookDetail
 	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
 		t.Fatal(err)
 	}
@@ -50,7 +132,8 @@ func TestGetBookHandler(t *testing.T) {
 }
 
 func TestBorrowBookHandler(t *testing.T) {
-	library := NewLibrary()
+	library := newTestLibrary(t)
+	srv := &server{library: library}
 
 	requestBody := map[string]string{
 		"title":    "Go Programming",
@@ -69,14 +152,14 @@ func TestBorrowBookHandler(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(library.borrowBookHandler)
+	handler := http.HandlerFunc(srv.borrowBookHandler)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusCreated {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
 	}
 
-	var loan LoanDetail
+	var loan librarypkg.LoanDetail
 	if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
 		t.Fatal(err)
 	}
@@ -86,33 +169,33 @@ func TestBorrowBookHandler(t *testing.T) {
 	}
 
 	// Verify book copies were reduced
-	library.mutex.RLock()
-	book := library.Books["Go Programming"]
-	library.mutex.RUnlock()
+	book := library.Books()["Go Programming"]
 	if book.AvailableCopies != 2 {
 		t.Errorf("expected 2 available copies, got %d", book.AvailableCopies)
 	}
-}
 
-func TestExtendLoanHandler(t *testing.T) {
-	library := NewLibrary()
+	// Test borrowing a second copy of the same title
+	req, err = http.NewRequest("POST", "/Borrow", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
 
-	// First, create a loan to extend
-	now := time.Now()
-	originalReturnDate := now.AddDate(0, 0, 28) // 4 weeks
-	loan := LoanDetail{
-		BookTitle:      "Clean Code",
-		NameOfBorrower: "Jane Smith",
-		LoanDate:       now,
-		ReturnDate:     originalReturnDate,
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+	if code := rr.Header().Get(errorCodeHeader); code != "TITLE_LOAN_LIMIT" {
+		t.Errorf("unexpected error code: %q", code)
 	}
+}
 
-	library.mutex.Lock()
-	library.Books["Clean Code"] = BookDetail{Title: "Clean Code", AvailableCopies: 1} // One is borrowed
-	library.Loans["Clean Code"] = []LoanDetail{loan}
-	library.mutex.Unlock()
+func TestExtendLoanHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	clock := useFakeClock(library, time.Date(2024, time.February, 5, 14, 30, 0, 0, time.UTC))
 
-	// Prepare request body for extension
+	// First, borrow the book so the loan is stamped by the fake clock
 	requestBody := map[string]string{
 		"title":    "Clean Code",
 		"borrower": "Jane Smith",
@@ -122,49 +205,86 @@ func TestExtendLoanHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Test extending the loan
-	req, err := http.NewRequest("POST", "/Extend", bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequest("POST", "/Borrow", bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		t.Fatal(err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(library.extendLoanHandler)
+	http.HandlerFunc(srv.borrowBookHandler).ServeHTTP(rr, req)
+
+	var loan librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+		t.Fatal(err)
+	}
+
+	originalReturnDate := clock.Now().AddDate(0, 0, 28) // 4 weeks
+	if !loan.LoanDate.Equal(clock.Now()) || !loan.ReturnDate.Equal(originalReturnDate) {
+		t.Fatalf("unexpected loan dates: got %v - %v", loan.LoanDate, loan.ReturnDate)
+	}
+
+	// Test extending the loan a week later
+	clock.Advance(7 * 24 * time.Hour)
+
+	req, err = http.NewRequest("POST", "/Extend", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr = httptest.NewRecorder()
+	handler := http.HandlerFunc(srv.extendLoanHandler)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
-	var extendedLoan LoanDetail
+	var extendedLoan librarypkg.LoanDetail
 	if err := json.Unmarshal(rr.Body.Bytes(), &extendedLoan); err != nil {
 		t.Fatal(err)
 	}
 
 	expectedNewReturnDate := originalReturnDate.AddDate(0, 0, 21) // 3 more weeks
-	if extendedLoan.ReturnDate.Format("2006-01-02") != expectedNewReturnDate.Format("2006-01-02") {
-		t.Errorf("unexpected return date: got %v, expected %v",
-			extendedLoan.ReturnDate.Format("2006-01-02"),
-			expectedNewReturnDate.Format("2006-01-02"))
+	if !extendedLoan.ReturnDate.Equal(expectedNewReturnDate) {
+		t.Errorf("unexpected return date: got %v, expected %v", extendedLoan.ReturnDate, expectedNewReturnDate)
+	}
+
+	// Test extending while someone else waits for the book
+	if _, err := library.Reserve("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", "/Extend", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(srv.extendLoanHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+	if code := rr.Header().Get(errorCodeHeader); code != "RESERVED_BY_OTHERS" {
+		t.Errorf("unexpected error code: %q", code)
+	}
+	if !strings.Contains(rr.Body.String(), "others are waiting") {
+		t.Errorf("expected the message to explain the refusal, got %q", rr.Body.String())
 	}
 }
 
 func TestReturnBookHandler(t *testing.T) {
-	library := NewLibrary()
+	library := newTestLibrary(t)
+	srv := &server{library: library}
 
 	// First, create a loan to return
-	loan := LoanDetail{
+	loan := librarypkg.LoanDetail{
 		BookTitle:      "Design Patterns",
 		NameOfBorrower: "Bob Johnson",
-		LoanDate:       time.Now(),
-		ReturnDate:     time.Now().AddDate(0, 0, 28),
+		LoanDate:       testNow,
+		ReturnDate:     testNow.AddDate(0, 0, 28),
 	}
 
-	library.mutex.Lock()
-	library.Books["Design Patterns"] = BookDetail{Title: "Design Patterns", AvailableCopies: 0}
-	library.Loans["Design Patterns"] = []LoanDetail{loan}
-	library.mutex.Unlock()
+	library.LoadBook(librarypkg.BookDetail{Title: "Design Patterns", AvailableCopies: 0, TotalCopies: 1}, loan)
 
 	// Prepare request body for returning
 	requestBody := map[string]string{
@@ -184,7 +304,7 @@ func TestReturnBookHandler(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(library.returnBookHandler)
+	handler := http.HandlerFunc(srv.returnBookHandler)
 	handler.ServeHTTP(rr, req)
 
 	if status := rr.Code; status != http.StatusOK {
@@ -192,18 +312,4924 @@ func TestReturnBookHandler(t *testing.T) {
 	}
 
 	// Verify book copies were increased
-	library.mutex.RLock()
-	book := library.Books["Design Patterns"]
-	library.mutex.RUnlock()
+	book := library.Books()["Design Patterns"]
 	if book.AvailableCopies != 1 {
 		t.Errorf("expected 1 available copy, got %d", book.AvailableCopies)
 	}
 
 	// Verify loan was removed
-	library.mutex.RLock()
-	loans := library.Loans["Design Patterns"]
-	library.mutex.RUnlock()
+	loans := library.Loans()["Design Patterns"]
 	if len(loans) != 0 {
 		t.Errorf("expected loan to be removed, but found %d loans", len(loans))
 	}
+
+	// Verify the empty loan slice was cleaned up
+	_, exists := library.Loans()["Design Patterns"]
+	if exists {
+		t.Error("expected loans entry to be deleted once the last loan was returned")
+	}
+}
+
+func TestReturnBookReceipt(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	loanDate := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	dueDate := loanDate.AddDate(0, 0, 28)
+
+	library.LoadBook(librarypkg.BookDetail{Title: "Clean Code", AvailableCopies: 0, TotalCopies: 2},
+		librarypkg.LoanDetail{BookTitle: "Clean Code", NameOfBorrower: "Jane Smith", LoanDate: loanDate, ReturnDate: dueDate},
+		librarypkg.LoanDetail{BookTitle: "Clean Code", NameOfBorrower: "Bob Johnson", LoanDate: loanDate, ReturnDate: dueDate},
+	)
+
+	clock := useFakeClock(library, loanDate)
+
+	returnBook := func(borrower string, at time.Time) librarypkg.ReturnReceipt {
+		clock.Set(at)
+
+		bodyBytes, err := json.Marshal(map[string]string{"title": "Clean Code", "borrower": borrower})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/Return", bytes.NewBuffer(bodyBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.returnBookHandler).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+
+		var receipt librarypkg.ReturnReceipt
+		if err := json.Unmarshal(rr.Body.Bytes(), &receipt); err != nil {
+			t.Fatal(err)
+		}
+		return receipt
+	}
+
+	// Test 1: On-time return
+	onTime := dueDate.Add(-time.Hour)
+	receipt := returnBook("Jane Smith", onTime)
+	if receipt.WasOverdue || receipt.DaysLate != 0 {
+		t.Errorf("expected on-time return, got wasOverdue=%v daysLate=%d", receipt.WasOverdue, receipt.DaysLate)
+	}
+	if !receipt.ReturnedAt.Equal(onTime) {
+		t.Errorf("unexpected returnedAt: got %v want %v", receipt.ReturnedAt, onTime)
+	}
+	if receipt.Loan.NameOfBorrower != "Jane Smith" || !receipt.Loan.ReturnDate.Equal(dueDate) {
+		t.Errorf("unexpected loan in receipt: %+v", receipt.Loan)
+	}
+	if receipt.Message == "" {
+		t.Error("expected message to be kept for backward compatibility")
+	}
+
+	// Test 2: Late return, two and a half days past the due date
+	receipt = returnBook("Bob Johnson", dueDate.Add(60*time.Hour))
+	if !receipt.WasOverdue {
+		t.Error("expected late return to be flagged as overdue")
+	}
+	if receipt.DaysLate != 3 {
+		t.Errorf("expected 3 days late, got %d", receipt.DaysLate)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	handler := http.HandlerFunc(srv.readyzHandler)
+
+	// Test 1: A fresh library is ready
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Test 2: Invalid state is reported
+	library.LoadBook(librarypkg.BookDetail{Title: "Clean Code", AvailableCopies: -1})
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+	if !strings.Contains(rr.Body.String(), "negative available copies") {
+		t.Errorf("expected body to explain the violation, got %q", rr.Body.String())
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	handler := (&server{library: newTestLibrary(t)}).routes()
+
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+
+	// Test 1: Local builds report dev
+	req := httptest.NewRequest("GET", "/version", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var got versionResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (versionResponse{Version: "dev", Commit: "dev", BuildDate: "dev"}) {
+		t.Errorf("expected dev build info, got %+v", got)
+	}
+
+	// Test 2: Values set with -ldflags are reported
+	version, commit, buildDate = "1.4.0", "8da3df6", "2024-05-01T12:00:00Z"
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != (versionResponse{Version: "1.4.0", Commit: "8da3df6", BuildDate: "2024-05-01T12:00:00Z"}) {
+		t.Errorf("expected the injected build info, got %+v", got)
+	}
+
+	// Test 3: Only GET is allowed
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/version", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	library := newTestLibrary(t)
+	handler := (&server{library: library}).routes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	const borrow = `{"title": "Go Programming", "borrower": "John Doe"}`
+
+	// Test 1: Turning maintenance mode on is reported by /healthz
+	if rr := do("POST", "/admin/maintenance", `{"readOnly": true}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr := do("GET", "/healthz", "")
+	var health healthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || !health.ReadOnly {
+		t.Errorf("expected a healthy read-only server, got %v and %+v", rr.Code, health)
+	}
+
+	// Test 2: Mutations are refused with a 503 and Retry-After
+	rr = do("POST", "/Borrow", borrow)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if code := rr.Header().Get(errorCodeHeader); code != "MAINTENANCE" {
+		t.Errorf("expected error code MAINTENANCE, got %q", code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+	if book, _ := library.Book("Go Programming"); book.AvailableCopies != 3 {
+		t.Errorf("expected no copy borrowed, got %d available", book.AvailableCopies)
+	}
+
+	// Test 3: Reads keep working
+	if rr := do("GET", "/Book?title=Go+Programming", ""); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 4: Turning it off lets the borrow through
+	if rr := do("POST", "/admin/maintenance", `{"readOnly": false}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := do("POST", "/Borrow", borrow); rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := do("POST", "/admin/maintenance", `{}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestCancelReservationHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	handler := (&server{library: library}).routes()
+	library.Reserve("Clean Code", "Alice")
+	library.Reserve("Clean Code", "Bob")
+
+	// Test 1: Cancelling answers with the position the borrower had
+	req := httptest.NewRequest("DELETE", "/Reserve?title=Clean+Code&borrower=Alice", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var got reservationResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Position != 1 || got.Borrower != "Alice" {
+		t.Errorf("expected Alice's position 1, got %+v", got)
+	}
+	if queue := library.Reservations()["Clean Code"]; len(queue) != 1 || queue[0].Borrower != "Bob" {
+		t.Errorf("expected only Bob left in the queue, got %v", queue)
+	}
+
+	// Test 2: A borrower who isn't queued gets a 404
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if code := rr.Header().Get(errorCodeHeader); code != "NOT_RESERVED" {
+		t.Errorf("expected error code NOT_RESERVED, got %q", code)
+	}
+
+	// Test 3: Both query parameters are required
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("DELETE", "/Reserve?title=Clean+Code", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestReturnBookByLoanID(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	// First, borrow a book to get a loan ID
+	bodyBytes, err := json.Marshal(map[string]string{"title": "Go Programming", "borrower": "John Doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/Borrow", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(srv.borrowBookHandler).ServeHTTP(rr, req)
+
+	var loan librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+		t.Fatal(err)
+	}
+	if loan.ID == "" {
+		t.Fatal("expected borrowed loan to have an ID")
+	}
+
+	handler := http.HandlerFunc(srv.returnBookHandler)
+
+	// Test 1: Unknown loan ID
+	bodyBytes, err = json.Marshal(map[string]string{"loanId": "does-not-exist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", "/Return", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// Test 2: Return using only the loan ID
+	bodyBytes, err = json.Marshal(map[string]string{"loanId": loan.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", "/Return", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var receipt librarypkg.ReturnReceipt
+	if err := json.Unmarshal(rr.Body.Bytes(), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Loan.ID != loan.ID || receipt.Loan.NameOfBorrower != "John Doe" {
+		t.Errorf("unexpected loan in receipt: %+v", receipt.Loan)
+	}
+
+	book := library.Books()["Go Programming"]
+	if book.AvailableCopies != 3 {
+		t.Errorf("expected 3 available copies, got %d", book.AvailableCopies)
+	}
+}
+
+type recordingNotifier struct {
+	notified []string
+}
+
+func (n *recordingNotifier) Notify(borrower, title string) error {
+	n.notified = append(n.notified, borrower+":"+title)
+	return nil
+}
+
+func TestReturnNotifiesNextReservation(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	notifier := &recordingNotifier{}
+	library.Notifier = notifier
+
+	library.LoadBook(librarypkg.BookDetail{Title: "Clean Code", AvailableCopies: 0, TotalCopies: 1},
+		librarypkg.LoanDetail{BookTitle: "Clean Code", NameOfBorrower: "Jane Smith", LoanDate: testNow, ReturnDate: testNow.AddDate(0, 0, 28)},
+	)
+
+	// Reserve the book for two borrowers
+	for i, borrower := range []string{"John Doe", "Bob Johnson"} {
+		bodyBytes, err := json.Marshal(map[string]string{"title": "Clean Code", "borrower": borrower})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/Reserve", bytes.NewBuffer(bodyBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.reserveBookHandler).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+
+		var response struct {
+			Position int `json:"position"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Position != i+1 {
+			t.Errorf("expected queue position %d, got %d", i+1, response.Position)
+		}
+	}
+
+	// Return the book and check the first in line was notified
+	bodyBytes, err := json.Marshal(map[string]string{"title": "Clean Code", "borrower": "Jane Smith"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/Return", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(srv.returnBookHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if len(notifier.notified) != 1 || notifier.notified[0] != "John Doe:Clean Code" {
+		t.Errorf("unexpected notifications: %v", notifier.notified)
+	}
+
+	queue := library.Reservations()["Clean Code"]
+	if len(queue) != 1 || queue[0].Borrower != "Bob Johnson" {
+		t.Errorf("expected only Bob Johnson left in the queue, got %v", queue)
+	}
+}
+
+func TestReturnBookClosesOldestLoan(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	older := time.Date(2024, time.January, 10, 9, 0, 0, 0, time.UTC)
+	newer := older.AddDate(0, 0, 5)
+
+	library.LoadBook(librarypkg.BookDetail{Title: "Go Programming", AvailableCopies: 0, TotalCopies: 4},
+		librarypkg.LoanDetail{ID: "newer", BookTitle: "Go Programming", NameOfBorrower: "John Doe", LoanDate: newer, ReturnDate: newer.AddDate(0, 0, 28)},
+		librarypkg.LoanDetail{ID: "bob", BookTitle: "Go Programming", NameOfBorrower: "Bob Johnson", LoanDate: older, ReturnDate: older.AddDate(0, 0, 28)},
+		librarypkg.LoanDetail{ID: "older", BookTitle: "Go Programming", NameOfBorrower: "John Doe", LoanDate: older, ReturnDate: older.AddDate(0, 0, 28)},
+		librarypkg.LoanDetail{ID: "jane", BookTitle: "Go Programming", NameOfBorrower: "Jane Smith", LoanDate: newer, ReturnDate: newer.AddDate(0, 0, 28)},
+	)
+
+	bodyBytes, err := json.Marshal(map[string]string{"title": "Go Programming", "borrower": "John Doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/Return", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(srv.returnBookHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var receipt librarypkg.ReturnReceipt
+	if err := json.Unmarshal(rr.Body.Bytes(), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Loan.ID != "older" {
+		t.Errorf("expected the older loan to be closed, got %q", receipt.Loan.ID)
+	}
+
+	// Verify the remaining loans are untouched and still in order
+	loans := library.Loans()["Go Programming"]
+
+	var ids []string
+	for _, loan := range loans {
+		ids = append(ids, loan.ID)
+	}
+	if strings.Join(ids, ",") != "newer,bob,jane" {
+		t.Errorf("unexpected remaining loans: %v", ids)
+	}
+	if !loans[0].ReturnDate.Equal(newer.AddDate(0, 0, 28)) {
+		t.Errorf("expected newer loan to be untouched, got %+v", loans[0])
+	}
+}
+
+func TestBookAvailabilityHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	soonest := time.Date(2024, time.May, 3, 12, 0, 0, 0, time.UTC)
+
+	library.LoadBook(librarypkg.BookDetail{Title: "Clean Code", AvailableCopies: 0, TotalCopies: 2},
+		librarypkg.LoanDetail{BookTitle: "Clean Code", NameOfBorrower: "Jane Smith", LoanDate: soonest.AddDate(0, 0, -20), ReturnDate: soonest.AddDate(0, 0, 8)},
+		librarypkg.LoanDetail{BookTitle: "Clean Code", NameOfBorrower: "Bob Johnson", LoanDate: soonest.AddDate(0, 0, -28), ReturnDate: soonest},
+	)
+	if _, err := library.Reserve("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/Book/availability?title=Clean Code", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(srv.bookAvailabilityHandler)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var availability librarypkg.BookAvailability
+	if err := json.Unmarshal(rr.Body.Bytes(), &availability); err != nil {
+		t.Fatal(err)
+	}
+
+	if availability.AvailableCopies != 0 || availability.ActiveLoans != 2 || availability.QueueLength != 1 {
+		t.Errorf("unexpected availability: %+v", availability)
+	}
+	if availability.NextReturnDate == nil || !availability.NextReturnDate.Equal(soonest) {
+		t.Errorf("expected next return date %v, got %v", soonest, availability.NextReturnDate)
+	}
+	if availability.NextAvailableDate == nil || !availability.NextAvailableDate.Equal(soonest) {
+		t.Errorf("expected next available date %v, got %v", soonest, availability.NextAvailableDate)
+	}
+
+	// A book with no loans has no next return date
+	req, err = http.NewRequest("GET", "/Book/availability?title=Go Programming", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	availability = librarypkg.BookAvailability{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &availability); err != nil {
+		t.Fatal(err)
+	}
+	if availability.NextReturnDate != nil {
+		t.Errorf("expected no next return date, got %v", availability.NextReturnDate)
+	}
+}
+
+func TestPatchBookHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	// Read the current version
+	req, err := http.NewRequest("GET", "/Book?title=Go Programming", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(srv.bookHandler)
+	handler.ServeHTTP(rr, req)
+
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected GET /Book to return an ETag")
+	}
+
+	patch := func(ifMatch string, copies int) *httptest.ResponseRecorder {
+		bodyBytes, err := json.Marshal(map[string]int{"availableCopies": copies})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("PATCH", "/Book?title=Go Programming", bytes.NewBuffer(bodyBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: Missing If-Match
+	if rr := patch("", 5); rr.Code != http.StatusPreconditionRequired {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusPreconditionRequired)
+	}
+
+	// Test 2: Matching version
+	rr = patch(etag, 5)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Error("expected ETag to change after the update")
+	}
+
+	// Test 3: A second admin still holding the old version is rejected
+	if rr := patch(etag, 1); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusPreconditionFailed)
+	}
+
+	book := library.Books()["Go Programming"]
+	if book.AvailableCopies != 5 {
+		t.Errorf("expected 5 available copies, got %d", book.AvailableCopies)
+	}
+}
+
+func TestImportBooksHandler(t *testing.T) {
+	importCSV := func(srv *server, mode, body string) (*httptest.ResponseRecorder, librarypkg.ImportSummary) {
+		req, err := http.NewRequest("POST", "/Books/import?mode="+mode, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/csv")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.importBooksHandler).ServeHTTP(rr, req)
+
+		var summary librarypkg.ImportSummary
+		if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+			t.Fatal(err)
+		}
+		return rr, summary
+	}
+
+	// Test 1: Clean import
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	rr, summary := importCSV(srv, "merge", "title,availableCopies\nRefactoring,4\nDesign Patterns,2\n")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if summary.Imported != 2 || len(summary.Errors) != 0 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if library.Books()["Refactoring"].AvailableCopies != 4 {
+		t.Errorf("expected 4 copies of Refactoring, got %d", library.Books()["Refactoring"].AvailableCopies)
+	}
+
+	// Test 2: A malformed row rejects the whole import
+	library = newTestLibrary(t)
+	srv = &server{library: library}
+	rr, summary = importCSV(srv, "merge", "title,availableCopies\nRefactoring,4\nDesign Patterns,many\n")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if len(summary.Errors) != 1 || summary.Errors[0].Line != 3 {
+		t.Errorf("expected one error on line 3, got %+v", summary.Errors)
+	}
+	if _, exists := library.Books()["Refactoring"]; exists {
+		t.Error("expected no rows to be applied when any row is invalid")
+	}
+
+	// Test 3: Duplicates add copies in merge mode and are skipped in strict mode
+	library = newTestLibrary(t)
+	srv = &server{library: library}
+	_, summary = importCSV(srv, "merge", "title,availableCopies\nGo Programming,2\n")
+	if summary.Imported != 1 || library.Books()["Go Programming"].AvailableCopies != 5 {
+		t.Errorf("expected merge to add copies, got %+v and %d copies", summary, library.Books()["Go Programming"].AvailableCopies)
+	}
+
+	_, summary = importCSV(srv, "strict", "title,availableCopies\nGo Programming,2\nRefactoring,1\n")
+	if summary.Imported != 1 || summary.SkippedDuplicates != 1 {
+		t.Errorf("unexpected strict summary: %+v", summary)
+	}
+	if library.Books()["Go Programming"].AvailableCopies != 5 {
+		t.Errorf("expected strict mode to leave existing copies alone, got %d", library.Books()["Go Programming"].AvailableCopies)
+	}
+
+	// Test 4: Rows over the copy limit, counted per title across the file,
+	// reject the whole import
+	library = newTestLibrary(t)
+	library.MaxCopies = 5
+	srv = &server{library: library}
+	rr, summary = importCSV(srv, "merge", "title,availableCopies\nRefactoring,3\nDesign Patterns,1\nRefactoring,3\n")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if len(summary.Errors) != 1 || summary.Errors[0].Line != 4 {
+		t.Errorf("expected one error on line 4, got %+v", summary.Errors)
+	}
+	if len(library.Books()) != 2 {
+		t.Errorf("expected no rows to be applied, got %d books", len(library.Books()))
+	}
+
+	// Test 5: A title differing only in case from an existing one rejects
+	// the whole import
+	library = newTestLibrary(t)
+	srv = &server{library: library}
+	rr, summary = importCSV(srv, "merge", "title,availableCopies\nRefactoring,1\nclean code,1\n")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if len(summary.Errors) != 1 || summary.Errors[0].Line != 3 {
+		t.Errorf("expected one error on line 3, got %+v", summary.Errors)
+	}
+	if _, exists := library.Books()["Refactoring"]; exists {
+		t.Error("expected no rows to be applied when a title collides")
+	}
+}
+
+func TestExportHandlers(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	clock := useFakeClock(library, time.Date(2024, time.June, 1, 9, 0, 0, 0, time.UTC))
+
+	cleanCode, _ := library.Book("Clean Code")
+	library.LoadBook(cleanCode,
+		librarypkg.LoanDetail{BookTitle: "Clean Code", NameOfBorrower: "Jane Smith", LoanDate: clock.Now().AddDate(0, 0, -40), ReturnDate: clock.Now().AddDate(0, 0, -12)},
+		librarypkg.LoanDetail{BookTitle: "Clean Code", NameOfBorrower: "Bob Johnson", LoanDate: clock.Now().AddDate(0, 0, -1), ReturnDate: clock.Now().AddDate(0, 0, 27)},
+	)
+
+	export := func(handler http.HandlerFunc, path string) [][]string {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if !strings.HasPrefix(rr.Header().Get("Content-Disposition"), "attachment") {
+			t.Errorf("expected attachment Content-Disposition, got %q", rr.Header().Get("Content-Disposition"))
+		}
+
+		records, err := csv.NewReader(rr.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+
+	// Test 1: Books export
+	records := export(srv.exportBooksHandler, "/Books/export")
+	if strings.Join(records[0], ",") != "title,availableCopies" {
+		t.Errorf("unexpected books header: %v", records[0])
+	}
+	if len(records) != 3 {
+		t.Errorf("expected 2 book rows, got %d", len(records)-1)
+	}
+
+	// Test 2: Loans export with overdue column
+	records = export(srv.exportLoansHandler, "/Loans/export")
+	if strings.Join(records[0], ",") != "title,borrower,loanDate,returnDate,overdue" {
+		t.Errorf("unexpected loans header: %v", records[0])
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 2 loan rows, got %d", len(records)-1)
+	}
+	if records[1][1] != "Jane Smith" || records[1][4] != "true" {
+		t.Errorf("expected Jane Smith's loan to be overdue, got %v", records[1])
+	}
+	if records[2][4] != "false" {
+		t.Errorf("expected Bob Johnson's loan not to be overdue, got %v", records[2])
+	}
+}
+
+func TestCreateBookAndLookupByISBN(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Book", srv.bookHandler)
+	mux.HandleFunc("/Books/isbn/{isbn}", srv.bookByISBNHandler)
+
+	create := func(book map[string]interface{}) *httptest.ResponseRecorder {
+		bodyBytes, err := json.Marshal(book)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/Book", bytes.NewBuffer(bodyBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: Invalid checksum is rejected
+	rr := create(map[string]interface{}{"title": "Refactoring", "isbn": "978-0-201-48567-0", "availableCopies": 1})
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// Test 2: Valid ISBN-13 with separators
+	rr = create(map[string]interface{}{
+		"title":           "Refactoring",
+		"author":          "Martin Fowler",
+		"isbn":            "978-0-201-48567-7",
+		"year":            1999,
+		"availableCopies": 2,
+	})
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	// Test 3: Lookup by ISBN returns the richer record
+	req, err := http.NewRequest("GET", "/Books/isbn/9780201485677", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var book librarypkg.BookDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Refactoring" || book.Author != "Martin Fowler" || book.Year != 1999 {
+		t.Errorf("unexpected book: %+v", book)
+	}
+
+	// Test 4: Unknown ISBN
+	req, err = http.NewRequest("GET", "/Books/isbn/0132350882", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	library := newTestLibrary(t)
+
+	req, err := http.NewRequest("GET", "/Return", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Domain errors keep their wrapped context in the response body
+	_, err = library.Return("Go Programming", "John Doe")
+	rr := httptest.NewRecorder()
+	writeError(rr, req, err)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != "No loans found for this book" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	if code := rr.Header().Get(errorCodeHeader); code != "NO_LOANS" {
+		t.Errorf("unexpected error code: %q", code)
+	}
+
+	// Unknown errors are not leaked to the client
+	rr = httptest.NewRecorder()
+	writeError(rr, req, errors.New("disk on fire"))
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+	if strings.Contains(rr.Body.String(), "disk") {
+		t.Errorf("expected internal error details to be hidden, got %q", rr.Body.String())
+	}
+
+	// Clients asking for XML get the code and message as XML
+	req.Header.Set("Accept", "application/xml")
+	rr = httptest.NewRecorder()
+	writeError(rr, req, err)
+
+	var xmlErr errorResponse
+	if err := xml.Unmarshal(rr.Body.Bytes(), &xmlErr); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusNotFound || xmlErr.Code != "NO_LOANS" || xmlErr.Message != "No loans found for this book" {
+		t.Errorf("unexpected XML error: %v %+v", rr.Code, xmlErr)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{librarypkg.ErrBookNotFound, http.StatusNotFound},
+		{librarypkg.ErrNoLoans, http.StatusNotFound},
+		{fmt.Errorf("%w for this borrower", librarypkg.ErrLoanNotFound), http.StatusNotFound},
+		{librarypkg.ErrNoCopies, http.StatusConflict},
+		{librarypkg.ErrAlreadyReserved, http.StatusConflict},
+		{fmt.Errorf("%w, 5 waiting", librarypkg.ErrReservationsFull), http.StatusConflict},
+		{librarypkg.ErrBookExists, http.StatusConflict},
+		{librarypkg.ErrISBNExists, http.StatusConflict},
+		{fmt.Errorf("%w, current version is 3", librarypkg.ErrVersionMismatch), http.StatusPreconditionFailed},
+		{librarypkg.ErrTitleRequired, http.StatusBadRequest},
+		{librarypkg.ErrNegativeCopies, http.StatusBadRequest},
+		{librarypkg.ErrInvalidISBN, http.StatusBadRequest},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("errorStatus(%q) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFilterBooks(t *testing.T) {
+	books := []librarypkg.BookDetail{
+		{Title: "Clean Code", Author: "Robert C. Martin", Year: 2008},
+		{Title: "Refactoring", Author: "Martin Fowler", Year: 1999},
+		{Title: "Design Patterns", Author: "Erich Gamma", Year: 1994},
+		{Title: "Go Programming"},
+	}
+
+	titles := func(books []librarypkg.BookDetail) string {
+		var names []string
+		for _, book := range books {
+			names = append(names, book.Title)
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct {
+		filter Filter
+		want   string
+	}{
+		{Filter{}, "Clean Code,Refactoring,Design Patterns,Go Programming"},
+		{Filter{Author: "martin"}, "Clean Code,Refactoring"},
+		{Filter{YearFrom: 1990, YearTo: 2005}, "Refactoring,Design Patterns"},
+		{Filter{Author: "MARTIN", YearFrom: 1990, YearTo: 2005}, "Refactoring"},
+		{Filter{YearFrom: 2000}, "Clean Code"},
+	}
+
+	for _, tt := range tests {
+		if got := titles(filterBooks(books, tt.filter)); got != tt.want {
+			t.Errorf("filterBooks(%+v) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestListBooksHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	library.LoadBook(librarypkg.BookDetail{Title: "Refactoring", Author: "Martin Fowler", Year: 1999})
+	library.LoadBook(librarypkg.BookDetail{Title: "Clean Architecture", Author: "Robert C. Martin", Year: 2017})
+
+	handler := http.HandlerFunc(srv.listBooksHandler)
+
+	// Test 1: Filters combine with pagination
+	req, err := http.NewRequest("GET", "/Books?author=martin&yearFrom=1990&limit=1&offset=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var page bookPage
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Books) != 1 || page.Books[0].Title != "Refactoring" {
+		t.Errorf("unexpected page: %+v", page)
+	}
+
+	// Test 2: Invalid year range
+	req, err = http.NewRequest("GET", "/Books?yearFrom=2010&yearTo=2000&limit=abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	var response struct {
+		Errors []fieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]bool{}
+	for _, e := range response.Errors {
+		fields[e.Field] = true
+	}
+	if !fields["yearFrom"] || !fields["limit"] {
+		t.Errorf("expected field errors for yearFrom and limit, got %+v", response.Errors)
+	}
+
+	// Test 3: A work's title lists all its editions and volumes
+	for _, book := range []librarypkg.BookDetail{
+		{Title: "Refactoring", Edition: "2nd edition", AvailableCopies: 1},
+		{Title: "Refactoring", Volume: 2, AvailableCopies: 1},
+		{Title: "Refactoring Databases", AvailableCopies: 1},
+	} {
+		if _, err := library.AddBook(book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/Books?title=refactoring", nil))
+	page = bookPage{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, book := range page.Books {
+		titles = append(titles, book.Title)
+	}
+	if want := []string{"Refactoring", "Refactoring (2nd edition)", "Refactoring, vol. 2"}; !slices.Equal(titles, want) {
+		t.Errorf("expected %v, got %v", want, titles)
+	}
+}
+
+func TestExtendAllHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	due := time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	goProgramming, _ := library.Book("Go Programming")
+	library.LoadBook(goProgramming,
+		librarypkg.LoanDetail{ID: "go", BookTitle: "Go Programming", NameOfBorrower: "John Doe", LoanDate: due.AddDate(0, 0, -28), ReturnDate: due},
+		librarypkg.LoanDetail{ID: "other", BookTitle: "Go Programming", NameOfBorrower: "Jane Smith", LoanDate: due.AddDate(0, 0, -28), ReturnDate: due},
+	)
+	cleanCode, _ := library.Book("Clean Code")
+	library.LoadBook(cleanCode,
+		librarypkg.LoanDetail{ID: "clean", BookTitle: "Clean Code", NameOfBorrower: "John Doe", LoanDate: due.AddDate(0, 0, -70), ReturnDate: due, Extensions: librarypkg.DefaultMaxExtensions},
+	)
+
+	bodyBytes, err := json.Marshal(map[string]string{"borrower": "John Doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/ExtendAll", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(srv.extendAllHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var results []librarypkg.ExtensionResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+
+	// Results are ordered by title, so Clean Code comes first
+	if results[0].Loan.ID != "clean" || results[0].Extended || results[0].Reason == "" {
+		t.Errorf("expected the capped loan to be skipped, got %+v", results[0])
+	}
+	if results[1].Loan.ID != "go" || !results[1].Extended || !results[1].Loan.ReturnDate.Equal(due.AddDate(0, 0, 21)) {
+		t.Errorf("expected Go Programming to be extended by 21 days, got %+v", results[1])
+	}
+
+	// Other borrowers' loans are untouched
+	if other := library.Loans()["Go Programming"][1]; !other.ReturnDate.Equal(due) {
+		t.Errorf("expected Jane Smith's loan to be untouched, got %v", other.ReturnDate)
+	}
+}
+
+func TestCreateBookWithEnrichment(t *testing.T) {
+	openLibrary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/isbn/9780132350884.json":
+			fmt.Fprint(w, `{"title": "Clean Code", "publish_date": "August 1, 2008", "authors": [{"key": "/authors/OL1A"}]}`)
+		case "/isbn/9780201485677.json":
+			fmt.Fprint(w, `{"title": "Refactoring", "publish_date": "1999", "authors": [{"key": "/authors/OL2A"}]}`)
+		case "/authors/OL1A.json":
+			fmt.Fprint(w, `{"name": "Robert C. Martin"}`)
+		case "/authors/OL2A.json":
+			fmt.Fprint(w, `{"name": "Martin Fowler"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer openLibrary.Close()
+
+	library := newTestLibrary(t)
+	library.Metadata = &librarypkg.OpenLibrary{BaseURL: openLibrary.URL, Client: openLibrary.Client()}
+	srv := &server{library: library}
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/Book?enrich=true", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.bookHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: A new ISBN is filled in from Open Library
+	rr := create(`{"isbn": "978-0-201-48567-7", "availableCopies": 2}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	var book librarypkg.BookDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Refactoring" || book.Author != "Martin Fowler" || book.Year != 1999 || book.AvailableCopies != 2 {
+		t.Errorf("unexpected book: %+v", book)
+	}
+
+	// Test 2: An ISBN resolving to an existing title merges the copies
+	rr = create(`{"isbn": "9780132350884", "availableCopies": 1}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	merged := library.Books()["Clean Code"]
+	if merged.AvailableCopies != 3 || merged.ISBN != "9780132350884" || merged.Author != "Robert C. Martin" || merged.Year != 2008 {
+		t.Errorf("unexpected merged book: %+v", merged)
+	}
+
+	// Test 3: A failed lookup asks for the details manually
+	rr = create(`{"isbn": "9780134190440", "availableCopies": 1}`)
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+	if len(library.Books()) != 3 {
+		t.Errorf("expected no book to be added on failed lookup, got %d books", len(library.Books()))
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	type received struct {
+		event     librarypkg.Event
+		signature string
+		body      []byte
+	}
+
+	var mu sync.Mutex
+	var events []received
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event librarypkg.Event
+		json.Unmarshal(body, &event)
+
+		mu.Lock()
+		events = append(events, received{event: event, signature: r.Header.Get(librarypkg.SignatureHeader), body: body})
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	// Fails twice before accepting the event
+	var flakyCalls int
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		flakyCalls++
+		if flakyCalls <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+
+	library := newTestLibrary(t)
+	library.Webhooks = librarypkg.NewWebhooks(2)
+	library.Webhooks.Backoff = time.Millisecond
+	srv := &server{library: library}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/webhooks", srv.registerWebhookHandler)
+	mux.HandleFunc("/admin/webhooks/{id}/deliveries", srv.webhookDeliveriesHandler)
+
+	register := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/admin/webhooks", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: Unknown event types are rejected
+	rr := register(`{"url": "` + receiver.URL + `", "events": ["book.stolen"]}`)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// Test 2: Register a receiver for borrows and a flaky one for returns
+	rr = register(`{"url": "` + receiver.URL + `", "events": ["book.borrowed"], "secret": "s3cret"}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	rr = register(`{"url": "` + flaky.URL + `", "events": ["book.returned"]}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var flakyHook librarypkg.Webhook
+	if err := json.Unmarshal(rr.Body.Bytes(), &flakyHook); err != nil {
+		t.Fatal(err)
+	}
+	if flakyHook.Secret == "" {
+		t.Error("expected a generated secret")
+	}
+
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	library.Webhooks.Close()
+
+	// Test 3: The borrow event arrives signed with the webhook's secret
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if events[0].event.Type != librarypkg.EventBookBorrowed || events[0].event.Borrower != "John Doe" {
+		t.Errorf("unexpected event: %+v", events[0].event)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(events[0].body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); events[0].signature != want {
+		t.Errorf("got signature %q, want %q", events[0].signature, want)
+	}
+
+	// Test 4: The flaky receiver gets the return event on the third attempt
+	req, err := http.NewRequest("GET", "/admin/webhooks/"+flakyHook.ID+"/deliveries", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var deliveries []librarypkg.WebhookDelivery
+	if err := json.Unmarshal(rr.Body.Bytes(), &deliveries); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 delivery attempts, got %d", len(deliveries))
+	}
+	for i, delivery := range deliveries {
+		if delivery.Attempt != i+1 || delivery.Delivered != (i == 2) {
+			t.Errorf("unexpected delivery %d: %+v", i, delivery)
+		}
+	}
+
+	// Test 5: Events after Close are dropped, and closing again is harmless
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	library.Webhooks.Close()
+	if len(events) != 1 {
+		t.Errorf("expected no events after Close, got %d", len(events))
+	}
+}
+
+func TestBookCategory(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxCopiesPerBorrowerPerTitle = 0
+	clock := useFakeClock(library, time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC))
+	handler := (&server{library: library}).routes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-Match", "*")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: The category is set on creation and returned
+	rr := do("POST", "/Book", `{"title": "Atlas", "category": "reference", "availableCopies": 2}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var book librarypkg.BookDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Category != "reference" {
+		t.Errorf("expected the reference category, got %q", book.Category)
+	}
+
+	borrow := func() librarypkg.LoanDetail {
+		rr := do("POST", "/Borrow", `{"title": "Atlas", "borrower": "John Doe"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var loan librarypkg.LoanDetail
+		if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+			t.Fatal(err)
+		}
+		return loan
+	}
+	if loan, want := borrow(), clock.Now().AddDate(0, 0, 7); !loan.ReturnDate.Equal(want) {
+		t.Errorf("got return date %v, want %v", loan.ReturnDate, want)
+	}
+
+	// Test 2: Moving the book to another category changes later loans
+	rr = do("PATCH", "/Book?title=Atlas", `{"category": "new"}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if loan, want := borrow(), clock.Now().AddDate(0, 0, 14); !loan.ReturnDate.Equal(want) {
+		t.Errorf("got return date %v, want %v", loan.ReturnDate, want)
+	}
+}
+
+func TestXMLResponses(t *testing.T) {
+	library := newTestLibrary(t)
+	handler := (&server{library: library}).routes()
+
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: A single book as XML
+	rr := get("/Book?title=Go+Programming", "application/xml")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/xml" {
+		t.Errorf("unexpected content type: %q", contentType)
+	}
+	var book librarypkg.BookDetail
+	if err := xml.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Go Programming" || book.AvailableCopies != 3 {
+		t.Errorf("unexpected book: %+v", book)
+	}
+	if !strings.Contains(rr.Body.String(), "<book><title>Go Programming</title>") {
+		t.Errorf("unexpected XML: %s", rr.Body.String())
+	}
+
+	// Test 2: The book list as XML
+	rr = get("/Books", "text/html;q=0.9, application/xml")
+	var page bookPage
+	if err := xml.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Books) != 2 {
+		t.Errorf("unexpected page: %+v", page)
+	}
+
+	// Test 3: JSON without an Accept header or when asked for
+	for _, accept := range []string{"", "application/json", "*/*"} {
+		rr = get("/Books", accept)
+		if contentType := rr.Header().Get("Content-Type"); rr.Code != http.StatusOK || contentType != "application/json" {
+			t.Errorf("Accept %q: got %v %q, want JSON", accept, rr.Code, contentType)
+		}
+	}
+
+	// Test 4: Anything else is not acceptable
+	if rr := get("/Book?title=Go+Programming", "text/csv"); rr.Code != http.StatusNotAcceptable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotAcceptable)
+	}
+	if vary := rr.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept" {
+		t.Errorf("expected Vary: Accept once, got %q", vary)
+	}
+
+	// Test 5: Loans and errors as XML
+	borrowed, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = get("/loans/"+borrowed.ID, "application/xml")
+	var loan librarypkg.LoanDetail
+	if err := xml.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || loan.ID != borrowed.ID || loan.NameOfBorrower != "John Doe" || !loan.ReturnDate.Equal(borrowed.ReturnDate) {
+		t.Errorf("unexpected loan: %v %+v", rr.Code, loan)
+	}
+	if !strings.Contains(rr.Body.String(), "<loan><id>"+borrowed.ID+"</id>") {
+		t.Errorf("unexpected XML: %s", rr.Body.String())
+	}
+
+	rr = get("/Book?title=Missing", "application/xml")
+	var xmlErr errorResponse
+	if err := xml.Unmarshal(rr.Body.Bytes(), &xmlErr); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusNotFound || xmlErr.Code != "BOOK_NOT_FOUND" {
+		t.Errorf("unexpected error: %v %+v", rr.Code, xmlErr)
+	}
+}
+
+func TestReferenceOnly(t *testing.T) {
+	library := newTestLibrary(t)
+	handler := (&server{library: library}).routes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-Match", "*")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	expectReferenceOnly := func(rr *httptest.ResponseRecorder) {
+		t.Helper()
+		if code := rr.Header().Get(errorCodeHeader); rr.Code != http.StatusConflict || code != "REFERENCE_ONLY" {
+			t.Errorf("expected a 409 REFERENCE_ONLY, got %v %q", rr.Code, code)
+		}
+	}
+
+	// Test 1: Reference books can't be borrowed or reserved
+	if rr := do("POST", "/Book", `{"title": "Atlas", "availableCopies": 1, "reference": true}`); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	expectReferenceOnly(do("POST", "/Borrow", `{"title": "Atlas", "borrower": "John Doe"}`))
+	expectReferenceOnly(do("POST", "/Reserve", `{"title": "Atlas", "borrower": "John Doe"}`))
+	if rr := do("POST", "/Borrow/batch", `{"borrower": "John Doe", "titles": ["Atlas"]}`); !strings.Contains(rr.Body.String(), "reference only") {
+		t.Errorf("expected the batch to report Atlas as reference only, got %s", rr.Body.String())
+	}
+
+	// Test 2: They are still listed, with the flag
+	rr := do("GET", "/Book?title=Atlas", "")
+	if !strings.Contains(rr.Body.String(), `"reference":true`) {
+		t.Errorf("expected the reference flag, got %s", rr.Body.String())
+	}
+
+	// Test 3: Flipping a book keeps its loans out working
+	if rr := do("POST", "/Borrow", `{"title": "Clean Code", "borrower": "John Doe"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := do("PATCH", "/Book?title=Clean+Code", `{"reference": true}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	expectReferenceOnly(do("POST", "/Borrow", `{"title": "Clean Code", "borrower": "Jane Doe"}`))
+	if rr := do("POST", "/Extend", `{"title": "Clean Code", "borrower": "John Doe"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := do("POST", "/Return", `{"title": "Clean Code", "borrower": "John Doe"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if copies := library.Books()["Clean Code"].AvailableCopies; copies != 2 {
+		t.Errorf("expected the copy back on the shelf, got %d", copies)
+	}
+}
+
+func TestPopularBooksHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	start := time.Date(2024, time.March, 4, 10, 0, 0, 0, time.UTC)
+	clock := useFakeClock(library, start)
+	srv := &server{library: library}
+
+	get := func(target string) ([]librarypkg.PopularBook, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.popularBooksHandler).ServeHTTP(rr, req)
+		var popular []librarypkg.PopularBook
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &popular); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return popular, rr
+	}
+
+	// Clean Code is borrowed once in March, Go Programming twice in April
+	// with one copy still out
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Set(start.AddDate(0, 1, 0))
+	for _, borrower := range []string{"John Doe", "Jane Doe"} {
+		if _, err := library.Borrow("Go Programming", borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := library.Return("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: All time, most borrowed first with current availability
+	popular, rr := get("/Book/popular")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	want := []librarypkg.PopularBook{
+		{Title: "Go Programming", Borrows: 2, AvailableCopies: 2},
+		{Title: "Clean Code", Borrows: 1, AvailableCopies: 2},
+	}
+	if len(popular) != 2 || popular[0] != want[0] || popular[1] != want[1] {
+		t.Errorf("got %+v, want %+v", popular, want)
+	}
+
+	// Test 2: A date range and a limit
+	popular, _ = get("/Book/popular?until=2024-03-31T00:00:00Z")
+	if len(popular) != 1 || popular[0].Title != "Clean Code" {
+		t.Errorf("expected only Clean Code before April, got %+v", popular)
+	}
+	popular, _ = get("/Book/popular?since=2024-03-31T00:00:00Z&limit=5")
+	if len(popular) != 1 || popular[0].Title != "Go Programming" {
+		t.Errorf("expected only Go Programming since April, got %+v", popular)
+	}
+	popular, _ = get("/Book/popular?limit=1")
+	if len(popular) != 1 || popular[0].Title != "Go Programming" {
+		t.Errorf("expected the top title only, got %+v", popular)
+	}
+
+	// Test 3: Invalid parameters
+	for _, target := range []string{"/Book/popular?limit=0", "/Book/popular?since=yesterday", "/Book/popular?since=2024-05-01T00:00:00Z&until=2024-04-01T00:00:00Z"} {
+		if _, rr := get(target); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", target, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestInventoryHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	library.LoadBook(librarypkg.BookDetail{Title: "Go Programming", AvailableCopies: 3, TotalCopies: 5})
+
+	req, err := http.NewRequest("GET", "/admin/inventory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	srv.inventoryHandler(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var report librarypkg.InventoryReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Discrepancies) != 1 || report.Discrepancies[0].Title != "Go Programming" || report.Discrepancies[0].Difference != 2 {
+		t.Errorf("expected Go Programming to be 2 copies short, got %+v", report)
+	}
+}
+
+func TestPutBookHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	put := func(title, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/Book?title="+url.QueryEscape(title), strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-Match", "*")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.bookHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	loan, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Unknown title
+	rr := put("Missing Book", `{"title": "Missing Book"}`)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// Test 2: Renaming onto an existing title
+	rr = put("Go Programming", `{"title": "Clean Code"}`)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	// Test 3: Rename and fill in the metadata
+	rr = put("Go Programming", `{"title": "The Go Programming Language", "author": "Alan Donovan", "isbn": "978-0134190440", "year": 2015, "availableCopies": 99}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var book librarypkg.BookDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "The Go Programming Language" || book.Author != "Alan Donovan" || book.ISBN != "9780134190440" {
+		t.Errorf("unexpected book: %+v", book)
+	}
+	if book.AvailableCopies != 2 {
+		t.Errorf("expected copy count to be preserved, got %d", book.AvailableCopies)
+	}
+
+	if _, exists := library.Books()["Go Programming"]; exists {
+		t.Error("expected old title to be removed")
+	}
+	if _, exists := library.Loans()["Go Programming"]; exists {
+		t.Error("expected loans to move to the new title")
+	}
+	loans := library.Loans()["The Go Programming Language"]
+	if len(loans) != 1 || loans[0].ID != loan.ID || loans[0].BookTitle != "The Go Programming Language" {
+		t.Errorf("unexpected loans after rename: %+v", loans)
+	}
+
+	// Test 4: The moved loan can be returned under the new title
+	if _, err := library.ReturnLoan(loan.ID); err != nil {
+		t.Errorf("failed to return renamed loan: %v", err)
+	}
+
+	// Test 5: A stale or missing If-Match is rejected
+	putVersion := func(ifMatch string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/Book?title="+url.QueryEscape("Clean Code"), strings.NewReader(`{"title": "Clean Code", "year": 2008}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.bookHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := putVersion(""); rr.Code != http.StatusPreconditionRequired {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusPreconditionRequired)
+	}
+	current := library.Books()["Clean Code"].Version
+	rr = putVersion(`"` + strconv.Itoa(current+1) + `"`)
+	if status := rr.Code; status != http.StatusPreconditionFailed {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPreconditionFailed)
+	}
+	if want := "current version is " + strconv.Itoa(current); !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("expected %q in body, got %s", want, rr.Body.String())
+	}
+	rr = putVersion(`"` + strconv.Itoa(current) + `"`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if etag := rr.Header().Get("ETag"); etag != `"`+strconv.Itoa(current+1)+`"` {
+		t.Errorf("unexpected ETag after replace: %s", etag)
+	}
+}
+
+func TestBorrowBatch(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxLoansPerBorrower = 4
+	library.MaxCopiesPerBorrowerPerTitle = 0
+	srv := &server{library: library}
+
+	borrow := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/Borrow/batch", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.borrowBatchHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	copies := func() (int, int) {
+		return library.Books()["Go Programming"].AvailableCopies, library.Books()["Clean Code"].AvailableCopies
+	}
+
+	// Test 1: Any unavailable title fails the whole batch and is listed
+	rr := borrow(`{"borrower": "John Doe", "titles": ["Missing Book", "Clean Code", "Clean Code", "Clean Code"]}`)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+	if code := rr.Header().Get(errorCodeHeader); code != "BATCH_UNAVAILABLE" {
+		t.Errorf("unexpected error code: %q", code)
+	}
+	var failed batchUnavailableResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed.Unavailable) != 2 || failed.Unavailable[0].Title != "Missing Book" || failed.Unavailable[1].Title != "Clean Code" {
+		t.Errorf("expected Missing Book and Clean Code to be unavailable, got %+v", failed.Unavailable)
+	}
+	if goCopies, cleanCopies := copies(); goCopies != 3 || cleanCopies != 2 || len(library.Loans()) != 0 {
+		t.Errorf("failed batch changed state: %d and %d copies, %d loans", goCopies, cleanCopies, len(library.Loans()))
+	}
+
+	// Test 2: A title listed twice borrows two copies
+	rr = borrow(`{"borrower": "John Doe", "titles": ["Clean Code", "Go Programming", "Clean Code"]}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var loans []librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &loans); err != nil {
+		t.Fatal(err)
+	}
+	if len(loans) != 3 || loans[0].ID == "" || loans[0].ID == loans[2].ID || loans[1].BookTitle != "Go Programming" {
+		t.Errorf("unexpected loans: %+v", loans)
+	}
+	if goCopies, cleanCopies := copies(); goCopies != 2 || cleanCopies != 0 {
+		t.Errorf("expected 2 and 0 copies left, got %d and %d", goCopies, cleanCopies)
+	}
+
+	// Test 3: The loan limit counts the whole batch
+	rr = borrow(`{"borrower": "John Doe", "titles": ["Go Programming", "Go Programming"]}`)
+	if code := rr.Header().Get(errorCodeHeader); rr.Code != http.StatusConflict || code != "LOAN_LIMIT" {
+		t.Errorf("expected a loan limit conflict, got %v %q", rr.Code, code)
+	}
+	if goCopies, _ := copies(); goCopies != 2 {
+		t.Errorf("loan limit failure changed copies to %d", goCopies)
+	}
+
+	// Test 4: Empty batches are rejected
+	if rr := borrow(`{"borrower": "John Doe", "titles": []}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestReturnBatch(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	first, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	other, err := library.Borrow("Go Programming", "Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	returnBatch := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/Return/batch", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.returnBatchHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: Valid items are returned even when others fail
+	rr := returnBatch(`{"borrower": "John Doe", "items": [
+		{"loanId": "` + first.ID + `"},
+		{"title": "Missing Book"},
+		{"loanId": "` + other.ID + `"},
+		{"title": "Clean Code"},
+		{"title": "Clean Code"},
+		{"loanId": "unknown"}
+	]}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var results []librarypkg.ReturnResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 6 {
+		t.Fatalf("expected a result per item, got %+v", results)
+	}
+	for i, want := range []bool{true, false, false, true, false, false} {
+		if results[i].Returned != want {
+			t.Errorf("item %d: got returned %v, want %v (%s)", i, results[i].Returned, want, results[i].Reason)
+		}
+		if !want && results[i].Reason == "" {
+			t.Errorf("item %d: expected a reason", i)
+		}
+	}
+	if results[0].Receipt == nil || results[0].Receipt.Loan.ID != first.ID {
+		t.Errorf("expected a receipt for the returned loan, got %+v", results[0])
+	}
+
+	// Test 2: Only closed loans put copies back
+	if copies := library.Books()["Go Programming"].AvailableCopies; copies != 2 {
+		t.Errorf("expected 2 copies of Go Programming, got %d", copies)
+	}
+	if copies := library.Books()["Clean Code"].AvailableCopies; copies != 2 {
+		t.Errorf("expected 2 copies of Clean Code, got %d", copies)
+	}
+	if loans := library.Loans()["Go Programming"]; len(loans) != 1 || loans[0].ID != other.ID {
+		t.Errorf("expected Jane Doe's loan to stay open, got %+v", loans)
+	}
+
+	// Test 3: Items need a loan ID or a title
+	if rr := returnBatch(`{"borrower": "John Doe", "items": [{}]}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if rr := returnBatch(`{"borrower": "John Doe"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	// Test 4: A list of titles returns part of a batch borrow
+	if _, err := library.BorrowBatch("Jim Beam", []string{"Go Programming", "Clean Code"}); err != nil {
+		t.Fatal(err)
+	}
+	rr = returnBatch(`{"borrower": "Jim Beam", "titles": ["clean code", "Missing Book"]}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	results = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Returned || results[1].Returned || results[1].Item.Title != "Missing Book" {
+		t.Errorf("expected Clean Code returned and Missing Book reported, got %+v", results)
+	}
+	if loans := library.BorrowerLoans("Jim Beam"); len(loans) != 1 || loans[0].BookTitle != "Go Programming" {
+		t.Errorf("expected Go Programming to stay out, got %+v", loans)
+	}
+
+	// Test 5: POST /ReturnBatch does the same, for members their own loans only
+	handler := requireToken([]apiToken{{Token: "jim", Role: roleMember, Member: "Jim Beam"}}, false, srv.routes())
+	returnBatchAt := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/ReturnBatch", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer jim")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := returnBatchAt(`{"borrower": "Jane Doe", "titles": ["Go Programming"]}`); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	rr = returnBatchAt(`{"borrower": "Jim Beam", "titles": ["Go Programming"]}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if loans := library.BorrowerLoans("Jim Beam"); len(loans) != 0 {
+		t.Errorf("expected Jim Beam's loans all returned, got %+v", loans)
+	}
+}
+
+func TestLoanResource(t *testing.T) {
+	library := newTestLibrary(t)
+	handler := (&server{library: library}).routes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(target string) (librarypkg.LoanDetail, *httptest.ResponseRecorder) {
+		rr := do("GET", target, "")
+		var loan librarypkg.LoanDetail
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return loan, rr
+	}
+
+	// Test 1: Borrowing points at the new loan
+	rr := do("POST", "/Borrow", `{"title": "Go Programming", "borrower": "John Doe"}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var borrowed librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &borrowed); err != nil {
+		t.Fatal(err)
+	}
+	location := rr.Header().Get("Location")
+	if location != "/loans/"+borrowed.ID {
+		t.Fatalf("unexpected Location header: %q", location)
+	}
+
+	loan, rr := get(location)
+	if rr.Code != http.StatusOK || loan.ID != borrowed.ID || !loan.ReturnDate.Equal(borrowed.ReturnDate) {
+		t.Fatalf("unexpected loan at %s: %v %s", location, rr.Code, rr.Body.String())
+	}
+
+	// Test 2: The resource reflects extensions
+	if rr := do("POST", "/Extend", `{"title": "Go Programming", "borrower": "John Doe"}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	loan, _ = get(location)
+	if want := borrowed.ReturnDate.AddDate(0, 0, librarypkg.DefaultExtensionDays); !loan.ReturnDate.Equal(want) || loan.Extensions != 1 {
+		t.Errorf("expected the extended loan due %v, got %+v", want, loan)
+	}
+
+	// Test 3: A returned loan is a 404 with its closed record
+	if _, err := library.ReturnLoan(borrowed.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, rr = get(location)
+	if code := rr.Header().Get(errorCodeHeader); rr.Code != http.StatusNotFound || code != "LOAN_RETURNED" {
+		t.Errorf("expected a 404 LOAN_RETURNED, got %v %q", rr.Code, code)
+	}
+	var returned returnedLoanResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &returned); err != nil {
+		t.Fatal(err)
+	}
+	if returned.Status != "returned" || returned.Loan.ID != borrowed.ID || returned.Loan.ReturnedAt.IsZero() {
+		t.Errorf("unexpected returned loan: %+v", returned)
+	}
+
+	// Test 4: A loan that never existed has a different code
+	_, rr = get("/loans/unknown")
+	if code := rr.Header().Get(errorCodeHeader); rr.Code != http.StatusNotFound || code != "LOAN_NOT_FOUND" {
+		t.Errorf("expected a 404 LOAN_NOT_FOUND, got %v %q", rr.Code, code)
+	}
+}
+
+func TestLostAndDamagedHandlers(t *testing.T) {
+	library := newTestLibrary(t)
+	library.ReplacementFee = 1500
+	handler := (&server{library: library}).routes()
+
+	post := func(target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	lost, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged, err := library.Borrow("Go Programming", "Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Report a copy lost
+	rr := post("/loans/" + lost.ID + "/lost")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var receipt librarypkg.ReturnReceipt
+	if err := json.Unmarshal(rr.Body.Bytes(), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.ReplacementFee != 1500 || receipt.Loan.Status != librarypkg.LoanLost {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+
+	// Test 2: Return a copy damaged
+	if rr := post("/loans/" + damaged.ID + "/damaged"); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if book := library.Books()["Go Programming"]; book.TotalCopies != 2 || book.AvailableCopies != 1 || book.InRepair != 1 {
+		t.Errorf("expected 1 of 2 copies in repair, got %+v", book)
+	}
+
+	// Test 3: The closed loan says how it was closed
+	req, err := http.NewRequest("GET", "/loans/"+lost.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var closed returnedLoanResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &closed); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusNotFound || closed.Status != librarypkg.LoanLost {
+		t.Errorf("expected a 404 for the lost loan, got %v %+v", rr.Code, closed)
+	}
+
+	// Test 4: A closed loan can't be reported again, and GET isn't allowed
+	if rr := post("/loans/" + lost.ID + "/damaged"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	req, err = http.NewRequest("GET", "/loans/"+damaged.ID+"/lost", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestLostHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	report := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/Lost", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.lostBookHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	cost := 2500
+	if _, err := library.UpdateBook("Go Programming", librarypkg.AnyVersion, librarypkg.BookUpdate{ReplacementCost: &cost}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	byID, err := library.Borrow("Go Programming", "Jane Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Report a loss by title and borrower
+	rr := report(`{"title": "Go Programming", "borrower": "John Doe"}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var receipt librarypkg.ReturnReceipt
+	if err := json.Unmarshal(rr.Body.Bytes(), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if receipt.ReplacementFee != 2500 || receipt.Loan.Status != librarypkg.LoanLost {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+
+	// Test 2: Report a loss by loan ID
+	if rr := report(`{"loanId": "` + byID.ID + `"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 3: The shelf is untouched, the copies are written off and the
+	// losses are in the history
+	if book := library.Books()["Go Programming"]; book.AvailableCopies != 1 || book.TotalCopies != 1 {
+		t.Errorf("expected 1 of 1 copies available, got %+v", book)
+	}
+	for _, loan := range library.History {
+		if loan.Status != librarypkg.LoanLost {
+			t.Errorf("expected only lost loans in the history, got %+v", loan)
+		}
+	}
+	if len(library.History) != 2 {
+		t.Errorf("expected 2 loans in the history, got %d", len(library.History))
+	}
+
+	// Test 4: Unknown loans and missing fields
+	if rr := report(`{"title": "Go Programming", "borrower": "John Doe"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := report(`{"title": "Go Programming"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestDueDateHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	start := time.Date(2024, time.September, 2, 10, 0, 0, 0, time.UTC)
+	clock := useFakeClock(library, start)
+	library.Audit = librarypkg.NewAuditLog(0)
+	handler := (&server{library: library}).routes()
+
+	put := func(id, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/admin/loans/"+id+"/due-date", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder) librarypkg.LoanDetail {
+		var loan librarypkg.LoanDetail
+		if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+			t.Fatal(err)
+		}
+		return loan
+	}
+
+	library.MaxExtensions = 0
+	loan, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Lengthen a loan to the end of the semester, past the extension limit
+	rr := put(loan.ID, `{"dueDate": "2024-12-20T17:00:00Z"}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	semester := time.Date(2024, time.December, 20, 17, 0, 0, 0, time.UTC)
+	if got := decode(rr); !got.ReturnDate.Equal(semester) || !got.DueOverridden {
+		t.Errorf("expected the loan due %v, got %+v", semester, got)
+	}
+
+	// Test 2: Shorten it for a recall
+	recall := start.AddDate(0, 0, 3)
+	rr = put(loan.ID, `{"dueDate": "`+recall.Format(time.RFC3339)+`"}`)
+	if got := decode(rr); rr.Code != http.StatusOK || !got.ReturnDate.Equal(recall) {
+		t.Errorf("expected the loan due %v, got %v %+v", recall, rr.Code, got)
+	}
+
+	// Test 3: A date in the past needs force, one before the loan is never allowed
+	clock.Set(start.AddDate(0, 0, 5))
+	past := start.AddDate(0, 0, 1).Format(time.RFC3339)
+	rr = put(loan.ID, `{"dueDate": "`+past+`"}`)
+	if code := rr.Header().Get(errorCodeHeader); rr.Code != http.StatusBadRequest || code != "DUE_IN_PAST" {
+		t.Errorf("expected a 400 DUE_IN_PAST, got %v %q", rr.Code, code)
+	}
+	if rr := put(loan.ID, `{"dueDate": "`+past+`", "force": true}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr = put(loan.ID, `{"dueDate": "2024-09-01T00:00:00Z", "force": true}`)
+	if code := rr.Header().Get(errorCodeHeader); rr.Code != http.StatusBadRequest || code != "DUE_BEFORE_LOAN" {
+		t.Errorf("expected a 400 DUE_BEFORE_LOAN, got %v %q", rr.Code, code)
+	}
+
+	// Test 4: Invalid timestamps and unknown loans
+	if rr := put(loan.ID, `{"dueDate": "next friday"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := put("unknown", `{"dueDate": "2024-12-20T17:00:00Z"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 5: Overrides are audited
+	entries := library.Audit.Entries(librarypkg.AuditFilter{Action: librarypkg.AuditDueDate})
+	if len(entries) != 6 || entries[0].Borrower != "John Doe" {
+		t.Errorf("expected 6 audited overrides, got %+v", entries)
+	}
+}
+
+func TestLoanUpdateHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PATCH", "/Loan", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.loanUpdateHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	typo, err := library.Borrow("Go Programming", "Jhon Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := library.Borrow("Clean Code", "Jane Deo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Correct a loan found by title and the misspelt name
+	rr := patch(`{"title": "Go Programming", "borrower": "Jhon Doe", "newBorrower": "John Doe"}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var loan librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+		t.Fatal(err)
+	}
+	if loan.ID != typo.ID || loan.NameOfBorrower != "John Doe" {
+		t.Errorf("unexpected loan: %+v", loan)
+	}
+	if _, err := library.Return("Go Programming", "John Doe"); err != nil {
+		t.Errorf("expected the corrected loan to be returnable, got %v", err)
+	}
+
+	// Test 2: Correct a loan found by ID
+	if rr := patch(`{"loanId": "` + other.ID + `", "newBorrower": "Jane Doe"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if loans := library.Loans()["Clean Code"]; len(loans) != 1 || loans[0].NameOfBorrower != "Jane Doe" {
+		t.Errorf("expected the borrower to be corrected, got %+v", loans)
+	}
+
+	// Test 3: Unknown loans and invalid names
+	if rr := patch(`{"loanId": "unknown", "newBorrower": "Jane Doe"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := patch(`{"loanId": "` + other.ID + `", "newBorrower": ""}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	long := strings.Repeat("x", maxNameLength+1)
+	if rr := patch(`{"loanId": "` + other.ID + `", "newBorrower": "` + long + `"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestBorrowDryRun(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxLoansPerBorrower = 1
+	clock := useFakeClock(library, time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC))
+	srv := &server{library: library}
+
+	borrow := func(query, title string) *httptest.ResponseRecorder {
+		body := `{"title": "` + title + `", "borrower": "John Doe"}`
+		req, err := http.NewRequest("POST", "/Borrow"+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.borrowBookHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: A dry run returns the would-be loan without borrowing
+	rr := borrow("?dryRun=true", "Go Programming")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var preview struct {
+		DryRun bool                  `json:"dryRun"`
+		Loan   librarypkg.LoanDetail `json:"loan"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if !preview.DryRun || preview.Loan.ID != "" {
+		t.Errorf("unexpected dry run response: %s", rr.Body.String())
+	}
+	if want := clock.Now().AddDate(0, 0, librarypkg.DefaultLoanDays); !preview.Loan.ReturnDate.Equal(want) {
+		t.Errorf("got return date %v, want %v", preview.Loan.ReturnDate, want)
+	}
+	if copies := library.Books()["Go Programming"].AvailableCopies; copies != 3 || len(library.Loans()) != 0 {
+		t.Errorf("dry run changed state: %d copies, %d loans", copies, len(library.Loans()))
+	}
+
+	// Test 2: A dry run reports the same errors as a real borrow
+	if rr := borrow("?dryRun=true", "Missing Book"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if rr := borrow("", "Go Programming"); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := borrow("?dryRun=true", "Clean Code"); rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	library := newTestLibrary(t)
+	for i := range 30 {
+		if _, err := library.AddBook(librarypkg.BookDetail{Title: fmt.Sprintf("Book %02d", i), Author: "Jane Doe", AvailableCopies: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := compressResponses((&server{library: library}).routes())
+
+	get := func(target, acceptEncoding string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: A large listing is gzipped and decompresses to the plain JSON
+	plain := get("/Books", "")
+	if encoding := plain.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("expected no compression without Accept-Encoding, got %q", encoding)
+	}
+	rr := get("/Books", "gzip, deflate")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if encoding := rr.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("expected a gzipped response, got %q", encoding)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("handler returned wrong content type: got %v want %v", ct, "application/json")
+	}
+	reader, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Errorf("decompressed body differs from the plain one:\n%s\n%s", body, plain.Body.Bytes())
+	}
+
+	// Test 2: Small responses, errors included, and gzip;q=0 go uncompressed
+	for _, rr := range []*httptest.ResponseRecorder{
+		get("/Book?title=Clean+Code", "gzip"),
+		get("/Book?title=Missing", "gzip"),
+		get("/Books", "gzip;q=0"),
+	} {
+		if encoding := rr.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("expected no compression, got %q for %s", encoding, rr.Body.String())
+		}
+	}
+	if rr := get("/Book?title=Missing", "gzip"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 3: Event streams still flush through the middleware
+	ts := httptest.NewServer(compressResponses(http.HandlerFunc((&server{library: library}).eventsHandler)))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		t.Errorf("expected an uncompressed stream, got %q", encoding)
+	}
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "event: book.borrowed\n" {
+		t.Errorf("expected the borrow event, got %q, %v", line, err)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	mux := (&server{library: newTestLibrary(t)}).routes()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		panic("store is broken")
+	})
+	mux.HandleFunc("/panic-midway", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("title,availableCopies\n"))
+		panic("store broke halfway")
+	})
+	ts := httptest.NewServer(recoverPanics(mux))
+	defer ts.Close()
+
+	// Test 1: A panic becomes a JSON 500 that leaks nothing
+	req, _ := http.NewRequest("GET", ts.URL+"/panic", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected a JSON error, got %q", ct)
+	}
+	var got errorResponse
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("expected a JSON body, got %q: %v", body, err)
+	}
+	if got.Code != "INTERNAL" || strings.Contains(string(body), "store is broken") {
+		t.Errorf("expected an INTERNAL error without the panic value, got %q", body)
+	}
+	if id := resp.Header.Get(requestIDHeader); id != "req-42" {
+		t.Errorf("expected the request ID to be echoed, got %q", id)
+	}
+
+	// Test 2: A panic after the response started aborts it instead
+	resp, err = http.Get(ts.URL + "/panic-midway")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("expected the truncated response to fail, got status %v", resp.StatusCode)
+	}
+
+	// Test 3: The server keeps serving, and generates request IDs
+	resp, err = http.Get(ts.URL + "/Book?title=Go+Programming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	if resp.Header.Get(requestIDHeader) == "" {
+		t.Errorf("expected a generated request ID")
+	}
+}
+
+// blockingMetadata is a metadata source that hangs until the caller gives up.
+type blockingMetadata struct{}
+
+func (blockingMetadata) LookupISBN(ctx context.Context, isbn string) (librarypkg.BookDetail, error) {
+	<-ctx.Done()
+	return librarypkg.BookDetail{}, ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Metadata = blockingMetadata{}
+	handler := (&server{library: library, timeout: 50 * time.Millisecond}).routes()
+
+	// Test 1: A hung lookup is answered with a 503 once the timeout passes
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest("POST", "/Book?enrich=true", strings.NewReader(`{"isbn": "978-0-201-48567-7", "availableCopies": 1}`))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		done <- rr
+	}()
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+		}
+		if code := rr.Header().Get(errorCodeHeader); code != "TIMEOUT" {
+			t.Errorf("expected error code TIMEOUT, got %q", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request hung past its timeout")
+	}
+
+	// Test 2: Scans give up on a request that is already done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/Book/popular", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	// Test 3: Requests within the timeout are unaffected
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/Book/popular", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestMemberCalendarHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	if _, err := library.AddMember(librarypkg.Member{Name: "John Doe", Email: "john@example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	loan, err := library.Borrow("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requireToken([]apiToken{
+		{Token: "john", Role: roleMember, Member: "John Doe"},
+		{Token: "jane", Role: roleMember, Member: "Jane Smith"},
+	}, true, srv.routes())
+	get := func(target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: The feed has an event on the due date of each loan
+	rr := get("/Members/John%20Doe/calendar.ics", "john")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/calendar; charset=utf-8" {
+		t.Errorf("handler returned wrong content type: got %v want %v", ct, "text/calendar; charset=utf-8")
+	}
+	for _, want := range []string{"UID:loan-" + loan.ID + "@library\r\n", "SUMMARY:Clean Code\r\n", "DTSTART;VALUE=DATE:" + loan.ReturnDate.Format("20060102") + "\r\n"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q in the feed, got %s", want, rr.Body.String())
+		}
+	}
+
+	// Test 2: Calendar apps can pass the token in the URL instead
+	if rr := get("/Members/John%20Doe/calendar.ics?token=john", ""); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := get("/Book?title=Clean+Code&token=john", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// Test 3: Members only get their own feed, and only members have one
+	if rr := get("/Members/John%20Doe/calendar.ics", "jane"); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := get("/Members/Jane%20Smith/calendar.ics", "jane"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestLoanTransferHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Audit = librarypkg.NewAuditLog(10)
+	handler := (&server{library: library}).routes()
+	loan, err := library.Borrow("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/Loan/transfer", strings.NewReader(body)))
+		return rr
+	}
+
+	// Test 1: The loan moves to the new borrower with its due date
+	rr := transfer(`{"title": "Clean Code", "borrower": "John Doe", "newBorrower": "Jane Smith"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var got librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != loan.ID || got.NameOfBorrower != "Jane Smith" || !got.ReturnDate.Equal(loan.ReturnDate) {
+		t.Errorf("expected loan %+v transferred to Jane Smith, got %+v", loan, got)
+	}
+	if entries := library.Audit.Entries(librarypkg.AuditFilter{}); len(entries) != 1 || entries[0].Action != librarypkg.AuditTransfer {
+		t.Errorf("expected a loan.transfer audit entry, got %+v", entries)
+	}
+
+	// Test 2: Transfers to the same borrower or of a missing loan fail
+	if rr := transfer(`{"title": "Clean Code", "borrower": "Jane Smith", "newBorrower": "Jane Smith"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if rr := transfer(`{"title": "Clean Code", "borrower": "John Doe", "newBorrower": "Bob"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestLoanTransferByIDHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Audit = librarypkg.NewAuditLog(10)
+	library.MaxLoansPerBorrower = 1
+	handler := (&server{library: library}).routes()
+	loan, err := library.Borrow("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := func(id, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/loans/"+id+"/transfer", strings.NewReader(body)))
+		return rr
+	}
+
+	// Test 1: The loan moves to the new borrower with its due date
+	rr := transfer(loan.ID, `{"newBorrower": "Jane Smith"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var got librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != loan.ID || got.NameOfBorrower != "Jane Smith" || !got.ReturnDate.Equal(loan.ReturnDate) || !slices.Equal(got.PreviousBorrowers, []string{"John Doe"}) {
+		t.Errorf("expected loan %+v transferred to Jane Smith, got %+v", loan, got)
+	}
+	if entries := library.Audit.Entries(librarypkg.AuditFilter{}); len(entries) != 1 || entries[0].Action != librarypkg.AuditTransfer || entries[0].Title != "Clean Code" {
+		t.Errorf("expected a loan.transfer audit entry, got %+v", entries)
+	}
+
+	// Test 2: A borrower at the loan limit can't receive it
+	if _, err := library.Borrow("Go Programming", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	rr = transfer(loan.ID, `{"newBorrower": "Bob"}`)
+	if rr.Code != http.StatusConflict || rr.Header().Get(errorCodeHeader) != "LOAN_LIMIT" {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Test 3: Missing loans and borrowers fail
+	if rr := transfer("missing", `{"newBorrower": "Bob"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := transfer(loan.ID, `{}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	// Test 4: Members can't transfer loans, not even their own
+	tokens := []apiToken{{Token: "jane", Role: roleMember, Member: "Jane Smith"}}
+	req := httptest.NewRequest("POST", "/loans/"+loan.ID+"/transfer", strings.NewReader(`{"newBorrower": "Carol"}`))
+	req.Header.Set("Authorization", "Bearer jane")
+	rr = httptest.NewRecorder()
+	requireToken(tokens, false, handler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestNewBooksFeed(t *testing.T) {
+	library := librarypkg.NewLibrary()
+	clock := useFakeClock(library, time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	handler := (&server{library: library}).routes()
+	for i := 0; i < newBooksFeedSize+2; i++ {
+		clock.Set(clock.Now().Add(time.Hour))
+		if _, err := library.AddBook(librarypkg.BookDetail{Title: fmt.Sprintf("Book %02d", i), Author: "A. Writer", Year: 2000 + i, AvailableCopies: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newest := clock.Now()
+	get := func(since string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", newBooksPath, nil)
+		if since != "" {
+			req.Header.Set("If-Modified-Since", since)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: The feed is valid Atom listing the newest books first
+	rr := get("")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var feed struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string   `xml:"id"`
+		Title   string   `xml:"title"`
+		Updated string   `xml:"updated"`
+		Author  string   `xml:"author>name"`
+		Entries []struct {
+			ID      string `xml:"id"`
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+			Link    struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(rr.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("feed isn't valid XML: %v", err)
+	}
+	if feed.ID == "" || feed.Title == "" || feed.Author == "" || feed.Updated != newest.Format(time.RFC3339) {
+		t.Errorf("feed is missing required elements: %+v", feed)
+	}
+	if len(feed.Entries) != newBooksFeedSize {
+		t.Fatalf("expected %d entries, got %d", newBooksFeedSize, len(feed.Entries))
+	}
+	for _, entry := range feed.Entries {
+		if entry.ID == "" || entry.Title == "" || entry.Link.Href == "" {
+			t.Errorf("entry is missing required elements: %+v", entry)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("entry %q has invalid updated %q", entry.Title, entry.Updated)
+		}
+	}
+	if first := feed.Entries[0]; first.Title != fmt.Sprintf("Book %02d", newBooksFeedSize+1) || first.ID != "tag:library,2024-03-03:books/Book%20"+fmt.Sprint(newBooksFeedSize+1) {
+		t.Errorf("expected the newest book first, got %+v", first)
+	}
+
+	// Test 2: Entry IDs stay the same across fetches
+	if again := get(""); !strings.Contains(again.Body.String(), "<id>"+feed.Entries[0].ID+"</id>") {
+		t.Errorf("expected entry ID %q again, got %s", feed.Entries[0].ID, again.Body.String())
+	}
+
+	// Test 3: Readers that are up to date get a 304
+	lastModified := rr.Header().Get("Last-Modified")
+	if lastModified != newest.Format(http.TimeFormat) {
+		t.Errorf("expected Last-Modified %q, got %q", newest.Format(http.TimeFormat), lastModified)
+	}
+	if rr := get(lastModified); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+	if rr := get(newest.Add(-time.Hour).Format(http.TimeFormat)); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 4: A new book changes the feed again
+	clock.Set(newest.Add(time.Minute))
+	library.AddBook(librarypkg.BookDetail{Title: "Latest", AvailableCopies: 1})
+	if rr := get(lastModified); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Audit = librarypkg.NewAuditLog(10)
+	if _, err := library.AddMember(librarypkg.Member{Name: "John Doe", Email: "john@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := (&server{library: library}).routes()
+	post := func(body string) (*httptest.ResponseRecorder, graphqlResult) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", graphqlPath, strings.NewReader(body)))
+		var result graphqlResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatalf("invalid response %q: %v", rr.Body.String(), err)
+		}
+		return rr, result
+	}
+
+	// Test 1: borrowBook borrows through the library and returns the loan
+	rr, result := post(`{"query": "mutation Borrow($title: String!) { loan: borrowBook(title: $title, borrower: \"John Doe\") { title borrower book { availableCopies } } }", "variables": {"title": "Clean Code"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("unexpected errors: %+v", result.Errors)
+	}
+	if want := `{"loan":{"title":"Clean Code","borrower":"John Doe","book":{"availableCopies":1}}}`; string(result.Data) != want {
+		t.Errorf("expected data %s, got %s", want, result.Data)
+	}
+	if entries := library.Audit.Entries(librarypkg.AuditFilter{}); len(entries) != 1 || entries[0].Action != librarypkg.AuditBorrow {
+		t.Errorf("expected a loan.borrow audit entry, got %+v", entries)
+	}
+
+	// Test 2: A nested query reaches the borrowed book from the member
+	_, result = post(`{"query": "{ member(id: \"John Doe\") { name loans { title book { availableCopies } } } }"}`)
+	if want := `{"member":{"name":"John Doe","loans":[{"title":"Clean Code","book":{"availableCopies":1}}]}}`; string(result.Data) != want {
+		t.Errorf("expected data %s, got %s (errors %+v)", want, result.Data, result.Errors)
+	}
+
+	// Test 3: A failing field is null with the REST error code, the rest
+	// of the operation still runs
+	_, result = post(`{"query": "mutation { a: borrowBook(title: \"Clean Code\", borrower: \"Jane\") { title } b: borrowBook(title: \"Clean Code\", borrower: \"Bob\") { title } }"}`)
+	if want := `{"a":{"title":"Clean Code"},"b":null}`; string(result.Data) != want {
+		t.Errorf("expected data %s, got %s", want, result.Data)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "NO_COPIES" || fmt.Sprint(result.Errors[0].Path) != "[b]" {
+		t.Errorf("expected a NO_COPIES error at b, got %+v", result.Errors)
+	}
+
+	// Test 4: Unknown fields and syntax errors are a 400 and run nothing
+	for _, query := range []string{`{ book(title: \"Clean Code\") { shelf } }`, `{ book(title: `} {
+		rr, result := post(`{"query": "` + query + `"}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+		if result.Data != nil || len(result.Errors) != 1 {
+			t.Errorf("expected only an error for %s, got %+v", query, result)
+		}
+	}
+
+	// Test 5: In maintenance mode queries still work but mutations don't
+	library.SetReadOnly(true)
+	_, result = post(`{"query": "mutation { returnBook(title: \"Clean Code\", borrower: \"John Doe\") { fine } } "}`)
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "MAINTENANCE" {
+		t.Errorf("expected a MAINTENANCE error, got %+v", result.Errors)
+	}
+	_, result = post(`{"query": "{ book(title: \"Clean Code\") { availableCopies } missing: book(title: \"Nope\") { title } }"}`)
+	if want := `{"book":{"availableCopies":0},"missing":null}`; string(result.Data) != want {
+		t.Errorf("expected data %s, got %s", want, result.Data)
+	}
+}
+
+// graphqlResult decodes a GraphQL response, keeping data as sent so its
+// field order can be checked.
+type graphqlResult struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string            `json:"message"`
+		Path       []any             `json:"path"`
+		Extensions map[string]string `json:"extensions"`
+	} `json:"errors"`
+}
+
+func TestSnapshotHandlers(t *testing.T) {
+	source := newTestLibrary(t)
+	if _, err := source.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	target := librarypkg.NewLibrary()
+	target.Audit = librarypkg.NewAuditLog(10)
+	tokens := []apiToken{{Token: "librarian", Role: roleLibrarian}, {Token: "john", Role: roleMember, Member: "John Doe"}}
+	serve := func(library *librarypkg.Library, method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		requireToken(tokens, false, (&server{library: library}).routes()).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: Members can't take or restore snapshots
+	if rr := serve(source, "GET", "/admin/snapshot", "john", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Test 2: A snapshot from one server restores another
+	rr := serve(source, "GET", "/admin/snapshot", "librarian", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr = serve(target, "POST", "/admin/restore", "librarian", rr.Body.String())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var stats librarypkg.Stats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Titles != 2 || stats.ActiveLoans != 1 {
+		t.Errorf("expected 2 titles and 1 loan restored, got %+v", stats)
+	}
+	if entries := target.Audit.Entries(librarypkg.AuditFilter{}); len(entries) != 1 || entries[0].Action != librarypkg.AuditRestore {
+		t.Errorf("expected a restore audit entry, got %+v", entries)
+	}
+
+	// Test 3: Invalid snapshots are a 400 and bodies without books are
+	// refused before reaching the library
+	rr = serve(target, "POST", "/admin/restore", "librarian", `{"books": {"A": {"title": "B", "availableCopies": 1, "totalCopies": 1}}}`)
+	if rr.Code != http.StatusBadRequest || rr.Header().Get(errorCodeHeader) != "INVALID_SNAPSHOT" {
+		t.Errorf("expected a 400 INVALID_SNAPSHOT, got %v %q", rr.Code, rr.Header().Get(errorCodeHeader))
+	}
+	if rr := serve(target, "POST", "/admin/restore", "librarian", `{}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if stats := target.Stats(); stats.Titles != 2 {
+		t.Errorf("expected the restored library kept, got %+v", stats)
+	}
+}
+
+func TestNextAvailableDate(t *testing.T) {
+	library := newTestLibrary(t)
+	clock := useFakeClock(library, testNow)
+	handler := (&server{library: library}).routes()
+	// Loans a day apart, so the first one out is the first due back
+	for _, borrower := range []string{"Jane Smith", "Bob Johnson"} {
+		if _, err := library.Borrow("Clean Code", borrower); err != nil {
+			t.Fatal(err)
+		}
+		clock.Set(clock.Now().AddDate(0, 0, 1))
+	}
+	earliest := library.BorrowerLoans("Jane Smith")[0].ReturnDate
+	if _, err := library.Reserve("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	getBook := func(title string) bookResponse {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/Book?title="+url.QueryEscape(title), nil))
+		var book bookResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+			t.Fatal(err)
+		}
+		return book
+	}
+
+	// Test 1: GET /Book says when the first copy is back and who's queued
+	book := getBook("Clean Code")
+	if book.NextAvailableDate == nil || !book.NextAvailableDate.Equal(earliest) || book.QueueLength != 1 {
+		t.Errorf("expected next available %v with 1 queued, got %v and %d", earliest, book.NextAvailableDate, book.QueueLength)
+	}
+
+	// Test 2: So does the 409 for a borrow that finds no copy
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/Borrow", strings.NewReader(`{"title": "Clean Code", "borrower": "Alice"}`)))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	var refused noCopiesResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &refused); err != nil {
+		t.Fatal(err)
+	}
+	if refused.Code != "NO_COPIES" || refused.Message != "No copies available" || refused.NextAvailableDate == nil || !refused.NextAvailableDate.Equal(earliest) || refused.QueueLength != 1 {
+		t.Errorf("unexpected 409 body %+v", refused)
+	}
+
+	// Test 3: A book with a copy on the shelf has no date
+	if book := getBook("Go Programming"); book.NextAvailableDate != nil || book.Title != "Go Programming" {
+		t.Errorf("expected no next available date, got %+v", book)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	library := newTestLibrary(t)
+	handler := (&server{library: library, metrics: newHTTPMetrics()}).routes()
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rr
+	}
+
+	serve("POST", "/Borrow", `{"title": "Go Programming", "borrower": "John Doe"}`)
+	serve("POST", "/Borrow", `{"title": "Missing Book", "borrower": "John Doe"}`)
+	loan := library.BorrowerLoans("John Doe")[0]
+	serve("GET", "/loans/"+loan.ID, "")
+	serve("GET", "/loans/missing", "")
+
+	rr := serve("GET", "/metrics", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	scrape := rr.Body.String()
+
+	// Test 1: Durations are labelled by route pattern and status class
+	for _, want := range []string{
+		`library_http_request_duration_seconds_count{route="/Borrow",status_class="2xx"} 1`,
+		`library_http_request_duration_seconds_count{route="/Borrow",status_class="4xx"} 1`,
+		`library_http_request_duration_seconds_bucket{route="/loans/{id}",status_class="2xx",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(scrape, want) {
+			t.Errorf("expected %s in the scrape, got:\n%s", want, scrape)
+		}
+	}
+
+	// Test 2: Responses are counted by status code, never by raw path
+	for _, want := range []string{
+		`library_http_responses_total{route="/Borrow",code="201"} 1`,
+		`library_http_responses_total{route="/loans/{id}",code="200"} 1`,
+		`library_http_responses_total{route="/loans/{id}",code="404"} 1`,
+	} {
+		if !strings.Contains(scrape, want) {
+			t.Errorf("expected %s in the scrape, got:\n%s", want, scrape)
+		}
+	}
+	if strings.Contains(scrape, loan.ID) {
+		t.Errorf("expected no series for the loan's path, got:\n%s", scrape)
+	}
+
+	// Test 3: Without metrics the endpoint is unavailable
+	handler = (&server{library: library}).routes()
+	if rr := serve("GET", "/metrics", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestBookByPathHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	for _, title := range []string{"Fish & Chips", "AC/DC: A Biography"} {
+		if _, err := library.AddBook(librarypkg.BookDetail{Title: title, AvailableCopies: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := (&server{library: library}).routes()
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr
+	}
+
+	// Test 1: Percent-encoded titles are decoded and matched in any case
+	for target, want := range map[string]string{
+		"/books/Go%20Programming":                        "Go Programming",
+		"/books/go%20programming":                        "Go Programming",
+		"/books/Fish%20%26%20Chips":                      "Fish & Chips",
+		"/books/Fish%20&%20Chips":                        "Fish & Chips",
+		"/books/AC%2FDC%3A%20A%20Biography":              "AC/DC: A Biography",
+		"/books/" + url.PathEscape("AC/DC: A Biography"): "AC/DC: A Biography",
+	} {
+		rr := get(target)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", target, rr.Code, http.StatusOK)
+			continue
+		}
+		var book bookResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+			t.Fatal(err)
+		}
+		if book.Title != want {
+			t.Errorf("%s: expected %q, got %q", target, want, book.Title)
+		}
+	}
+
+	// Test 2: An unencoded slash splits the title and matches no book route
+	if rr := get("/books/AC/DC:%20A%20Biography"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := get("/books/Missing%20Book"); rr.Code != http.StatusNotFound || rr.Header().Get(errorCodeHeader) != "BOOK_NOT_FOUND" {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 3: The query parameter form still works
+	if rr := get("/Book?title=Fish%20%26%20Chips"); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestLoanDurationsHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	clock := useFakeClock(library, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	srv := &server{library: library}
+
+	get := func(target string) (librarypkg.LoanDurations, *httptest.ResponseRecorder) {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.loanDurationsHandler).ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		var durations librarypkg.LoanDurations
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &durations); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return durations, rr
+	}
+	lend := func(title, borrower string, days int) librarypkg.LoanDetail {
+		loan, err := library.Borrow(title, borrower)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Duration(days) * 24 * time.Hour)
+		return loan
+	}
+	giveBack := func(title, borrower string) {
+		if _, err := library.Return(title, borrower); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Loans of 2, 4 and 10 days come back, one copy is lost and one is
+	// still out
+	lend("Go Programming", "Alice", 2)
+	giveBack("Go Programming", "Alice")
+	lend("Clean Code", "Bob", 4)
+	giveBack("Clean Code", "Bob")
+	lend("Go Programming", "Carol", 10)
+	giveBack("Go Programming", "Carol")
+	lost := lend("Clean Code", "Dan", 30)
+	if _, err := library.ReportLost(lost.ID); err != nil {
+		t.Fatal(err)
+	}
+	lend("Go Programming", "Erin", 1)
+
+	// Test 1: Only returned loans count
+	durations, rr := get("/Stats/duration")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if want := (librarypkg.LoanDurations{Loans: 3, AverageDays: 16.0 / 3, MedianDays: 4, MinDays: 2, MaxDays: 10}); durations != want {
+		t.Errorf("expected %+v, got %+v", want, durations)
+	}
+
+	// Test 2: Filter by title in any case, and by loan date
+	if durations, _ := get("/Stats/duration?title=go+programming"); durations != (librarypkg.LoanDurations{Loans: 2, AverageDays: 6, MedianDays: 6, MinDays: 2, MaxDays: 10}) {
+		t.Errorf("expected the two Go Programming loans, got %+v", durations)
+	}
+	if durations, _ := get("/Stats/duration?since=2024-03-05T00:00:00Z"); durations.Loans != 1 || durations.MaxDays != 10 {
+		t.Errorf("expected Carol's loan, got %+v", durations)
+	}
+	if durations, _ := get("/Stats/duration?title=Missing+Book"); durations != (librarypkg.LoanDurations{}) {
+		t.Errorf("expected no loans, got %+v", durations)
+	}
+
+	// Test 3: Invalid ranges are rejected
+	if _, rr := get("/Stats/duration?since=yesterday"); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if _, rr := get("/Stats/duration?since=2024-04-01T00:00:00Z&until=2024-03-01T00:00:00Z"); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	handler := (&server{library: newTestLibrary(t)}).routes()
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	// Test 1: An unsupported method is a 405 naming the allowed ones
+	rr := serve("PUT", "/Borrow")
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := rr.Header().Get("Allow"); allow != "POST, OPTIONS" {
+		t.Errorf("unexpected Allow header: %q", allow)
+	}
+
+	// Test 2: OPTIONS lists the methods of the route without running it
+	for target, want := range map[string]string{
+		"/Borrow":                 "POST, OPTIONS",
+		"/Book?title=Clean+Code":  "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		"/loans/missing/transfer": "POST, OPTIONS",
+	} {
+		rr := serve("OPTIONS", target)
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", target, rr.Code, http.StatusNoContent)
+		}
+		if allow := rr.Header().Get("Allow"); allow != want {
+			t.Errorf("%s: expected Allow %q, got %q", target, want, allow)
+		}
+		if rr.Body.Len() != 0 {
+			t.Errorf("%s: expected no body, got %q", target, rr.Body.String())
+		}
+	}
+
+	// Test 3: Supported methods don't get the header
+	if rr := serve("GET", "/Book?title=Clean+Code"); rr.Code != http.StatusOK || rr.Header().Get("Allow") != "" {
+		t.Errorf("expected a plain 200, got %v with Allow %q", rr.Code, rr.Header().Get("Allow"))
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	srv := &server{library: newTestLibrary(t)}
+	handler := srv.routes()
+
+	post := func(target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	fieldsOf := func(rr *httptest.ResponseRecorder) []fieldError {
+		var response struct {
+			Errors []fieldError `json:"errors"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("expected a JSON body, got %q: %v", rr.Body.String(), err)
+		}
+		return response.Errors
+	}
+
+	// Test 1: Every missing field is reported at once
+	rr := post("/Borrow", `{}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	want := []fieldError{{Field: "title", Message: "is required"}, {Field: "borrower", Message: "is required"}}
+	if got := fieldsOf(rr); !slices.Equal(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// Test 2: Different problems with different fields are listed together
+	long := strings.Repeat("x", maxNameLength+1)
+	rr = post("/Extend", `{"title": "`+long+`", "days": -1}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	want = []fieldError{
+		{Field: "title", Message: "must be at most 200 characters"},
+		{Field: "borrower", Message: "is required"},
+		{Field: "days", Message: "must not be negative"},
+	}
+	if got := fieldsOf(rr); !slices.Equal(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// Test 3: Batch entries are named by their index
+	rr = post("/Borrow/batch", `{"borrower": "John Doe", "titles": ["Clean Code", ""]}`)
+	if got := fieldsOf(rr); len(got) != 1 || got[0].Field != "titles[1]" {
+		t.Errorf("expected an error for titles[1], got %+v", got)
+	}
+
+	// Test 4: A body that isn't JSON is still a plain 400
+	if rr := post("/Borrow", `{`); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestArchiveOnDelete(t *testing.T) {
+	library := newTestLibrary(t)
+	tokens := []apiToken{
+		{Token: "desk", Role: roleLibrarian},
+		{Token: "john", Role: roleMember, Member: "John Doe"},
+	}
+	handler := requireToken(tokens, false, (&server{library: library}).routes())
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	listed := func(token string) []string {
+		rr := do("GET", "/Books?includeArchived=true", token, "")
+		var page bookPage
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, book := range page.Books {
+			titles = append(titles, book.Title)
+		}
+		return titles
+	}
+
+	if rr := do("POST", "/Borrow", "john", `{"title": "Clean Code", "borrower": "John Doe"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := do("POST", "/Return", "john", `{"title": "Clean Code", "borrower": "John Doe"}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 1: A book with history can't be removed, only archived
+	rr := do("DELETE", "/Book?title=Clean+Code&hard=true", "desk", "")
+	if rr.Code != http.StatusConflict || rr.Header().Get(errorCodeHeader) != "BOOK_HAS_HISTORY" {
+		t.Errorf("expected a 409 BOOK_HAS_HISTORY, got %v %q", rr.Code, rr.Header().Get(errorCodeHeader))
+	}
+	if rr := do("DELETE", "/Book?title=Clean+Code", "desk", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+
+	// Test 2: The archived book can't be borrowed but can still be looked up
+	rr = do("POST", "/Borrow", "john", `{"title": "Clean Code", "borrower": "John Doe"}`)
+	if rr.Code != http.StatusConflict || rr.Header().Get(errorCodeHeader) != "BOOK_ARCHIVED" {
+		t.Errorf("expected a 409 BOOK_ARCHIVED, got %v %q", rr.Code, rr.Header().Get(errorCodeHeader))
+	}
+	var book librarypkg.BookDetail
+	rr = do("GET", "/Book?title=Clean+Code", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil || !book.Archived {
+		t.Errorf("expected the archived book, got %v %s", rr.Code, rr.Body.String())
+	}
+	if len(library.History) != 1 {
+		t.Errorf("expected the loan to stay in the history, got %+v", library.History)
+	}
+
+	// Test 3: Only librarians see archived books in listings
+	if titles := listed(""); !slices.Equal(titles, []string{"Go Programming"}) {
+		t.Errorf("expected anonymous readers to see only Go Programming, got %v", titles)
+	}
+	if titles := listed("john"); !slices.Equal(titles, []string{"Go Programming"}) {
+		t.Errorf("expected members to see only Go Programming, got %v", titles)
+	}
+	if titles := listed("desk"); len(titles) != 2 {
+		t.Errorf("expected librarians to see both books, got %v", titles)
+	}
+
+	// Test 4: Restoring takes librarians and makes the book borrowable again
+	if rr := do("POST", "/books/Clean%20Code/restore", "john", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	rr = do("POST", "/books/Clean%20Code/restore", "desk", "")
+	var restored librarypkg.BookDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &restored); err != nil || rr.Code != http.StatusOK || restored.Archived {
+		t.Errorf("expected the restored book, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/Borrow", "john", `{"title": "Clean Code", "borrower": "John Doe"}`); rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := do("POST", "/books/Missing/restore", "desk", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestBookHistoryHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	clock := useFakeClock(library, time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC))
+	library.MaxCopiesPerBorrowerPerTitle = 0
+	srv := &server{library: library}
+
+	get := func(target string) ([]librarypkg.BookLoan, *httptest.ResponseRecorder) {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.bookHistoryHandler).ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		var history []librarypkg.BookLoan
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return history, rr
+	}
+	lend := func(borrower string) librarypkg.LoanDetail {
+		loan, err := library.Borrow("Go Programming", borrower)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour)
+		return loan
+	}
+
+	// Alice returns on time, Bob 40 days late after Carol borrowed, and
+	// Dan still has his copy
+	alice := lend("Alice")
+	if _, err := library.Return("Go Programming", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	bob := lend("Bob")
+	carol := lend("Carol")
+	clock.Advance(40 * 24 * time.Hour)
+	if _, err := library.Return("Go Programming", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Return("Go Programming", "Carol"); err != nil {
+		t.Fatal(err)
+	}
+	dan := lend("Dan")
+	if _, err := library.Borrow("Clean Code", "Erin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Every loan of the title, oldest first, active ones included
+	history, rr := get("/Book/history?title=go+programming")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var ids []string
+	for _, loan := range history {
+		ids = append(ids, loan.ID)
+	}
+	if want := []string{alice.ID, bob.ID, carol.ID, dan.ID}; !slices.Equal(ids, want) {
+		t.Fatalf("expected loans %v, got %v", want, ids)
+	}
+
+	// Test 2: Returns carry their timestamp and whether they were late
+	if history[0].ReturnedAt.IsZero() || history[0].ReturnedLate {
+		t.Errorf("expected Alice's loan returned on time, got %+v", history[0])
+	}
+	if !history[1].ReturnedLate || !history[2].ReturnedLate {
+		t.Errorf("expected Bob's and Carol's loans returned late, got %+v and %+v", history[1], history[2])
+	}
+	if !history[3].ReturnedAt.IsZero() || history[3].ReturnedLate {
+		t.Errorf("expected Dan's loan still out, got %+v", history[3])
+	}
+
+	// Test 3: Unknown books and missing titles
+	if _, rr := get("/Book/history?title=Missing"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if _, rr := get("/Book/history"); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRenameBookHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Audit = librarypkg.NewAuditLog(100)
+	handler := requireToken([]apiToken{
+		{Token: "desk", Role: roleLibrarian, Name: "Front Desk"},
+		{Token: "john", Role: roleMember, Member: "John Doe"},
+	}, false, (&server{library: library}).routes())
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("POST", "/Borrow", "john", `{"title": "Go Programming", "borrower": "John Doe"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	// Test 1: Only librarians can rename
+	if rr := do("POST", "/admin/books/rename", "john", `{"from": "Go Programming", "to": "Go Programming Language"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Test 2: The rename is answered with the book and audited
+	rr := do("POST", "/admin/books/rename", "desk", `{"from": "Go Programming", "to": "Go Programming Language"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var book librarypkg.BookDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Go Programming Language" || rr.Header().Get("ETag") != bookETag(book) {
+		t.Errorf("unexpected book %+v with ETag %q", book, rr.Header().Get("ETag"))
+	}
+	entries := library.Audit.Entries(librarypkg.AuditFilter{Action: librarypkg.AuditRename})
+	if len(entries) != 1 || entries[0].Title != "Go Programming -> Go Programming Language" || entries[0].Actor != "Front Desk" {
+		t.Errorf("expected the rename in the audit log, got %+v", entries)
+	}
+
+	// Test 3: The borrower extends and returns under the new title
+	if rr := do("POST", "/Extend", "john", `{"title": "Go Programming Language", "borrower": "John Doe"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := do("POST", "/Return", "john", `{"title": "Go Programming Language", "borrower": "John Doe"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 4: Existing titles and incomplete bodies are refused
+	rr = do("POST", "/admin/books/rename", "desk", `{"from": "Go Programming Language", "to": "Clean Code"}`)
+	if rr.Code != http.StatusConflict || rr.Header().Get(errorCodeHeader) != "BOOK_EXISTS" {
+		t.Errorf("expected a 409 BOOK_EXISTS, got %v %q", rr.Code, rr.Header().Get(errorCodeHeader))
+	}
+	if rr := do("POST", "/admin/books/rename", "desk", `{"from": "Clean Code"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	library := newTestLibrary(t)
+	reached := 0
+	routes := (&server{library: library}).routes()
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		routes.ServeHTTP(w, r)
+	})
+	tokens := []apiToken{{Token: "s3cret", Role: roleLibrarian}}
+	handler := allowCORS(parseOrigins("https://catalog.example.org/, https://kiosk.example.org"), requireToken(tokens, false, counted))
+
+	do := func(method, target, origin string, header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Origin", origin)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: An allowed origin is echoed back
+	rr := do("GET", "/Books", "https://catalog.example.org", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://catalog.example.org" {
+		t.Errorf("expected the origin to be allowed, got %q", got)
+	}
+	if got := rr.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, "X-Error-Code") {
+		t.Errorf("expected X-Error-Code to be exposed, got %q", got)
+	}
+
+	// Test 2: Other origins get no CORS headers
+	rr = do("GET", "/Books", "https://evil.example.com", nil)
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("expected no Access-Control-Allow-Origin, got %q", got)
+	}
+
+	// Test 3: A preflight to /Borrow is answered without a token and without
+	// reaching the handlers
+	reached = 0
+	preflight := http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"authorization, content-type"},
+	}
+	rr = do("OPTIONS", "/Borrow", "https://kiosk.example.org", preflight)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+		t.Errorf("expected POST to be allowed, got %q", got)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Authorization") || !strings.Contains(got, "X-Request-ID") {
+		t.Errorf("expected Authorization and X-Request-ID to be allowed, got %q", got)
+	}
+	if rr := do("OPTIONS", "/Borrow", "https://evil.example.com", preflight); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if reached != 0 {
+		t.Errorf("expected preflights not to reach the handlers, got %d", reached)
+	}
+
+	// Test 4: "*" allows any origin
+	handler = allowCORS(parseOrigins("*"), counted)
+	if got := do("GET", "/Books", "https://anywhere.example.net", nil).Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected any origin to be allowed, got %q", got)
+	}
+}
+
+func TestBorrowOrReserve(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	borrow := func(borrower string) *httptest.ResponseRecorder {
+		body := `{"title": "Clean Code", "borrower": "` + borrower + `"}`
+		req, err := http.NewRequest("POST", "/Borrow?reserveIfUnavailable=true", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(srv.borrowBookHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: A free copy is borrowed as usual
+	for _, borrower := range []string{"John Doe", "Jane Doe"} {
+		if rr := borrow(borrower); rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+	}
+
+	// Test 2: Without a free copy the borrower joins the queue instead
+	rr := borrow("Alice")
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusAccepted)
+	}
+	var reservation reservationResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &reservation); err != nil {
+		t.Fatal(err)
+	}
+	if reservation.Position != 1 || reservation.Borrower != "Alice" {
+		t.Errorf("unexpected reservation: %+v", reservation)
+	}
+	if rr := borrow("Bob"); rr.Code != http.StatusAccepted || !strings.Contains(rr.Body.String(), `"position":2`) {
+		t.Errorf("expected Bob second in the queue, got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// Test 3: Reserving twice and other failures are still errors
+	if rr := borrow("Alice"); rr.Code != http.StatusConflict || rr.Header().Get(errorCodeHeader) != "ALREADY_RESERVED" {
+		t.Errorf("expected a 409 ALREADY_RESERVED, got %v %q", rr.Code, rr.Header().Get(errorCodeHeader))
+	}
+	if _, err := library.Return("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if queue := library.Reservations()["Clean Code"]; len(queue) != 1 || queue[0].Borrower != "Bob" {
+		t.Errorf("expected Alice to be served first, got queue %v", queue)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.eventsHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("handler returned wrong content type: got %v want %v", ct, "text/event-stream")
+	}
+
+	loan, err := library.Borrow("Go Programming", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: The borrow arrives as an SSE message carrying the loan
+	reader := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(line, "\n")
+	}
+
+	if line := readLine(); line != "event: book.borrowed" {
+		t.Errorf("unexpected event line: %q", line)
+	}
+
+	data, found := strings.CutPrefix(readLine(), "data: ")
+	if !found {
+		t.Fatal("expected a data line")
+	}
+	var received librarypkg.LoanDetail
+	if err := json.Unmarshal([]byte(data), &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.ID != loan.ID || received.BookTitle != "Go Programming" || received.NameOfBorrower != "John Doe" {
+		t.Errorf("unexpected loan in event: %+v", received)
+	}
+
+	// Test 2: Closing the bus ends the stream
+	library.Events.Close()
+	readLine()
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+}
+
+func TestOverdueAndFineHandlers(t *testing.T) {
+	library := newTestLibrary(t)
+	library.GraceDays = 2
+	clock := useFakeClock(library, time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC))
+	srv := &server{library: library}
+
+	get := func(handler http.HandlerFunc, target string, v interface{}) {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, title := range []string{"Go Programming", "Clean Code"} {
+		if _, err := library.Borrow(title, "John Doe"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Test 1: A day late is still within the grace period
+	clock.Advance(29 * 24 * time.Hour)
+
+	var overdue []librarypkg.OverdueLoan
+	get(srv.overdueHandler, "/Overdue", &overdue)
+	if len(overdue) != 0 {
+		t.Errorf("expected no overdue loans within the grace period, got %d", len(overdue))
+	}
+
+	receipt, err := library.Return("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !receipt.WasOverdue || receipt.Fine != 0 {
+		t.Errorf("expected a late return without fine, got %+v", receipt)
+	}
+
+	// Test 2: Fines accrue for the days beyond the grace period
+	clock.Advance(4 * 24 * time.Hour)
+
+	get(srv.overdueHandler, "/Overdue", &overdue)
+	if len(overdue) != 1 || overdue[0].DaysOverdue != 3 || overdue[0].Fine != 3*librarypkg.DefaultFinePerDay {
+		t.Errorf("unexpected overdue loans: %+v", overdue)
+	}
+
+	var fine librarypkg.FineSummary
+	get(srv.fineHandler, "/Fine?borrower=John+Doe", &fine)
+	if fine.Total != 3*librarypkg.DefaultFinePerDay || len(fine.Loans) != 1 {
+		t.Errorf("unexpected fine: %+v", fine)
+	}
+
+	get(srv.fineHandler, "/Fine?borrower=Jane+Doe", &fine)
+	if fine.Total != 0 || len(fine.Loans) != 0 {
+		t.Errorf("expected no fine for Jane Doe, got %+v", fine)
+	}
+}
+
+// dialGRPC serves grpcSrv over an in-memory listener and returns a client
+// for it. Both are stopped when the test ends.
+func dialGRPC(t *testing.T, grpcSrv *grpc.Server) librarypb.LibraryClient {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	go grpcSrv.Serve(listener)
+	t.Cleanup(grpcSrv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return librarypb.NewLibraryClient(conn)
+}
+
+func TestGRPCBorrowReturn(t *testing.T) {
+	library := newTestLibrary(t)
+	client := dialGRPC(t, newGRPCServer(library, nil, false))
+	ctx := context.Background()
+
+	// Test 1: Borrow a book
+	loan, err := client.BorrowBook(ctx, &librarypb.LoanRequest{Title: "Go Programming", Borrower: "John Doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.GetBookTitle() != "Go Programming" || loan.GetId() == "" {
+		t.Errorf("unexpected loan: %v", loan)
+	}
+
+	// Test 2: The HTTP side sees the same state
+	book, err := client.GetBook(ctx, &librarypb.GetBookRequest{Title: "Go Programming"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.GetAvailableCopies() != 2 || library.Books()["Go Programming"].AvailableCopies != 2 {
+		t.Errorf("expected 2 available copies, got %d", book.GetAvailableCopies())
+	}
+
+	// Test 3: Errors map to gRPC codes
+	if _, err := client.GetBook(ctx, &librarypb.GetBookRequest{Title: "Missing Book"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	library.LoadBook(librarypkg.BookDetail{Title: "Clean Code"})
+	if _, err := client.BorrowBook(ctx, &librarypb.LoanRequest{Title: "Clean Code", Borrower: "John Doe"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", err)
+	}
+
+	// Test 4: Return by loan ID
+	receipt, err := client.ReturnBook(ctx, &librarypb.ReturnBookRequest{LoanId: loan.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.GetLoan().GetId() != loan.GetId() || receipt.GetWasOverdue() {
+		t.Errorf("unexpected receipt: %v", receipt)
+	}
+	if copies := library.Books()["Go Programming"].AvailableCopies; copies != 3 {
+		t.Errorf("expected 3 available copies after return, got %d", copies)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Audit = librarypkg.NewAuditLog(10)
+	client := dialGRPC(t, newGRPCServer(library, []apiToken{
+		{Token: "librarian", Role: roleLibrarian},
+		{Token: "john", Role: roleMember, Member: "John Doe", Name: "John's phone"},
+	}, false))
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	borrow := &librarypb.LoanRequest{Title: "Go Programming", Borrower: "John Doe"}
+
+	// Test 1: Writes need a valid token
+	if _, err := client.BorrowBook(context.Background(), borrow); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", err)
+	}
+	if _, err := client.BorrowBook(withToken("guess"), borrow); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+	if loans := library.Loans(); len(loans) != 0 {
+		t.Errorf("expected no loans, got %v", loans)
+	}
+
+	// Test 2: Reads don't
+	if _, err := client.GetBook(context.Background(), &librarypb.GetBookRequest{Title: "Go Programming"}); err != nil {
+		t.Errorf("expected an open read, got %v", err)
+	}
+
+	// Test 3: Members act for themselves only, and are audited as such
+	loan, err := client.BorrowBook(withToken("john"), borrow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BorrowBook(withToken("john"), &librarypb.LoanRequest{Title: "Go Programming", Borrower: "Jane Doe"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+	entries := library.Audit.Entries(librarypkg.AuditFilter{})
+	if len(entries) != 1 || entries[0].Actor != "John's phone" {
+		t.Errorf("expected John's borrow audited, got %+v", entries)
+	}
+
+	// Test 4: Including returns by loan ID, once the loan is someone else's
+	if _, err := library.TransferLoanByID(loan.GetId(), "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReturnBook(withToken("john"), &librarypb.ReturnBookRequest{LoanId: loan.GetId()}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", err)
+	}
+	if _, err := client.ReturnBook(withToken("librarian"), &librarypb.ReturnBookRequest{LoanId: loan.GetId()}); err != nil {
+		t.Errorf("expected the librarian to return it, got %v", err)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	long := strings.Repeat("x", maxNameLength+1)
+
+	tests := []struct {
+		name    string
+		request validator
+		wantErr string
+	}{
+		{"valid loan", loanRequest{Title: "Go Programming", Borrower: "John Doe"}, ""},
+		{"loan without borrower", loanRequest{Title: "Go Programming"}, "borrower is required"},
+		{"empty loan", loanRequest{}, "title is required; borrower is required"},
+		{"loan with long title", loanRequest{Title: long, Borrower: "John Doe"}, "title must be at most 200 characters"},
+		{"return by ID", returnRequest{LoanID: "abc"}, ""},
+		{"return without loan", returnRequest{Title: "Go Programming"}, "borrower is required without a loanId"},
+		{"borrower with long name", borrowerRequest{Borrower: long}, "borrower must be at most 200 characters"},
+		{"book with long author", bookRequest{librarypkg.BookDetail{Title: "Go", Author: long}}, "author must be at most 200 characters"},
+		{"webhook without URL", webhookRequest{Events: []string{"book.borrowed"}}, "url is required"},
+		{"extension of nothing", extendRequest{Days: -1}, "title is required; borrower is required; days must not be negative"},
+	}
+
+	for _, tt := range tests {
+		err := tt.request.Validate()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	client := libraryclient.New(ts.URL, "")
+	ctx := context.Background()
+
+	// Test 1: Borrow through the client
+	loan, err := client.Borrow(ctx, "Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.BookTitle != "Clean Code" || loan.ID == "" {
+		t.Errorf("unexpected loan: %+v", loan)
+	}
+
+	book, err := client.GetBook(ctx, "Clean Code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.AvailableCopies != 1 {
+		t.Errorf("expected 1 available copy, got %d", book.AvailableCopies)
+	}
+
+	// Test 2: Domain errors come back typed
+	if _, err := client.GetBook(ctx, "Missing Book"); !errors.Is(err, libraryclient.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := client.Borrow(ctx, "Clean Code", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Borrow(ctx, "Clean Code", "Jim Doe"); !errors.Is(err, libraryclient.ErrNoCopies) {
+		t.Errorf("expected ErrNoCopies, got %v", err)
+	}
+	_, err = client.Borrow(ctx, "", "")
+	var apiErr *libraryclient.APIError
+	if !errors.Is(err, libraryclient.ErrInvalidRequest) || !errors.As(err, &apiErr) || len(apiErr.Fields) != 2 {
+		t.Errorf("expected ErrInvalidRequest with two invalid fields, got %v", err)
+	}
+
+	// Test 3: Extend, list and return
+	extended, err := client.Extend(ctx, "Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extended.ReturnDate.After(loan.ReturnDate) {
+		t.Errorf("expected the return date to move, got %v", extended.ReturnDate)
+	}
+
+	loans, err := client.ListLoans(ctx, "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loans) != 1 || loans[0].ID != loan.ID {
+		t.Errorf("unexpected loans: %+v", loans)
+	}
+
+	receipt, err := client.ReturnLoan(ctx, loan.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Loan.ID != loan.ID {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+}
+
+func TestDeleteBookAndStats(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	mux := srv.routes()
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: A book on loan can't be deleted
+	if rr := do("DELETE", "/Book?title=Go+Programming&hard=true"); rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Test 2: Delete a book without loans
+	if rr := do("DELETE", "/Book?title=Clean+Code&hard=true"); rr.Code != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if rr := do("DELETE", "/Book?title=Clean+Code&hard=true"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Test 3: Stats reflect the remaining catalog
+	rr := do("GET", "/Stats")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var stats librarypkg.Stats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Titles != 1 || stats.AvailableCopies != 2 || stats.ActiveLoans != 1 || stats.OverdueLoans != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestArchiveBook(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	mux := srv.routes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	listTitles := func(query string) []string {
+		rr := do("GET", "/Books"+query, "")
+		var page bookPage
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, book := range page.Books {
+			titles = append(titles, book.Title)
+		}
+		return titles
+	}
+
+	loan, err := library.Borrow("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Archive a book that is on loan
+	if rr := do("POST", "/Book/archive?title=Clean+Code", ""); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if len(library.Loans()["Clean Code"]) != 1 {
+		t.Error("expected the active loan to be kept")
+	}
+
+	// Test 2: Archived books are hidden from the default listing
+	if titles := listTitles(""); len(titles) != 1 || titles[0] != "Go Programming" {
+		t.Errorf("unexpected titles: %v", titles)
+	}
+	if titles := listTitles("?includeArchived=true"); len(titles) != 2 {
+		t.Errorf("expected archived books with includeArchived, got %v", titles)
+	}
+
+	// Test 3: Archived books can't be borrowed but can be returned
+	rr := do("POST", "/Borrow", `{"title": "Clean Code", "borrower": "Jane Doe"}`)
+	if rr.Code != http.StatusConflict || rr.Header().Get(errorCodeHeader) != "BOOK_ARCHIVED" {
+		t.Errorf("expected 409 BOOK_ARCHIVED, got %v %q", rr.Code, rr.Header().Get(errorCodeHeader))
+	}
+	if _, err := library.ReturnLoan(loan.ID); err != nil {
+		t.Errorf("failed to return loan of archived book: %v", err)
+	}
+
+	// Test 4: Unarchive makes the book borrowable again
+	if rr := do("POST", "/Book/unarchive?title=Clean+Code", ""); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := do("POST", "/Borrow", `{"title": "Clean Code", "borrower": "Jane Doe"}`); rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+
+	do := func(handler http.Handler, method, target, authorization string) int {
+		req, err := http.NewRequest(method, target, strings.NewReader(`{"title": "Go Programming", "borrower": "John Doe"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	handler := requireToken([]apiToken{{Token: "s3cret", Role: roleLibrarian}}, false, srv.routes())
+
+	// Test 1: Reads stay public
+	if status := do(handler, "GET", "/Book?title=Go+Programming", ""); status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Test 2: Writes need a token
+	if status := do(handler, "POST", "/Borrow", ""); status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+	if status := do(handler, "POST", "/Borrow", "Basic czNjcmV0"); status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	// Test 3: A wrong token is forbidden
+	if status := do(handler, "POST", "/Borrow", "Bearer guess"); status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	if len(library.Loans()) != 0 {
+		t.Error("expected rejected requests not to borrow")
+	}
+
+	// Test 4: The right token goes through
+	if status := do(handler, "POST", "/Borrow", "Bearer s3cret"); status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	// Test 5: Reads can be protected too
+	handler = requireToken([]apiToken{{Token: "s3cret", Role: roleLibrarian}}, true, srv.routes())
+	if status := do(handler, "GET", "/Book?title=Go+Programming", ""); status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	handler := requireToken([]apiToken{
+		{Token: "librarian", Role: roleLibrarian},
+		{Token: "john", Role: roleMember, Member: "John Doe"},
+	}, false, srv.routes())
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Test 1: Members cannot manage books or members
+	if rr := do("POST", "/Book", "john", `{"title": "Dune", "author": "Frank Herbert", "availableCopies": 1}`); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := do("POST", "/Members", "john", `{"name": "Jane Doe", "email": "jane@example.com"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Test 2: Librarians can
+	if rr := do("POST", "/Book", "librarian", `{"title": "Dune", "author": "Frank Herbert", "availableCopies": 1}`); rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	// Test 3: Members borrow for themselves only
+	if rr := do("POST", "/Borrow", "john", `{"title": "Go Programming", "borrower": "Jane Doe"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	rr := do("POST", "/Borrow", "john", `{"title": "Go Programming", "borrower": "John Doe"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	var johns librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &johns); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 4: Members cannot return someone else's loan by ID
+	rr = do("POST", "/Borrow", "librarian", `{"title": "Go Programming", "borrower": "Jane Doe"}`)
+	var janes librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &janes); err != nil {
+		t.Fatal(err)
+	}
+	if rr := do("POST", "/Return", "john", `{"loanId": "`+janes.ID+`"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := do("POST", "/Return", "john", `{"loanId": "`+johns.ID+`"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Test 5: Nor once their own loan was transferred to someone else
+	transferred, err := library.Borrow("Clean Code", "John Doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.TransferLoanByID(transferred.ID, "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := do("POST", "/Return", "john", `{"loanId": "`+transferred.ID+`"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	for _, report := range []string{"lost", "damaged"} {
+		if rr := do("POST", "/loans/"+transferred.ID+"/"+report, "john", ""); rr.Code != http.StatusForbidden {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", report, rr.Code, http.StatusForbidden)
+		}
+	}
+	if loan, err := library.Loan(transferred.ID); err != nil || loan.NameOfBorrower != "Jane Doe" {
+		t.Errorf("expected Jane's loan to stay open, got %+v, %v", loan, err)
+	}
+}
+
+// slowWriter blocks the first Write until release is closed, like a client
+// reading a large response over a slow connection.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestSlowClientDoesNotBlockWriters(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	handler := srv.routes()
+
+	for i := 0; i < 1000; i++ {
+		title := fmt.Sprintf("Title %d", i)
+		library.LoadBook(librarypkg.BookDetail{Title: title, AvailableCopies: 1, TotalCopies: 1})
+	}
+
+	slow := &slowWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		writing:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		req, _ := http.NewRequest("GET", "/Books?limit=1000", nil)
+		handler.ServeHTTP(slow, req)
+	}()
+	<-slow.writing
+
+	// Test 1: Borrowing and returning go through while the listing is stuck
+	// writing its response
+	done := make(chan int, 2)
+	go func() {
+		for _, target := range []string{"/Borrow", "/Return"} {
+			req, _ := http.NewRequest("POST", target, strings.NewReader(`{"title": "Title 1", "borrower": "John Doe"}`))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			done <- rr.Code
+		}
+	}()
+	for _, want := range []int{http.StatusCreated, http.StatusOK} {
+		select {
+		case status := <-done:
+			if status != want {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("writer blocked by a slow client")
+		}
+	}
+
+	// Test 2: The listing still completes once the client catches up
+	close(slow.release)
+	<-listed
+	if slow.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", slow.Code, http.StatusOK)
+	}
+}
+
+func TestDueLoansHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	clock := useFakeClock(library, time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC))
+	srv := &server{library: library}
+
+	get := func(target string) ([]librarypkg.LoanDetail, int) {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		srv.dueLoansHandler(rr, req)
+
+		var loans []librarypkg.LoanDetail
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &loans); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return loans, rr.Code
+	}
+
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * 24 * time.Hour)
+	if _, err := library.Borrow("Clean Code", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Only loans due within the default 3 days are listed
+	clock.Advance(16 * 24 * time.Hour)
+	loans, status := get("/Loans/due")
+	if status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if len(loans) != 1 || loans[0].BookTitle != "Go Programming" {
+		t.Errorf("expected only Go Programming to be due, got %+v", loans)
+	}
+
+	// Test 2: A wider window includes later loans, soonest first
+	loans, _ = get("/Loans/due?days=14")
+	if len(loans) != 2 || loans[0].BookTitle != "Go Programming" || loans[1].BookTitle != "Clean Code" {
+		t.Errorf("expected both loans soonest first, got %+v", loans)
+	}
+
+	// Test 3: Overdue loans are left out
+	clock.Advance(3 * 24 * time.Hour)
+	loans, _ = get("/Loans/due?days=14")
+	if len(loans) != 1 || loans[0].BookTitle != "Clean Code" {
+		t.Errorf("expected only Clean Code once Go Programming is overdue, got %+v", loans)
+	}
+
+	// Test 4: Invalid windows are rejected
+	for _, target := range []string{"/Loans/due?days=soon", "/Loans/due?days=-1"} {
+		if _, status := get(target); status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", target, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLoanCountsHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	clock := useFakeClock(library, time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC))
+	srv := &server{library: library}
+
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(20 * 24 * time.Hour)
+	if _, err := library.Borrow("Clean Code", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Reserve("Clean Code", "Max Doe"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * 24 * time.Hour)
+
+	req, err := http.NewRequest("GET", "/Loans/count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	srv.loanCountsHandler(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var counts librarypkg.LoanCounts
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil {
+		t.Fatal(err)
+	}
+	want := librarypkg.LoanCounts{ActiveLoans: 3, OverdueLoans: 2, Reservations: 1, Borrowers: 2, AsOf: clock.Now()}
+	if !counts.AsOf.Equal(want.AsOf) {
+		t.Errorf("got snapshot time %v, want %v", counts.AsOf, want.AsOf)
+	}
+	counts.AsOf = want.AsOf
+	if counts != want {
+		t.Errorf("got counts %+v, want %+v", counts, want)
+	}
+}
+
+func TestBorrowerHandler(t *testing.T) {
+	library := newTestLibrary(t)
+	clock := useFakeClock(library, time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC))
+	srv := &server{library: library}
+
+	get := func(target string) ([]librarypkg.BorrowerLoan, *httptest.ResponseRecorder) {
+		req, err := http.NewRequest("GET", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		srv.borrowerHandler(rr, req)
+
+		var loans []librarypkg.BorrowerLoan
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &loans); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return loans, rr
+	}
+
+	// Test 1: The name is required
+	if _, rr := get("/Borrower"); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Test 2: Nothing checked out is an empty list
+	_, rr := get("/Borrower?name=John+Doe")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != "[]" {
+		t.Errorf("expected an empty list, got %s", body)
+	}
+
+	// Test 3: Loans across titles, soonest due first, with days remaining
+	if _, err := library.Borrow("Clean Code", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := library.Borrow("Clean Code", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(24 * time.Hour)
+	if _, err := library.Borrow("Go Programming", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(6 * time.Hour)
+
+	loans, _ := get("/Borrower?name=John+Doe")
+	if len(loans) != 2 || loans[0].BookTitle != "Clean Code" || loans[1].BookTitle != "Go Programming" {
+		t.Fatalf("expected John Doe's loans soonest first, got %+v", loans)
+	}
+	if loans[0].DaysRemaining != librarypkg.DefaultLoanDays-1 || loans[1].DaysRemaining != librarypkg.DefaultLoanDays {
+		t.Errorf("unexpected days remaining: %d and %d", loans[0].DaysRemaining, loans[1].DaysRemaining)
+	}
+
+	// Test 4: Overdue loans have negative days remaining
+	clock.Advance(time.Duration(librarypkg.DefaultLoanDays+1) * 24 * time.Hour)
+	loans, _ = get("/Borrower?name=John+Doe")
+	if len(loans) != 2 || loans[0].DaysRemaining != -3 || loans[1].DaysRemaining != -2 {
+		t.Errorf("expected overdue loans to count down below zero, got %+v", loans)
+	}
+}
+
+func TestBorrowLastCopiesStress(t *testing.T) {
+	const borrowers, copies = 50, 3
+
+	library := newTestLibrary(t)
+	library.LoadBook(librarypkg.BookDetail{Title: "Dune", AvailableCopies: copies, TotalCopies: copies})
+	srv := &server{library: library}
+	handler := srv.routes()
+
+	do := func(target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", target, strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return httptest.NewRecorder()
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	start := make(chan struct{})
+	results := make(chan *httptest.ResponseRecorder, borrowers)
+	var wg sync.WaitGroup
+	for i := 0; i < borrowers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			results <- do("/Borrow", fmt.Sprintf(`{"title": "Dune", "borrower": "Borrower %d"}`, i))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	// Test 1: Exactly as many borrows succeed as there are copies
+	var loanIDs []string
+	conflicts := 0
+	for rr := range results {
+		switch rr.Code {
+		case http.StatusCreated:
+			var loan librarypkg.LoanDetail
+			if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+				t.Fatal(err)
+			}
+			loanIDs = append(loanIDs, loan.ID)
+		case http.StatusConflict:
+			conflicts++
+		default:
+			t.Errorf("handler returned unexpected status code: %v", rr.Code)
+		}
+	}
+	if len(loanIDs) != copies || conflicts != borrowers-copies {
+		t.Fatalf("expected %d borrows and %d conflicts, got %d and %d", copies, borrowers-copies, len(loanIDs), conflicts)
+	}
+	if book, _ := library.Book("Dune"); book.AvailableCopies != 0 {
+		t.Errorf("expected no copies left, got %d", book.AvailableCopies)
+	}
+
+	// Test 2: Returning them all concurrently restores every copy
+	for _, id := range loanIDs {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if rr := do("/Return", `{"loanId": "`+id+`"}`); rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if book, _ := library.Book("Dune"); book.AvailableCopies != copies {
+		t.Errorf("expected %d copies back, got %d", copies, book.AvailableCopies)
+	}
+	if len(library.Loans()) != 0 {
+		t.Errorf("expected no loans left, got %d titles with loans", len(library.Loans()))
+	}
+	if err := library.Validate(); err != nil {
+		t.Errorf("expected a valid library, got %v", err)
+	}
+}
+
+func TestIdempotentBorrow(t *testing.T) {
+	library := newTestLibrary(t)
+	library.LoadBook(librarypkg.BookDetail{Title: "Dune", AvailableCopies: 5, TotalCopies: 5})
+	library.MaxCopiesPerBorrowerPerTitle = 0
+	clock := useFakeClock(library, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	srv := &server{library: library, idempotency: newIdempotencyCache(time.Hour, 2, clock.Now)}
+	handler := srv.routes()
+
+	borrow := func(key, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/Borrow", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	available := func() int {
+		book, _ := library.Book("Dune")
+		return book.AvailableCopies
+	}
+	const alice = `{"title": "Dune", "borrower": "Alice"}`
+
+	// Test 1: A retry with the same key replays the response and borrows once
+	first := borrow("key-1", alice)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", first.Code, http.StatusCreated)
+	}
+	retry := borrow("key-1", alice)
+	if retry.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", retry.Code, http.StatusCreated)
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("expected the replayed body %q, got %q", first.Body.String(), retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected only the retry to be marked replayed")
+	}
+	if retry.Header().Get("Content-Type") != first.Header().Get("Content-Type") {
+		t.Errorf("expected the replayed content type %q, got %q", first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	}
+	if got := available(); got != 4 {
+		t.Errorf("expected 4 copies left, got %d", got)
+	}
+
+	// Test 2: Reusing the key for a different request is a 422
+	if rr := borrow("key-1", `{"title": "Dune", "borrower": "Bob"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if got := available(); got != 4 {
+		t.Errorf("expected 4 copies left, got %d", got)
+	}
+
+	// Test 3: Requests without a key are never deduplicated
+	borrow("", alice)
+	borrow("", alice)
+	if got := available(); got != 2 {
+		t.Errorf("expected 2 copies left, got %d", got)
+	}
+
+	// Test 4: An expired key runs the request again
+	clock.Advance(time.Hour)
+	if rr := borrow("key-1", alice); rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected a fresh borrow after the key expired, got %v", rr.Code)
+	}
+	if got := available(); got != 1 {
+		t.Errorf("expected 1 copy left, got %d", got)
+	}
+
+	// Test 5: Errors are replayed too, and the oldest key goes past the size cap
+	if rr := borrow("key-2", `{"title": "Dune", "borrower": "Carol"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	conflict := borrow("key-3", `{"title": "Dune", "borrower": "Dan"}`)
+	if conflict.Code != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v", conflict.Code, http.StatusConflict)
+	}
+	if rr := borrow("key-3", `{"title": "Dune", "borrower": "Dan"}`); rr.Code != http.StatusConflict || rr.Header().Get(errorCodeHeader) != conflict.Header().Get(errorCodeHeader) {
+		t.Errorf("expected the conflict to be replayed, got %v", rr.Code)
+	}
+	if _, err := library.Return("Dune", "Carol"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := borrow("key-1", alice); rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected the evicted key to borrow again, got %v", rr.Code)
+	}
+}
+
+func TestCaseInsensitiveTitleHandlers(t *testing.T) {
+	handler := (&server{library: newTestLibrary(t)}).routes()
+
+	// Test 1: GET /Book finds a title in any case
+	req := httptest.NewRequest("GET", "/Book?title=go+programming", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var book librarypkg.BookDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Go Programming" {
+		t.Errorf("expected the display title 'Go Programming', got '%s'", book.Title)
+	}
+
+	// Test 2: Adding a title that differs only in case is a 409
+	req = httptest.NewRequest("POST", "/Book", strings.NewReader(`{"title": "GO PROGRAMMING", "availableCopies": 1}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if code := rr.Header().Get(errorCodeHeader); code != "TITLE_COLLISION" {
+		t.Errorf("expected error code TITLE_COLLISION, got %q", code)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	library := newTestLibrary(t)
+	library.Audit = librarypkg.NewAuditLog(100)
+	library.Webhooks = librarypkg.NewWebhooks(1)
+	clock := useFakeClock(library, time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC))
+	srv := &server{library: library}
+	handler := requireToken([]apiToken{
+		{Token: "desk", Role: roleLibrarian, Name: "Front Desk"},
+		{Token: "john", Role: roleMember, Member: "John Doe"},
+	}, false, srv.routes())
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if method == "PATCH" {
+			req.Header.Set("If-Match", "*")
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		clock.Advance(time.Minute)
+		return rr
+	}
+	entries := func(target string) []librarypkg.AuditEntry {
+		rr := do("GET", target, "desk", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var page auditPage
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page.Entries
+	}
+
+	do("POST", "/Book", "desk", `{"title": "Dune", "availableCopies": 1}`)
+	do("PATCH", "/Book?title=Dune", "desk", `{"category": "Fiction"}`)
+	do("POST", "/Borrow", "john", `{"title": "Dune", "borrower": "John Doe"}`)
+	do("POST", "/Borrow", "desk", `{"title": "Dune", "borrower": "Jane Doe"}`)
+	do("POST", "/Reserve", "desk", `{"title": "Dune", "borrower": "Jane Doe"}`)
+	do("DELETE", "/Reserve?title=Dune&borrower=Jane+Doe", "desk", "")
+	do("POST", "/Extend", "john", `{"title": "Dune", "borrower": "John Doe"}`)
+	do("POST", "/Return", "john", `{"title": "Dune", "borrower": "John Doe"}`)
+	do("POST", "/Books/import", "desk", "title,availableCopies\nEmma,2\n")
+	do("POST", "/Members", "desk", `{"name": "Jane Doe", "email": "jane@example.com"}`)
+	do("POST", "/admin/webhooks", "desk", `{"url": "not a url", "events": ["book.returned"]}`)
+	do("DELETE", "/Book?title=Dune", "desk", "")
+
+	// Test 1: Every operation is recorded in order with its actor and outcome
+	want := []librarypkg.AuditEntry{
+		{Actor: "Front Desk", Action: librarypkg.AuditAddBook, Title: "Dune", Outcome: librarypkg.AuditOK},
+		{Actor: "Front Desk", Action: librarypkg.AuditUpdateBook, Title: "Dune", Outcome: librarypkg.AuditOK},
+		{Actor: "John Doe", Action: librarypkg.AuditBorrow, Title: "Dune", Borrower: "John Doe", Outcome: librarypkg.AuditOK},
+		{Actor: "Front Desk", Action: librarypkg.AuditBorrow, Title: "Dune", Borrower: "Jane Doe", Outcome: "NO_COPIES"},
+		{Actor: "Front Desk", Action: librarypkg.AuditReserve, Title: "Dune", Borrower: "Jane Doe", Outcome: librarypkg.AuditOK},
+		{Actor: "Front Desk", Action: librarypkg.AuditCancel, Title: "Dune", Borrower: "Jane Doe", Outcome: librarypkg.AuditOK},
+		{Actor: "John Doe", Action: librarypkg.AuditExtend, Title: "Dune", Borrower: "John Doe", Outcome: librarypkg.AuditOK},
+		{Actor: "John Doe", Action: librarypkg.AuditReturn, Title: "Dune", Borrower: "John Doe", Outcome: librarypkg.AuditOK},
+		{Actor: "Front Desk", Action: librarypkg.AuditImport, Outcome: librarypkg.AuditOK},
+		{Actor: "Front Desk", Action: librarypkg.AuditAddMember, Borrower: "Jane Doe", Outcome: librarypkg.AuditOK},
+		{Actor: "Front Desk", Action: librarypkg.AuditAddWebhook, Title: "not a url", Outcome: "INVALID_WEBHOOK"},
+		{Actor: "Front Desk", Action: librarypkg.AuditArchive, Title: "Dune", Outcome: librarypkg.AuditOK},
+	}
+	got := entries("/admin/audit")
+	if len(got) != len(want) {
+		t.Fatalf("expected %d audit entries, got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		want[i].At = got[i].At
+		if got[i] != want[i] {
+			t.Errorf("entry %d: got %+v want %+v", i, got[i], want[i])
+		}
+		if i > 0 && !got[i].At.After(got[i-1].At) {
+			t.Errorf("entry %d is not after the one before it", i)
+		}
+	}
+
+	// Test 2: Filters and pagination
+	if got := entries("/admin/audit?actor=John+Doe&action=borrow"); len(got) != 1 || got[0].Borrower != "John Doe" {
+		t.Errorf("unexpected filtered entries: %+v", got)
+	}
+	from := want[6].At.Format(time.RFC3339)
+	if got := entries("/admin/audit?from=" + url.QueryEscape(from)); len(got) != 6 || got[0].Action != librarypkg.AuditExtend {
+		t.Errorf("unexpected entries from %s: %+v", from, got)
+	}
+	if got := entries("/admin/audit?limit=2&offset=2"); len(got) != 2 || got[0].Action != librarypkg.AuditBorrow {
+		t.Errorf("unexpected page: %+v", got)
+	}
+	if rr := do("GET", "/admin/audit?from=yesterday", "desk", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Test 3: Bad ranges and pages get the same field errors as other listings
+	to := want[0].At.Format(time.RFC3339)
+	rr := do("GET", "/admin/audit?from="+url.QueryEscape(from)+"&to="+url.QueryEscape(to)+"&limit=0", "desk", "")
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	var response struct {
+		Errors []fieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	wantErrs := []fieldError{
+		{Field: "from", Message: "must not be after to"},
+		{Field: "limit", Message: "must be between 1 and 1000"},
+	}
+	if !slices.Equal(response.Errors, wantErrs) {
+		t.Errorf("unexpected field errors: got %+v want %+v", response.Errors, wantErrs)
+	}
+
+	// Test 4: Only librarians can read the audit log
+	if rr := do("GET", "/admin/audit", "john", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	library := newTestLibrary(t)
+	library.MaxExtensions = 0
+	srv := &server{library: library}
+	handler := srv.routes()
+
+	do := func(method, target, body string) int {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Readers list across titles while the writers run, and check the copy
+	// count never goes negative
+	for _, target := range []string{"/Books", "/Loans", "/Loans/due?days=60", "/Stats", "/Overdue", "/Book/availability?title=Go+Programming"} {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if status := do("GET", target, ""); status != http.StatusOK {
+					t.Errorf("%s: handler returned wrong status code: got %v want %v", target, status, http.StatusOK)
+					return
+				}
+				if book, _ := library.Book("Go Programming"); book.AvailableCopies < 0 {
+					t.Errorf("available copies went negative: %d", book.AvailableCopies)
+					return
+				}
+			}
+		}(target)
+	}
+
+	var writers sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			body := fmt.Sprintf(`{"title": "Go Programming", "borrower": "Borrower %d"}`, i)
+			for j := 0; j < 50; j++ {
+				switch status := do("POST", "/Borrow", body); status {
+				case http.StatusCreated:
+				case http.StatusConflict:
+					continue
+				default:
+					t.Errorf("borrow: unexpected status code %v", status)
+					return
+				}
+				if status := do("POST", "/Extend", body); status != http.StatusOK {
+					t.Errorf("extend: handler returned wrong status code: got %v want %v", status, http.StatusOK)
+				}
+				if status := do("POST", "/Return", body); status != http.StatusOK {
+					t.Errorf("return: handler returned wrong status code: got %v want %v", status, http.StatusOK)
+				}
+			}
+		}(i)
+	}
+	writers.Wait()
+	close(stop)
+	wg.Wait()
+
+	// Test 1: Everything borrowed came back and the invariants hold
+	if book, _ := library.Book("Go Programming"); book.AvailableCopies != 3 {
+		t.Errorf("expected 3 available copies, got %d", book.AvailableCopies)
+	}
+	if len(library.Loans()) != 0 {
+		t.Errorf("expected no loans, got %d titles with loans", len(library.Loans()))
+	}
+	if err := library.Validate(); err != nil {
+		t.Errorf("expected a valid library, got %v", err)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	srv := &server{library: newTestLibrary(t)}
+	handler := srv.routes()
+
+	req, err := http.NewRequest("GET", "/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var spec struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Every registered route and method is described
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("expected an OpenAPI 3 document, got version %q", spec.OpenAPI)
+	}
+	for _, route := range srv.routeTable() {
+		item, exists := spec.Paths[route.pattern]
+		if !exists {
+			t.Errorf("route %s is missing from the spec", route.pattern)
+			continue
+		}
+		if len(route.operations) == 0 {
+			t.Errorf("route %s documents no operations", route.pattern)
+		}
+		for _, op := range route.operations {
+			if _, exists := item[strings.ToLower(op.method)]; !exists {
+				t.Errorf("%s %s is missing from the spec", op.method, route.pattern)
+			}
+		}
+	}
+
+	// Test 2: Schemas follow the Go types, including embedded structs
+	book := spec.Components.Schemas["BookDetail"]
+	for _, field := range []string{"title", "availableCopies", "loanDays", "version"} {
+		if _, exists := book.Properties[field]; !exists {
+			t.Errorf("BookDetail schema is missing %s", field)
+		}
+	}
+	loan := spec.Components.Schemas["LoanDetail"]
+	for _, field := range []string{"id", "bookTitle", "nameOfBorrower", "returnDate", "barcode"} {
+		if _, exists := loan.Properties[field]; !exists {
+			t.Errorf("LoanDetail schema is missing %s", field)
+		}
+	}
+	extend := spec.Components.Schemas["ExtendRequest"]
+	for _, field := range []string{"title", "borrower", "days"} {
+		if _, exists := extend.Properties[field]; !exists {
+			t.Errorf("ExtendRequest schema is missing %s", field)
+		}
+	}
+	if _, exists := spec.Components.Schemas["FieldErrors"]; !exists {
+		t.Error("expected the FieldErrors schema")
+	}
+
+	// Test 3: The docs page renders the spec
+	req, _ = http.NewRequest("GET", "/docs", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), "/openapi.json") {
+		t.Error("expected the docs page to load /openapi.json")
+	}
+}
+
+func TestDoubleReturn(t *testing.T) {
+	library := newTestLibrary(t)
+	srv := &server{library: library}
+	handler := srv.routes()
+
+	do := func(target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", target, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("/Borrow", `{"title": "Clean Code", "borrower": "Jane Smith"}`)
+	var loan librarypkg.LoanDetail
+	if err := json.Unmarshal(rr.Body.Bytes(), &loan); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test 1: Retried returns of the same loan only count once
+	statuses := make(chan int, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- do("/Return", `{"loanId": "`+loan.ID+`"}`).Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	returned := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			returned++
+		case http.StatusNotFound:
+		default:
+			t.Errorf("handler returned unexpected status code: %v", status)
+		}
+	}
+	if returned != 1 {
+		t.Errorf("expected exactly one return to succeed, got %d", returned)
+	}
+	if rr := do("/Return", `{"title": "Clean Code", "borrower": "Jane Smith"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	book, _ := library.Book("Clean Code")
+	if book.AvailableCopies != 2 || book.TotalCopies != 2 {
+		t.Errorf("expected 2 of 2 copies available, got %d of %d", book.AvailableCopies, book.TotalCopies)
+	}
+
+	// Test 2: A stray loan on a book with every copy on the shelf can't push
+	// the count past the total
+	cleanCode, _ := library.Book("Clean Code")
+	library.LoadBook(cleanCode, librarypkg.LoanDetail{ID: "stray", BookTitle: "Clean Code", NameOfBorrower: "Bob Johnson"})
+	if rr := do("/Return", `{"loanId": "stray"}`); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if book, _ := library.Book("Clean Code"); book.AvailableCopies != 2 {
+		t.Errorf("expected available copies to stay at 2, got %d", book.AvailableCopies)
+	}
 }
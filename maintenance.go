@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"Library/librarypkg"
+)
+
+// maintenanceRetryAfter is how many seconds clients are told to wait before
+// retrying a change refused in maintenance mode.
+const maintenanceRetryAfter = 300
+
+// maintenancePath is the one mutation still allowed in maintenance mode, so
+// it can be turned off again.
+const maintenancePath = "/admin/maintenance"
+
+// refuseInMaintenance answers requests that could change the library with a
+// 503 while it is read-only. Reads go through as usual, and so does
+// graphqlPath, whose mutations are refused one by one.
+func (s *server) refuseInMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if s.library.ReadOnly() && r.URL.Path != maintenancePath && r.URL.Path != graphqlPath {
+				w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+				writeError(w, r, librarypkg.ErrReadOnly)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+type maintenanceResponse struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+func (s *server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request maintenanceRequest
+		if !decodeRequest(w, r, &request) {
+			return
+		}
+		s.library.SetReadOnly(*request.ReadOnly)
+		s.audit(r, librarypkg.AuditMaintenance, "", "", nil)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, maintenanceResponse{ReadOnly: s.library.ReadOnly()})
+}
+
+type healthResponse struct {
+	Status   string `json:"status"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+// healthzHandler reports that the server is up, unlike readyzHandler without
+// checking the library, and whether it is in maintenance mode.
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok", ReadOnly: s.library.ReadOnly()})
+}
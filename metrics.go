@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// durationBuckets are the upper bounds in seconds of the request duration
+// histogram, Prometheus' defaults.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// httpMetrics counts responses and times requests per route, in the
+// Prometheus text format. Routes are labelled by their pattern, such as
+// /loans/{id}, rather than the path, so titles and IDs don't each get a
+// series of their own.
+type httpMetrics struct {
+	mutex     sync.Mutex
+	durations map[durationKey]*histogram
+	responses map[responseKey]uint64
+}
+
+type durationKey struct {
+	route       string
+	statusClass string // 2xx, 4xx...
+}
+
+type responseKey struct {
+	route string
+	code  int
+}
+
+type histogram struct {
+	counts []uint64 // per bucket of durationBuckets, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		durations: make(map[durationKey]*histogram),
+		responses: make(map[responseKey]uint64),
+	}
+}
+
+func (m *httpMetrics) observe(route string, status int, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := durationKey{route: route, statusClass: strconv.Itoa(status/100) + "xx"}
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[key] = h
+	}
+	seconds := elapsed.Seconds()
+	if i, _ := slices.BinarySearch(durationBuckets, seconds); i < len(durationBuckets) {
+		h.counts[i]++
+	}
+	h.sum += seconds
+	h.count++
+
+	m.responses[responseKey{route: route, code: status}]++
+}
+
+// write renders the metrics in the Prometheus text exposition format, with
+// series sorted so scrapes are stable.
+func (m *httpMetrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP library_http_request_duration_seconds Time taken to answer requests, by route and status class.")
+	fmt.Fprintln(w, "# TYPE library_http_request_duration_seconds histogram")
+	durations := slices.SortedFunc(maps.Keys(m.durations), func(a, b durationKey) int {
+		return strings.Compare(a.route+" "+a.statusClass, b.route+" "+b.statusClass)
+	})
+	for _, key := range durations {
+		h := m.durations[key]
+		labels := fmt.Sprintf(`route="%s",status_class="%s"`, escapeLabel(key.route), key.statusClass)
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "library_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "library_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "library_http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "library_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP library_http_responses_total Responses sent, by route and status code.")
+	fmt.Fprintln(w, "# TYPE library_http_responses_total counter")
+	responses := slices.SortedFunc(maps.Keys(m.responses), func(a, b responseKey) int {
+		if c := strings.Compare(a.route, b.route); c != 0 {
+			return c
+		}
+		return a.code - b.code
+	})
+	for _, key := range responses {
+		fmt.Fprintf(w, "library_http_responses_total{route=\"%s\",code=\"%d\"} %d\n", escapeLabel(key.route), key.code, m.responses[key])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// instrument times next and counts its responses under route, the pattern
+// it was registered with. It does nothing when metrics are off.
+func (s *server) instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	if s.metrics == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			// A handler that never wrote anything answered 200
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			s.metrics.observe(route, status, time.Since(start))
+		}()
+		next(sw, r)
+	}
+}
+
+// statusWriter records the status a handler answered with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush and Unwrap keep streaming handlers working behind the middleware.
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.metrics == nil {
+		http.Error(w, "Metrics are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w)
+}
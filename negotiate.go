@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"Library/librarypkg"
+)
+
+// preferredFormat picks the response format from an Accept header: JSON when
+// it's absent or accepts JSON first, XML for application/xml. Acceptable is
+// false when the header allows neither.
+func preferredFormat(accept string) (useXML, acceptable bool) {
+	if accept == "" {
+		return false, true
+	}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(mediaRange, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json", "application/*", "*/*":
+			return false, true
+		case "application/xml", "text/xml":
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// negotiateXML is preferredFormat for handlers that check the Accept header
+// up front. It writes a 406 and returns ok false when the client accepts
+// neither format.
+func negotiateXML(w http.ResponseWriter, r *http.Request) (useXML, ok bool) {
+	varyAccept(w)
+
+	useXML, ok = preferredFormat(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "Not acceptable, use application/json or application/xml", http.StatusNotAcceptable)
+	}
+	return useXML, ok
+}
+
+// writeResponse encodes v in the format the client prefers, XML or else
+// JSON, so handlers don't have to branch on it. Clients accepting neither
+// still get JSON, since the request has been carried out by then.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	varyAccept(w)
+	if useXML, _ := preferredFormat(r.Header.Get("Accept")); useXML {
+		writeXML(w, status, xmlRoot(v), v)
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+// varyAccept marks the response as depending on the Accept header, once.
+func varyAccept(w http.ResponseWriter) {
+	if !slices.Contains(w.Header().Values("Vary"), "Accept") {
+		w.Header().Add("Vary", "Accept")
+	}
+}
+
+// xmlRoots names the document root of types whose Go name reads badly in XML.
+var xmlRoots = map[reflect.Type]string{
+	reflect.TypeFor[librarypkg.BookDetail](): "book",
+	reflect.TypeFor[librarypkg.LoanDetail](): "loan",
+	reflect.TypeFor[bookResponse]():          "book",
+	reflect.TypeFor[noCopiesResponse]():      "error",
+}
+
+// xmlRoot is the document root for v: its xmlRoots entry, or else its type
+// name starting in lower case.
+func xmlRoot(v any) string {
+	t := reflect.TypeOf(v)
+	if root, found := xmlRoots[t]; found {
+		return root
+	}
+	first, size := utf8.DecodeRuneInString(t.Name())
+	return string(unicode.ToLower(first)) + t.Name()[size:]
+}
+
+// writeXML encodes v as the XML document root, the counterpart of writeJSON
+// for clients that asked for XML.
+func writeXML(w http.ResponseWriter, status int, root string, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).EncodeElement(v, xml.StartElement{Name: xml.Name{Local: root}})
+}
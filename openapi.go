@@ -0,0 +1,546 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"Library/librarypkg"
+)
+
+// route is a registered pattern with its handler and the operations it serves.
+// routes registers the handlers, only letting through the methods of the
+// operations, and the OpenAPI spec is built from them, so the two can't drift
+// apart.
+type route struct {
+	pattern    string
+	handler    http.HandlerFunc
+	operations []operation
+}
+
+// methods lists the methods the route serves, in the order documented.
+func (rt route) methods() []string {
+	methods := make([]string, len(rt.operations))
+	for i, op := range rt.operations {
+		methods[i] = op.method
+	}
+	return methods
+}
+
+// operation documents one method of a route. request and response are zero
+// values of the JSON body types, which are described by reflection.
+type operation struct {
+	method      string
+	summary     string
+	description string
+	params      []param
+	request     any
+	requestType string // non-JSON request body, e.g. text/csv
+	status      int    // success status, 200 when unset
+	response    any
+	contentType string // non-JSON success response, e.g. text/csv
+	xml         bool   // the response is also served as XML for Accept: application/xml
+	fieldErrors bool   // invalid parameters are answered with fieldErrors
+}
+
+type param struct {
+	name        string
+	in          string // "query" when unset
+	kind        string // JSON schema type, "string" when unset
+	description string
+	required    bool
+}
+
+var (
+	titleParam          = param{name: "title", description: "Exact book title", required: true}
+	ifMatchParam        = param{name: "If-Match", in: "header", description: "The book's current ETag, or *", required: true}
+	idempotencyKeyParam = param{name: "Idempotency-Key", in: "header", description: "Client chosen key that makes retrying the request safe"}
+)
+
+func (s *server) routeTable() []route {
+	pageParams := []param{
+		{name: "limit", kind: "integer", description: "Page size between 1 and 1000, 50 by default"},
+		{name: "offset", kind: "integer", description: "Number of results to skip"},
+	}
+
+	return []route{
+		{"/Book", s.bookHandler, []operation{
+			{method: "GET", summary: "Get a book", params: []param{titleParam}, response: bookResponse{}, xml: true,
+				description: "While no copy can be borrowed, nextAvailableDate is the earliest due date of the copies on loan. queueLength counts the borrowers waiting in the reservation queue."},
+			{method: "POST", summary: "Add a book", status: http.StatusCreated,
+				description: "With enrich=true and only an ISBN, the rest is looked up on Open Library; copies of a known title are merged with a 200.",
+				params:      []param{{name: "enrich", kind: "boolean", description: "Fill in the book from its ISBN"}},
+				request:     bookRequest{}, response: librarypkg.BookDetail{}, xml: true},
+			{method: "PUT", summary: "Replace a book's metadata", params: []param{titleParam, ifMatchParam},
+				request: bookRequest{}, response: librarypkg.BookDetail{}, xml: true},
+			{method: "PATCH", summary: "Update a book", params: []param{titleParam, ifMatchParam},
+				request: bookUpdateRequest{}, response: librarypkg.BookDetail{}, xml: true},
+			{method: "DELETE", summary: "Archive or delete a book", status: http.StatusNoContent,
+				description: "Archives the book, keeping it for loan histories and statistics. With hard=true it is removed instead, which is refused with BOOK_HAS_HISTORY once it has been borrowed.",
+				params:      []param{titleParam, {name: "hard", kind: "boolean", description: "Remove the book rather than archive it"}}},
+		}},
+		{"/Book/availability", s.bookAvailabilityHandler, []operation{
+			{method: "GET", summary: "Get a book's availability", params: []param{titleParam}, response: librarypkg.BookAvailability{}},
+		}},
+		{"/Book/history", s.bookHistoryHandler, []operation{
+			{method: "GET", summary: "List a book's loans", params: []param{titleParam}, response: []librarypkg.BookLoan{},
+				description: "Active loans and those in the loan history, oldest loan first. returnedLate marks loans closed after their due date."},
+		}},
+		{"/Book/popular", s.popularBooksHandler, []operation{
+			{method: "GET", summary: "Rank books by borrows", fieldErrors: true, response: []librarypkg.PopularBook{},
+				description: "Counts the loans made in the range, returned or still out, from the loan history.",
+				params: []param{
+					{name: "limit", kind: "integer", description: "Titles to return, 10 by default"},
+					{name: "since", description: "Only loans made at or after this RFC 3339 time"},
+					{name: "until", description: "Only loans made at or before this RFC 3339 time"},
+				}},
+		}},
+		{"/Book/archive", s.archiveBookHandler(true), []operation{
+			{method: "POST", summary: "Archive a book", params: []param{titleParam}, response: librarypkg.BookDetail{}, xml: true},
+		}},
+		{"/Book/unarchive", s.archiveBookHandler(false), []operation{
+			{method: "POST", summary: "Unarchive a book", params: []param{titleParam}, response: librarypkg.BookDetail{}, xml: true},
+		}},
+		{"/Books", s.listBooksHandler, []operation{
+			{method: "GET", summary: "List books", fieldErrors: true, response: bookPage{}, xml: true, params: append([]param{
+				{name: "title", description: "A work's title, matching every edition and volume of it"},
+				{name: "author", description: "Case-insensitive substring of the author"},
+				{name: "yearFrom", kind: "integer", description: "Earliest publication year"},
+				{name: "yearTo", kind: "integer", description: "Latest publication year"},
+				{name: "includeArchived", kind: "boolean", description: "Include archived books, for librarians"},
+			}, pageParams...)},
+		}},
+		{"/books/{title}", s.bookByPathHandler, []operation{
+			{method: "GET", summary: "Get a book by title in the path", response: bookResponse{}, xml: true,
+				description: "The same as GET /Book, with the title percent-encoded as one path segment, e.g. /books/Go%20Programming. A slash in the title is encoded as %2F."},
+		}},
+		{"/books/{title}/restore", s.restoreBookHandler, []operation{
+			{method: "POST", summary: "Restore an archived book", response: librarypkg.BookDetail{}, xml: true},
+		}},
+		{"/Books/isbn/{isbn}", s.bookByISBNHandler, []operation{
+			{method: "GET", summary: "Find a book by ISBN", response: librarypkg.BookDetail{}, xml: true},
+		}},
+		{"/Books/import", s.importBooksHandler, []operation{
+			{method: "POST", summary: "Import books from CSV", requestType: "text/csv", response: librarypkg.ImportSummary{},
+				params: []param{{name: "mode", description: "merge (default) or strict"}}},
+		}},
+		{newBooksPath, s.newBooksHandler, []operation{
+			{method: "GET", summary: "Atom feed of recently added books", contentType: "application/atom+xml",
+				description: "The 50 most recently added books, newest first. Last-Modified is when the newest was added, and a request with an If-Modified-Since at or after it gets a 304.",
+				params:      []param{{name: "If-Modified-Since", in: "header", description: "Last-Modified of the feed already fetched"}}},
+		}},
+		{"/Books/export", s.exportBooksHandler, []operation{
+			{method: "GET", summary: "Export the catalog as CSV", contentType: "text/csv"},
+		}},
+		{"/Loans", s.listLoansHandler, []operation{
+			{method: "GET", summary: "List active loans", response: []librarypkg.LoanDetail{},
+				params: []param{{name: "borrower", description: "Only this borrower's loans"}}},
+		}},
+		{"/Loans/count", s.loanCountsHandler, []operation{
+			{method: "GET", summary: "Count loans, reservations and borrowers", response: librarypkg.LoanCounts{}},
+		}},
+		{"/Loans/due", s.dueLoansHandler, []operation{
+			{method: "GET", summary: "List loans due soon", response: []librarypkg.LoanDetail{},
+				params: []param{{name: "days", kind: "integer", description: "Window in days, 3 by default"}}},
+		}},
+		{"/Loan", s.loanUpdateHandler, []operation{
+			{method: "PATCH", summary: "Correct a loan's borrower name", request: loanUpdateRequest{}, response: librarypkg.LoanDetail{}, xml: true},
+		}},
+		{"/Loan/transfer", s.loanTransferHandler, []operation{
+			{method: "POST", summary: "Transfer a loan to another borrower", request: loanTransferRequest{}, response: librarypkg.LoanDetail{}, xml: true,
+				description: "Hands the borrower's oldest loan of the title to the new borrower, keeping its dates. The new borrower is held to the loan limit and, once members are registered, must be one."},
+		}},
+		{"/loans/{id}", s.loanHandler, []operation{
+			{method: "GET", summary: "Get a loan", response: librarypkg.LoanDetail{}, xml: true,
+				description: "A returned loan is a 404 with X-Error-Code LOAN_RETURNED and a returnedLoanResponse body; LOAN_NOT_FOUND means it never existed."},
+		}},
+		{"/loans/{id}/transfer", s.loanTransferByIDHandler, []operation{
+			{method: "POST", summary: "Transfer a loan by ID", request: transferRequest{}, response: librarypkg.LoanDetail{}, xml: true,
+				description: "Hands the loan to the new borrower, keeping its due date and extensions, and adds the old borrower to previousBorrowers. The new borrower is held to the loan limits and, once members are registered, must be one."},
+		}},
+		{"/loans/{id}/lost", s.loanLostHandler, []operation{
+			{method: "POST", summary: "Report a loaned copy lost", response: librarypkg.ReturnReceipt{},
+				description: "Closes the loan and writes the copy off totalCopies. The borrower is charged the book's replacementCost, or the library's replacement fee, in their fines."},
+		}},
+		{"/loans/{id}/damaged", s.loanDamagedHandler, []operation{
+			{method: "POST", summary: "Return a loaned copy damaged", response: librarypkg.ReturnReceipt{},
+				description: "Closes the loan and counts the copy inRepair instead of available. Lowering inRepair with PATCH /Book puts it back on the shelf."},
+		}},
+		{"/Loans/export", s.exportLoansHandler, []operation{
+			{method: "GET", summary: "Export active loans as CSV", contentType: "text/csv"},
+		}},
+		{"/Borrower", s.borrowerHandler, []operation{
+			{method: "GET", summary: "List a borrower's loans", response: []librarypkg.BorrowerLoan{},
+				description: "Loans across all titles with the days remaining until each is due, soonest first.",
+				params:      []param{{name: "name", description: "Borrower name", required: true}}},
+		}},
+		{"/Borrow", s.idempotent(s.borrowBookHandler), []operation{
+			{method: "POST", summary: "Borrow a book", status: http.StatusCreated,
+				description: "With dryRun=true nothing is borrowed and the response is a 200 dryRunResponse. With reserveIfUnavailable=true a borrow that would fail for lack of copies joins the reservation queue instead, answering 202 with a reservationResponse. A retry with the same Idempotency-Key gets the first response back with Idempotent-Replayed: true; reusing the key for a different request is a 422. A 409 NO_COPIES comes with a noCopiesResponse body saying when a copy is due back.",
+				params: []param{
+					{name: "dryRun", kind: "boolean", description: "Only check whether the borrow would succeed"},
+					{name: "reserveIfUnavailable", kind: "boolean", description: "Reserve the book when no copy is available"},
+					idempotencyKeyParam,
+				},
+				request: loanRequest{}, response: librarypkg.LoanDetail{}, xml: true},
+		}},
+		{"/Borrow/batch", s.borrowBatchHandler, []operation{
+			{method: "POST", summary: "Borrow several books at once", status: http.StatusCreated,
+				description: "All or nothing: if any title is missing, archived or short of copies nothing is borrowed and the 409 body is a batchUnavailableResponse.",
+				request:     batchBorrowRequest{}, response: []librarypkg.LoanDetail{}},
+		}},
+		{"/Extend", s.extendLoanHandler, []operation{
+			{method: "POST", summary: "Extend a loan", request: extendRequest{}, response: librarypkg.LoanDetail{}, xml: true},
+		}},
+		{"/ExtendAll", s.extendAllHandler, []operation{
+			{method: "POST", summary: "Extend all of a borrower's loans", request: borrowerRequest{}, response: []librarypkg.ExtensionResult{}},
+		}},
+		{"/Return", s.returnBookHandler, []operation{
+			{method: "POST", summary: "Return a book", request: returnRequest{}, response: librarypkg.ReturnReceipt{}},
+		}},
+		{"/Lost", s.lostBookHandler, []operation{
+			{method: "POST", summary: "Report a borrowed book lost", request: returnRequest{}, response: librarypkg.ReturnReceipt{},
+				description: "Like /Return, by loan ID or by title and borrower, but the copy is written off totalCopies and the borrower is charged its replacement cost."},
+		}},
+		{"/Return/batch", s.returnBatchHandler, []operation{
+			{method: "POST", summary: "Return several books at once",
+				description: "Best effort: every item that matches one of the borrower's loans is returned, and the rest are reported with a reason.",
+				request:     batchReturnRequest{}, response: []librarypkg.ReturnResult{}},
+		}},
+		{"/ReturnBatch", s.returnBatchHandler, []operation{
+			{method: "POST", summary: "Return several books at once",
+				description: "The same as POST /Return/batch.",
+				request:     batchReturnRequest{}, response: []librarypkg.ReturnResult{}},
+		}},
+		{"/Reserve", s.reserveHandler, []operation{
+			{method: "POST", summary: "Reserve a book", status: http.StatusCreated, request: loanRequest{}, response: reservationResponse{},
+				description: "A queue already -max-reservations long answers 409 with RESERVATIONS_FULL."},
+			{method: "DELETE", summary: "Cancel a reservation", response: reservationResponse{},
+				description: "Removes the borrower from the title's reservation queue; everyone behind them moves up. A copy already held for them goes to the next borrower in the queue. The response holds the position they had, 0 for a cancelled hold, and a borrower who wasn't queued gets a 404.",
+				params: []param{
+					titleParam,
+					{name: "borrower", description: "Borrower name", required: true},
+				}},
+		}},
+		{"/Overdue", s.overdueHandler, []operation{
+			{method: "GET", summary: "List overdue loans", response: []librarypkg.OverdueLoan{}},
+		}},
+		{"/Fine", s.fineHandler, []operation{
+			{method: "GET", summary: "Get a borrower's fines", response: librarypkg.FineSummary{},
+				params: []param{{name: "borrower", description: "Borrower name", required: true}}},
+		}},
+		{"/Stats", s.statsHandler, []operation{
+			{method: "GET", summary: "Library statistics", response: librarypkg.Stats{}},
+		}},
+		{"/Stats/duration", s.loanDurationsHandler, []operation{
+			{method: "GET", summary: "Loan duration statistics", fieldErrors: true, response: librarypkg.LoanDurations{},
+				description: "Average, median, shortest and longest time in days from loan to return, over the returned loans in the history. Loans written off as lost or abandoned don't count.",
+				params: []param{
+					{name: "title", description: "Only loans of this book, in any case"},
+					{name: "since", description: "Only loans made at or after this RFC 3339 time"},
+					{name: "until", description: "Only loans made at or before this RFC 3339 time"},
+				}},
+		}},
+		{"/Members", s.addMemberHandler, []operation{
+			{method: "POST", summary: "Register a member", status: http.StatusCreated, request: memberRequest{}, response: librarypkg.Member{}},
+		}},
+		{"/Members/{name}" + calendarSuffix, s.memberCalendarHandler, []operation{
+			{method: "GET", summary: "Subscribe to a member's due dates", contentType: "text/calendar",
+				description: "An iCalendar feed with an all-day event on the due date of each of the member's active loans. Where reads need a token, calendar apps that can't send an Authorization header can pass it as the token query parameter."},
+		}},
+		{graphqlPath, s.graphqlHandler, []operation{
+			{method: "POST", summary: "Run a GraphQL query or mutation", request: graphqlRequest{}, response: graphqlResponse{},
+				description: "Queries book, books and member, with loans and their books nested to any depth; mutations borrowBook, returnBook and extendLoan. Field errors come back in errors with the REST error code as extensions.code, next to the rest of data. Documents that don't parse or don't fit the schema are a 400."},
+		}},
+		{"/events", s.eventsHandler, []operation{
+			{method: "GET", summary: "Stream loan events", contentType: "text/event-stream"},
+		}},
+		{"/healthz", s.healthzHandler, []operation{
+			{method: "GET", summary: "Liveness check", description: "Answers as long as the server is up, and reports whether it is in maintenance mode.", response: healthResponse{}},
+		}},
+		{"/readyz", s.readyzHandler, []operation{
+			{method: "GET", summary: "Readiness check", response: map[string]string{}},
+		}},
+		{metricsPath, s.metricsHandler, []operation{
+			{method: "GET", summary: "Request metrics", contentType: "text/plain",
+				description: "Prometheus text format: library_http_request_duration_seconds, a histogram by route pattern and status class, and library_http_responses_total by route pattern and status code."},
+		}},
+		{"/version", s.versionHandler, []operation{
+			{method: "GET", summary: "Build version", description: "The version, git commit and build date the server was built with, \"dev\" for local builds.", response: versionResponse{}},
+		}},
+		{"/openapi.json", s.openAPIHandler, []operation{
+			{method: "GET", summary: "This OpenAPI document", contentType: "application/json"},
+		}},
+		{"/docs", s.docsHandler, []operation{
+			{method: "GET", summary: "API documentation", contentType: "text/html"},
+		}},
+		{maintenancePath, s.maintenanceHandler, []operation{
+			{method: "GET", summary: "Get the maintenance mode", response: maintenanceResponse{}},
+			{method: "POST", summary: "Turn maintenance mode on or off",
+				description: "While readOnly is set every other POST, PUT, PATCH and DELETE is answered with 503, X-Error-Code MAINTENANCE and a Retry-After header; reads keep working.",
+				request:     maintenanceRequest{}, response: maintenanceResponse{}},
+		}},
+		{"/admin/audit", s.auditHandler, []operation{
+			{method: "GET", summary: "Query the audit log", fieldErrors: true, response: auditPage{}, params: append([]param{
+				{name: "action", description: "Only this action"},
+				{name: "actor", description: "Only this actor"},
+				{name: "from", description: "Earliest time, RFC 3339"},
+				{name: "to", description: "Latest time, RFC 3339"},
+			}, pageParams...)},
+		}},
+		{"/admin/loans/{id}/due-date", s.dueDateHandler, []operation{
+			{method: "PUT", summary: "Override a loan's due date", request: dueDateRequest{}, response: librarypkg.LoanDetail{}, xml: true,
+				description: "Sets the due date outright, ignoring the extension limit. A date before the loan date is a 400 DUE_BEFORE_LOAN, and a date in the past a 400 DUE_IN_PAST unless force is set."},
+		}},
+		{"/admin/books/rename", s.renameBookHandler, []operation{
+			{method: "POST", summary: "Rename a book", request: renameRequest{}, response: librarypkg.BookDetail{}, xml: true,
+				description: "Moves the book with its loans, history, reservations and fees to the new title in one step. A title already in use is a 409."},
+		}},
+		{"/admin/inventory", s.inventoryHandler, []operation{
+			{method: "GET", summary: "Cross-check copy counts", response: librarypkg.InventoryReport{},
+				description: "Lists titles whose totalCopies isn't availableCopies plus the active loans and copies in repair."},
+		}},
+		{"/admin/snapshot", s.snapshotHandler, []operation{
+			{method: "GET", summary: "Snapshot the library's state", response: librarypkg.Snapshot{},
+				description: "Books, loans, reservations, holds, history, members and fees as one document, copied with every book locked. Settings given as flags aren't included."},
+		}},
+		{"/admin/restore", s.restoreHandler, []operation{
+			{method: "POST", summary: "Restore the library from a snapshot", request: restoreRequest{}, response: librarypkg.Stats{},
+				description: "Replaces the whole state with a snapshot from GET /admin/snapshot. A snapshot that doesn't hold together, such as loans of missing books or two books with one ISBN, is a 400 INVALID_SNAPSHOT and changes nothing."},
+		}},
+		{"/admin/webhooks", s.registerWebhookHandler, []operation{
+			{method: "POST", summary: "Register a webhook", status: http.StatusCreated, request: webhookRequest{}, response: librarypkg.Webhook{}},
+		}},
+		{"/admin/webhooks/{id}/deliveries", s.webhookDeliveriesHandler, []operation{
+			{method: "GET", summary: "List webhook deliveries", response: []librarypkg.WebhookDelivery{},
+				description: "Lists the webhook's last 100 delivery attempts and queue-full drops, oldest first."},
+		}},
+	}
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPISpec builds the OpenAPI 3 document from the route table.
+func (s *server) openAPISpec() map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+
+	for _, route := range s.routeTable() {
+		var pathParams []any
+		for _, match := range pathParam.FindAllStringSubmatch(route.pattern, -1) {
+			pathParams = append(pathParams, map[string]any{
+				"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+
+		item := map[string]any{}
+		for _, op := range route.operations {
+			item[strings.ToLower(op.method)] = op.spec(schemas, pathParams)
+		}
+		paths[route.pattern] = item
+	}
+
+	schemas["FieldErrors"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"errors": map[string]any{"type": "array", "items": schemaFor(reflect.TypeOf(fieldError{}), schemas)},
+		},
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "Library API", "version": "1.0"},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"responses": map[string]any{
+				"Error": map[string]any{
+					"description": "Plain text error message. Errors raised by the library carry a stable code in the X-Error-Code header.",
+					"headers": map[string]any{
+						errorCodeHeader: map[string]any{"schema": map[string]any{"type": "string"}},
+					},
+					"content": map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}},
+				},
+			},
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func (op operation) spec(schemas map[string]any, pathParams []any) map[string]any {
+	spec := map[string]any{"summary": op.summary}
+	if op.description != "" {
+		spec["description"] = op.description
+	}
+
+	params := append([]any{}, pathParams...)
+	for _, p := range op.params {
+		in, kind := p.in, p.kind
+		if in == "" {
+			in = "query"
+		}
+		if kind == "" {
+			kind = "string"
+		}
+		params = append(params, map[string]any{
+			"name": p.name, "in": in, "required": p.required, "description": p.description,
+			"schema": map[string]any{"type": kind},
+		})
+	}
+	if len(params) > 0 {
+		spec["parameters"] = params
+	}
+
+	switch {
+	case op.requestType != "":
+		spec["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{op.requestType: map[string]any{"schema": map[string]any{"type": "string"}}},
+		}
+	case op.request != nil:
+		spec["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(op.request), schemas)}},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case op.contentType != "":
+		success["content"] = map[string]any{op.contentType: map[string]any{"schema": map[string]any{"type": "string"}}}
+	case op.response != nil:
+		schema := schemaFor(reflect.TypeOf(op.response), schemas)
+		content := map[string]any{"application/json": map[string]any{"schema": schema}}
+		if op.xml {
+			content["application/xml"] = map[string]any{"schema": schema}
+		}
+		success["content"] = content
+	}
+
+	responses := map[string]any{
+		strconv.Itoa(status): success,
+		"default":            map[string]any{"$ref": "#/components/responses/Error"},
+	}
+	if op.fieldErrors {
+		responses["400"] = map[string]any{
+			"description": "Invalid parameters",
+			"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/FieldErrors"}}},
+		}
+	}
+	if _, ok := op.request.(validator); ok {
+		responses["422"] = map[string]any{
+			"description": "Invalid request body",
+			"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/FieldErrors"}}},
+		}
+	}
+	spec["responses"] = responses
+
+	if isMutation(op.method) {
+		spec["security"] = []any{map[string]any{"bearerAuth": []any{}}}
+	}
+	return spec
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor describes t as a JSON schema the way encoding/json would encode
+// it. Named structs are added to schemas once and referenced from then on.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, exists := schemas[name]; !exists {
+			schemas[name] = map[string]any{} // placeholder for recursive types
+			properties := map[string]any{}
+			addProperties(t, properties, schemas)
+			schemas[name] = map[string]any{"type": "object", "properties": properties}
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+// addProperties adds the JSON fields of struct t, flattening embedded structs
+// as encoding/json does.
+func addProperties(t reflect.Type, properties map[string]any, schemas map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addProperties(field.Type, properties, schemas)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaFor(field.Type, schemas)
+	}
+}
+
+// schemaName capitalises unexported request and response types so every
+// schema name reads the same.
+func schemaName(t reflect.Type) string {
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+func (s *server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.openAPISpec())
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+// docsHandler serves a Redoc page rendering /openapi.json.
+func (s *server) docsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the request IDs accepted from clients, which end up
+// in the logs.
+const maxRequestIDLength = 64
+
+type requestIDKey struct{}
+
+// requestIDOf returns the ID recoverPanics gave the request, or "".
+func requestIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// recoverPanics turns a panic in next into a logged stack trace and a JSON
+// 500, so one bad request neither drops the connection with an empty reply
+// nor takes the server down. Every request gets an ID, the client's
+// X-Request-ID if it sent a usable one, which is echoed back so a report can
+// be matched with the log. If the response had already started, its status
+// can't change any more, so the connection is aborted instead and the client
+// sees a truncated response rather than a complete-looking one.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength || !printable(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		// The headers set so far, e.g. by CORS, also belong on an error
+		outer := w.Header().Clone()
+
+		rw := &startedWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+
+			slog.Error("panic serving request", "requestId", id, "method", r.Method, "path", r.URL.Path,
+				"panic", recovered, "stack", string(debug.Stack()))
+			if rw.started {
+				panic(http.ErrAbortHandler)
+			}
+
+			// Drop whatever the handler had set for its own response
+			clear(w.Header())
+			for name, values := range outer {
+				w.Header()[name] = values
+			}
+			w.Header().Set(errorCodeHeader, "INTERNAL")
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Code: "INTERNAL", Message: "Internal server error"})
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// printable reports whether s is plain printable ASCII, safe to log.
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// startedWriter records whether the response has started, after which its
+// status can't be changed.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *startedWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush and Unwrap keep streaming handlers working behind the middleware.
+func (w *startedWriter) Flush() {
+	w.started = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *startedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
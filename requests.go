@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"Library/librarypkg"
+)
+
+// validator is implemented by request bodies so decodeRequest can check
+// their fields in one place.
+type validator interface {
+	Validate() error
+}
+
+// maxNameLength limits titles, authors and borrower names. The library
+// enforces the same limit for callers that don't go through the API.
+const maxNameLength = librarypkg.MaxNameLength
+
+// decodeRequest reads a JSON body into request and validates it. It writes a
+// 400 if the body is malformed, or a 422 listing every invalid field, and
+// returns false.
+func decodeRequest(w http.ResponseWriter, r *http.Request, request validator) bool {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+
+	if err := request.Validate(); err != nil {
+		var errs validationErrors
+		if errors.As(err, &errs) {
+			writeFieldErrors(w, http.StatusUnprocessableEntity, errs)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return false
+	}
+
+	return true
+}
+
+// validationErrors collects everything wrong with a request body, so a form
+// can point out all the bad fields at once rather than one per submit.
+// Fields are named as in the JSON body.
+type validationErrors []fieldError
+
+func (e validationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Field + " " + err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *validationErrors) add(field, message string) {
+	*e = append(*e, fieldError{Field: field, Message: message})
+}
+
+// required records field as missing when value is empty.
+func (e *validationErrors) required(field, value string) {
+	if value == "" {
+		e.add(field, "is required")
+	}
+}
+
+// checkLength records field as too long when value exceeds maxNameLength.
+func (e *validationErrors) checkLength(field, value string) {
+	if len(value) > maxNameLength {
+		e.add(field, fmt.Sprintf("must be at most %d characters", maxNameLength))
+	}
+}
+
+// err returns e, or nil when nothing was wrong, so a Validate method can end
+// with return errs.err().
+func (e validationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+type loanRequest struct {
+	Title    string `json:"title"`
+	Borrower string `json:"borrower"`
+}
+
+func (r loanRequest) Validate() error {
+	return r.validate().err()
+}
+
+func (r loanRequest) validate() validationErrors {
+	var errs validationErrors
+	errs.required("title", r.Title)
+	errs.checkLength("title", r.Title)
+	errs.required("borrower", r.Borrower)
+	errs.checkLength("borrower", r.Borrower)
+	return errs
+}
+
+// extendRequest is a loanRequest with an optional extension length; zero
+// asks for the full extension period.
+type extendRequest struct {
+	loanRequest
+	Days int `json:"days"`
+}
+
+func (r extendRequest) Validate() error {
+	errs := r.loanRequest.validate()
+	if r.Days < 0 {
+		errs.add("days", "must not be negative")
+	}
+	return errs.err()
+}
+
+// batchBorrowRequest lists the titles to borrow in one go; a title listed
+// twice borrows two copies.
+type batchBorrowRequest struct {
+	Borrower string   `json:"borrower"`
+	Titles   []string `json:"titles"`
+}
+
+func (r batchBorrowRequest) Validate() error {
+	var errs validationErrors
+	errs.required("borrower", r.Borrower)
+	errs.checkLength("borrower", r.Borrower)
+	if len(r.Titles) == 0 {
+		errs.add("titles", "is required")
+	}
+	for i, title := range r.Titles {
+		field := fmt.Sprintf("titles[%d]", i)
+		if title == "" {
+			errs.add(field, "must not be empty")
+		}
+		errs.checkLength(field, title)
+	}
+	return errs.err()
+}
+
+type borrowerRequest struct {
+	Borrower string `json:"borrower"`
+}
+
+func (r borrowerRequest) Validate() error {
+	var errs validationErrors
+	errs.required("borrower", r.Borrower)
+	errs.checkLength("borrower", r.Borrower)
+	return errs.err()
+}
+
+// returnRequest identifies a loan by ID, or by title and borrower.
+type returnRequest struct {
+	LoanID   string `json:"loanId"`
+	Title    string `json:"title"`
+	Borrower string `json:"borrower"`
+}
+
+func (r returnRequest) Validate() error {
+	var errs validationErrors
+	errs.requireLoan(r.LoanID, r.Title, r.Borrower)
+	return errs.err()
+}
+
+// requireLoan records the missing fields of a loan given by ID, or by title
+// and borrower.
+func (e *validationErrors) requireLoan(loanID, title, borrower string) {
+	if loanID != "" {
+		return
+	}
+	if title == "" {
+		e.add("title", "is required without a loanId")
+	}
+	if borrower == "" {
+		e.add("borrower", "is required without a loanId")
+	}
+}
+
+// batchReturnRequest lists the loans a borrower is handing back, each by
+// loan ID or by title. Titles is a shorthand for items by title, taking the
+// same body as POST /Borrow/batch.
+type batchReturnRequest struct {
+	Borrower string                  `json:"borrower"`
+	Items    []librarypkg.ReturnItem `json:"items,omitempty"`
+	Titles   []string                `json:"titles,omitempty"`
+}
+
+func (r batchReturnRequest) Validate() error {
+	var errs validationErrors
+	errs.required("borrower", r.Borrower)
+	errs.checkLength("borrower", r.Borrower)
+	if len(r.Items) == 0 && len(r.Titles) == 0 {
+		errs.add("items", "or titles is required")
+	}
+	for i, item := range r.Items {
+		if item.LoanID == "" && item.Title == "" {
+			errs.add(fmt.Sprintf("items[%d]", i), "needs a loanId or a title")
+		}
+	}
+	for i, title := range r.Titles {
+		if title == "" {
+			errs.add(fmt.Sprintf("titles[%d]", i), "must not be empty")
+		}
+	}
+	return errs.err()
+}
+
+// items returns Items followed by an item for each of Titles.
+func (r batchReturnRequest) items() []librarypkg.ReturnItem {
+	items := slices.Clone(r.Items)
+	for _, title := range r.Titles {
+		items = append(items, librarypkg.ReturnItem{Title: title})
+	}
+	return items
+}
+
+// loanUpdateRequest is the body of PATCH /Loan: the loan by ID, or by title
+// and the borrower it was recorded under, and the corrected borrower name.
+type loanUpdateRequest struct {
+	LoanID      string `json:"loanId"`
+	Title       string `json:"title"`
+	Borrower    string `json:"borrower"`
+	NewBorrower string `json:"newBorrower"`
+}
+
+func (r loanUpdateRequest) Validate() error {
+	var errs validationErrors
+	errs.requireLoan(r.LoanID, r.Title, r.Borrower)
+	errs.required("newBorrower", r.NewBorrower)
+	errs.checkLength("newBorrower", r.NewBorrower)
+	return errs.err()
+}
+
+// loanTransferRequest is the body of POST /Loan/transfer: the borrower's
+// loan of title to hand over to the new borrower.
+type loanTransferRequest struct {
+	Title       string `json:"title"`
+	Borrower    string `json:"borrower"`
+	NewBorrower string `json:"newBorrower"`
+}
+
+func (r loanTransferRequest) Validate() error {
+	var errs validationErrors
+	errs.required("title", r.Title)
+	errs.required("borrower", r.Borrower)
+	errs.required("newBorrower", r.NewBorrower)
+	errs.checkLength("newBorrower", r.NewBorrower)
+	if r.NewBorrower != "" && r.NewBorrower == r.Borrower {
+		errs.add("newBorrower", "must differ from the borrower")
+	}
+	return errs.err()
+}
+
+// transferRequest is the body of POST /loans/{id}/transfer.
+type transferRequest struct {
+	NewBorrower string `json:"newBorrower"`
+}
+
+func (r transferRequest) Validate() error {
+	var errs validationErrors
+	errs.required("newBorrower", r.NewBorrower)
+	errs.checkLength("newBorrower", r.NewBorrower)
+	return errs.err()
+}
+
+// dueDateRequest is the body of PUT /admin/loans/{id}/due-date. Force allows
+// a due date in the past.
+type dueDateRequest struct {
+	DueDate time.Time `json:"dueDate"`
+	Force   bool      `json:"force"`
+}
+
+func (r dueDateRequest) Validate() error {
+	var errs validationErrors
+	if r.DueDate.IsZero() {
+		errs.add("dueDate", "is required")
+	}
+	return errs.err()
+}
+
+// renameRequest is the body of POST /admin/books/rename.
+type renameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (r renameRequest) Validate() error {
+	var errs validationErrors
+	errs.required("from", r.From)
+	errs.required("to", r.To)
+	errs.checkLength("to", r.To)
+	return errs.err()
+}
+
+// maintenanceRequest is the body of POST /admin/maintenance.
+type maintenanceRequest struct {
+	ReadOnly *bool `json:"readOnly"`
+}
+
+func (r maintenanceRequest) Validate() error {
+	var errs validationErrors
+	if r.ReadOnly == nil {
+		errs.add("readOnly", "is required")
+	}
+	return errs.err()
+}
+
+// bookRequest is the body of POST and PUT /Book. Required fields are checked
+// by the library, since enriched books arrive without a title.
+type bookRequest struct {
+	librarypkg.BookDetail
+}
+
+func (r bookRequest) Validate() error {
+	var errs validationErrors
+	errs.checkLength("title", r.Title)
+	errs.checkLength("author", r.Author)
+	return errs.err()
+}
+
+type bookUpdateRequest struct {
+	librarypkg.BookUpdate
+}
+
+func (r bookUpdateRequest) Validate() error {
+	return nil
+}
+
+type memberRequest struct {
+	librarypkg.Member
+}
+
+func (r memberRequest) Validate() error {
+	var errs validationErrors
+	errs.checkLength("name", r.Name)
+	return errs.err()
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+func (r webhookRequest) Validate() error {
+	var errs validationErrors
+	errs.required("url", r.URL)
+	return errs.err()
+}
+
+// restoreRequest is the body of POST /admin/restore, a snapshot as GET
+// /admin/snapshot returns it.
+type restoreRequest struct {
+	librarypkg.Snapshot
+}
+
+func (r restoreRequest) Validate() error {
+	var errs validationErrors
+	if r.Books == nil {
+		errs.add("books", "is required")
+	}
+	return errs.err()
+}
+
+// graphqlRequest is a GraphQL request as sent over HTTP. OperationName picks
+// the operation to run from a document holding several.
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+func (r graphqlRequest) Validate() error {
+	var errs validationErrors
+	errs.required("query", strings.TrimSpace(r.Query))
+	return errs.err()
+}
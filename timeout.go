@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// eventsPath streams for as long as the client listens, so it is exempt
+// from the request timeout and from the server's write timeout.
+const eventsPath = "/events"
+
+// withTimeout gives each request a context that is done after s.timeout.
+// The metadata lookups and long scans it reaches give up with
+// context.DeadlineExceeded, which is answered with a 503, instead of leaving
+// the client waiting on a hung dependency.
+func (s *server) withTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.timeout <= 0 || r.URL.Path == eventsPath {
+			next(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// clearWriteDeadline lifts the server's write timeout for a response that
+// streams. Writers that can't set deadlines, like test recorders, never had
+// one.
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}